@@ -0,0 +1,257 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
+	"github.com/infinimesh/infinimesh/pkg/revocation"
+	"github.com/infinimesh/infinimesh/pkg/rotation"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"github.com/pion/dtls/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errBadCredentials = errors.New("bad credentials")
+
+// loadDevice - devcache.LoadFunc fetching the device from the registry as root
+func loadDevice(_ context.Context, uuid string) (*devpb.Device, error) {
+	return client.Get(internal_ctx, &devpb.Device{Uuid: uuid})
+}
+
+// pskKey - dtls.PSKCallback resolving PSK Identity (device UUID) to the key, which is the device certificate fingerprint.
+// Devices must be enabled for Basic Auth to use PSK, as the fingerprint serves as a shared secret then
+func pskKey(identity []byte) ([]byte, error) {
+	device, err := devices.Get(context.Background(), string(identity))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadCredentials, err)
+	}
+	if !device.BasicEnabled {
+		return nil, fmt.Errorf("%w: device is not enabled for Basic Auth", errBadCredentials)
+	}
+	fingerprint := device.GetCertificate().GetFingerprint()
+	if len(fingerprint) == 0 {
+		return nil, fmt.Errorf("%w: device has no certificate", errBadCredentials)
+	}
+	return fingerprint, nil
+}
+
+func getFingerprint(c []byte) []byte {
+	s := sha256.New()
+	_, _ = s.Write(c) // nolint: gosec
+	return s.Sum(nil)
+}
+
+// authenticate - finds the device the DTLS session belongs to, by its client certificate or PSK Identity.
+// Device is fetched by fingerprint in both cases, so it comes with the token to access its state
+func authenticate(log *zap.Logger, state dtls.State) (*devpb.Device, error) {
+	var fingerprint []byte
+	var uuid string
+	var chain []*x509.Certificate
+	switch {
+	case len(state.PeerCertificates) > 0:
+		chain = make([]*x509.Certificate, len(state.PeerCertificates))
+		for i, raw := range state.PeerCertificates {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errBadCredentials, err)
+			}
+			chain[i] = cert
+		}
+		fingerprint = getFingerprint(chain[0].Raw)
+	case len(state.IdentityHint) > 0:
+		uuid = string(state.IdentityHint)
+		key, err := pskKey(state.IdentityHint)
+		if err != nil {
+			return nil, err
+		}
+		fingerprint = key
+	default:
+		return nil, fmt.Errorf("%w: neither certificate nor PSK given", errBadCredentials)
+	}
+
+	device, err := client.GetByFingerprint(internal_ctx, &devpb.GetByFingerprintRequest{
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if uuid != "" && device.GetUuid() != uuid {
+		return nil, fmt.Errorf("%w: device UUID doesn't match PSK Identity", errBadCredentials)
+	}
+	if !device.Enabled {
+		return nil, fmt.Errorf("%w: device is not enabled", errBadCredentials)
+	}
+
+	// Revocations of the device Namespace apply. PSK is the fingerprint of the device certificate,
+	// it's refused once the certificate is revoked
+	dev, err := devices.Get(context.Background(), device.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	if chain == nil {
+		if block, _ := pem.Decode([]byte(dev.GetCertificate().GetPemData())); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				chain = []*x509.Certificate{cert}
+			}
+		}
+	}
+	if err := checkRevoked(log, dev.GetAccess().GetNamespace(), chain); err != nil {
+		return nil, err
+	}
+	log.Debug("Device authenticated", zap.String("device", device.Uuid), zap.Bool("psk", uuid != ""))
+
+	// Only the DTLS handshake with the certificate proves the device holds its key, PSK doesn't
+	if uuid == "" && certificates != nil && rotation.Rotates(device.GetCertificate().GetFingerprint(), fingerprint) {
+		go func() {
+			if err := certificates.Connected(context.Background(), device.Uuid, fingerprint); err != nil {
+				log.Warn("Can't tell the registry which certificate the device connected with", zap.String("device", device.Uuid), zap.Error(err))
+			}
+		}()
+	}
+	return device, nil
+}
+
+// checkRevoked - refuses chains with any certificate revoked by the Namespace of the device.
+// Revocations can't be checked without Redis, so it fails closed
+func checkRevoked(log *zap.Logger, namespace string, chain []*x509.Certificate) error {
+	r, err := revocations.Check(context.Background(), namespace, chain)
+	if err != nil {
+		log.Warn("Can't check certificate revocations", zap.Error(err))
+		return status.Error(codes.Unavailable, "can't check certificate revocations")
+	}
+	if r != nil {
+		log.Warn("Certificate is revoked", zap.String("fingerprint", r.Fingerprint), zap.String("reason", r.Reason))
+		return revocation.ErrRevoked
+	}
+	return nil
+}
+
+var (
+	connsMu sync.Mutex
+	// conns - close functions of active sessions by device UUID
+	conns = make(map[string]map[*func()]struct{})
+)
+
+// trackConn - registers the session to be closed when the device is disabled, deleted or its certificate is revoked,
+// returns function to unregister it
+func trackConn(device string, kick func()) (untrack func()) {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+
+	if conns[device] == nil {
+		conns[device] = make(map[*func()]struct{})
+	}
+	key := &kick
+	conns[device][key] = struct{}{}
+
+	return func() {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+
+		delete(conns[device], key)
+		if len(conns[device]) == 0 {
+			delete(conns, device)
+		}
+	}
+}
+
+// kick - closes all sessions of the device
+func kick(device string) {
+	connsMu.Lock()
+	var kicks []func()
+	for k := range conns[device] {
+		kicks = append(kicks, *k)
+	}
+	connsMu.Unlock()
+
+	for _, k := range kicks {
+		k()
+	}
+}
+
+// kickAll - closes all sessions, so devices are reported disconnected on shutdown
+func kickAll() {
+	connsMu.Lock()
+	uuids := make([]string, 0, len(conns))
+	for uuid := range conns {
+		uuids = append(uuids, uuid)
+	}
+	connsMu.Unlock()
+
+	for _, uuid := range uuids {
+		kick(uuid)
+	}
+}
+
+// checkDevice - closes sessions of the device if it's disabled or doesn't exist anymore.
+// Sessions are kept if the registry can't be reached
+func checkDevice(log *zap.Logger, uuid string) {
+	device, err := devices.Get(context.Background(), uuid)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound, codes.PermissionDenied:
+			log.Info("Device not found, disconnecting", zap.String("device", uuid), zap.Error(err))
+		default:
+			log.Warn("Can't retrieve device status from registry", zap.String("device", uuid), zap.Error(err))
+			return
+		}
+	} else if device.Enabled {
+		return
+	} else {
+		log.Info("Device is disabled, disconnecting", zap.String("device", uuid))
+	}
+	kick(uuid)
+}
+
+// handleDeviceChanges - re-checks devices with active sessions once they're changed in the registry
+func handleDeviceChanges(rdb redis.UniversalClient) {
+	log := log.Named("DeviceChanges")
+
+	devcache.Subscribe(context.Background(), rdb, func(uuid string) {
+		devices.Invalidate(uuid)
+
+		connsMu.Lock()
+		_, ok := conns[uuid]
+		connsMu.Unlock()
+		if ok {
+			checkDevice(log, uuid)
+		}
+	})
+}
+
+// handleRevocations - closes sessions of devices once their certificate is revoked
+func handleRevocations() {
+	log := log.Named("Revocations")
+
+	revocations.Subscribe(context.Background(), func(r *revocation.Revocation) {
+		if r.Device == "" {
+			return
+		}
+		log.Info("Device certificate revoked, disconnecting", zap.String("device", r.Device), zap.String("fingerprint", r.Fingerprint))
+		kick(r.Device)
+	})
+}
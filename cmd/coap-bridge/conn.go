@@ -0,0 +1,444 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/coap"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/pubsub"
+	devpb "github.com/infinimesh/proto/node/devices"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// stateResource - the only resource devices use, Uri-Path is "state"
+const stateResource = "state"
+
+// payloadTagPrefix - Device tag setting its default payload format, e.g. "payload:cbor", same as in MQTT Bridge
+const payloadTagPrefix = "payload:"
+
+// recentResponses - number of responses to Confirmable requests kept to answer retransmitted ones
+const recentResponses = 16
+
+// formats - codecs by CoAP Content-Format, only these can be negotiated with Content-Format and Accept options
+var formats = map[uint32]codec.Codec{
+	coap.AppJSON: codec.JSON,
+	coap.AppCBOR: codec.CBOR,
+}
+
+// knownOptions - options understood in requests, requests with other critical ones are refused with Bad Option
+var knownOptions = map[coap.OptionID]bool{
+	coap.URIHost:       true,
+	coap.URIPort:       true,
+	coap.URIPath:       true,
+	coap.URIQuery:      true,
+	coap.ContentFormat: true,
+	coap.Accept:        true,
+	coap.Observe:       true,
+}
+
+// observer - registration of the device for Desired state notifications
+type observer struct {
+	token []byte
+	codec codec.Codec
+	seq   uint32
+}
+
+// session - CoAP exchange with an authenticated device over its DTLS session
+type session struct {
+	log    *zap.Logger
+	conn   net.Conn
+	device *devpb.Device
+	// ctx - authorized with device token, so the device can only access its own state
+	ctx context.Context
+
+	mu        sync.Mutex
+	messageID uint16
+	observer  *observer
+	responses map[uint16][]byte
+	recent    []uint16
+}
+
+// HandleConn - serves the device until its session times out, is closed or kicked.
+// Device is reported connected meanwhile, same as with MQTT
+func HandleConn(conn net.Conn, device *devpb.Device) {
+	clientID := "coap/" + conn.RemoteAddr().String()
+	log := log.Named(device.GetUuid()).Named(clientID)
+	defer log.Debug("Client disconnected")
+
+	s := &session{
+		log:       log,
+		conn:      conn,
+		device:    device,
+		ctx:       metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+device.GetToken()),
+		messageID: uint16(rand.Intn(1 << 16)),
+		responses: make(map[uint16][]byte),
+	}
+
+	publishConnection(device.Uuid, clientID, true)
+	defer publishConnection(device.Uuid, clientID, false)
+
+	backChannel := ps.Sub()
+	defer unsub(ps, backChannel)
+	ps.AddSub(backChannel, "mqtt.outgoing/"+device.Uuid)
+	go s.handleBackChannel(backChannel)
+
+	defer trackConn(device.Uuid, func() {
+		if err := conn.Close(); err != nil {
+			log.Debug("Couldn't close connection", zap.Error(err))
+		}
+	})()
+
+	buf := make([]byte, 64*1024)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idle_timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			var nerr net.Error
+			switch {
+			case errors.As(err, &nerr) && nerr.Timeout():
+				log.Info("Session is idle, closing", zap.Duration("idle_timeout", idle_timeout))
+			case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+				log.Debug("Session closed")
+			default:
+				log.Warn("Failed to read message", zap.Error(err))
+			}
+			_ = conn.Close()
+			return
+		}
+		s.handle(buf[:n])
+	}
+}
+
+// handle - processes a single datagram. Malformed Confirmable messages are rejected with Reset, others are ignored
+func (s *session) handle(data []byte) {
+	m, err := coap.Unmarshal(data)
+	if err != nil {
+		s.log.Debug("Malformed message", zap.Error(err))
+		if len(data) >= 4 && coap.Type(data[0]>>4&3) == coap.Confirmable {
+			s.write(&coap.Message{Type: coap.Reset, MessageID: uint16(data[2])<<8 | uint16(data[3])})
+		}
+		return
+	}
+
+	switch {
+	case m.Type == coap.Reset:
+		// Device rejects notification, so it's not interested anymore
+		s.cancel(nil)
+		return
+	case m.Type == coap.Acknowledgement:
+		return
+	case m.Code == coap.Empty:
+		// CoAP ping
+		if m.Type == coap.Confirmable {
+			s.write(&coap.Message{Type: coap.Reset, MessageID: m.MessageID})
+		}
+		return
+	case !m.Code.IsRequest():
+		if m.Type == coap.Confirmable {
+			s.write(&coap.Message{Type: coap.Reset, MessageID: m.MessageID})
+		}
+		return
+	}
+
+	if m.Type == coap.Confirmable {
+		s.mu.Lock()
+		data, ok := s.responses[m.MessageID]
+		s.mu.Unlock()
+		if ok {
+			s.log.Debug("Answering retransmitted request", zap.Uint16("message", m.MessageID))
+			s.writeRaw(data)
+			return
+		}
+	}
+
+	res := s.serve(m)
+	res.Token = m.Token
+	if m.Type == coap.Confirmable {
+		// Response is piggybacked on the Acknowledgement
+		res.Type = coap.Acknowledgement
+		res.MessageID = m.MessageID
+	} else {
+		res.Type = coap.NonConfirmable
+		res.MessageID = s.nextID()
+	}
+
+	data, err = res.Marshal()
+	if err != nil {
+		s.log.Warn("Failed to marshal response", zap.Error(err))
+		return
+	}
+	if m.Type == coap.Confirmable {
+		s.remember(m.MessageID, data)
+	}
+	s.writeRaw(data)
+}
+
+// serve - handles the request, returns response without type, Message ID and token set
+func (s *session) serve(m *coap.Message) *coap.Message {
+	s.log.Debug("Request", zap.Stringer("method", m.Code), zap.String("path", m.Path()))
+
+	for _, o := range m.Options {
+		if o.ID.Critical() && !knownOptions[o.ID] {
+			return &coap.Message{Code: coap.BadOption}
+		}
+	}
+	if len(m.Payload) > max_message_size {
+		res := &coap.Message{Code: coap.RequestEntityTooLarge}
+		res.SetUint(coap.Size1, uint32(max_message_size))
+		return res
+	}
+
+	if m.Path() != stateResource {
+		return &coap.Message{Code: coap.NotFound}
+	}
+	switch m.Code {
+	case coap.POST, coap.PUT:
+		return s.reported(m)
+	case coap.GET:
+		return s.desired(m)
+	default:
+		return &coap.Message{Code: coap.MethodNotAllowed}
+	}
+}
+
+// reported - publishes the payload as Reported state, format is taken from Content-Format or device default
+func (s *session) reported(m *coap.Message) *coap.Message {
+	c := s.defaultCodec()
+	if format, ok := m.Uint(coap.ContentFormat); ok {
+		if c = formats[format]; c == nil {
+			return &coap.Message{Code: coap.UnsupportedContentFormat}
+		}
+	}
+
+	data, err := codec.DecodeStruct(c, m.Payload)
+	if err != nil {
+		s.log.Warn("Failed to decode Reported state", zap.String("format", c.Name()), zap.Error(err))
+		return &coap.Message{Code: coap.BadRequest, Payload: []byte(err.Error())}
+	}
+
+	ps.TryPub(&pb.Shadow{
+		Device: s.device.Uuid,
+		Reported: &pb.State{
+			Timestamp: timestamppb.Now(),
+			Data:      data,
+		},
+		Connection: &pb.ConnectionState{
+			Connected: true,
+			Timestamp: timestamppb.Now(),
+		},
+	}, "mqtt.incoming")
+	return &coap.Message{Code: coap.Changed}
+}
+
+// desired - returns current Desired state, registers or cancels observation if asked to.
+// Observation is requested with Observe option (RFC 7641) or "observe" query for clients without it
+func (s *session) desired(m *coap.Message) *coap.Message {
+	c := s.defaultCodec()
+	if format, ok := m.Uint(coap.Accept); ok {
+		if c = formats[format]; c == nil {
+			return &coap.Message{Code: coap.NotAcceptable}
+		}
+	}
+
+	obs, ok := m.Uint(coap.Observe)
+	if !ok {
+		if _, query := m.Query()["observe"]; query {
+			obs, ok = coap.ObserveRegister, true
+		}
+	}
+
+	var data *structpb.Struct
+	if shadow == nil {
+		return &coap.Message{Code: coap.ServiceUnavailable}
+	}
+	r, err := shadow.Get(s.ctx, &pb.GetRequest{Pool: []string{s.device.Uuid}})
+	if err != nil {
+		s.log.Warn("Failed to get Desired state", zap.Error(err))
+		return &coap.Message{Code: coap.ServiceUnavailable}
+	}
+	if shadows := r.GetShadows(); len(shadows) > 0 {
+		data = shadows[0].GetDesired().GetData()
+	}
+	if data == nil {
+		data = &structpb.Struct{}
+	}
+
+	payload, err := c.Encode(structpb.NewStructValue(data))
+	if err != nil {
+		s.log.Warn("Failed to encode Desired state", zap.String("format", c.Name()), zap.Error(err))
+		return &coap.Message{Code: coap.InternalServerError}
+	}
+	res := &coap.Message{Code: coap.Content, Payload: payload}
+	setContentFormat(res, c)
+
+	switch {
+	case ok && obs == coap.ObserveRegister:
+		s.mu.Lock()
+		s.observer = &observer{token: m.Token, codec: c}
+		res.SetUint(coap.Observe, 0)
+		s.mu.Unlock()
+		s.log.Debug("Observing Desired state")
+	case ok && obs == coap.ObserveCancel:
+		s.cancel(m.Token)
+	}
+	return res
+}
+
+// cancel - stops notifications, token must match the registration unless it's nil
+func (s *session) cancel(token []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.observer == nil || (token != nil && string(s.observer.token) != string(token)) {
+		return
+	}
+	s.observer = nil
+	s.log.Debug("Stopped observing Desired state")
+}
+
+// handleBackChannel - notifies the observer about Desired state changes, notifications are Non-confirmable
+func (s *session) handleBackChannel(ch chan interface{}) {
+	defer s.log.Debug("BackChannel handler closed")
+	var ts int64 = 0
+	for msg := range ch {
+		shadow := msg.(*pb.Shadow)
+		if shadow.Desired == nil || shadow.Desired.Timestamp == nil {
+			continue
+		}
+		if shadow.Desired.Timestamp.Seconds < ts {
+			continue
+		}
+		ts = shadow.Desired.Timestamp.Seconds
+
+		s.mu.Lock()
+		o := s.observer
+		if o == nil {
+			s.mu.Unlock()
+			continue
+		}
+		// Observe sequence numbers are 24 bit
+		o.seq = (o.seq + 1) & 0xffffff
+		s.messageID++
+		n := &coap.Message{
+			Type:      coap.NonConfirmable,
+			Code:      coap.Content,
+			MessageID: s.messageID,
+			Token:     o.token,
+		}
+		n.SetUint(coap.Observe, o.seq)
+		c := o.codec
+		s.mu.Unlock()
+
+		payload, err := c.Encode(structpb.NewStructValue(shadow.Desired.Data))
+		if err != nil {
+			s.log.Warn("Failed to encode Desired state", zap.String("format", c.Name()), zap.Error(err))
+			continue
+		}
+		n.Payload = payload
+		setContentFormat(n, c)
+		s.write(n)
+	}
+}
+
+// defaultCodec - default payload codec of the device, JSON unless set by "payload:" tag
+func (s *session) defaultCodec() codec.Codec {
+	for _, tag := range s.device.GetTags() {
+		name := strings.TrimPrefix(tag, payloadTagPrefix)
+		if name == tag {
+			continue
+		}
+		if c := codec.ByName(name); c != nil {
+			return c
+		}
+	}
+	return codec.JSON
+}
+
+func (s *session) nextID() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messageID++
+	return s.messageID
+}
+
+// remember - keeps the response to the Confirmable request, the oldest one is dropped once there are too many
+func (s *session) remember(id uint16, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.recent) >= recentResponses {
+		delete(s.responses, s.recent[0])
+		s.recent = s.recent[1:]
+	}
+	s.responses[id] = data
+	s.recent = append(s.recent, id)
+}
+
+func (s *session) write(m *coap.Message) {
+	data, err := m.Marshal()
+	if err != nil {
+		s.log.Warn("Failed to marshal message", zap.Error(err))
+		return
+	}
+	s.writeRaw(data)
+}
+
+func (s *session) writeRaw(data []byte) {
+	if _, err := s.conn.Write(data); err != nil {
+		s.log.Debug("Failed to write message", zap.Error(err))
+	}
+}
+
+// setContentFormat - sets Content-Format of the codec, codecs without registered format are sent without it
+func setContentFormat(m *coap.Message, c codec.Codec) {
+	for format, fc := range formats {
+		if fc == c {
+			m.SetUint(coap.ContentFormat, format)
+			return
+		}
+	}
+}
+
+func publishConnection(device, clientID string, connected bool) {
+	ps.TryPub(&pb.Shadow{
+		Device: device,
+		Connection: &pb.ConnectionState{
+			Connected: connected,
+			Timestamp: timestamppb.Now(),
+			ClientId:  clientID,
+		},
+	}, "mqtt.incoming")
+}
+
+func unsub(ps pubsub.PubSub, ch chan any) {
+	go ps.Unsub(ch)
+
+	for range ch {
+	}
+}
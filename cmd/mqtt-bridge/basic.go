@@ -16,13 +16,14 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 
 	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
 	devpb "github.com/infinimesh/proto/node/devices"
-	"github.com/slntopp/mqtt-go/packet"
 	"go.uber.org/zap"
 )
 
@@ -30,6 +31,9 @@ func HandleTCPConnections(tcp net.Listener) {
 	log := log.Named("TCP")
 	for {
 		conn, err := tcp.Accept()
+		if err != nil && shuttingDown.Load() {
+			return
+		}
 		metrics.BasicAuthAcceptedTotal.Inc()
 		if err != nil {
 			log.Warn("Couldn't accept connection", zap.Error(err))
@@ -39,54 +43,75 @@ func HandleTCPConnections(tcp net.Listener) {
 		log.Debug("Connection Accepted", zap.String("remote", conn.RemoteAddr().String()))
 
 		go func(conn net.Conn) {
-			p, err := packet.ReadPacket(conn, 0)
+			pc := protocol.NewConn(conn)
+			pc.SetTimeouts(connect_timeout, write_timeout)
+			p, err := pc.ReadPacket(0)
 			if err != nil {
-				LogErrorAndClose(conn, fmt.Errorf("error while reading connect packet: %v", err))
+				LogErrorAndClose(conn, 0, protocol.ReasonMalformedPacket, fmt.Errorf("error while reading connect packet: %v", err))
 				metrics.ConnNotAnMqttPacketTotal.Inc()
 				return
 			}
 			log.Debug("ControlPacket", zap.Any("packet", p))
 
-			connectPacket, ok := p.(*packet.ConnectControlPacket)
+			connectPacket, ok := p.(*protocol.ConnectControlPacket)
 			if !ok {
-				LogErrorAndClose(conn, errors.New("first packet isn't ConnectControlPacket"))
+				LogErrorAndClose(conn, 0, protocol.ReasonProtocolError, errors.New("first packet isn't ConnectControlPacket"))
 				metrics.ConnNotAnMqttPacketTotal.Inc()
 				return
 			}
 			log.Debug("ConnectPacket", zap.Any("packet", p))
 
-			var fingerprint []byte
-			fingerprint, err = verifyBasicAuth(connectPacket)
+			device, err := verifyBasicAuthDevice(log, connectPacket)
 			if err != nil {
-				LogErrorAndClose(conn, fmt.Errorf("error verifying Basic Auth: %v", err))
+				LogErrorAndClose(conn, connectPacket.VariableHeader.ProtocolLevel, connAckCode(err), err)
 				metrics.BasicAuthDeviceAuthFailedTotal.Inc()
 				return
 			}
 
-			log.Debug("Fingerprint", zap.ByteString("fingerprint", fingerprint))
+			go HandleConn(pc, connectPacket, device)
+		}(conn)
+	}
+}
 
-			device, err := GetByFingerprintAndVerify(fingerprint, func(device *devpb.Device) bool {
-				if device.GetUuid() != connectPacket.ConnectPayload.Username {
-					log.Warn("Failed to verify client as the device UUID doesn't match Basic Auth Username", zap.String("uuid", device.Uuid), zap.String("device", device.Title), zap.String("username", connectPacket.ConnectPayload.Username))
-					return false
-				} else if !device.BasicEnabled {
-					log.Warn("Failed to verify client as the device is not enabled for Basic Auth", zap.String("uuid", device.Uuid))
-					return false
-				} else if !device.Enabled {
-					log.Warn("Failed to verify client as the device is not enabled", zap.String("uuid", device.Uuid))
-					return false
-				} else {
-					log.Debug("Verified client as the device is enabled", zap.String("uuid", device.Uuid), zap.Strings("tags", device.Tags))
-					return true
-				}
-			})
-			if err != nil {
-				LogErrorAndClose(conn, err)
-				metrics.BasicAuthDeviceAuthFailedTotal.Inc()
-				return
-			}
+// verifyBasicAuthDevice - authenticates the device by Username (device UUID) and Password (base64 encoded certificate fingerprint).
+// Fingerprints aren't secret, so ones of certificates revoked by the device Namespace are refused as on TLS handshake
+func verifyBasicAuthDevice(log *zap.Logger, connectPacket *protocol.ConnectControlPacket) (*devpb.Device, error) {
+	fingerprint, err := verifyBasicAuth(connectPacket)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying Basic Auth: %w", err)
+	}
 
-			go HandleConn(conn, connectPacket, device)
-		}(conn)
+	log.Debug("Fingerprint", zap.ByteString("fingerprint", fingerprint))
+
+	device, err := GetByFingerprintAndVerify(fingerprint, verifyBasicEnabled(log, connectPacket))
+	if err != nil {
+		return nil, err
+	}
+	dev, err := devices.Get(context.Background(), device.GetUuid())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRevokedFingerprint(log, dev.GetAccess().GetNamespace(), fingerprint); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// verifyBasicEnabled - accepts enabled devices with Basic Auth enabled, which UUID is the Basic Auth Username
+func verifyBasicEnabled(log *zap.Logger, connectPacket *protocol.ConnectControlPacket) VerifyDeviceFunc {
+	return func(device *devpb.Device) bool {
+		if device.GetUuid() != connectPacket.ConnectPayload.Username {
+			log.Warn("Failed to verify client as the device UUID doesn't match Basic Auth Username", zap.String("uuid", device.Uuid), zap.String("device", device.Title), zap.String("username", connectPacket.ConnectPayload.Username))
+			return false
+		} else if !device.BasicEnabled {
+			log.Warn("Failed to verify client as the device is not enabled for Basic Auth", zap.String("uuid", device.Uuid))
+			return false
+		} else if !device.Enabled {
+			log.Warn("Failed to verify client as the device is not enabled", zap.String("uuid", device.Uuid))
+			return false
+		} else {
+			log.Debug("Verified client as the device is enabled", zap.String("uuid", device.Uuid), zap.Strings("tags", device.Tags))
+			return true
+		}
 	}
 }
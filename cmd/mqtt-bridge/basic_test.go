@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	node_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/proto/node"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/revocation"
+	"github.com/infinimesh/proto/node/access"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// basicAuthFixture - CONNECT of an enabled device with Basic Auth, which certificate is revoked by its Namespace if revoked is set
+func basicAuthFixture(t *testing.T, revoked bool) *protocol.ConnectControlPacket {
+	namespace := "ns"
+	fingerprint := getFingerprint([]byte("certificate"))
+	device := &devpb.Device{
+		Uuid: "device", Enabled: true, BasicEnabled: true,
+		Access: &access.Access{Namespace: &namespace},
+	}
+
+	devs := node_mocks.NewMockDevicesServiceClient(t)
+	devs.EXPECT().GetByFingerprint(mock.Anything, mock.Anything).Return(device, nil)
+	devs.EXPECT().Get(mock.Anything, mock.Anything).Return(device, nil)
+	client = devs
+	devices = devcache.New(time.Minute, loadDevice)
+
+	rdb := redis_mocks.NewMockUniversalClient(t)
+	values := []interface{}{nil}
+	if revoked {
+		data, err := json.Marshal(&revocation.Revocation{Fingerprint: hex.EncodeToString(fingerprint), Namespace: namespace, Device: device.Uuid})
+		require.NoError(t, err)
+		values[0] = string(data)
+	}
+	rdb.EXPECT().HMGet(mock.Anything, revocation.Key(namespace), hex.EncodeToString(fingerprint)).Return(redis.NewSliceResult(values, nil))
+	revocations = revocation.NewStore(rdb)
+
+	p := &protocol.ConnectControlPacket{}
+	p.ConnectPayload.Username = device.Uuid
+	p.ConnectPayload.Password = base64.StdEncoding.EncodeToString(fingerprint)
+	return p
+}
+
+func TestVerifyBasicAuthDevice_Success(t *testing.T) {
+	p := basicAuthFixture(t, false)
+
+	device, err := verifyBasicAuthDevice(zap.NewNop(), p)
+
+	require.NoError(t, err)
+	assert.Equal(t, "device", device.GetUuid())
+}
+
+func TestVerifyBasicAuthDevice_FailsOn_RevokedFingerprint(t *testing.T) {
+	p := basicAuthFixture(t, true)
+
+	device, err := verifyBasicAuthDevice(zap.NewNop(), p)
+
+	assert.ErrorIs(t, err, revocation.ErrRevoked)
+	assert.Nil(t, device)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"strings"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"go.uber.org/zap"
+)
+
+// payloadTagPrefix - Device tag setting its default payload format, e.g. "payload:cbor"
+const payloadTagPrefix = "payload:"
+
+// deviceCodec - default payload codec of the device, JSON unless set by "payload:" tag
+func deviceCodec(log *zap.Logger, device *devpb.Device) codec.Codec {
+	for _, tag := range device.GetTags() {
+		name := strings.TrimPrefix(tag, payloadTagPrefix)
+		if name == tag {
+			continue
+		}
+		if c := codec.ByName(name); c != nil {
+			return c
+		}
+		log.Warn("Unknown payload format in device tag, using JSON", zap.String("tag", tag), zap.Strings("formats", codec.Names()))
+	}
+	return codec.JSON
+}
+
+// publishCodec - codec of the incoming message chosen by topic suffix, then MQTT 5 Content Type, then device default.
+// Content Types of no registered codec are ignored
+func publishCodec(log *zap.Logger, device *devpb.Device, t topics.Topic, props *protocol.Properties) codec.Codec {
+	if t.Format != "" {
+		return codec.ByName(t.Format)
+	}
+	if props != nil && props.ContentType != "" {
+		contentType, _, _ := strings.Cut(props.ContentType, ";")
+		if c := codec.ByContentType(strings.TrimSpace(contentType)); c != nil {
+			return c
+		}
+	}
+	return deviceCodec(log, device)
+}
+
+// desiredTopic - topic Desired state is delivered to and codec it's encoded with
+type desiredTopic struct {
+	topic string
+	codec codec.Codec
+}
+
+// desiredTopics - plain Desired state topic with device default codec followed by format suffixed ones
+func desiredTopics(device string, def codec.Codec) []desiredTopic {
+	return formatTopics(topics.Desired(device), def)
+}
+
+// deltaTopics - same as desiredTopics for the difference between Desired and Reported state
+func deltaTopics(device string, def codec.Codec) []desiredTopic {
+	return formatTopics(topics.DesiredDelta(device), def)
+}
+
+func formatTopics(topic string, def codec.Codec) []desiredTopic {
+	res := []desiredTopic{{topic, def}}
+	for _, name := range codec.Names() {
+		res = append(res, desiredTopic{topics.WithFormat(topic, name), codec.ByName(name)})
+	}
+	return res
+}
+
+// contentType - MQTT 5 Content Type property of the message encoded with the codec
+func contentType(c codec.Codec, protocolLevel byte) *protocol.Properties {
+	if protocolLevel != 5 {
+		return nil
+	}
+	return &protocol.Properties{ContentType: c.ContentType()}
+}
@@ -20,15 +20,25 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/inflight"
 	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/ratelimit"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/sparkplug"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
 	"github.com/infinimesh/infinimesh/pkg/pubsub"
+	shadowsvc "github.com/infinimesh/infinimesh/pkg/shadow"
 	devpb "github.com/infinimesh/proto/node/devices"
 	pb "github.com/infinimesh/proto/shadow"
 	"github.com/slntopp/mqtt-go/packet"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -49,97 +59,255 @@ func GetByFingerprintAndVerify(fingerprint []byte, cb VerifyDeviceFunc) (device
 	return nil, errors.New("not found")
 }
 
-// LogErrorAndClose - Logs Error, Sends Acknowlegement(ACK) packet and Closes the connection
+// LogErrorAndClose - Logs Error, Sends Acknowlegement(ACK) packet with the Reason Code and Closes the connection
 // ACK Packet needs to be sent to prevent MQTT Client sending CONN packets further
-func LogErrorAndClose(c net.Conn, err error) {
-	log.Warn("Closing connection on error", zap.Error(err))
-	resp := packet.ConnAckControlPacket{
-		FixedHeader: packet.FixedHeader{
-			ControlPacketType: packet.CONNACK,
-		},
-		VariableHeader: packet.ConnAckVariableHeader{},
+func LogErrorAndClose(c net.Conn, protocolLevel byte, code byte, err error) {
+	log.Warn("Closing connection on error", zap.Error(err), zap.Uint8("reason", code))
+	resp := &protocol.ConnAck{
+		ReasonCode:    code,
+		ProtocolLevel: protocolLevel,
 	}
 	resp.WriteTo(c)
 	c.Close()
 }
 
+// disconnect - sends MQTT 5 DISCONNECT with the Reason Code and closes the connection, older Clients are just disconnected
+func disconnect(log *zap.Logger, c *protocol.Conn, protocolLevel byte, code byte) {
+	log.Debug("Disconnecting Client", zap.Uint8("reason", code))
+	if protocolLevel == 5 {
+		if err := c.WritePacket(protocol.NewDisconnect(code)); err != nil {
+			log.Warn("Failed to write Disconnect", zap.Error(err))
+		}
+	}
+	if err := c.Close(); err != nil {
+		log.Warn("Couldn't close connection", zap.Error(err))
+	}
+}
+
+// activeConnections - number of connections served by HandleConn, limited by max_connections
+var activeConnections atomic.Int64
+
 // HandleConn - note: Connection is expected to be valid & legitimate at this point
-func HandleConn(c net.Conn, connectPacket *packet.ConnectControlPacket, device *devpb.Device) {
-	log := log.Named(device.GetUuid()).Named(connectPacket.ConnectPayload.ClientID)
+func HandleConn(c *protocol.Conn, connectPacket *protocol.ConnectControlPacket, device *devpb.Device) {
+	clientID := connectPacket.ConnectPayload.ClientID
+	log := log.Named(device.GetUuid()).Named(clientID)
 
 	defer log.Debug("Client disconnected")
 
+	protocolLevel := connectPacket.VariableHeader.ProtocolLevel
+
+	// Client must send a packet within one and a half times the Keep Alive, otherwise the connection is reaped
+	keepAlive := time.Duration(serverKeepAlive(connectPacket)) * time.Second
+	c.SetTimeouts(keepAlive*3/2, write_timeout)
+
+	defer activeConnections.Add(-1)
+	if n := activeConnections.Add(1); max_connections > 0 && n > max_connections {
+		c.WritePacket(&protocol.ConnAck{ReasonCode: protocol.ReasonServerBusy, ProtocolLevel: protocolLevel})
+		c.Close()
+		log.Warn("Connection rejected, server is busy", zap.Int64("connections", n))
+		return
+	}
+	if shuttingDown.Load() {
+		c.WritePacket(&protocol.ConnAck{ReasonCode: protocol.ReasonServerUnavailable, ProtocolLevel: protocolLevel})
+		c.Close()
+		log.Info("Connection rejected, server is shutting down")
+		return
+	}
+
 	log.Debug(
 		"Client connected", zap.String("device", device.Uuid),
-		zap.Int("protocol_level", int(connectPacket.VariableHeader.ProtocolLevel)),
+		zap.Int("protocol_level", int(protocolLevel)),
 		zap.String("protocol", connectPacket.VariableHeader.ProtocolName),
 		zap.Int("QoS", connectPacket.VariableHeader.ConnectFlags.WillQoS),
+		zap.Bool("clean_start", connectPacket.CleanStart),
 	)
 	// TODO ignore/compare this ID with the given ID from the verify function
 
-	//TODO : MQTT CONNACK Properties need to add here
-	resp := packet.ConnAckControlPacket{
-		FixedHeader: packet.FixedHeader{
-			ControlPacketType: packet.CONNACK,
-		},
-		VariableHeader: packet.ConnAckVariableHeader{},
+	limits, namespace := deviceLimits(log, device)
+
+	resp := &protocol.ConnAck{
+		ProtocolLevel: protocolLevel,
+	}
+	if protocolLevel == 5 {
+		resp.Properties = connAckProperties(connectPacket)
+		if limits.MaxPacketSize > 0 {
+			size := uint32(limits.MaxPacketSize)
+			resp.Properties.MaximumPacketSize = &size
+		}
 	}
 
-	if len(connectPacket.ConnectPayload.ClientID) <= 0 {
-		resp.VariableHeader.ConnAckProperties.AssignedClientID = device.Uuid
+	if len(clientID) <= 0 {
+		clientID = device.Uuid
+		if resp.Properties != nil {
+			resp.Properties.AssignedClientIdentifier = device.Uuid
+		}
 	}
+
+	// Deferred before closeSession, so the ClientID is released once the session is closed.
+	// Connection of the same ClientID is taken over before the limits are checked, so it frees its slot first
+	expiry := sessionExpiry(connectPacket)
+	release := takeOverSession(log, clientID, expiry, func() {
+		disconnect(log, c, protocolLevel, protocol.ReasonSessionTakenOver)
+	})
+	defer release()
+
+	limiter, releaseLimiter, err := limiters.Acquire(device.Uuid, limits)
+	if err == ratelimit.ErrTooManyConnections {
+		c.WritePacket(&protocol.ConnAck{ReasonCode: protocol.ReasonQuotaExceeded, ProtocolLevel: protocolLevel})
+		c.Close()
+		log.Warn("Connection rejected, device has too many connections", zap.Int("max", limits.MaxConnections))
+		metrics.RateLimitedTotal.WithLabelValues(namespace, ratelimit.ReasonConnections).Inc()
+		return
+	}
+	// Released before the ClientID, so the connection taking it over has the slot
+	defer releaseLimiter()
+	c.SetMaxPacketSize(limits.MaxPacketSize)
+
+	sess, present := openSession(log, clientID, device.Uuid, connectPacket.CleanStart, expiry)
+	resp.SessionPresent = present
+
 	// Only open Back-channel after conn packet was received
 
 	// Create empty subscription
 	backChannel := ps.Sub()
 	defer unsub(ps, backChannel)
+	deltaChannel := ps.Sub()
+	defer unsub(ps, deltaChannel)
 
-	_, err := resp.WriteTo(c)
+	err = c.WritePacket(resp)
 	if err != nil {
 		log.Warn("Failed to write Connection Acknowlegement", zap.Error(err))
 		return
 	}
 
+	window := inflight.New(inflight_window, retry_timeout)
+	defer func() {
+		window.Close()
+		metrics.InflightMessages.Sub(float64(window.Len()))
+	}()
+	defer func() {
+		closeSession(log, sess, expiry, window.Pending())
+	}()
+	go handleRetransmissions(log, c, window)
+
 	metrics.ActiveConnectionsTotal.Inc()
 	ps.TryPub(&pb.Shadow{
 		Device: device.Uuid,
 		Connection: &pb.ConnectionState{
 			Connected: true,
 			Timestamp: timestamppb.Now(),
-			ClientId:  connectPacket.ConnectPayload.ClientID,
+			ClientId:  clientID,
 		},
 	}, "mqtt.incoming")
 
+	// Children of the gateway are connected and disconnected along with it
+	gw := newGatewayConn(log, device.Uuid, clientID, backChannel, deltaChannel)
+
+	// Back channel may still be delivering after the connection is gone, it mustn't report it connected again
+	var closed atomic.Bool
 	defer func() {
+		closed.Store(true)
 		metrics.ActiveConnectionsTotal.Dec()
 		ps.TryPub(&pb.Shadow{
 			Device: device.Uuid,
 			Connection: &pb.ConnectionState{
 				Connected: false,
 				Timestamp: timestamppb.Now(),
-				ClientId:  connectPacket.ConnectPayload.ClientID,
+				ClientId:  clientID,
 			},
 		}, "mqtt.incoming")
+		gw.close()
 	}()
 
-	token := device.GetToken()
-	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
-	for {
-		device, err = client.GetByToken(ctx, device)
-		if err != nil {
-			log.Warn("Can't retrieve device status from registry", zap.Error(err))
+	// Subscriptions are modified by the read loop below and matched by the back channel.
+	// Children unlinked since they were subscribed to don't receive anything
+	var subsMu sync.RWMutex
+	match := func(topic string) (packet.QosLevel, bool) {
+		// Sparkplug messages are only generated for the Edge Node of the connection
+		if sparkplug.IsTopic(topic) {
+			subsMu.RLock()
+			defer subsMu.RUnlock()
+			return topics.MaxQoS(sess.Subscriptions, topic)
 		}
-		if !device.Enabled {
-			log.Debug("Device is disabled, disconnecting", zap.String("device", device.Uuid), zap.Bool("enabled", device.Enabled))
-			err = c.Close()
-			log.Warn("Error closing connection", zap.Error(err))
-			break
+		if target := topics.Parse(topic).Device; target != device.Uuid && !gw.isChild(target) {
+			return 0, false
 		}
+		subsMu.RLock()
+		defer subsMu.RUnlock()
+		return topics.MaxQoS(sess.Subscriptions, topic)
+	}
 
-		p, err := packet.ReadPacket(c, connectPacket.VariableHeader.ProtocolLevel)
+	sp := newSparkplugNode(log, device, gw, sparkplugSender(log, c, window, match, protocolLevel))
+
+	connected := func() {
+		if closed.Load() {
+			return
+		}
+		ps.TryPub(&pb.Shadow{
+			Device: device.Uuid,
+			Connection: &pb.ConnectionState{
+				Connected: true,
+				Timestamp: timestamppb.Now(),
+			},
+		}, "mqtt.incoming")
+	}
+	def := deviceCodec(log, device)
+	ps.AddSub(backChannel, "mqtt.outgoing/"+device.Uuid)
+	go handleBackChannel(log, backChannel, c, window, match, protocolLevel, def, desiredTopics, sp, connected)
+	// Delta is published by the Shadow as Desired state, Sparkplug Edge Nodes only receive Desired state itself
+	ps.AddSub(deltaChannel, "mqtt.delta/"+device.Uuid)
+	go handleBackChannel(log, deltaChannel, c, window, match, protocolLevel, def, deltaTopics, nil, connected)
+
+	// Will Message is published unless the Client disconnects gracefully
+	cancelWill(log, clientID)
+	graceful := false
+	defer func() {
+		if !graceful && connectPacket.Will != nil {
+			scheduleWill(log, device, clientID, connectPacket.Will, willDelay(connectPacket, expiry))
+		}
+	}()
+
+	if present {
+		for filter := range sess.Subscriptions {
+			if sparkplug.CanSubscribe(filter) {
+				continue
+			}
+			if !topics.CanSubscribeFor(device.Uuid, gw.isChild, filter) {
+				delete(sess.Subscriptions, filter)
+			} else if target := topics.FilterDevice(filter); target != device.Uuid {
+				gw.add(target)
+			}
+		}
+		log.Debug("Restored Subscriptions", zap.Any("subscriptions", sess.Subscriptions), zap.String("device", device.Uuid))
+		go drainSession(log, c, window, sess, protocolLevel)
+	}
+
+	aliases := protocol.NewTopicAliases(topic_alias_maximum)
+
+	// Device state is checked on changes in the registry rather than on every packet
+	defer trackConn(device.Uuid, func(code byte) {
+		disconnect(log, c, protocolLevel, code)
+	})()
+
+	token := device.GetToken()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	for {
+		p, err := c.ReadPacket(protocolLevel)
 		if err != nil {
+			if protocol.IsTimeout(err) {
+				log.Info("Keep Alive timed out, reaping connection", zap.Duration("keep_alive", keepAlive))
+				metrics.ConnectionsReapedTotal.Inc()
+				disconnect(log, c, protocolLevel, protocol.ReasonKeepAliveTimeout)
+				return
+			}
+			if err == protocol.ErrPacketTooLarge {
+				log.Warn("Packet exceeds maximum packet size", zap.Int("max", limits.MaxPacketSize))
+				metrics.RateLimitedTotal.WithLabelValues(namespace, ratelimit.ReasonPacketSize).Inc()
+				disconnect(log, c, protocolLevel, protocol.ReasonPacketTooLarge)
+				return
+			}
 			if err == io.EOF {
-				log.Debug("Client closed connection", zap.String("client", connectPacket.ConnectPayload.ClientID))
+				log.Debug("Client closed connection", zap.String("client", clientID))
 			} else {
 				log.Warn("Failed to read packet", zap.Error(err))
 			}
@@ -152,108 +320,422 @@ func HandleConn(c net.Conn, connectPacket *packet.ConnectControlPacket, device *
 		switch p := p.(type) {
 		case *packet.PingReqControlPacket:
 			pong := packet.NewPingRespControlPacket()
-			_, err := pong.WriteTo(c)
+			err := c.WritePacket(pong)
 			if err != nil {
 				log.Warn("Failed to write Ping Response", zap.Error(err))
 			}
-		case *packet.PublishControlPacket:
-			var data structpb.Struct
-			err = data.UnmarshalJSON(p.Payload)
-			if err != nil {
-				log.Warn("Failed to handle Publish", zap.Error(err))
+		case *protocol.Publish:
+			if protocolLevel == 5 {
+				if err := aliases.Resolve(p); err != nil {
+					log.Warn("Failed to resolve Topic Alias", zap.Error(err))
+					code := protocol.ReasonProtocolError
+					if err == protocol.ErrTopicAliasInvalid {
+						code = protocol.ReasonTopicAliasInvalid
+					}
+					disconnect(log, c, protocolLevel, code)
+					return
+				}
+			}
+			if p.QoS > max_qos {
+				log.Warn("Publish QoS exceeds Maximum QoS", zap.Int("qos", int(p.QoS)), zap.Int("max", int(max_qos)))
+				disconnect(log, c, protocolLevel, protocol.ReasonQoSNotSupported)
+				return
+			}
+			if ok, reason := limiter.Allow(len(p.Payload), time.Now()); !ok {
+				metrics.RateLimitedTotal.WithLabelValues(namespace, reason).Inc()
+				if limits.Policy == ratelimit.PolicyDisconnect {
+					log.Warn("Publish exceeds rate limits, disconnecting", zap.String("limit", reason))
+					disconnect(log, c, protocolLevel, protocol.ReasonMessageRateTooHigh)
+					return
+				}
+				log.Debug("Publish exceeds rate limits, dropping", zap.String("limit", reason))
+				rejectPublish(log, c, p, protocolLevel, protocol.ReasonQuotaExceeded)
 				continue
 			}
-			payload := &pb.Shadow{
-				Device: device.Uuid,
-				Reported: &pb.State{
-					Timestamp: timestamppb.Now(),
-					Data:      &data,
-				},
-				Connection: &pb.ConnectionState{
-					Connected: true,
-					Timestamp: timestamppb.Now(),
-				},
+
+			id := p.PacketID
+			switch p.QoS {
+			case packet.QoSLevelNone:
+				handlePublish(log, device, gw, sp, p)
+			case packet.QoSLevelAtLeastOnce:
+				ack := protocol.NewPubAck(id)
+				if code := handlePublish(log, device, gw, sp, p); protocolLevel == 5 {
+					ack.ReasonCode = code
+				}
+				if err := c.WritePacket(ack); err != nil {
+					log.Warn("Failed to write Publish Acknowlegement", zap.Error(err))
+				}
+			case packet.QoSLevelExactlyOnce:
+				rec := protocol.NewPubRec(id)
+				if window.Store(id) {
+					code := handlePublish(log, device, gw, sp, p)
+					if protocolLevel == 5 && code != protocol.ReasonSuccess {
+						// PUBREC with failure Reason Code completes the exchange, no PUBREL follows
+						rec.ReasonCode = code
+						window.Release(id)
+					}
+				} else {
+					log.Debug("Skipping duplicate Publish", zap.Uint16("packet", id))
+					metrics.DuplicatePublishesTotal.Inc()
+				}
+				if err := c.WritePacket(rec); err != nil {
+					log.Warn("Failed to write Publish Received", zap.Error(err))
+				}
 			}
-			ps.TryPub(payload, "mqtt.incoming")
 
-			// _, err := packet.NewPubAckControlPacket(uint16(p.VariableHeader.PacketID)).WriteTo(c)
-			// if err != nil {
-			// 	log.Warn("Failed to write Publish Acknowlegement", zap.Error(err))
-			// }
+		case *protocol.AckControlPacket:
+			handleAck(log, c, window, p, protocolLevel)
+
+		case *protocol.DisconnectControlPacket:
+			log.Debug("Client sent Disconnect", zap.String("client", clientID))
+			// MQTT 5 Client may still ask to publish the Will Message on Disconnect
+			graceful = p.ReasonCode != protocol.ReasonDisconnectWithWill
+			if err := c.Close(); err != nil {
+				log.Warn("Couldn't close connection", zap.Error(err))
+			}
+			return
 
 		case *packet.SubscribeControlPacket:
-			response := packet.NewSubAck(uint16(p.VariableHeader.PacketID), connectPacket.VariableHeader.ProtocolLevel, []byte{1})
-			_, err := response.WriteTo(c)
+			codes := make([]byte, len(p.Payload.Subscriptions))
+			subsMu.Lock()
+			for i, sub := range p.Payload.Subscriptions {
+				isSparkplug := sparkplug.CanSubscribe(sub.Topic)
+				if !isSparkplug && !topics.CanSubscribeFor(device.Uuid, gw.isChild, sub.Topic) {
+					log.Warn("Subscription is not allowed", zap.String("topic", sub.Topic), zap.String("device", device.Uuid))
+					metrics.SubscribeDeniedTotal.Inc()
+					codes[i] = packet.ReturncodeFailure
+					continue
+				}
+				qos := sub.QoS
+				if qos > max_qos {
+					qos = max_qos
+				}
+				codes[i] = byte(qos)
+				sess.Subscriptions[sub.Topic] = qos
+				if target := topics.FilterDevice(sub.Topic); !isSparkplug && target != device.Uuid {
+					gw.add(target)
+				}
+				log.Debug("Added Subscription", zap.String("topic", sub.Topic), zap.Int("qos", int(qos)), zap.String("device", device.Uuid))
+			}
+			saveSession(log, sess, expiry)
+			subsMu.Unlock()
+
+			response := packet.NewSubAck(uint16(p.VariableHeader.PacketID), protocolLevel, codes)
+			err := c.WritePacket(response)
 			if err != nil {
 				log.Warn("Failed to write Subscription Acknowlegement", zap.Error(err))
 			}
 
-			for _, sub := range p.Payload.Subscriptions {
-				ps.AddSub(backChannel, "mqtt.outgoing/"+device.Uuid)
-				go handleBackChannel(log, backChannel, c, sub.Topic, connectPacket.VariableHeader.ProtocolLevel, func() {
-					ps.TryPub(&pb.Shadow{
-						Device: device.Uuid,
-						Connection: &pb.ConnectionState{
-							Connected: true,
-							Timestamp: timestamppb.Now(),
-						},
-					}, "mqtt.incoming")
-				})
-				log.Debug("Added Subscription", zap.String("topic", sub.Topic), zap.String("device", device.Uuid))
+			targets := map[string]bool{device.Uuid: true}
+			for i, sub := range p.Payload.Subscriptions {
+				if codes[i] == packet.ReturncodeFailure {
+					continue
+				}
+				if t, ok := sparkplug.ParseTopic(sub.Topic); ok && t.Type == sparkplug.STATE {
+					go sp.online(sub.Topic)
+				}
+				if !sparkplug.IsTopic(sub.Topic) {
+					target := topics.FilterDevice(sub.Topic)
+					targets[target] = true
+					go sendRetained(log, c, window, target, sub.Topic, packet.QosLevel(codes[i]), protocolLevel)
+				}
 			}
 
 			go func() {
-				if shadow != nil {
-					r, err := shadow.Get(ctx, &pb.GetRequest{Pool: []string{device.Uuid}})
+				if shadow == nil {
+					return
+				}
+				for target := range targets {
+					// Device token only grants access to the device itself, children are checked already
+					tctx := ctx
+					if target != device.Uuid {
+						tctx = internal_ctx
+					}
+					r, err := shadow.Get(tctx, &pb.GetRequest{Pool: []string{target}})
 					if err != nil || len(r.GetShadows()) == 0 {
-						return
+						continue
 					}
 					state := r.GetShadows()[0]
 					if state.Desired != nil {
-						ps.TryPub(state, "mqtt.outgoing/"+device.Uuid)
+						ps.TryPub(state, "mqtt.outgoing/"+target)
+					}
+					if delta, err := shadowsvc.LoadDelta(tctx, rdb, target); err != nil {
+						log.Warn("Failed to load delta", zap.String("device", target), zap.Error(err))
+					} else if len(delta.GetData().GetFields()) > 0 {
+						ps.TryPub(&pb.Shadow{Device: target, Desired: delta}, "mqtt.delta/"+target)
 					}
 				}
 			}()
 		case *packet.UnsubscribeControlPacket:
-			response := packet.NewUnSubAck(uint16(p.VariableHeader.PacketID), connectPacket.VariableHeader.ProtocolLevel, []byte{1})
-			_, err := response.WriteTo(c)
+			response := packet.NewUnSubAck(uint16(p.VariableHeader.PacketID), protocolLevel, []byte{1})
+			err := c.WritePacket(response)
 			if err != nil {
 				log.Warn("Failed to write Unsubscription Acknowlegement", zap.Error(err))
 			}
+			subsMu.Lock()
 			for _, unsub := range p.Payload.UnSubscriptions {
-				ps.Unsub(backChannel, "mqtt.outgoing/"+device.Uuid)
+				delete(sess.Subscriptions, unsub.Topic)
 				log.Debug("Removed Subscription", zap.String("topic", unsub.Topic), zap.String("device", device.Uuid))
 			}
+			saveSession(log, sess, expiry)
+			subsMu.Unlock()
+		}
+	}
+}
+
+// handlePublish - routes device message according to its topic, returns Reason Code to acknowledge the message with.
+// Gateway publishes messages of its children as if they were sent by them, gw and sp are nil if the connection is gone already
+func handlePublish(log *zap.Logger, device *devpb.Device, gw *gatewayConn, sp *sparkplugNode, p *protocol.Publish) byte {
+	topic := p.Topic
+	if !canPublish(device) {
+		log.Warn("Publish is not allowed, device token is read-only", zap.String("topic", topic), zap.String("device", device.Uuid))
+		metrics.PublishDeniedTotal.Inc()
+		return protocol.ReasonNotAuthorized
+	}
+	if sparkplug.IsTopic(topic) {
+		if sp == nil {
+			// NDEATH Will Message, devices are reported disconnected along with the connection already
+			if t, ok := sparkplug.ParseTopic(topic); ok && t.Type == sparkplug.NDEATH {
+				return protocol.ReasonSuccess
+			}
+			return protocol.ReasonNotAuthorized
+		}
+		return sp.handle(p)
+	}
+	var isChild func(string) bool
+	if gw != nil {
+		isChild = gw.isChild
+	}
+	if !topics.CanPublishFor(device.Uuid, isChild, topic) {
+		log.Warn("Publish is not allowed", zap.String("topic", topic), zap.String("device", device.Uuid))
+		metrics.PublishDeniedTotal.Inc()
+		return protocol.ReasonNotAuthorized
+	}
+	t := topics.Parse(topic)
+	if t.Device != device.Uuid {
+		child, err := gw.child(t.Device)
+		if err != nil {
+			log.Warn("Publish for child device is not allowed", zap.String("topic", topic), zap.String("child", t.Device), zap.Error(err))
+			metrics.PublishDeniedTotal.Inc()
+			return protocol.ReasonNotAuthorized
+		}
+		device = child
+	}
+
+	retain := p.Retain
+	if retain && len(p.Payload) == 0 {
+		// Zero-byte retained message only clears the retained message of the topic
+		storeRetained(log, device.Uuid, p, nil)
+		return protocol.ReasonSuccess
+	}
+
+	var code byte
+	c := publishCodec(log, device, t, p.Properties)
+	if t.Kind == topics.Event {
+		code = handleEvent(log, device, t.Name, c, p.Payload, p.Properties)
+	} else {
+		code = handleReported(log, device, c, p.Payload, p.Properties)
+	}
+
+	if retain && code == protocol.ReasonSuccess {
+		storeRetained(log, device.Uuid, p, c)
+	}
+	return code
+}
+
+// handleReported - publishes device message as Reported state, MQTT 5 User Properties are put under "$metadata".
+// State not matching the device schema is rejected or quarantined
+func handleReported(log *zap.Logger, device *devpb.Device, c codec.Codec, msg []byte, props *protocol.Properties) byte {
+	data, err := codec.DecodeStruct(c, msg)
+	if err != nil {
+		log.Warn("Failed to handle Publish", zap.String("format", c.Name()), zap.Error(err))
+		return protocol.ReasonPayloadFormatInvalid
+	}
+	return publishReported(log, device, data, props)
+}
+
+// publishReported - publishes decoded state as Reported state of the device, props are nil unless it came in MQTT 5 Publish
+func publishReported(log *zap.Logger, device *devpb.Device, data *structpb.Struct, props *protocol.Properties) byte {
+	if code, apply := validateReported(log, device.Uuid, data); !apply {
+		return code
+	}
+	if up := userPropertiesStruct(props); up != nil {
+		if data.Fields == nil {
+			data.Fields = make(map[string]*structpb.Value)
+		}
+		data.Fields["$metadata"] = &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"user_properties": {Kind: &structpb.Value_StructValue{StructValue: up}},
+			},
+		}}}
+	}
+	payload := &pb.Shadow{
+		Device: device.Uuid,
+		Reported: &pb.State{
+			Timestamp: timestamppb.Now(),
+			Data:      data,
+		},
+		Connection: &pb.ConnectionState{
+			Connected: true,
+			Timestamp: timestamppb.Now(),
+		},
+	}
+	ps.TryPub(payload, "mqtt.incoming")
+	return protocol.ReasonSuccess
+}
+
+// handleEvent - publishes device event to mqtt.events, event is wrapped into State as {"event": name, "data": payload}
+// with "user_properties" added if MQTT 5 User Properties are given
+func handleEvent(log *zap.Logger, device *devpb.Device, name string, c codec.Codec, msg []byte, props *protocol.Properties) byte {
+	value, err := c.Decode(msg)
+	if err != nil {
+		log.Warn("Failed to handle Event", zap.String("event", name), zap.String("format", c.Name()), zap.Error(err))
+		return protocol.ReasonPayloadFormatInvalid
+	}
+	data := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"event": {Kind: &structpb.Value_StringValue{StringValue: name}},
+		"data":  value,
+	}}
+	if up := userPropertiesStruct(props); up != nil {
+		data.Fields["user_properties"] = &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: up}}
+	}
+	ps.TryPub(&pb.Shadow{
+		Device: device.Uuid,
+		Reported: &pb.State{
+			Timestamp: timestamppb.Now(),
+			Data:      data,
+		},
+	}, "mqtt.events")
+	return protocol.ReasonSuccess
+}
+
+// handleAck - handles PUBACK, PUBREC, PUBCOMP for messages sent to device and PUBREL for messages received from device
+func handleAck(log *zap.Logger, c *protocol.Conn, window *inflight.Window, p *protocol.AckControlPacket, protocolLevel byte) {
+	switch p.FixedHeader.ControlPacketType {
+	case packet.PUBACK:
+		if window.Ack(p.PacketID) {
+			metrics.InflightMessages.Dec()
+		} else {
+			log.Debug("Received Publish Acknowlegement for unknown packet", zap.Uint16("packet", p.PacketID))
+		}
+	case packet.PUBREC:
+		rel := protocol.NewPubRel(p.PacketID)
+		if !window.Received(p.PacketID) {
+			log.Debug("Received Publish Received for unknown packet", zap.Uint16("packet", p.PacketID))
+			if protocolLevel == 5 {
+				rel.ReasonCode = protocol.ReasonPacketIdentifierNotFound
+			}
+		}
+		if err := c.WritePacket(rel); err != nil {
+			log.Warn("Failed to write Publish Release", zap.Error(err))
+		}
+	case packet.PUBREL:
+		window.Release(p.PacketID)
+		if err := c.WritePacket(protocol.NewPubComp(p.PacketID)); err != nil {
+			log.Warn("Failed to write Publish Complete", zap.Error(err))
+		}
+	case packet.PUBCOMP:
+		if window.Complete(p.PacketID) {
+			metrics.InflightMessages.Dec()
+		} else {
+			log.Debug("Received Publish Complete for unknown packet", zap.Uint16("packet", p.PacketID))
+		}
+	}
+}
+
+// handleRetransmissions - resends unacknowledged PUBLISH (with DUP flag) and PUBREL packets until window is closed
+func handleRetransmissions(log *zap.Logger, c *protocol.Conn, window *inflight.Window) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-window.Done():
+			return
+		case now := <-ticker.C:
+			for _, m := range window.Expired(now) {
+				if m.Retries > max_retries {
+					log.Warn("Dropping message after max retries", zap.Uint16("packet", m.Packet.PacketID), zap.String("topic", m.Packet.Topic))
+					window.Drop(m.Packet.PacketID)
+					metrics.InflightMessages.Dec()
+					metrics.PublishDroppedTotal.Inc()
+					continue
+				}
+
+				var p io.WriterTo = m.Packet
+				if m.State == inflight.AwaitingPubComp {
+					p = protocol.NewPubRel(m.Packet.PacketID)
+				}
+				log.Debug("Retransmitting", zap.Uint16("packet", m.Packet.PacketID), zap.Int("retry", m.Retries))
+				metrics.PublishRetriesTotal.Inc()
+				if err := c.WritePacket(p); err != nil {
+					log.Warn("Failed to retransmit packet", zap.Error(err))
+				}
+			}
 		}
 	}
 }
 
-func handleBackChannel(log *zap.Logger, ch chan interface{}, c net.Conn, topic string, protocolLevel byte, connected func()) {
+// handleBackChannel - delivers Desired state to the Client if it's subscribed to it, match returns QoS of matching subscriptions.
+// stateTopics are the topics it's delivered to, plain topic is encoded with the device default codec def, format suffixed ones with their own.
+// Sparkplug node is optional
+func handleBackChannel(log *zap.Logger, ch chan interface{}, c *protocol.Conn, window *inflight.Window, match func(topic string) (packet.QosLevel, bool), protocolLevel byte, def codec.Codec, stateTopics func(string, codec.Codec) []desiredTopic, sp *sparkplugNode, connected func()) {
 	defer log.Debug("BackChannel handler closed")
 	var ts int64 = 0
 	for msg := range ch {
 		shadow := msg.(*pb.Shadow)
-		log.Debug("Received message", zap.String("topic", topic), zap.String("device", shadow.Device))
+		log.Debug("Received message", zap.String("device", shadow.Device))
 		if shadow.Desired == nil || shadow.Desired.Timestamp == nil {
 			log.Debug("Skipping empty Desired state")
 			continue
 		}
 		if shadow.Desired.Timestamp.Seconds < ts {
-			log.Debug("Skipping message", zap.String("topic", topic), zap.String("device", shadow.Device))
+			log.Debug("Skipping message", zap.String("device", shadow.Device))
 			continue
 		}
-		payload, err := shadow.Desired.Data.MarshalJSON()
-		if err != nil {
-			log.Warn("Failed to marshal shadow", zap.Error(err))
-			continue
+
+		sent := false
+		for _, dt := range stateTopics(shadow.Device, def) {
+			qos, ok := match(dt.topic)
+			if !ok {
+				continue
+			}
+			payload, err := dt.codec.Encode(structpb.NewStructValue(shadow.Desired.Data))
+			if err != nil {
+				log.Warn("Failed to marshal shadow", zap.String("format", dt.codec.Name()), zap.Error(err))
+				continue
+			}
+
+			m, err := window.Add(&protocol.Publish{
+				Topic:         dt.topic,
+				QoS:           qos,
+				Payload:       payload,
+				ProtocolLevel: protocolLevel,
+				Properties:    contentType(dt.codec, protocolLevel),
+			})
+			if err != nil {
+				log.Debug("Connection closed, message is not sent", zap.Error(err))
+				return
+			}
+			if qos > packet.QoSLevelNone {
+				metrics.InflightMessages.Inc()
+			}
+
+			err = c.WritePacket(m.Packet)
+			if err != nil {
+				log.Error("Failed to write packet", zap.Error(err))
+				return
+			}
+			sent = true
 		}
-		p := packet.NewPublish(topic, 0, payload, protocolLevel)
-		_, err = p.WriteTo(c)
-		if err != nil {
-			log.Error("Failed to write packet", zap.Error(err))
-			return
+		if sp != nil && sp.deliver(shadow) {
+			sent = true
 		}
 
+		if !sent {
+			log.Debug("Client isn't subscribed, skipping message", zap.String("device", shadow.Device))
+			continue
+		}
 		connected()
 	}
 }
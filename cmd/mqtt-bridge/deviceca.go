@@ -0,0 +1,202 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"sync"
+
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/rotation"
+	pb "github.com/infinimesh/proto/node"
+	devpb "github.com/infinimesh/proto/node/devices"
+	nspb "github.com/infinimesh/proto/node/namespaces"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// provisionMu - serializes JIT Provisioning, so concurrent connects of the same new device don't register it twice
+var provisionMu sync.Mutex
+
+// loadNamespaces - deviceca.LoadFunc fetching all Namespaces as root
+func loadNamespaces(_ context.Context) ([]*nspb.Namespace, error) {
+	r, err := namespaces.List(internal_ctx, &pb.EmptyMessage{})
+	if err != nil {
+		return nil, err
+	}
+	return r.GetNamespaces(), nil
+}
+
+// verifyEnabled - VerifyDeviceFunc accepting enabled devices only
+func verifyEnabled(log *zap.Logger) VerifyDeviceFunc {
+	return func(device *devpb.Device) bool {
+		if device.Enabled {
+			log.Info("Device is enabled", zap.String("device", device.Uuid), zap.Strings("tags", device.Tags))
+			return true
+		}
+		log.Warn("Failed to verify client as the device is not enabled", zap.String("device", device.Uuid))
+		return false
+	}
+}
+
+// authenticateCertificate - finds the device by its client certificate fingerprint, certificates revoked by its Namespace are refused.
+// Chain is verified against CAs trusted by the device Namespace if it enforces them, certificates with a known issuer are checked with OCSP.
+// Unknown devices with chain trusted by a single Namespace with JIT Provisioning are registered there
+func authenticateCertificate(log *zap.Logger, chain []*x509.Certificate) (*devpb.Device, error) {
+	fingerprint := getFingerprint(chain[0].Raw)
+	log.Debug("Fingerprint", zap.Binary("fingerprint", fingerprint))
+
+	device, err := GetByFingerprintAndVerify(fingerprint, verifyEnabled(log))
+	if err == nil {
+		dev, err := devices.Get(context.Background(), device.Uuid)
+		if err != nil {
+			return nil, err
+		}
+		ns := dev.GetAccess().GetNamespace()
+		if err := checkRevoked(log, ns, chain); err != nil {
+			return nil, err
+		}
+		issuer, err := verifyEnforced(log, ns, device, chain)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkOCSP(log, chain[0], issuer); err != nil {
+			return nil, err
+		}
+		connected(log, device, fingerprint)
+		return device, nil
+	}
+	if status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+
+	config, verr := trustedCAs.Find(context.Background(), chain)
+	if verr != nil {
+		switch {
+		case errors.Is(verr, deviceca.ErrAmbiguous):
+			log.Warn("Certificate is trusted by several Namespaces, refusing JIT Provisioning", zap.Error(verr))
+		case !errors.Is(verr, deviceca.ErrUntrusted):
+			log.Warn("Can't retrieve trusted CAs", zap.Error(verr))
+		}
+		return nil, err
+	}
+	if !config.JITProvisioning {
+		log.Info("Certificate is trusted, but JIT Provisioning is disabled", zap.String("namespace", config.Namespace))
+		return nil, err
+	}
+	if err := checkRevoked(log, config.Namespace, chain); err != nil {
+		return nil, err
+	}
+	issuer, err := config.Issuer(chain)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOCSP(log, chain[0], issuer); err != nil {
+		return nil, err
+	}
+	return provisionDevice(log, config, chain[0], fingerprint)
+}
+
+// connected - tells the registry the device has connected with a certificate other than its primary one,
+// so a pending certificate becomes primary. Only called once the device is fully authenticated, it doesn't hold the connection up
+func connected(log *zap.Logger, device *devpb.Device, fingerprint []byte) {
+	if certificates == nil || !rotation.Rotates(device.GetCertificate().GetFingerprint(), fingerprint) {
+		return
+	}
+	go func() {
+		if err := certificates.Connected(context.Background(), device.Uuid, fingerprint); err != nil {
+			log.Warn("Can't tell the registry which certificate the device connected with", zap.String("device", device.Uuid), zap.Error(err))
+		}
+	}()
+}
+
+// verifyEnforced - checks the chain of a registered device against CAs trusted by its Namespace ns, the device is refused
+// if the Namespace enforces them and the chain isn't trusted. Returns issuer of the device certificate for OCSP checks:
+// the trusted one if the chain is trusted by the Namespace, otherwise the one sent by the device, if it signed the certificate.
+// Issuer is nil for self-signed certificates, so OCSP isn't checked for them
+func verifyEnforced(log *zap.Logger, ns string, device *devpb.Device, chain []*x509.Certificate) (*x509.Certificate, error) {
+	if ns == "" {
+		return presentedIssuer(chain), nil
+	}
+	config, err := trustedCAs.Get(context.Background(), ns)
+	if err != nil {
+		log.Warn("Can't retrieve trusted CAs of the Namespace", zap.String("namespace", ns), zap.Error(err))
+		return nil, err
+	}
+	if config == nil {
+		return presentedIssuer(chain), nil
+	}
+	issuer, err := config.Issuer(chain)
+	if err == nil {
+		return issuer, nil
+	}
+	if config.Enforce {
+		log.Warn("Device certificate is not trusted by its Namespace", zap.String("device", device.Uuid), zap.Error(err))
+		return nil, err
+	}
+	log.Debug("Device certificate is not trusted by its Namespace, which doesn't enforce trusted CAs", zap.String("device", device.Uuid), zap.Error(err))
+	return presentedIssuer(chain), nil
+}
+
+// presentedIssuer - certificate sent by the device right after its own one, if it signed it
+func presentedIssuer(chain []*x509.Certificate) *x509.Certificate {
+	if len(chain) < 2 || chain[0].CheckSignatureFrom(chain[1]) != nil {
+		return nil
+	}
+	return chain[1]
+}
+
+// provisionDevice - registers the device with the certificate in the Namespace and returns it as GetByFingerprint would
+func provisionDevice(log *zap.Logger, config *deviceca.Config, cert *x509.Certificate, fingerprint []byte) (*devpb.Device, error) {
+	provisionMu.Lock()
+	defer provisionMu.Unlock()
+
+	// Device might have been registered while waiting for the lock
+	device, err := GetByFingerprintAndVerify(fingerprint, verifyEnabled(log))
+	if status.Code(err) != codes.NotFound {
+		return device, err
+	}
+
+	title := cert.Subject.CommonName
+	if title == "" {
+		title = hex.EncodeToString(fingerprint[:8])
+	}
+	_, err = client.Create(internal_ctx, &devpb.CreateRequest{
+		Namespace: config.Namespace,
+		Device: &devpb.Device{
+			Title:   title,
+			Enabled: true,
+			Tags:    config.Tags,
+			Certificate: &devpb.Certificate{
+				PemData: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+			},
+		},
+	})
+	if err != nil {
+		log.Warn("Couldn't provision device", zap.String("namespace", config.Namespace), zap.Error(err))
+		return nil, err
+	}
+	metrics.DevicesProvisionedTotal.Inc()
+	log.Info("Device provisioned", zap.String("namespace", config.Namespace), zap.String("title", title))
+
+	return GetByFingerprintAndVerify(fingerprint, verifyEnabled(log))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	devpb "github.com/infinimesh/proto/node/devices"
+	nspb "github.com/infinimesh/proto/node/namespaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issueCert - certificate signed by parent, self-signed if parent is nil
+func issueCert(t *testing.T, parent *testIssuer, name string, ca bool) *testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testIssuer{cert: cert, key: key}
+}
+
+// trustCAs - makes the Namespace "ns" trust the CA
+func trustCAs(t *testing.T, ca *x509.Certificate, enforce bool) {
+	config, err := structpb.NewStruct(map[string]interface{}{
+		deviceca.ConfigKey: map[string]interface{}{
+			"certificates": []interface{}{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))},
+			"enforce":      enforce,
+		},
+	})
+	require.NoError(t, err)
+	trustedCAs = deviceca.NewStore(time.Minute, func(context.Context) ([]*nspb.Namespace, error) {
+		return []*nspb.Namespace{{Uuid: "ns", Config: config}}, nil
+	})
+}
+
+func TestVerifyEnforced_Trusted(t *testing.T) {
+	ca := issueCert(t, nil, "ca", true)
+	trustCAs(t, ca.cert, true)
+	leaf := issueCert(t, ca, "device", false)
+
+	issuer, err := verifyEnforced(zap.NewNop(), "ns", &devpb.Device{Uuid: "device"}, []*x509.Certificate{leaf.cert})
+
+	require.NoError(t, err)
+	assert.Equal(t, ca.cert, issuer)
+}
+
+func TestVerifyEnforced_FailsOn_Untrusted(t *testing.T) {
+	trustCAs(t, issueCert(t, nil, "ca", true).cert, true)
+	other := issueCert(t, nil, "other", true)
+	leaf := issueCert(t, other, "device", false)
+
+	_, err := verifyEnforced(zap.NewNop(), "ns", &devpb.Device{Uuid: "device"}, []*x509.Certificate{leaf.cert, other.cert})
+
+	assert.ErrorIs(t, err, deviceca.ErrUntrusted)
+}
+
+// Namespace not enforcing trusted CAs accepts the chain, but its issuer is still checked with OCSP
+func TestVerifyEnforced_NotEnforced_PresentedIssuer(t *testing.T) {
+	trustCAs(t, issueCert(t, nil, "ca", true).cert, false)
+	other := issueCert(t, nil, "other", true)
+	leaf := issueCert(t, other, "device", false)
+
+	issuer, err := verifyEnforced(zap.NewNop(), "ns", &devpb.Device{Uuid: "device"}, []*x509.Certificate{leaf.cert, other.cert})
+
+	require.NoError(t, err)
+	assert.Equal(t, other.cert, issuer)
+}
+
+// Self-signed certificates have no issuer to ask the OCSP responder about
+func TestVerifyEnforced_NotEnforced_SelfSigned(t *testing.T) {
+	trustCAs(t, issueCert(t, nil, "ca", true).cert, false)
+	leaf := issueCert(t, nil, "device", false)
+
+	issuer, err := verifyEnforced(zap.NewNop(), "ns", &devpb.Device{Uuid: "device"}, []*x509.Certificate{leaf.cert})
+
+	require.NoError(t, err)
+	assert.Nil(t, issuer)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	connsMu sync.Mutex
+	// conns - kick functions of active connections by device UUID, kick disconnects with the given Reason Code
+	conns = make(map[string]map[*func(code byte)]struct{})
+)
+
+// loadDevice - devcache.LoadFunc fetching the device from the registry as root
+func loadDevice(_ context.Context, uuid string) (*devpb.Device, error) {
+	return client.Get(internal_ctx, &devpb.Device{Uuid: uuid})
+}
+
+// trackConn - registers the connection to be kicked when the device is disabled or deleted, returns function to unregister it
+func trackConn(device string, kick func(code byte)) (untrack func()) {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+
+	if conns[device] == nil {
+		conns[device] = make(map[*func(code byte)]struct{})
+	}
+	key := &kick
+	conns[device][key] = struct{}{}
+
+	return func() {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+
+		delete(conns[device], key)
+		if len(conns[device]) == 0 {
+			delete(conns, device)
+		}
+	}
+}
+
+// checkDevice - kicks all connections of the device if it's disabled or doesn't exist anymore.
+// Connections are kept if the registry can't be reached
+func checkDevice(log *zap.Logger, uuid string) {
+	device, err := devices.Get(context.Background(), uuid)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound, codes.PermissionDenied:
+			log.Info("Device not found, disconnecting", zap.String("device", uuid), zap.Error(err))
+		default:
+			log.Warn("Can't retrieve device status from registry", zap.String("device", uuid), zap.Error(err))
+			return
+		}
+	} else if device.Enabled {
+		return
+	} else {
+		log.Info("Device is disabled, disconnecting", zap.String("device", uuid))
+	}
+
+	connsMu.Lock()
+	var kicks []func(byte)
+	for kick := range conns[uuid] {
+		kicks = append(kicks, *kick)
+	}
+	connsMu.Unlock()
+
+	for _, kick := range kicks {
+		metrics.DevicesKickedTotal.Inc()
+		kick(protocol.ReasonNotAuthorized)
+	}
+}
+
+// handleDeviceChanges - re-checks devices with active connections once they're changed in the registry,
+// and all of them every TTL in case a notification was missed
+func handleDeviceChanges(rdb redis.UniversalClient) {
+	log := log.Named("DeviceChanges")
+
+	go devcache.Subscribe(context.Background(), rdb, func(uuid string) {
+		devices.Invalidate(uuid)
+		schemas.Invalidate(uuid)
+		gateways.Invalidate(uuid)
+
+		connsMu.Lock()
+		_, ok := conns[uuid]
+		connsMu.Unlock()
+		if ok {
+			checkDevice(log, uuid)
+		}
+	})
+
+	ticker := time.NewTicker(device_cache_ttl)
+	defer ticker.Stop()
+	for range ticker.C {
+		connsMu.Lock()
+		uuids := make([]string, 0, len(conns))
+		for uuid := range conns {
+			uuids = append(uuids, uuid)
+		}
+		connsMu.Unlock()
+
+		for _, uuid := range uuids {
+			checkDevice(log, uuid)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	devpb "github.com/infinimesh/proto/node/devices"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var errNotChild = errors.New("device is not a child of the gateway")
+
+// gatewayConn - child devices served over the gateway connection, their connection state follows the gateway's one.
+// Children are added once the gateway connects or uses their topics for the first time
+type gatewayConn struct {
+	log          *zap.Logger
+	gateway      string
+	clientID     string
+	backChannel  chan interface{}
+	deltaChannel chan interface{}
+
+	mu       sync.Mutex
+	children map[string]bool
+	closed   bool
+}
+
+// newGatewayConn - adds children linked to the device, so they're reported connected and their Desired state is delivered.
+// Devices without children aren't affected
+func newGatewayConn(log *zap.Logger, device, clientID string, backChannel, deltaChannel chan interface{}) *gatewayConn {
+	g := &gatewayConn{
+		log: log.Named("Gateway"), gateway: device, clientID: clientID, backChannel: backChannel, deltaChannel: deltaChannel,
+		children: make(map[string]bool),
+	}
+
+	children, err := gatewayLinks.Children(context.Background(), device)
+	if err != nil {
+		g.log.Warn("Can't retrieve gateway children, they're added once used", zap.Error(err))
+	}
+	for _, child := range children {
+		g.add(child)
+	}
+	return g
+}
+
+// isChild - checks if the device is linked to the gateway, links can't be checked without Redis, so it fails closed
+func (g *gatewayConn) isChild(device string) bool {
+	ok, err := gateways.IsChild(context.Background(), g.gateway, device)
+	if err != nil {
+		g.log.Warn("Can't check gateway children", zap.String("child", device), zap.Error(err))
+		return false
+	}
+	return ok
+}
+
+// child - enabled child device the gateway acts for
+func (g *gatewayConn) child(uuid string) (*devpb.Device, error) {
+	if !g.isChild(uuid) {
+		return nil, errNotChild
+	}
+	device, err := devices.Get(context.Background(), uuid)
+	if err != nil {
+		return nil, err
+	}
+	if !device.Enabled {
+		return nil, errors.New("device is not enabled")
+	}
+	g.add(uuid)
+	return device, nil
+}
+
+// add - starts serving the child over the connection
+func (g *gatewayConn) add(child string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed || g.children[child] {
+		return
+	}
+	g.children[child] = true
+
+	g.log.Debug("Serving child device", zap.String("child", child))
+	ps.AddSub(g.backChannel, "mqtt.outgoing/"+child)
+	ps.AddSub(g.deltaChannel, "mqtt.delta/"+child)
+	g.publishConnection(child, true)
+}
+
+// close - reports all children disconnected along with the gateway
+func (g *gatewayConn) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+
+	for child := range g.children {
+		g.publishConnection(child, false)
+	}
+}
+
+func (g *gatewayConn) publishConnection(child string, connected bool) {
+	ps.TryPub(&pb.Shadow{
+		Device: child,
+		Connection: &pb.ConnectionState{
+			Connected: connected,
+			Timestamp: timestamppb.Now(),
+			ClientId:  g.clientID,
+		},
+	}, "mqtt.incoming")
+}
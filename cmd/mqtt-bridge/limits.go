@@ -0,0 +1,100 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/ratelimit"
+	devpb "github.com/infinimesh/proto/node/devices"
+	nspb "github.com/infinimesh/proto/node/namespaces"
+	"github.com/slntopp/mqtt-go/packet"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type cachedConfig struct {
+	config  *structpb.Struct
+	expires time.Time
+}
+
+var (
+	namespacesMu     sync.Mutex
+	namespaceConfigs = make(map[string]cachedConfig)
+)
+
+// limiters - rate limiters shared by connections of the same device
+var limiters = ratelimit.NewRegistry()
+
+// namespaceConfig - Namespace config, cached for device_cache_ttl. Errors aren't cached, nil is returned instead
+func namespaceConfig(log *zap.Logger, uuid string) *structpb.Struct {
+	namespacesMu.Lock()
+	c, ok := namespaceConfigs[uuid]
+	namespacesMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.config
+	}
+
+	ns, err := namespaces.Get(internal_ctx, &nspb.Namespace{Uuid: uuid})
+	if err != nil {
+		log.Warn("Can't retrieve namespace config from registry", zap.String("namespace", uuid), zap.Error(err))
+		return nil
+	}
+
+	namespacesMu.Lock()
+	namespaceConfigs[uuid] = cachedConfig{config: ns.GetConfig(), expires: time.Now().Add(device_cache_ttl)}
+	namespacesMu.Unlock()
+	return ns.GetConfig()
+}
+
+// deviceLimits - ingress limits of the device: bridge defaults overridden by its Namespace and then Device config
+func deviceLimits(log *zap.Logger, device *devpb.Device) (limits ratelimit.Limits, namespace string) {
+	limits = default_limits
+
+	dev, err := devices.Get(context.Background(), device.Uuid)
+	if err != nil {
+		log.Warn("Can't retrieve device from registry, applying default limits", zap.Error(err))
+		return limits, ""
+	}
+
+	namespace = dev.GetAccess().GetNamespace()
+	if namespace != "" {
+		limits = limits.Merge(namespaceConfig(log, namespace))
+	}
+	return limits.Merge(dev.GetConfig()), namespace
+}
+
+// rejectPublish - acknowledges QoS 1 and QoS 2 publish which isn't processed, MQTT 5 Clients get the Reason Code
+func rejectPublish(log *zap.Logger, c *protocol.Conn, p *protocol.Publish, protocolLevel byte, code byte) {
+	var ack *protocol.AckControlPacket
+	switch p.QoS {
+	case packet.QoSLevelAtLeastOnce:
+		ack = protocol.NewPubAck(p.PacketID)
+	case packet.QoSLevelExactlyOnce:
+		ack = protocol.NewPubRec(p.PacketID)
+	default:
+		return
+	}
+	if protocolLevel == 5 {
+		ack.ReasonCode = code
+	}
+	if err := c.WritePacket(ack); err != nil {
+		log.Warn("Failed to write Publish Acknowlegement", zap.Error(err))
+	}
+}
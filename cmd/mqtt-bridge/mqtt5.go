@@ -0,0 +1,119 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/slntopp/mqtt-go/packet"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// errBadCredentials - wrapped by authentication errors caused by malformed credentials
+var errBadCredentials = errors.New("bad credentials")
+
+// connAckCode - Reason Code to reject the connection with on authentication error
+func connAckCode(err error) byte {
+	if errors.Is(err, errBadCredentials) {
+		return protocol.ReasonBadUserNameOrPassword
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unauthenticated:
+			return protocol.ReasonBadUserNameOrPassword
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return protocol.ReasonServerUnavailable
+		}
+	}
+	return protocol.ReasonNotAuthorized
+}
+
+// connAckProperties - MQTT 5 CONNACK properties telling the Client about the Server limits
+func connAckProperties(p *protocol.ConnectControlPacket) *protocol.Properties {
+	receiveMaximum := uint16(inflight_window)
+	topicAliasMaximum := topic_alias_maximum
+	sharedSubscriptionAvailable := byte(0)
+
+	props := &protocol.Properties{
+		ReceiveMaximum:              &receiveMaximum,
+		TopicAliasMaximum:           &topicAliasMaximum,
+		SharedSubscriptionAvailable: &sharedSubscriptionAvailable,
+	}
+
+	// It's a Protocol Error to send Maximum QoS of 2, absent property means QoS 2 is supported
+	if max_qos < packet.QoSLevelExactlyOnce {
+		maximumQoS := byte(max_qos)
+		props.MaximumQoS = &maximumQoS
+	}
+
+	if keepAlive := serverKeepAlive(p); keepAlive != uint16(p.VariableHeader.KeepAlive) {
+		props.ServerKeepAlive = &keepAlive
+	}
+
+	if p.Properties != nil && p.Properties.SessionExpiryInterval != nil {
+		if granted := uint32(sessionExpiry(p).Seconds()); granted != *p.Properties.SessionExpiryInterval {
+			props.SessionExpiryInterval = &granted
+		}
+	}
+	return props
+}
+
+// serverKeepAlive - Keep Alive the Client must use, Client's one if it doesn't exceed the maximum.
+// MQTT 3.1.1 Clients can't be told to use another one, those which turned Keep Alive off aren't timed out
+// and rely on TCP keep-alive to detect dead peers
+func serverKeepAlive(p *protocol.ConnectControlPacket) uint16 {
+	keepAlive := uint16(p.VariableHeader.KeepAlive)
+	if p.VariableHeader.ProtocolLevel != 5 && keepAlive == 0 {
+		return 0
+	}
+	limit := uint16(math.MaxUint16)
+	if seconds := max_keep_alive.Seconds(); seconds < math.MaxUint16 {
+		limit = uint16(seconds)
+	}
+	if limit > 0 && (keepAlive == 0 || keepAlive > limit) {
+		return limit
+	}
+	return keepAlive
+}
+
+// userPropertiesStruct - User Properties as Struct, repeated keys are kept as lists
+func userPropertiesStruct(props *protocol.Properties) *structpb.Struct {
+	if props == nil || len(props.UserProperties) == 0 {
+		return nil
+	}
+
+	res := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+	for _, up := range props.UserProperties {
+		value := &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: up.Value}}
+		prev, ok := res.Fields[up.Key]
+		if !ok {
+			res.Fields[up.Key] = value
+			continue
+		}
+		if list := prev.GetListValue(); list != nil {
+			list.Values = append(list.Values, value)
+			continue
+		}
+		res.Fields[up.Key] = &structpb.Value{Kind: &structpb.Value_ListValue{ListValue: &structpb.ListValue{
+			Values: []*structpb.Value{prev, value},
+		}}}
+	}
+	return res
+}
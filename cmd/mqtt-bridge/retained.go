@@ -0,0 +1,94 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/inflight"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/retained"
+	"github.com/slntopp/mqtt-go/packet"
+	"go.uber.org/zap"
+)
+
+// storeRetained - keeps the message as the last value of its topic along with the codec its payload was decoded with,
+// empty payload removes it. Message is kept until its MQTT 5 Message Expiry Interval passes
+func storeRetained(log *zap.Logger, device string, p *protocol.Publish, c codec.Codec) {
+	msg := retained.Message{
+		Topic:     p.Topic,
+		QoS:       p.QoS,
+		Payload:   p.Payload,
+		Timestamp: time.Now(),
+	}
+	if c != nil {
+		msg.Codec = c.Name()
+	}
+	if p.Properties != nil && p.Properties.MessageExpiryInterval != nil {
+		msg.Expiry = time.Duration(*p.Properties.MessageExpiryInterval) * time.Second
+	}
+
+	err := retainedMessages.Set(context.Background(), device, msg)
+	if err != nil {
+		log.Warn("Failed to store retained message", zap.String("topic", p.Topic), zap.Error(err))
+	}
+}
+
+// sendRetained - sends retained messages matching the new subscription
+func sendRetained(log *zap.Logger, c *protocol.Conn, window *inflight.Window, device, filter string, qos packet.QosLevel, protocolLevel byte) {
+	msgs, err := retainedMessages.Match(context.Background(), device, filter)
+	if err != nil {
+		log.Warn("Failed to get retained messages", zap.String("filter", filter), zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	for _, msg := range msgs {
+		q := msg.QoS
+		if qos < q {
+			q = qos
+		}
+		p := &protocol.Publish{
+			Topic:         msg.Topic,
+			QoS:           q,
+			Retain:        true,
+			Payload:       msg.Payload,
+			ProtocolLevel: protocolLevel,
+		}
+		// Client receives the lifetime left rather than the original interval
+		if remaining := uint32(msg.Remaining(now).Seconds()); msg.Expiry > 0 {
+			if remaining == 0 {
+				remaining = 1
+			}
+			p.Properties = &protocol.Properties{MessageExpiryInterval: &remaining}
+		}
+		m, err := window.Add(p)
+		if err != nil {
+			log.Debug("Connection closed, retained message is not sent", zap.Error(err))
+			return
+		}
+		if q > packet.QoSLevelNone {
+			metrics.InflightMessages.Inc()
+		}
+		if err := c.WritePacket(m.Packet); err != nil {
+			log.Warn("Failed to write retained message", zap.Error(err))
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/revocation"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkRevoked - refuses chains with any certificate revoked by the Namespace of the device.
+// Revocations can't be checked without Redis, so it fails closed
+func checkRevoked(log *zap.Logger, namespace string, chain []*x509.Certificate) error {
+	r, err := revocations.Check(context.Background(), namespace, chain)
+	return refuseRevoked(log, r, err)
+}
+
+// checkRevokedFingerprint - refuses the certificate fingerprint devices authenticate with Basic Auth by,
+// if it's revoked by the Namespace of the device. Fails closed as checkRevoked does
+func checkRevokedFingerprint(log *zap.Logger, namespace string, fingerprint []byte) error {
+	r, err := revocations.CheckFingerprints(context.Background(), namespace, hex.EncodeToString(fingerprint))
+	return refuseRevoked(log, r, err)
+}
+
+// refuseRevoked - turns revocation lookup result into the error the connection is refused with
+func refuseRevoked(log *zap.Logger, r *revocation.Revocation, err error) error {
+	if err != nil {
+		log.Warn("Can't check certificate revocations", zap.Error(err))
+		return status.Error(codes.Unavailable, "can't check certificate revocations")
+	}
+	if r != nil {
+		log.Warn("Certificate is revoked", zap.String("fingerprint", r.Fingerprint), zap.String("reason", r.Reason), zap.Time("revoked_at", r.RevokedAt))
+		metrics.RevokedCertificatesRefusedTotal.Inc()
+		return revocation.ErrRevoked
+	}
+	return nil
+}
+
+// checkOCSP - asks the OCSP responder about the certificate if it's configured and the issuer is known.
+// Responder errors are ignored if ocsp_fail_open is set
+func checkOCSP(log *zap.Logger, cert, issuer *x509.Certificate) error {
+	if ocspResponder == nil || issuer == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ocsp_timeout)
+	defer cancel()
+
+	err := ocspResponder.Check(ctx, cert, issuer)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, revocation.ErrRevoked):
+		log.Warn("Certificate is revoked according to OCSP responder", zap.String("serial", cert.SerialNumber.String()))
+		metrics.RevokedCertificatesRefusedTotal.Inc()
+		return err
+	case ocsp_fail_open:
+		log.Warn("OCSP check failed, accepting certificate", zap.Error(err))
+		return nil
+	default:
+		log.Warn("OCSP check failed", zap.Error(err))
+		return status.Error(codes.Unavailable, "can't check certificate status")
+	}
+}
+
+// handleRevocations - disconnects devices once their certificate is revoked, they can reconnect with another valid one
+func handleRevocations() {
+	log := log.Named("Revocations")
+
+	revocations.Subscribe(context.Background(), func(r *revocation.Revocation) {
+		if r.Device == "" {
+			return
+		}
+
+		connsMu.Lock()
+		var kicks []func(byte)
+		for kick := range conns[r.Device] {
+			kicks = append(kicks, *kick)
+		}
+		connsMu.Unlock()
+
+		if len(kicks) > 0 {
+			log.Info("Device certificate revoked, disconnecting", zap.String("device", r.Device), zap.String("fingerprint", r.Fingerprint))
+		}
+		for _, kick := range kicks {
+			metrics.DevicesKickedTotal.Inc()
+			kick(protocol.ReasonNotAuthorized)
+		}
+	})
+}
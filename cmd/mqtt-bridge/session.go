@@ -0,0 +1,406 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/inflight"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/session"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/slntopp/mqtt-go/packet"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// sessionExpiry - how long the session must be kept after the Client disconnects, 0 means session is not persistent.
+// MQTT 3.1.1 Clients get the maximum allowed expiry when Clean Session is 0
+func sessionExpiry(p *protocol.ConnectControlPacket) time.Duration {
+	if p.VariableHeader.ProtocolLevel == 5 {
+		expiry := time.Duration(p.SessionExpiryInterval()) * time.Second
+		if expiry > session_expiry {
+			return session_expiry
+		}
+		return expiry
+	}
+	if p.CleanStart {
+		return 0
+	}
+	return session_expiry
+}
+
+// clientConn - connection currently serving the ClientID
+type clientConn struct {
+	// owner identifies the connection as the holder of the ClientID lease
+	owner      string
+	disconnect func()
+	// done is closed once the connection closed its session
+	done chan struct{}
+}
+
+const (
+	// takeOverTimeout - how long the connection taking over the ClientID waits for the previous one to close its session
+	takeOverTimeout = 10 * time.Second
+	// leaseTTL - how long the ClientID stays leased by a bridge which stopped renewing it, e.g. crashed.
+	// Connected sessions expire this much later than the Client asked, so they survive until the lease is renewed
+	leaseTTL = 30 * time.Second
+	// leasePollInterval - how often the ClientID leased by another bridge is checked while taking it over
+	leasePollInterval = 100 * time.Millisecond
+)
+
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[string]*clientConn)
+)
+
+// takeOverSession - registers the connection as the one serving the ClientID. Connection already using it, on this
+// or another bridge, is disconnected and its session is closed before this one opens it, so subscriptions and
+// unacknowledged messages carry over. ClientID is leased in Redis for as long as the connection is open and the lease
+// also keeps the session, which expires after expiry once the Client is disconnected, from expiring meanwhile.
+// Returned func releases the ClientID and must be called after closeSession
+func takeOverSession(log *zap.Logger, clientID string, expiry time.Duration, disconnect func()) (release func()) {
+	self := &clientConn{owner: uuid.New().String(), disconnect: disconnect, done: make(chan struct{})}
+
+	for {
+		clientsMu.Lock()
+		prev, ok := clients[clientID]
+		if !ok {
+			clients[clientID] = self
+			clientsMu.Unlock()
+			break
+		}
+		clientsMu.Unlock()
+
+		log.Info("ClientID is already connected, taking over the session", zap.String("client", clientID))
+		prev.disconnect()
+		select {
+		case <-prev.done:
+			continue
+		case <-time.After(takeOverTimeout):
+			log.Warn("Previous connection didn't close its session in time", zap.String("client", clientID))
+		}
+
+		clientsMu.Lock()
+		if clients[clientID] == prev {
+			clients[clientID] = self
+			clientsMu.Unlock()
+			break
+		}
+		clientsMu.Unlock()
+	}
+
+	leaseSession(log, clientID, self.owner)
+	stop := make(chan struct{})
+	go renewSession(log, clientID, self, expiry, stop)
+
+	return func() {
+		close(stop)
+		if err := sessions.Release(context.Background(), clientID, self.owner); err != nil {
+			log.Warn("Failed to release ClientID", zap.String("client", clientID), zap.Error(err))
+		}
+
+		clientsMu.Lock()
+		if clients[clientID] == self {
+			delete(clients, clientID)
+		}
+		clientsMu.Unlock()
+		close(self.done)
+	}
+}
+
+// leaseSession - leases the ClientID in Redis. If another bridge holds it, it's asked to disconnect its connection and
+// the lease is awaited until takeOverTimeout, after which it's taken anyway
+func leaseSession(log *zap.Logger, clientID, owner string) {
+	ctx := context.Background()
+	deadline := time.Now().Add(takeOverTimeout)
+	requested := false
+
+	for {
+		ok, err := sessions.Lease(ctx, clientID, owner, leaseTTL)
+		if err != nil {
+			log.Warn("Failed to lease ClientID", zap.String("client", clientID), zap.Error(err))
+			return
+		}
+		if ok {
+			return
+		}
+
+		if !requested {
+			log.Info("ClientID is connected to another bridge, taking over the session", zap.String("client", clientID))
+			if err := session.RequestTakeOver(ctx, rdb, clientID, owner); err != nil {
+				log.Warn("Failed to request session take over", zap.String("client", clientID), zap.Error(err))
+			}
+			requested = true
+		}
+		if time.Now().After(deadline) {
+			log.Warn("Previous connection didn't release ClientID in time", zap.String("client", clientID))
+			if err := sessions.TakeLease(ctx, clientID, owner, leaseTTL); err != nil {
+				log.Warn("Failed to lease ClientID", zap.String("client", clientID), zap.Error(err))
+			}
+			return
+		}
+		time.Sleep(leasePollInterval)
+	}
+}
+
+// renewSession - renews the ClientID lease and the session expiration until stop is closed.
+// Connection is disconnected once the lease is taken by another one
+func renewSession(log *zap.Logger, clientID string, conn *clientConn, expiry time.Duration, stop <-chan struct{}) {
+	var ttl time.Duration
+	if expiry > 0 {
+		ttl = expiry + leaseTTL
+	}
+
+	ticker := time.NewTicker(leaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ok, err := sessions.Renew(context.Background(), clientID, conn.owner, leaseTTL, ttl)
+		if err != nil {
+			log.Warn("Failed to renew ClientID lease", zap.String("client", clientID), zap.Error(err))
+			continue
+		}
+		if !ok {
+			log.Info("ClientID was taken over by another connection", zap.String("client", clientID))
+			conn.disconnect()
+			return
+		}
+	}
+}
+
+// handleTakeOvers - disconnects connections of ClientIDs taken over by other bridges
+func handleTakeOvers(rdb redis.UniversalClient) {
+	session.SubscribeTakeOvers(context.Background(), rdb, func(t *session.TakeOver) {
+		clientsMu.Lock()
+		conn, ok := clients[t.ClientID]
+		clientsMu.Unlock()
+		if ok && conn.owner != t.Owner {
+			log.Info("ClientID is taken over by another bridge", zap.String("client", t.ClientID))
+			conn.disconnect()
+		}
+	})
+}
+
+// openSession - discards the previous session if Clean Start is requested and returns the one to continue with,
+// present is true if the session is resumed. Session is only stored when it's persistent
+func openSession(log *zap.Logger, clientID, device string, cleanStart bool, expiry time.Duration) (s *session.Session, present bool) {
+	ctx := context.Background()
+	s = &session.Session{
+		ClientID:      clientID,
+		Device:        device,
+		Subscriptions: make(map[string]packet.QosLevel),
+	}
+
+	if cleanStart {
+		if err := sessions.Delete(ctx, clientID, device); err != nil {
+			log.Warn("Failed to delete session", zap.Error(err))
+		}
+	} else {
+		stored, err := sessions.Get(ctx, clientID)
+		if err != nil {
+			log.Warn("Failed to load session", zap.Error(err))
+		} else if stored != nil && stored.Device == device {
+			s, present = stored, true
+		}
+	}
+
+	if expiry == 0 {
+		if present {
+			// Client resumed the session, but doesn't want it to be kept anymore
+			if err := sessions.Delete(ctx, clientID, device); err != nil {
+				log.Warn("Failed to delete session", zap.Error(err))
+			}
+		}
+		return s, present
+	}
+
+	// Connected session is kept alive by the ClientID lease renewal, see renewSession
+	if err := sessions.Save(ctx, s, expiry+leaseTTL); err != nil {
+		log.Warn("Failed to store session", zap.Error(err))
+	}
+	if present {
+		metrics.SessionsResumedTotal.Inc()
+	}
+	return s, present
+}
+
+// saveSession - persists subscriptions changes, if session is persistent
+func saveSession(log *zap.Logger, s *session.Session, expiry time.Duration) {
+	if expiry == 0 {
+		return
+	}
+	if err := sessions.Save(context.Background(), s, expiry+leaseTTL); err != nil {
+		log.Warn("Failed to store session", zap.Error(err))
+	}
+}
+
+// closeSession - stores messages left unacknowledged to deliver them on reconnect and schedules session expiration.
+// Unacknowledged messages are pinned at the head of the queue, so they're never dropped to fit the queue limit
+func closeSession(log *zap.Logger, s *session.Session, expiry time.Duration, pending []*inflight.Message) {
+	if expiry == 0 {
+		return
+	}
+	ctx := context.Background()
+
+	msgs := make([]session.Message, len(pending))
+	for i, m := range pending {
+		msgs[i] = session.Message{
+			Topic:   m.Packet.Topic,
+			QoS:     m.Packet.QoS,
+			Payload: m.Packet.Payload,
+		}
+	}
+
+	if err := sessions.Save(ctx, s, expiry); err != nil {
+		log.Warn("Failed to store session", zap.Error(err))
+	}
+	dropped, err := sessions.Requeue(ctx, s.ClientID, msgs...)
+	if err != nil {
+		log.Warn("Failed to queue unacknowledged messages", zap.Error(err))
+	}
+	metrics.QueuedMessagesTotal.Add(float64(len(msgs)))
+	metrics.QueueDroppedTotal.Add(float64(dropped))
+}
+
+// drainSession - sends messages queued while the Client was offline
+func drainSession(log *zap.Logger, c *protocol.Conn, window *inflight.Window, s *session.Session, protocolLevel byte) {
+	msgs, err := sessions.Drain(context.Background(), s.ClientID)
+	if err != nil {
+		log.Warn("Failed to load queued messages", zap.Error(err))
+		return
+	}
+	log.Debug("Sending queued messages", zap.Int("amount", len(msgs)))
+
+	for i, msg := range msgs {
+		p := &protocol.Publish{
+			Topic:         msg.Topic,
+			QoS:           msg.QoS,
+			Payload:       msg.Payload,
+			ProtocolLevel: protocolLevel,
+		}
+		if protocolLevel == 5 && msg.ContentType != "" {
+			p.Properties = &protocol.Properties{ContentType: msg.ContentType}
+		}
+		m, err := window.Add(p)
+		if err != nil {
+			log.Debug("Connection closed, putting messages back to the queue", zap.Error(err))
+			if _, err := sessions.Requeue(context.Background(), s.ClientID, msgs[i:]...); err != nil {
+				log.Warn("Failed to queue messages", zap.Error(err))
+			}
+			return
+		}
+		if msg.QoS > packet.QoSLevelNone {
+			metrics.InflightMessages.Inc()
+		}
+		if err := c.WritePacket(m.Packet); err != nil {
+			log.Warn("Failed to write queued message", zap.Error(err))
+			return
+		}
+	}
+}
+
+// handleOfflineSessions - queues Desired state updates published to the topic for devices with persistent sessions which are currently disconnected,
+// stateTopics are the topics they're delivered to
+func handleOfflineSessions(topic string, stateTopics func(string, codec.Codec) []desiredTopic) {
+	log := log.Named("Sessions")
+	ctx := context.Background()
+
+	for msg := range ps.Sub(topic) {
+		shadow := msg.(*pb.Shadow)
+		if shadow.Desired == nil || shadow.Desired.Timestamp == nil {
+			continue
+		}
+
+		clients, err := sessions.ByDevice(ctx, shadow.Device)
+		if err != nil {
+			log.Warn("Failed to get device sessions", zap.String("device", shadow.Device), zap.Error(err))
+			continue
+		}
+		if len(clients) == 0 {
+			continue
+		}
+
+		def := codec.JSON
+		if dev, err := devices.Get(ctx, shadow.Device); err == nil {
+			def = deviceCodec(log, dev)
+		} else {
+			log.Warn("Can't retrieve device from registry, queueing Desired state as JSON", zap.String("device", shadow.Device), zap.Error(err))
+		}
+		// Desired state is encoded once per format no matter how many sessions receive it
+		payloads := make(map[string][]byte)
+
+		for _, id := range clients {
+			s, err := sessions.Get(ctx, id)
+			if err != nil {
+				log.Warn("Failed to load session", zap.String("client", id), zap.Error(err))
+				continue
+			}
+			if s == nil {
+				// Session expired, clean up the index
+				_ = sessions.Delete(ctx, id, shadow.Device)
+				continue
+			}
+			// Session is connected while its ClientID is leased, lease of a crashed bridge expires after leaseTTL
+			if online, err := sessions.Online(ctx, id); err != nil {
+				log.Warn("Failed to check if session is connected", zap.String("client", id), zap.Error(err))
+				continue
+			} else if online {
+				continue
+			}
+
+			for _, dt := range stateTopics(shadow.Device, def) {
+				qos, ok := topics.MaxQoS(s.Subscriptions, dt.topic)
+				if !ok || qos == packet.QoSLevelNone {
+					continue
+				}
+
+				payload, ok := payloads[dt.codec.Name()]
+				if !ok {
+					payload, err = dt.codec.Encode(structpb.NewStructValue(shadow.Desired.Data))
+					if err != nil {
+						log.Warn("Failed to marshal shadow", zap.String("format", dt.codec.Name()), zap.Error(err))
+						continue
+					}
+					payloads[dt.codec.Name()] = payload
+				}
+
+				dropped, err := sessions.Enqueue(ctx, id, session.Message{
+					Topic: dt.topic, QoS: qos, Payload: payload, ContentType: dt.codec.ContentType(),
+				})
+				if err != nil {
+					log.Warn("Failed to queue message", zap.String("client", id), zap.Error(err))
+					continue
+				}
+				log.Debug("Queued message for offline session", zap.String("client", id), zap.String("topic", dt.topic))
+				metrics.QueuedMessagesTotal.Inc()
+				metrics.QueueDroppedTotal.Add(float64(dropped))
+			}
+		}
+	}
+}
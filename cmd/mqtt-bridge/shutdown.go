@@ -0,0 +1,137 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	mqttps "github.com/infinimesh/infinimesh/pkg/mqtt/pubsub"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// shuttingDown - set once shutdown starts, listeners stop accepting and new connections are refused
+var shuttingDown atomic.Bool
+
+var (
+	listenersMu sync.Mutex
+	listeners   []io.Closer
+)
+
+// addListener - registers listener to be closed on shutdown
+func addListener(l io.Closer) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	listeners = append(listeners, l)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// shutdown - stops accepting connections, disconnects all Clients with Server shutting down, flushes PubSub to RabbitMQ
+// and marks devices which were connected as disconnected. Returns once done or after shutdown_timeout
+func shutdown() {
+	log := log.Named("Shutdown")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer cancel()
+
+	shuttingDown.Store(true)
+	log.Info("Shutting down", zap.Duration("timeout", shutdown_timeout), zap.Int64("connections", activeConnections.Load()))
+
+	listenersMu.Lock()
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			log.Warn("Couldn't close listener", zap.Error(err))
+		}
+	}
+	listenersMu.Unlock()
+
+	connected := drainConnections(ctx)
+	if n := activeConnections.Load(); n > 0 {
+		log.Warn("Connections didn't close in time", zap.Int64("connections", n))
+	}
+
+	// Will Messages of Clients disconnected above are in Redis already, due ones are published before PubSub is flushed
+	stopWills(log)
+
+	// Buffered Reported state still says device is connected, so it must reach RabbitMQ first
+	if err := mqttps.Shutdown(ctx); err != nil {
+		log.Warn("Couldn't flush messages to RabbitMQ", zap.Error(err))
+	}
+
+	now := timestamppb.Now()
+	msgs := make([]*pb.Shadow, 0, len(connected))
+	for _, device := range connected {
+		msgs = append(msgs, &pb.Shadow{
+			Device:     device,
+			Connection: &pb.ConnectionState{Connected: false, Timestamp: now},
+		})
+	}
+	if err := mqttps.PublishNow(ctx, "mqtt.incoming", msgs...); err != nil {
+		log.Warn("Couldn't publish connection state", zap.Error(err))
+	}
+
+	log.Info("Shutdown complete", zap.Int("devices", len(connected)))
+}
+
+// drainConnections - disconnects all tracked connections until none are left or ctx is done.
+// Connections authenticated meanwhile are tracked late, so they're kicked on the following rounds.
+// Returns UUIDs of devices which were connected
+func drainConnections(ctx context.Context) (connected []string) {
+	kicked := make(map[*func(byte)]struct{})
+	seen := make(map[string]struct{})
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var kicks []func(byte)
+		connsMu.Lock()
+		for device, set := range conns {
+			if _, ok := seen[device]; !ok {
+				seen[device] = struct{}{}
+				connected = append(connected, device)
+			}
+			for kick := range set {
+				if _, ok := kicked[kick]; !ok {
+					kicked[kick] = struct{}{}
+					kicks = append(kicks, *kick)
+				}
+			}
+		}
+		connsMu.Unlock()
+
+		for _, kick := range kicks {
+			kick(protocol.ReasonServerShuttingDown)
+		}
+
+		if activeConnections.Load() == 0 {
+			return connected
+		}
+		select {
+		case <-ctx.Done():
+			return connected
+		case <-ticker.C:
+		}
+	}
+}
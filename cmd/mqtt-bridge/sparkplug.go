@@ -0,0 +1,413 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/inflight"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/sparkplug"
+	devpb "github.com/infinimesh/proto/node/devices"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/slntopp/mqtt-go/packet"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// sparkplugTagPrefix - Device tag mapping Sparkplug device ID to the child device, e.g. "sparkplug:Pump1".
+// Children may also be addressed by their UUID
+const sparkplugTagPrefix = "sparkplug:"
+
+// sparkplugRebirthInterval - Rebirth is requested at most once per interval, Edge Node needs time to publish BIRTH
+const sparkplugRebirthInterval = 5 * time.Second
+
+// sparkplugDevice - Sparkplug device behind the Edge Node, served as the gateway child
+type sparkplugDevice struct {
+	id   string
+	uuid string
+	born bool
+	defs *sparkplug.Definitions
+}
+
+// sparkplugNode - Sparkplug B Edge Node served over the connection. Edge Node is the connected device itself,
+// devices behind it are its gateway children. State lives as long as the connection, Edge Nodes are reborn on every connect
+type sparkplugNode struct {
+	log    *zap.Logger
+	device *devpb.Device
+	gw     *gatewayConn
+	send   func(topic string, payload []byte) bool
+
+	mu          sync.Mutex
+	group       string
+	edgeNode    string
+	born        bool
+	bdSeq       *structpb.Value
+	seq         uint64 // expected sequence number of the next message
+	defs        *sparkplug.Definitions
+	devices     map[string]*sparkplugDevice // by Sparkplug device ID
+	byUUID      map[string]*sparkplugDevice
+	commanded   map[string]map[string]*structpb.Value // last values written to metrics, by device UUID
+	lastRebirth time.Time
+}
+
+func newSparkplugNode(log *zap.Logger, device *devpb.Device, gw *gatewayConn, send func(topic string, payload []byte) bool) *sparkplugNode {
+	return &sparkplugNode{
+		log: log.Named("Sparkplug"), device: device, gw: gw, send: send,
+		devices:   make(map[string]*sparkplugDevice),
+		byUUID:    make(map[string]*sparkplugDevice),
+		commanded: make(map[string]map[string]*structpb.Value),
+	}
+}
+
+// sparkplugSender - publishes messages to the Client if it's subscribed to the topic, match returns QoS of matching subscriptions
+func sparkplugSender(log *zap.Logger, c *protocol.Conn, window *inflight.Window, match func(topic string) (packet.QosLevel, bool), protocolLevel byte) func(topic string, payload []byte) bool {
+	return func(topic string, payload []byte) bool {
+		qos, ok := match(topic)
+		if !ok {
+			log.Debug("Client isn't subscribed, skipping message", zap.String("topic", topic))
+			return false
+		}
+		m, err := window.Add(&protocol.Publish{
+			Topic:         topic,
+			QoS:           qos,
+			Payload:       payload,
+			ProtocolLevel: protocolLevel,
+		})
+		if err != nil {
+			log.Debug("Connection closed, message is not sent", zap.Error(err))
+			return false
+		}
+		if qos > packet.QoSLevelNone {
+			metrics.InflightMessages.Inc()
+		}
+		if err := c.WritePacket(m.Packet); err != nil {
+			log.Warn("Failed to write packet", zap.Error(err))
+			return false
+		}
+		return true
+	}
+}
+
+// handle - handles message of the Edge Node, returns Reason Code to acknowledge it with.
+// Commands and Host Application state can't be published by Edge Nodes
+func (s *sparkplugNode) handle(p *protocol.Publish) byte {
+	t, ok := sparkplug.ParseTopic(p.Topic)
+	if !ok || t.Type == sparkplug.NCMD || t.Type == sparkplug.DCMD || t.Type == sparkplug.STATE {
+		s.log.Warn("Publish is not allowed", zap.String("topic", p.Topic))
+		metrics.PublishDeniedTotal.Inc()
+		return protocol.ReasonNotAuthorized
+	}
+	payload, err := sparkplug.Unmarshal(p.Payload)
+	if err != nil {
+		s.log.Warn("Failed to handle Publish", zap.String("topic", p.Topic), zap.Error(err))
+		return protocol.ReasonPayloadFormatInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch t.Type {
+	case sparkplug.NBIRTH:
+		return s.nbirth(t, payload)
+	case sparkplug.NDEATH:
+		s.ndeath(t, payload)
+		return protocol.ReasonSuccess
+	}
+
+	if !s.born {
+		s.log.Debug("Message before NBIRTH", zap.String("topic", p.Topic))
+		s.rebirth(t)
+		return protocol.ReasonSuccess
+	}
+	if t.Group != s.group || t.EdgeNode != s.edgeNode {
+		s.log.Warn("Publish for another Edge Node is not allowed", zap.String("topic", p.Topic))
+		metrics.PublishDeniedTotal.Inc()
+		return protocol.ReasonNotAuthorized
+	}
+	if payload.HasSeq {
+		if payload.Seq != s.seq {
+			s.log.Info("Sequence number gap", zap.Uint64("expected", s.seq), zap.Uint64("seq", payload.Seq))
+			s.rebirth(t)
+		}
+		s.seq = (payload.Seq + 1) % 256
+	}
+
+	if t.Type == sparkplug.NDATA {
+		return s.reported(s.device, s.defs, payload.Metrics, t)
+	}
+
+	d, err := s.child(t.Device)
+	if err != nil {
+		s.log.Warn("Publish for child device is not allowed", zap.String("topic", p.Topic), zap.Error(err))
+		metrics.PublishDeniedTotal.Inc()
+		return protocol.ReasonNotAuthorized
+	}
+	child, err := s.gw.child(d.uuid)
+	if err != nil {
+		s.log.Warn("Publish for child device is not allowed", zap.String("topic", p.Topic), zap.Error(err))
+		metrics.PublishDeniedTotal.Inc()
+		return protocol.ReasonNotAuthorized
+	}
+
+	switch t.Type {
+	case sparkplug.DBIRTH:
+		d.born, d.defs = true, sparkplug.NewDefinitions(payload.Metrics)
+		delete(s.commanded, d.uuid)
+		s.gw.publishConnection(d.uuid, true)
+		go s.syncDesired(d.uuid)
+		return s.reported(child, d.defs, payload.Metrics, t)
+	case sparkplug.DDEATH:
+		d.born = false
+		s.gw.publishConnection(d.uuid, false)
+		return protocol.ReasonSuccess
+	}
+	if !d.born {
+		s.log.Debug("Message before DBIRTH", zap.String("topic", p.Topic))
+		s.rebirth(t)
+		return protocol.ReasonSuccess
+	}
+	return s.reported(child, d.defs, payload.Metrics, t)
+}
+
+// nbirth - starts the Edge Node session, metrics of the previous one are forgotten along with its devices
+func (s *sparkplugNode) nbirth(t sparkplug.Topic, payload *sparkplug.Payload) byte {
+	if s.born && (t.Group != s.group || t.EdgeNode != s.edgeNode) {
+		s.log.Warn("Connection already serves another Edge Node", zap.String("group", s.group), zap.String("edge_node", s.edgeNode))
+		metrics.PublishDeniedTotal.Inc()
+		return protocol.ReasonNotAuthorized
+	}
+	s.log.Debug("Edge Node born", zap.String("group", t.Group), zap.String("edge_node", t.EdgeNode))
+
+	s.group, s.edgeNode, s.born = t.Group, t.EdgeNode, true
+	s.seq = (payload.Seq + 1) % 256
+	s.defs = sparkplug.NewDefinitions(payload.Metrics)
+	s.bdSeq = nil
+	for _, m := range payload.Metrics {
+		if m.Name == "bdSeq" {
+			s.bdSeq, _ = m.Value()
+		}
+	}
+	for _, d := range s.devices {
+		d.born = false
+	}
+	s.commanded = make(map[string]map[string]*structpb.Value)
+
+	go s.syncDesired(s.device.Uuid)
+	return s.reported(s.device, s.defs, payload.Metrics, t)
+}
+
+// ndeath - reports devices of the Edge Node disconnected, NDEATH of the previous session (bdSeq mismatch) is ignored.
+// Edge Node itself stays connected as long as the connection does
+func (s *sparkplugNode) ndeath(t sparkplug.Topic, payload *sparkplug.Payload) {
+	if !s.born || t.Group != s.group || t.EdgeNode != s.edgeNode {
+		return
+	}
+	for _, m := range payload.Metrics {
+		if m.Name != "bdSeq" || s.bdSeq == nil {
+			continue
+		}
+		if v, err := m.Value(); err == nil && !proto.Equal(v, s.bdSeq) {
+			s.log.Debug("Ignoring NDEATH of the previous session", zap.Any("bdSeq", v))
+			return
+		}
+	}
+	s.log.Debug("Edge Node dead", zap.String("group", s.group), zap.String("edge_node", s.edgeNode))
+
+	s.born = false
+	for _, d := range s.devices {
+		if d.born {
+			d.born = false
+			s.gw.publishConnection(d.uuid, false)
+		}
+	}
+}
+
+// reported - publishes metric values as Reported state, metrics are resolved by their BIRTH definitions.
+// Rebirth is requested if the Edge Node refers to metrics it didn't declare
+func (s *sparkplugNode) reported(device *devpb.Device, defs *sparkplug.Definitions, ms []*sparkplug.Metric, t sparkplug.Topic) byte {
+	data := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(ms))}
+	for _, m := range ms {
+		if !defs.Resolve(m) {
+			s.log.Debug("Unknown metric", zap.String("name", m.Name), zap.Uint64("alias", m.Alias))
+			s.rebirth(t)
+			continue
+		}
+		if isControlMetric(m.Name) {
+			continue
+		}
+		v, err := m.Value()
+		if err != nil {
+			s.log.Warn("Failed to decode metric", zap.String("name", m.Name), zap.Error(err))
+			continue
+		}
+		data.Fields[m.Name] = v
+	}
+	if len(data.Fields) == 0 {
+		return protocol.ReasonSuccess
+	}
+	return publishReported(s.log, device, data, nil)
+}
+
+// isControlMetric - metrics of the Sparkplug session rather than the device state
+func isControlMetric(name string) bool {
+	return name == "bdSeq" || strings.HasPrefix(name, "Node Control/") || strings.HasPrefix(name, "Device Control/")
+}
+
+// child - Sparkplug device by its ID, resolved among the gateway children by "sparkplug:" tag or UUID
+func (s *sparkplugNode) child(id string) (*sparkplugDevice, error) {
+	if d, ok := s.devices[id]; ok {
+		return d, nil
+	}
+
+	ctx := context.Background()
+	children, err := gatewayLinks.Children(ctx, s.device.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range children {
+		if uuid != id {
+			dev, err := devices.Get(ctx, uuid)
+			if err != nil || !hasTag(dev, sparkplugTagPrefix+id) {
+				continue
+			}
+		}
+		d := &sparkplugDevice{id: id, uuid: uuid}
+		s.devices[id], s.byUUID[uuid] = d, d
+		return d, nil
+	}
+	return nil, errNotChild
+}
+
+func hasTag(device *devpb.Device, tag string) bool {
+	for _, t := range device.GetTags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// rebirth - asks the Edge Node to publish BIRTH messages again
+func (s *sparkplugNode) rebirth(t sparkplug.Topic) {
+	if time.Since(s.lastRebirth) < sparkplugRebirthInterval {
+		return
+	}
+	s.lastRebirth = time.Now()
+
+	m, _ := sparkplug.NewMetric("Node Control/Rebirth", sparkplug.Boolean, structpb.NewBoolValue(true))
+	payload := &sparkplug.Payload{Timestamp: uint64(time.Now().UnixMilli()), Metrics: []*sparkplug.Metric{m}}
+	topic := sparkplug.Topic{Group: t.Group, Type: sparkplug.NCMD, EdgeNode: t.EdgeNode}.String()
+	if s.send(topic, payload.Marshal()) {
+		s.log.Info("Requested rebirth", zap.String("topic", topic))
+		metrics.SparkplugRebirthsTotal.Inc()
+	}
+}
+
+// syncDesired - writes current Desired state of the newly born Edge Node or device
+func (s *sparkplugNode) syncDesired(uuid string) {
+	if shadow == nil {
+		return
+	}
+	r, err := shadow.Get(internal_ctx, &pb.GetRequest{Pool: []string{uuid}})
+	if err != nil || len(r.GetShadows()) == 0 {
+		return
+	}
+	if state := r.GetShadows()[0]; state.Desired != nil {
+		s.deliver(state)
+	}
+}
+
+// deliver - writes Desired state values of declared metrics with NCMD or DCMD, values written already are skipped.
+// Returns false if nothing was sent
+func (s *sparkplugNode) deliver(state *pb.Shadow) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.born || state.GetDesired().GetData() == nil {
+		return false
+	}
+
+	t := sparkplug.Topic{Group: s.group, Type: sparkplug.NCMD, EdgeNode: s.edgeNode}
+	defs := s.defs
+	if state.Device != s.device.Uuid {
+		d, ok := s.byUUID[state.Device]
+		if !ok || !d.born {
+			return false
+		}
+		t.Type, t.Device, defs = sparkplug.DCMD, d.id, d.defs
+	}
+
+	fields := state.Desired.Data.Fields
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := uint64(time.Now().UnixMilli())
+	commanded := s.commanded[state.Device]
+	payload := &sparkplug.Payload{Timestamp: now}
+	values := make(map[string]*structpb.Value)
+	for _, name := range names {
+		v := fields[name]
+		if prev, ok := commanded[name]; ok && proto.Equal(prev, v) {
+			continue
+		}
+		def, ok := defs.Lookup(name)
+		if !ok || isControlMetric(name) {
+			s.log.Debug("Skipping undeclared metric", zap.String("name", name))
+			continue
+		}
+		dt := def.DataType
+		if dt == sparkplug.Unknown {
+			dt = sparkplug.InferDataType(v)
+		}
+		m, err := sparkplug.NewMetric(name, dt, v)
+		if err != nil {
+			s.log.Warn("Failed to encode metric", zap.String("name", name), zap.Error(err))
+			continue
+		}
+		m.Alias, m.HasAlias, m.Timestamp = def.Alias, def.HasAlias, now
+		payload.Metrics = append(payload.Metrics, m)
+		values[name] = v
+	}
+	if len(payload.Metrics) == 0 || !s.send(t.String(), payload.Marshal()) {
+		return false
+	}
+
+	if commanded == nil {
+		commanded = make(map[string]*structpb.Value, len(values))
+		s.commanded[state.Device] = commanded
+	}
+	for name, v := range values {
+		commanded[name] = v
+	}
+	return true
+}
+
+// online - publishes Host Application state to the Edge Node subscribed to it, bridge is the Host Application
+// for every Edge Node, so any host is online as long as the connection is
+func (s *sparkplugNode) online(topic string) {
+	payload, _ := json.Marshal(map[string]any{"online": true, "timestamp": time.Now().UnixMilli()})
+	s.send(topic, payload)
+}
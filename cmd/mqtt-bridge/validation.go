@@ -0,0 +1,60 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/shadow/validation"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// stateConfigs - Namespace and Device config of the device, Namespace config is omitted if it can't be retrieved
+func stateConfigs(ctx context.Context, uuid string) ([]*structpb.Struct, error) {
+	dev, err := devices.Get(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	if ns := dev.GetAccess().GetNamespace(); ns != "" {
+		return []*structpb.Struct{namespaceConfig(log, ns), dev.GetConfig()}, nil
+	}
+	return []*structpb.Struct{dev.GetConfig()}, nil
+}
+
+// validateReported - checks Reported state against the device schema, apply is false if state must be dropped,
+// code is the Reason Code to acknowledge the message with then
+func validateReported(log *zap.Logger, device string, data *structpb.Struct) (code byte, apply bool) {
+	s, err := schemas.Get(context.Background(), device)
+	if err != nil {
+		log.Warn("Can't retrieve state schemas, state is not validated", zap.Error(err))
+		return protocol.ReasonSuccess, true
+	}
+	v := s.Validate(device, pb.StateKey_REPORTED, data)
+	if v == nil {
+		return protocol.ReasonSuccess, true
+	}
+
+	ps.TryPub(v.Event(data), "mqtt.events")
+	if v.Policy == validation.PolicyQuarantine {
+		log.Info("Reported state quarantined", zap.Error(v))
+		return protocol.ReasonSuccess, false
+	}
+	log.Warn("Reported state rejected", zap.Error(v))
+	return protocol.ReasonPayloadFormatInvalid, false
+}
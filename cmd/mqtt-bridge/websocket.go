@@ -0,0 +1,167 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/ws"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/proto/node/access"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// ServeWebSockets - serves MQTT over WebSockets on addr, over TLS if config is given
+func ServeWebSockets(addr string, config *tls.Config) {
+	log := log.Named("WS")
+	if config != nil {
+		log = log.Named("TLS")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("Couldn't listen", zap.String("addr", addr), zap.Error(err))
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+
+	wsl := ws.NewListener(l.Addr())
+	go HandleWSConnections(log, wsl)
+
+	srv := &http.Server{Handler: wsl}
+	addListener(closerFunc(func() error {
+		wsl.Close()
+		// Upgraded connections are hijacked, so closing the server leaves them to HandleConn
+		return srv.Close()
+	}))
+
+	log.Info("Serving MQTT over WebSockets", zap.String("addr", addr), zap.Bool("tls", config != nil))
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Fatal("Failed to serve", zap.Error(err))
+	}
+}
+
+func HandleWSConnections(log *zap.Logger, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		metrics.WebsocketAcceptedTotal.Inc()
+		if err != nil {
+			log.Warn("Couldn't accept connection", zap.Error(err))
+			metrics.WebsocketFailedToAcceptTotal.Inc()
+			if err == ws.ErrListenerClosed {
+				return
+			}
+			continue
+		}
+		log.Debug("Connection Accepted", zap.String("remote", conn.RemoteAddr().String()))
+
+		go func(conn net.Conn) {
+			pc := protocol.NewConn(conn)
+			pc.SetTimeouts(connect_timeout, write_timeout)
+			p, err := pc.ReadPacket(0)
+			if err != nil {
+				LogErrorAndClose(conn, 0, protocol.ReasonMalformedPacket, fmt.Errorf("error while reading connect packet: %v", err))
+				metrics.ConnNotAnMqttPacketTotal.Inc()
+				return
+			}
+
+			connectPacket, ok := p.(*protocol.ConnectControlPacket)
+			if !ok {
+				LogErrorAndClose(conn, 0, protocol.ReasonProtocolError, errors.New("first packet isn't ConnectControlPacket"))
+				metrics.ConnNotAnMqttPacketTotal.Inc()
+				return
+			}
+			log.Debug("ConnectPacket", zap.Any("packet", p))
+
+			var device *devpb.Device
+			if isToken(connectPacket.ConnectPayload.Password) {
+				device, err = verifyTokenAuth(log, connectPacket)
+			} else {
+				device, err = verifyBasicAuthDevice(log, connectPacket)
+			}
+			if err != nil {
+				LogErrorAndClose(conn, connectPacket.VariableHeader.ProtocolLevel, connAckCode(err), err)
+				metrics.WebsocketDeviceAuthFailedTotal.Inc()
+				return
+			}
+
+			go HandleConn(pc, connectPacket, device)
+		}(conn)
+	}
+}
+
+// isToken - tells JWT apart from base64 encoded fingerprint, which never contains dots
+func isToken(password string) bool {
+	return strings.Count(password, ".") == 2
+}
+
+// verifyTokenAuth - authenticates the device by Username (device UUID) and Password (device token issued by MakeDevicesToken)
+func verifyTokenAuth(log *zap.Logger, p *protocol.ConnectControlPacket) (*devpb.Device, error) {
+	if p.ConnectPayload.Username == "" {
+		return nil, fmt.Errorf("%w: payload Username is Empty", errBadCredentials)
+	}
+
+	token := p.ConnectPayload.Password
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	device, err := client.GetByToken(ctx, &devpb.Device{Uuid: p.ConnectPayload.Username})
+	if err != nil {
+		return nil, fmt.Errorf("error verifying Token Auth: %w", err)
+	}
+	if !device.Enabled {
+		log.Warn("Failed to verify client as the device is not enabled", zap.String("uuid", device.Uuid))
+		return nil, errors.New("not found")
+	}
+
+	level, err := tokenLevel(token, device.Uuid)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying Token Auth: %w", err)
+	}
+
+	log.Debug("Verified client by token", zap.String("uuid", device.Uuid), zap.Strings("tags", device.Tags), zap.Any("level", level))
+	device.Token = token
+	// Access level of the device is the one its token grants, see canPublish
+	if device.Access == nil {
+		device.Access = &access.Access{}
+	}
+	device.Access.Level = level
+	return device, nil
+}
+
+// tokenLevel - access level the device token grants to the device
+func tokenLevel(token, device string) (access.Level, error) {
+	ctx, _, err := tokens.ConnectDeviceAuthMiddleware(context.Background(), signingKey, token)
+	if err != nil {
+		return access.Level_NONE, err
+	}
+	scope, _ := ctx.Value(inf.InfinimeshDevicesCtxKey).(map[string]access.Level)
+	return scope[device], nil
+}
+
+// canPublish - devices authenticated by a token may only publish if the token grants them write access, i.e. MGMT or above
+func canPublish(device *devpb.Device) bool {
+	return device.GetToken() == "" || device.GetAccess().GetLevel() >= access.Level_MGMT
+}
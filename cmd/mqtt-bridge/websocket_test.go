@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	node_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/proto/node"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/infinimesh/pkg/shared/auth"
+	"github.com/infinimesh/proto/node/access"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// tokenAuthFixture - CONNECT of an enabled device with a token granting level to it
+func tokenAuthFixture(t *testing.T, level access.Level) *protocol.ConnectControlPacket {
+	signingKey = []byte("key")
+	tokens = auth.NewAuthInterceptor(zap.NewNop(), nil, nil, signingKey)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		inf.INFINIMESH_DEVICES_CLAIM: map[string]access.Level{"device": level},
+	}).SignedString(signingKey)
+	require.NoError(t, err)
+
+	devs := node_mocks.NewMockDevicesServiceClient(t)
+	devs.EXPECT().GetByToken(mock.Anything, mock.Anything).Return(&devpb.Device{Uuid: "device", Enabled: true}, nil)
+	client = devs
+
+	p := &protocol.ConnectControlPacket{}
+	p.ConnectPayload.Username = "device"
+	p.ConnectPayload.Password = token
+	return p
+}
+
+func TestVerifyTokenAuth_CanPublish(t *testing.T) {
+	p := tokenAuthFixture(t, access.Level_MGMT)
+
+	device, err := verifyTokenAuth(zap.NewNop(), p)
+
+	require.NoError(t, err)
+	assert.True(t, canPublish(device))
+}
+
+func TestVerifyTokenAuth_ReadOnly(t *testing.T) {
+	p := tokenAuthFixture(t, access.Level_READ)
+
+	device, err := verifyTokenAuth(zap.NewNop(), p)
+	require.NoError(t, err)
+	assert.False(t, canPublish(device))
+
+	code := handlePublish(zap.NewNop(), device, nil, nil, &protocol.Publish{Topic: "devices/device/state/reported/delta", Payload: []byte("{}")})
+	assert.Equal(t, protocol.ReasonNotAuthorized, code)
+}
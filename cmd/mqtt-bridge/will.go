@@ -0,0 +1,148 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/metrics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/sparkplug"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/will"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"go.uber.org/zap"
+)
+
+// willsInterval - how often pending Will Messages are checked for being due
+const willsInterval = time.Second
+
+var (
+	// wills - delayed Will Messages pending in Redis, published by whichever bridge finds them due first
+	wills will.Store
+
+	willsStop    = make(chan struct{})
+	willsStopped = make(chan struct{})
+)
+
+// willDelay - MQTT 5 Will Delay Interval, Will Message is published when the session ends if that happens earlier
+func willDelay(p *protocol.ConnectControlPacket, expiry time.Duration) time.Duration {
+	if p.Will == nil || p.Will.Properties == nil || p.Will.Properties.WillDelayInterval == nil {
+		return 0
+	}
+	delay := time.Duration(*p.Will.Properties.WillDelayInterval) * time.Second
+	if delay > expiry {
+		return expiry
+	}
+	return delay
+}
+
+// scheduleWill - publishes Will Message after the delay, unless the Client reconnects before that.
+// Delayed Will Messages are stored in Redis, so they're published even if the bridge is restarted meanwhile
+func scheduleWill(log *zap.Logger, device *devpb.Device, clientID string, w *protocol.Will, delay time.Duration) {
+	// Delayed Will Message is published for the device loaded from the registry, which has no token to check then
+	if !canPublish(device) {
+		log.Warn("Will Message is not allowed, device token is read-only", zap.String("topic", w.Topic))
+		return
+	}
+	if delay == 0 {
+		publishWill(log, device, w)
+		return
+	}
+
+	log.Debug("Scheduling Will Message", zap.String("topic", w.Topic), zap.Duration("delay", delay))
+	err := wills.Schedule(context.Background(), &will.Pending{ClientID: clientID, Device: device.Uuid, Will: w}, time.Now().Add(delay))
+	if err != nil {
+		log.Warn("Failed to schedule Will Message, publishing it now", zap.Error(err))
+		publishWill(log, device, w)
+	}
+}
+
+// cancelWill - discards delayed Will Message of the Client
+func cancelWill(log *zap.Logger, clientID string) {
+	if err := wills.Cancel(context.Background(), clientID); err != nil {
+		log.Warn("Failed to cancel Will Message", zap.String("client", clientID), zap.Error(err))
+	}
+}
+
+// handleWills - publishes delayed Will Messages once they're due until stopWills is called
+func handleWills() {
+	log := log.Named("Wills")
+	defer close(willsStopped)
+
+	ticker := time.NewTicker(willsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-willsStop:
+			return
+		case now := <-ticker.C:
+			publishDueWills(log, now)
+		}
+	}
+}
+
+// stopWills - stops handleWills and publishes Will Messages due by now, including the ones of Clients disconnected
+// by shutdown without delay. Ones still pending are left in Redis for other bridges or for this one once restarted
+func stopWills(log *zap.Logger) {
+	close(willsStop)
+	<-willsStopped
+	publishDueWills(log, time.Now())
+}
+
+// publishDueWills - claims Will Messages due by now and publishes them on behalf of their devices
+func publishDueWills(log *zap.Logger, now time.Time) {
+	ctx := context.Background()
+	pending, err := wills.Due(ctx, now)
+	if err != nil {
+		log.Warn("Failed to get due Will Messages", zap.Error(err))
+		return
+	}
+
+	for _, p := range pending {
+		device, err := devices.Get(ctx, p.Device)
+		if err != nil {
+			log.Warn("Can't retrieve device from registry, dropping Will Message", zap.String("device", p.Device), zap.String("client", p.ClientID), zap.Error(err))
+			continue
+		}
+		publishWill(log, device, p.Will)
+	}
+}
+
+// publishWill - publishes Will Message as if it was sent by the device and emits "will" device event.
+// Connection is gone by then, so gateways can't publish Will Messages on behalf of their children
+func publishWill(log *zap.Logger, device *devpb.Device, will *protocol.Will) {
+	log.Debug("Publishing Will Message", zap.String("topic", will.Topic))
+
+	p := &protocol.Publish{
+		Topic:      will.Topic,
+		QoS:        will.QoS,
+		Retain:     will.Retain,
+		Properties: will.Properties,
+		Payload:    will.Payload,
+	}
+	if code := handlePublish(log, device, nil, nil, p); code != protocol.ReasonSuccess {
+		log.Warn("Failed to publish Will Message", zap.String("topic", will.Topic), zap.Uint8("reason", code))
+		return
+	}
+	metrics.WillsPublishedTotal.Inc()
+
+	// Sparkplug NDEATH isn't in the device payload format
+	if t := topics.Parse(will.Topic); t.Kind != topics.Event && !sparkplug.IsTopic(will.Topic) {
+		handleEvent(log, device, "will", publishCodec(log, device, t, will.Properties), will.Payload, will.Properties)
+	}
+}
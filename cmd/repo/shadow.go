@@ -20,6 +20,7 @@ package main
 import (
 	"context"
 	"errors"
+	"net/http"
 
 	"github.com/infinimesh/proto/node/access"
 
@@ -27,11 +28,59 @@ import (
 
 	"go.uber.org/zap"
 
+	shadowsvc "github.com/infinimesh/infinimesh/pkg/shadow"
 	inf "github.com/infinimesh/infinimesh/pkg/shared"
 	pb "github.com/infinimesh/proto/node"
 	"github.com/infinimesh/proto/shadow"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+// ExpectedVersionHeader - HTTP header Patch and Remove take the expected version of the changed state from,
+// versions of the returned states are sent back in VersionHeader as "{device}:{reported|desired}={version}",
+// StreamShadow sends the ones at its start in the header and at its end in the trailer
+const (
+	ExpectedVersionHeader = "Expected-Version"
+	VersionHeader         = "Shadow-Version"
+)
+
+// DeltaHeader - HTTP header Get and StreamShadow send stored deltas of the devices in, as base64 encoded "{device}={State JSON}"
+const DeltaHeader = "Shadow-Delta-Bin"
+
+// versioned - passes expected version of the request to the Shadow service, returned header must be passed to withVersions
+func versioned(ctx context.Context, header http.Header) context.Context {
+	if v := header.Get(ExpectedVersionHeader); v != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, shadowsvc.ExpectedVersionHeader, v)
+	}
+	return ctx
+}
+
+// withVersions - sets versions of the returned states and deltas of the devices to the response header
+func withVersions[T any](res *connect.Response[T], md metadata.MD) *connect.Response[T] {
+	setVersions(res.Header(), md)
+	return res
+}
+
+// setVersions - copies versions and deltas the Shadow service sent to the HTTP header
+func setVersions(header http.Header, md metadata.MD) {
+	for _, v := range md.Get(shadowsvc.VersionHeader) {
+		header.Add(VersionHeader, v)
+	}
+	for _, v := range md.Get(shadowsvc.DeltaHeader) {
+		header.Add(DeltaHeader, connect.EncodeBinaryHeader([]byte(v)))
+	}
+}
+
+// versionError - keeps the Shadow service status code, so version conflicts are Aborted, along with the current version
+func versionError(err error, md metadata.MD) error {
+	cerr := connect.NewError(connect.Code(status.Code(err)), errors.New(status.Convert(err).Message()))
+	for _, v := range md.Get(shadowsvc.VersionHeader) {
+		cerr.Meta().Add(VersionHeader, v)
+	}
+	return cerr
+}
+
 // ShadowAPI data strcuture
 type ShadowAPI struct {
 	pb.UnimplementedShadowServiceServer
@@ -60,12 +109,13 @@ func (s *ShadowAPI) Get(ctx context.Context, _ *connect.Request[shadow.GetReques
 		pool = append(pool, device)
 	}
 
-	res, err := s.client.Get(ctx, &shadow.GetRequest{Pool: pool})
+	var md metadata.MD
+	res, err := s.client.Get(ctx, &shadow.GetRequest{Pool: pool}, grpc.Header(&md))
 	if err != nil {
 		return nil, err
 	}
 
-	return connect.NewResponse(res), nil
+	return withVersions(connect.NewResponse(res), md), nil
 }
 
 // Patch - is a method to update the current state of the device
@@ -84,12 +134,13 @@ func (s *ShadowAPI) Patch(ctx context.Context, request *connect.Request[shadow.S
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("requested device is outside of token scope"))
 	}
 
-	res, err := s.client.Patch(ctx, shadow)
+	var md metadata.MD
+	res, err := s.client.Patch(versioned(ctx, request.Header()), shadow, grpc.Header(&md))
 	if err != nil {
-		return nil, err
+		return nil, versionError(err, md)
 	}
 
-	return connect.NewResponse(res), nil
+	return withVersions(connect.NewResponse(res), md), nil
 }
 
 func (s *ShadowAPI) Remove(ctx context.Context, request *connect.Request[shadow.RemoveRequest]) (response *connect.Response[shadow.Shadow], err error) {
@@ -107,12 +158,13 @@ func (s *ShadowAPI) Remove(ctx context.Context, request *connect.Request[shadow.
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("requested device is outside of token scope"))
 	}
 
-	res, err := s.client.Remove(ctx, req)
+	var md metadata.MD
+	res, err := s.client.Remove(versioned(ctx, request.Header()), req, grpc.Header(&md))
 	if err != nil {
-		return nil, err
+		return nil, versionError(err, md)
 	}
 
-	return connect.NewResponse(res), nil
+	return withVersions(connect.NewResponse(res), md), nil
 }
 
 // StreamShadow is a method to get the stream for a device
@@ -140,11 +192,15 @@ func (s *ShadowAPI) StreamShadow(ctx context.Context, request *connect.Request[s
 		log.Warn("Stream API Method: Failed to start the Stream", zap.Error(err))
 		return connect.NewError(connect.CodeAborted, errors.New("failed to start the Stream"))
 	}
+	if md, err := c.Header(); err == nil {
+		setVersions(srv.ResponseHeader(), md)
+	}
 
 	for {
 		msg, err := c.Recv()
 		if err != nil {
 			log.Info("Error receiving message, closing stream", zap.Error(err))
+			setVersions(srv.ResponseTrailer(), c.Trailer())
 			return err
 		}
 
@@ -0,0 +1,419 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package coap implements messages of the Constrained Application Protocol (RFC 7252) along with the Observe option (RFC 7641).
+// Only the message format is covered, transport (UDP/DTLS), deduplication and retransmissions are up to the server
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Version - the only CoAP version defined
+const Version = 1
+
+var (
+	ErrShortMessage   = errors.New("message is too short")
+	ErrVersion        = errors.New("unsupported CoAP version")
+	ErrTokenLength    = errors.New("token is longer than 8 bytes")
+	ErrOptionFormat   = errors.New("malformed option")
+	ErrEmptyPayload   = errors.New("payload marker followed by empty payload")
+	ErrNotEmptyFormat = errors.New("empty message with token, options or payload")
+)
+
+// Type - message type, Confirmable messages are acknowledged by the other side
+type Type uint8
+
+const (
+	Confirmable Type = iota
+	NonConfirmable
+	Acknowledgement
+	Reset
+)
+
+func (t Type) String() string {
+	switch t {
+	case Confirmable:
+		return "CON"
+	case NonConfirmable:
+		return "NON"
+	case Acknowledgement:
+		return "ACK"
+	case Reset:
+		return "RST"
+	}
+	return fmt.Sprintf("Type(%d)", uint8(t))
+}
+
+// Code - request method or response code, written as c.dd where c is the class
+type Code uint8
+
+func code(class, detail uint8) Code {
+	return Code(class<<5 | detail)
+}
+
+const (
+	Empty  Code = 0
+	GET    Code = 1
+	POST   Code = 2
+	PUT    Code = 3
+	DELETE Code = 4
+)
+
+var (
+	Created                  = code(2, 1)
+	Deleted                  = code(2, 2)
+	Valid                    = code(2, 3)
+	Changed                  = code(2, 4)
+	Content                  = code(2, 5)
+	BadRequest               = code(4, 0)
+	Unauthorized             = code(4, 1)
+	BadOption                = code(4, 2)
+	Forbidden                = code(4, 3)
+	NotFound                 = code(4, 4)
+	MethodNotAllowed         = code(4, 5)
+	NotAcceptable            = code(4, 6)
+	RequestEntityTooLarge    = code(4, 13)
+	UnsupportedContentFormat = code(4, 15)
+	TooManyRequests          = code(4, 29)
+	InternalServerError      = code(5, 0)
+	ServiceUnavailable       = code(5, 3)
+)
+
+// Class - 0 for requests, 2 for success, 4 for client and 5 for server errors
+func (c Code) Class() uint8 {
+	return uint8(c) >> 5
+}
+
+// IsRequest - whether the code is a request method
+func (c Code) IsRequest() bool {
+	return c != Empty && c.Class() == 0
+}
+
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c.Class(), uint8(c)&0x1f)
+}
+
+// OptionID - option number, options are ordered by it in the message
+type OptionID uint16
+
+const (
+	IfMatch       OptionID = 1
+	URIHost       OptionID = 3
+	ETag          OptionID = 4
+	IfNoneMatch   OptionID = 5
+	Observe       OptionID = 6
+	URIPort       OptionID = 7
+	LocationPath  OptionID = 8
+	URIPath       OptionID = 11
+	ContentFormat OptionID = 12
+	MaxAge        OptionID = 14
+	URIQuery      OptionID = 15
+	Accept        OptionID = 17
+	LocationQuery OptionID = 20
+	ProxyURI      OptionID = 35
+	ProxyScheme   OptionID = 39
+	Size1         OptionID = 60
+)
+
+// Critical - unrecognized critical options must make the request fail with Bad Option
+func (id OptionID) Critical() bool {
+	return id&1 == 1
+}
+
+// Content-Format registry values
+const (
+	TextPlain      uint32 = 0
+	AppLinkFormat  uint32 = 40
+	AppOctetStream uint32 = 42
+	AppJSON        uint32 = 50
+	AppCBOR        uint32 = 60
+)
+
+// Observe option values of requests
+const (
+	ObserveRegister uint32 = 0
+	ObserveCancel   uint32 = 1
+)
+
+type Option struct {
+	ID    OptionID
+	Value []byte
+}
+
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Get - value of the first option with the ID, nil if there is none
+func (m *Message) Get(id OptionID) []byte {
+	for _, o := range m.Options {
+		if o.ID == id {
+			return o.Value
+		}
+	}
+	return nil
+}
+
+// Has - whether the option is present, options might have empty values
+func (m *Message) Has(id OptionID) bool {
+	for _, o := range m.Options {
+		if o.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// All - values of all options with the ID in order
+func (m *Message) All(id OptionID) [][]byte {
+	var res [][]byte
+	for _, o := range m.Options {
+		if o.ID == id {
+			res = append(res, o.Value)
+		}
+	}
+	return res
+}
+
+// Uint - value of the uint option, ok is false if it's not present or longer than 4 bytes
+func (m *Message) Uint(id OptionID) (v uint32, ok bool) {
+	if !m.Has(id) {
+		return 0, false
+	}
+	b := m.Get(id)
+	if len(b) > 4 {
+		return 0, false
+	}
+	for _, x := range b {
+		v = v<<8 | uint32(x)
+	}
+	return v, true
+}
+
+// Add - appends the option, repeatable options keep the order they are added in
+func (m *Message) Add(id OptionID, value []byte) {
+	m.Options = append(m.Options, Option{ID: id, Value: value})
+}
+
+// Set - replaces all options with the ID with the given value
+func (m *Message) Set(id OptionID, value []byte) {
+	m.Remove(id)
+	m.Add(id, value)
+}
+
+// SetUint - replaces all options with the ID with the given uint value
+func (m *Message) SetUint(id OptionID, v uint32) {
+	m.Set(id, EncodeUint(v))
+}
+
+// Remove - drops all options with the ID
+func (m *Message) Remove(id OptionID) {
+	res := m.Options[:0]
+	for _, o := range m.Options {
+		if o.ID != id {
+			res = append(res, o)
+		}
+	}
+	m.Options = res
+}
+
+// Path - Uri-Path options joined with "/" and without the leading one, e.g. "state"
+func (m *Message) Path() string {
+	segments := m.All(URIPath)
+	res := make([]string, len(segments))
+	for i, s := range segments {
+		res[i] = string(s)
+	}
+	return strings.Join(res, "/")
+}
+
+// SetPath - replaces Uri-Path options with segments of the path
+func (m *Message) SetPath(path string) {
+	m.Remove(URIPath)
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		if s != "" {
+			m.Add(URIPath, []byte(s))
+		}
+	}
+}
+
+// Query - Uri-Query options as key-value pairs, arguments without "=" like "observe" have empty values
+func (m *Message) Query() map[string]string {
+	res := make(map[string]string)
+	for _, q := range m.All(URIQuery) {
+		k, v, _ := strings.Cut(string(q), "=")
+		res[k] = v
+	}
+	return res
+}
+
+// EncodeUint - shortest big-endian representation of the value, zero is encoded as empty value
+func EncodeUint(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	i := 0
+	for i < 4 && b[i] == 0 {
+		i++
+	}
+	return b[i:]
+}
+
+// Marshal - encodes the message, options are sorted by ID keeping the order of repeated ones
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, ErrTokenLength
+	}
+
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+8*len(m.Options)+1)
+	buf[0] = Version<<6 | byte(m.Type&3)<<4 | byte(len(m.Token))
+	buf[1] = byte(m.Code)
+	binary.BigEndian.PutUint16(buf[2:], m.MessageID)
+	buf = append(buf, m.Token...)
+
+	options := make([]Option, len(m.Options))
+	copy(options, m.Options)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].ID < options[j].ID
+	})
+
+	var prev OptionID
+	for _, o := range options {
+		if len(o.Value) > 65535+269 {
+			return nil, ErrOptionFormat
+		}
+		delta, deltaExt := optionNibble(uint32(o.ID - prev))
+		length, lengthExt := optionNibble(uint32(len(o.Value)))
+		buf = append(buf, delta<<4|length)
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, o.Value...)
+		prev = o.ID
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, 0xff)
+		buf = append(buf, m.Payload...)
+	}
+	return buf, nil
+}
+
+// optionNibble - option delta or length nibble with its extended bytes
+func optionNibble(v uint32) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(v-269))
+		return 14, ext
+	}
+}
+
+// Unmarshal - decodes the message, errors mean the message must be rejected (with Reset if it's Confirmable)
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < 4 {
+		return nil, ErrShortMessage
+	}
+	if data[0]>>6 != Version {
+		return nil, ErrVersion
+	}
+
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 3),
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+	}
+	tkl := int(data[0] & 0xf)
+	if tkl > 8 {
+		return nil, ErrTokenLength
+	}
+	if m.Code == Empty && (tkl > 0 || len(data) > 4) {
+		return nil, ErrNotEmptyFormat
+	}
+	data = data[4:]
+	if len(data) < tkl {
+		return nil, ErrShortMessage
+	}
+	if tkl > 0 {
+		m.Token = append([]byte(nil), data[:tkl]...)
+	}
+	data = data[tkl:]
+
+	var id uint32
+	for len(data) > 0 {
+		if data[0] == 0xff {
+			if len(data) == 1 {
+				return nil, ErrEmptyPayload
+			}
+			m.Payload = append([]byte(nil), data[1:]...)
+			break
+		}
+
+		delta, length := uint32(data[0]>>4), uint32(data[0]&0xf)
+		data = data[1:]
+
+		var err error
+		if delta, data, err = optionExtended(delta, data); err != nil {
+			return nil, err
+		}
+		if length, data, err = optionExtended(length, data); err != nil {
+			return nil, err
+		}
+		if uint32(len(data)) < length {
+			return nil, ErrOptionFormat
+		}
+
+		id += delta
+		if id > 65535 {
+			return nil, ErrOptionFormat
+		}
+		m.Options = append(m.Options, Option{ID: OptionID(id), Value: append([]byte(nil), data[:length]...)})
+		data = data[length:]
+	}
+
+	return m, nil
+}
+
+// optionExtended - resolves extended option delta or length, 15 is reserved for the payload marker
+func optionExtended(v uint32, data []byte) (uint32, []byte, error) {
+	switch v {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, ErrOptionFormat
+		}
+		return uint32(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, ErrOptionFormat
+		}
+		return uint32(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, ErrOptionFormat
+	}
+	return v, data, nil
+}
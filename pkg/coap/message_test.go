@@ -0,0 +1,100 @@
+package coap_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/coap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal_RoundTrip(t *testing.T) {
+	m := &coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.POST,
+		MessageID: 0x1234,
+		Token:     []byte{0xca, 0xfe},
+		Payload:   []byte(`{"temperature":21.5}`),
+	}
+	m.SetUint(coap.ContentFormat, coap.AppJSON)
+	m.SetPath("/state/")
+	m.Add(coap.URIQuery, []byte("observe"))
+	m.Add(coap.URIQuery, []byte("format=json"))
+	// Long values need extended lengths
+	m.Add(coap.ProxyURI, bytes.Repeat([]byte("a"), 300))
+
+	data, err := m.Marshal()
+	require.NoError(t, err)
+
+	res, err := coap.Unmarshal(data)
+	require.NoError(t, err)
+	assert.Equal(t, m.Type, res.Type)
+	assert.Equal(t, m.Code, res.Code)
+	assert.Equal(t, m.MessageID, res.MessageID)
+	assert.Equal(t, m.Token, res.Token)
+	assert.Equal(t, m.Payload, res.Payload)
+	assert.Equal(t, "state", res.Path())
+	assert.Equal(t, map[string]string{"observe": "", "format": "json"}, res.Query())
+	assert.Len(t, res.Get(coap.ProxyURI), 300)
+
+	format, ok := res.Uint(coap.ContentFormat)
+	assert.True(t, ok)
+	assert.Equal(t, coap.AppJSON, format)
+}
+
+func TestMarshal_SortsOptions(t *testing.T) {
+	m := &coap.Message{Type: coap.NonConfirmable, Code: coap.Content}
+	m.SetUint(coap.ContentFormat, coap.AppCBOR)
+	m.SetUint(coap.Observe, 1)
+
+	data, err := m.Marshal()
+	require.NoError(t, err)
+	// Observe (6) goes first with delta 6, then Content-Format (12) with delta 6
+	assert.Equal(t, []byte{0x50, 0x45, 0, 0, 0x61, 1, 0x61, 60}, data)
+}
+
+func TestUnmarshal_Empty(t *testing.T) {
+	m, err := coap.Unmarshal([]byte{0x40, 0, 0, 7})
+	require.NoError(t, err)
+	assert.Equal(t, coap.Confirmable, m.Type)
+	assert.Equal(t, coap.Empty, m.Code)
+	assert.Equal(t, uint16(7), m.MessageID)
+}
+
+func TestUnmarshal_Fails(t *testing.T) {
+	cases := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"short":         {[]byte{0x40, 1}, coap.ErrShortMessage},
+		"version":       {[]byte{0x80, 1, 0, 0}, coap.ErrVersion},
+		"token length":  {[]byte{0x49, 1, 0, 0}, coap.ErrTokenLength},
+		"missing token": {[]byte{0x42, 1, 0, 0, 1}, coap.ErrShortMessage},
+		"empty payload": {[]byte{0x40, 1, 0, 0, 0xff}, coap.ErrEmptyPayload},
+		"not empty":     {[]byte{0x41, 0, 0, 0, 1}, coap.ErrNotEmptyFormat},
+		"option length": {[]byte{0x40, 1, 0, 0, 0xb3, 's'}, coap.ErrOptionFormat},
+		"reserved":      {[]byte{0x40, 1, 0, 0, 0xf0}, coap.ErrOptionFormat},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := coap.Unmarshal(c.data)
+			assert.Equal(t, c.err, err)
+		})
+	}
+}
+
+func TestEncodeUint(t *testing.T) {
+	assert.Empty(t, coap.EncodeUint(0))
+	assert.Equal(t, []byte{1}, coap.EncodeUint(1))
+	assert.Equal(t, []byte{1, 0}, coap.EncodeUint(256))
+	assert.Equal(t, []byte{0xff, 0xff, 0xff}, coap.EncodeUint(1<<24-1))
+}
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, "2.05", coap.Content.String())
+	assert.Equal(t, "4.04", coap.NotFound.String())
+	assert.True(t, coap.GET.IsRequest())
+	assert.False(t, coap.Empty.IsRequest())
+	assert.False(t, coap.Changed.IsRequest())
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package devcache keeps devices fetched from the registry for a limited time and
+// propagates device changes (toggle, update, delete) through Redis Pub/Sub, so cached entries are dropped right away
+package devcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	devpb "github.com/infinimesh/proto/node/devices"
+)
+
+// Channel - Redis Pub/Sub channel device UUIDs are published to once the device is changed
+const Channel = "devices:changes"
+
+// Notify - tells caches the device has changed
+func Notify(ctx context.Context, rdb redis.Cmdable, device string) error {
+	return rdb.Publish(ctx, Channel, device).Err()
+}
+
+// Subscribe - calls cb with UUID of each changed device until ctx is done
+func Subscribe(ctx context.Context, rdb redis.UniversalClient, cb func(device string)) {
+	sub := rdb.Subscribe(ctx, Channel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			cb(msg.Payload)
+		}
+	}
+}
+
+// LoadFunc - fetches the device from the registry
+type LoadFunc func(ctx context.Context, uuid string) (*devpb.Device, error)
+
+type entry struct {
+	device  *devpb.Device
+	expires time.Time
+}
+
+type Cache struct {
+	ttl  time.Duration
+	load LoadFunc
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func New(ttl time.Duration, load LoadFunc) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		load:    load,
+		entries: make(map[string]entry),
+	}
+}
+
+// Get - returns cached device, loads it if it's not cached or TTL has passed. Errors are not cached
+func (c *Cache) Get(ctx context.Context, uuid string) (*devpb.Device, error) {
+	c.mu.Lock()
+	e, ok := c.entries[uuid]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.device, nil
+	}
+
+	device, err := c.load(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	c.Put(device)
+	return device, nil
+}
+
+// Put - caches the device obtained elsewhere, e.g. while authenticating it
+func (c *Cache) Put(device *devpb.Device) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[device.GetUuid()] = entry{
+		device:  device,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// Invalidate - drops the device, so next Get loads it again
+func (c *Cache) Invalidate(uuid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, uuid)
+}
@@ -0,0 +1,84 @@
+package devcache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+type cacheFixture struct {
+	cache *devcache.Cache
+	loads int
+	err   error
+}
+
+func newCacheFixture(ttl time.Duration) (f *cacheFixture) {
+	f = &cacheFixture{}
+	f.cache = devcache.New(ttl, func(ctx context.Context, uuid string) (*devpb.Device, error) {
+		f.loads++
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &devpb.Device{Uuid: uuid, Enabled: true}, nil
+	})
+	return f
+}
+
+func TestGet_LoadsOnce(t *testing.T) {
+	f := newCacheFixture(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		dev, err := f.cache.Get(context.Background(), "dev")
+		assert.NoError(t, err)
+		assert.Equal(t, "dev", dev.Uuid)
+	}
+	assert.Equal(t, 1, f.loads)
+}
+
+func TestGet_ReloadsAfterTTL(t *testing.T) {
+	f := newCacheFixture(0)
+
+	_, _ = f.cache.Get(context.Background(), "dev")
+	_, _ = f.cache.Get(context.Background(), "dev")
+	assert.Equal(t, 2, f.loads)
+}
+
+func TestGet_DoesntCacheErrors(t *testing.T) {
+	f := newCacheFixture(time.Minute)
+	f.err = assert.AnError
+
+	_, err := f.cache.Get(context.Background(), "dev")
+	assert.Equal(t, assert.AnError, err)
+
+	f.err = nil
+	dev, err := f.cache.Get(context.Background(), "dev")
+	assert.NoError(t, err)
+	assert.Equal(t, "dev", dev.Uuid)
+	assert.Equal(t, 2, f.loads)
+}
+
+func TestInvalidate(t *testing.T) {
+	f := newCacheFixture(time.Minute)
+	f.cache.Put(&devpb.Device{Uuid: "dev"})
+
+	_, _ = f.cache.Get(context.Background(), "dev")
+	assert.Equal(t, 0, f.loads)
+
+	f.cache.Invalidate("dev")
+	_, _ = f.cache.Get(context.Background(), "dev")
+	assert.Equal(t, 1, f.loads)
+}
+
+func TestNotify(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	rdb.EXPECT().Publish(context.Background(), devcache.Channel, "dev").
+		Return(redis.NewIntCmd(context.Background()))
+
+	assert.NoError(t, devcache.Notify(context.Background(), rdb, "dev"))
+}
@@ -0,0 +1,414 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package deviceca
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// RootName - storage name of the built-in root CA, intermediates are stored by Namespace
+const RootName = "root"
+
+const (
+	rootValidity         = 20 * 365 * 24 * time.Hour
+	intermediateValidity = 10 * 365 * 24 * time.Hour
+
+	encryptedKeyType = "INFINIMESH ENCRYPTED PRIVATE KEY"
+)
+
+// ErrExists - CA has been stored already, e.g. by another replica
+var ErrExists = errors.New("CA already exists")
+
+// ErrInvalidCSR - CSR isn't signed by the key it requests the certificate for
+var ErrInvalidCSR = errors.New("invalid CSR signature")
+
+// StoredCA - PEM encoded CA certificate and its private key encrypted with EncryptKey
+type StoredCA struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+// Storage - persists built-in CAs by name, Load returns nil if there's no such CA and Create returns ErrExists if there is
+type Storage interface {
+	Load(ctx context.Context, name string) (*StoredCA, error)
+	Create(ctx context.Context, name string, ca *StoredCA) error
+}
+
+// EncryptKey - PEM encoded PKCS #8 key encrypted with AES-256-GCM, AES key is derived from passphrase with scrypt
+func EncryptKey(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, der, nil),
+	}), nil
+}
+
+// DecryptKey - reverses EncryptKey
+func DecryptKey(data []byte, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return nil, errors.New("not an encrypted key")
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	der, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("can't decrypt key, passphrase is wrong")
+	}
+	return ParsePrivateKey(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func keyCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type authorityCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Authority - built-in CA issuing device certificates. Root CA signs an intermediate CA per Namespace, which signs
+// certificates of the Namespace devices. Keys are kept encrypted in Storage
+type Authority struct {
+	storage    Storage
+	passphrase []byte
+
+	// Validity - validity of issued device certificates, capped by the intermediate one
+	Validity time.Duration
+	// OnIntermediate - called before the Namespace intermediate is first used to issue certificates, e.g. to make the Namespace trust it
+	OnIntermediate func(ctx context.Context, namespace string, ca *x509.Certificate) error
+
+	mu            sync.Mutex
+	root          *authorityCA
+	intermediates map[string]*authorityCA
+}
+
+// NewAuthority - loads root CA from storage, it's generated on the first start
+func NewAuthority(ctx context.Context, storage Storage, passphrase []byte) (*Authority, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase is required")
+	}
+	a := &Authority{
+		storage:       storage,
+		passphrase:    passphrase,
+		Validity:      365 * 24 * time.Hour,
+		intermediates: make(map[string]*authorityCA),
+	}
+
+	root, err := a.loadOrCreate(ctx, RootName, func() (*authorityCA, error) {
+		return a.create(pkix.Name{CommonName: "infinimesh Device Root CA"}, nil, rootValidity, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.root = root
+	return a, nil
+}
+
+// Root - root CA certificate
+func (a *Authority) Root() *x509.Certificate {
+	return a.root.cert
+}
+
+// load - CA by name from storage, nil if it's not there
+func (a *Authority) load(ctx context.Context, name string) (*authorityCA, error) {
+	stored, err := a.storage.Load(ctx, name)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(stored.Certificate))
+	if block == nil {
+		return nil, fmt.Errorf("%s CA certificate is not PEM", name)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := DecryptKey([]byte(stored.Key), a.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s CA: %w", name, err)
+	}
+	return &authorityCA{cert: cert, key: key}, nil
+}
+
+// loadOrCreate - CA by name from storage, it's created and stored if it's not there.
+// If another replica stores it first, the stored one is used
+func (a *Authority) loadOrCreate(ctx context.Context, name string, create func() (*authorityCA, error)) (*authorityCA, error) {
+	ca, err := a.load(ctx, name)
+	if err != nil || ca != nil {
+		return ca, err
+	}
+
+	ca, err = create()
+	if err != nil {
+		return nil, err
+	}
+	key, err := EncryptKey(ca.key, a.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = a.storage.Create(ctx, name, &StoredCA{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})),
+		Key:         string(key),
+	})
+	if errors.Is(err, ErrExists) {
+		return a.load(ctx, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// create - generates CA signed by parent, self-signed if parent is nil
+func (a *Authority) create(subject pkix.Name, parent *authorityCA, validity time.Duration, maxPathLen int) (*authorityCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+	}
+
+	signer, signerKey := tmpl, crypto.Signer(key)
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+		if tmpl.NotAfter.After(parent.cert.NotAfter) {
+			tmpl.NotAfter = parent.cert.NotAfter
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, key.Public(), signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &authorityCA{cert: cert, key: key}, nil
+}
+
+// intermediate - Namespace intermediate CA, it's created if create is set, nil is returned otherwise
+func (a *Authority) intermediate(ctx context.Context, namespace string, create bool) (*authorityCA, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ca, ok := a.intermediates[namespace]; ok {
+		return ca, nil
+	}
+
+	var ca *authorityCA
+	var err error
+	if create {
+		ca, err = a.loadOrCreate(ctx, namespace, func() (*authorityCA, error) {
+			return a.create(pkix.Name{
+				CommonName:         "infinimesh Device CA " + namespace,
+				OrganizationalUnit: []string{namespace},
+			}, a.root, intermediateValidity, 0)
+		})
+		if err == nil && a.OnIntermediate != nil {
+			err = a.OnIntermediate(ctx, namespace, ca.cert)
+		}
+	} else {
+		ca, err = a.load(ctx, namespace)
+	}
+	if err != nil || ca == nil {
+		return nil, err
+	}
+	a.intermediates[namespace] = ca
+	return ca, nil
+}
+
+// Intermediate - Namespace intermediate CA certificate, nil if it hasn't been created yet
+func (a *Authority) Intermediate(ctx context.Context, namespace string) (*x509.Certificate, error) {
+	ca, err := a.intermediate(ctx, namespace, false)
+	if err != nil || ca == nil {
+		return nil, err
+	}
+	return ca.cert, nil
+}
+
+// KeyFor - key of the Namespace intermediate CA if it's the given certificate, nil otherwise
+func (a *Authority) KeyFor(ctx context.Context, namespace string, cert *x509.Certificate) crypto.Signer {
+	if a == nil {
+		return nil
+	}
+	ca, err := a.intermediate(ctx, namespace, false)
+	if err != nil || ca == nil || !ca.cert.Equal(cert) {
+		return nil
+	}
+	return ca.key
+}
+
+// Issued - device certificate with the chain up to the root CA, Key is only set if it was generated
+type Issued struct {
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+	Key         crypto.Signer
+}
+
+// CertificatePEM - device certificate followed by the chain, as devices present it
+func (i *Issued) CertificatePEM() string {
+	var data []byte
+	for _, cert := range append([]*x509.Certificate{i.Certificate}, i.Chain...) {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return string(data)
+}
+
+// KeyPEM - PEM encoded PKCS #8 device key, empty if it wasn't generated
+func (i *Issued) KeyPEM() (string, error) {
+	if i.Key == nil {
+		return "", nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(i.Key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// Issue - signs device certificate with the Namespace intermediate CA, Common Name is the device UUID.
+// Public key is taken from csr, key pair is generated if csr is nil
+func (a *Authority) Issue(ctx context.Context, namespace, device string, csr *x509.CertificateRequest) (*Issued, error) {
+	ca, err := a.intermediate(ctx, namespace, true)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Issued{Chain: []*x509.Certificate{ca.cert, a.root.cert}}
+	var pub crypto.PublicKey
+	if csr != nil {
+		if err := csr.CheckSignature(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+		}
+		pub = csr.PublicKey
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		res.Key, pub = key, key.Public()
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         device,
+			OrganizationalUnit: []string{namespace},
+		},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(a.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if tmpl.NotAfter.After(ca.cert.NotAfter) {
+		tmpl.NotAfter = ca.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	res.Certificate, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,148 @@
+package deviceca_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"sync"
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type memoryStorage struct {
+	mu  sync.Mutex
+	cas map[string]*deviceca.StoredCA
+}
+
+func (s *memoryStorage) Load(_ context.Context, name string) (*deviceca.StoredCA, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cas[name], nil
+}
+
+func (s *memoryStorage) Create(_ context.Context, name string, ca *deviceca.StoredCA) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cas[name]; ok {
+		return deviceca.ErrExists
+	}
+	s.cas[name] = ca
+	return nil
+}
+
+func TestEncryptKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	data, err := deviceca.EncryptKey(key, []byte("secret"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "BEGIN PRIVATE KEY")
+
+	decrypted, err := deviceca.DecryptKey(data, []byte("secret"))
+	require.NoError(t, err)
+	assert.True(t, key.Equal(decrypted))
+
+	_, err = deviceca.DecryptKey(data, []byte("wrong"))
+	assert.Error(t, err)
+}
+
+func TestAuthority(t *testing.T) {
+	ctx := context.Background()
+	storage := &memoryStorage{cas: map[string]*deviceca.StoredCA{}}
+
+	_, err := deviceca.NewAuthority(ctx, storage, nil)
+	assert.Error(t, err)
+
+	a, err := deviceca.NewAuthority(ctx, storage, []byte("secret"))
+	require.NoError(t, err)
+	assert.True(t, a.Root().IsCA)
+	assert.Contains(t, storage.cas, deviceca.RootName)
+
+	var trusted []string
+	a.OnIntermediate = func(_ context.Context, namespace string, ca *x509.Certificate) error {
+		trusted = append(trusted, namespace)
+		return nil
+	}
+
+	issued, err := a.Issue(ctx, "ns", "device", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "device", issued.Certificate.Subject.CommonName)
+	assert.NotNil(t, issued.Key)
+	require.Len(t, issued.Chain, 2)
+	assert.Equal(t, []string{"ns"}, trusted)
+
+	// Chain as presented by the device is trusted by the Namespace trusting the intermediate
+	config, changed, err := deviceca.Trust(&structpb.Struct{}, issued.Chain[0])
+	require.NoError(t, err)
+	assert.True(t, changed)
+	c, err := deviceca.Parse("ns", config)
+	require.NoError(t, err)
+	ca, err := c.Issuer([]*x509.Certificate{issued.Certificate, issued.Chain[0]})
+	require.NoError(t, err)
+	assert.True(t, ca.Equal(issued.Chain[0]))
+
+	_, changed, err = deviceca.Trust(config, issued.Chain[0])
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Intermediates aren't shared between Namespaces
+	other, err := a.Issue(ctx, "other", "device", nil)
+	require.NoError(t, err)
+	assert.Error(t, c.Verify([]*x509.Certificate{other.Certificate, other.Chain[0]}))
+
+	// Keys are loaded from storage after restart
+	restarted, err := deviceca.NewAuthority(ctx, storage, []byte("secret"))
+	require.NoError(t, err)
+	assert.True(t, restarted.Root().Equal(a.Root()))
+	intermediate, err := restarted.Intermediate(ctx, "ns")
+	require.NoError(t, err)
+	assert.True(t, intermediate.Equal(issued.Chain[0]))
+	assert.NotNil(t, restarted.KeyFor(ctx, "ns", intermediate))
+	assert.Nil(t, restarted.KeyFor(ctx, "other", intermediate))
+
+	missing, err := restarted.Intermediate(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	_, err = deviceca.NewAuthority(ctx, storage, []byte("wrong"))
+	assert.Error(t, err)
+}
+
+func TestAuthority_CSR(t *testing.T) {
+	ctx := context.Background()
+	a, err := deviceca.NewAuthority(ctx, &memoryStorage{cas: map[string]*deviceca.StoredCA{}}, []byte("secret"))
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ignored"},
+	}, key)
+	require.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	require.NoError(t, err)
+
+	issued, err := a.Issue(ctx, "ns", "device", csr)
+	require.NoError(t, err)
+	assert.Nil(t, issued.Key)
+	assert.Equal(t, "device", issued.Certificate.Subject.CommonName)
+	assert.True(t, key.PublicKey.Equal(issued.Certificate.PublicKey))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Root())
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(issued.Chain[0])
+	_, err = issued.Certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,291 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deviceca verifies device client certificates against CA certificates trusted by a Namespace.
+// CAs are set in Namespace config:
+//
+//	"device_ca": {
+//	  "certificates":     ["-----BEGIN CERTIFICATE-----..."],
+//	  "jit_provisioning": true,
+//	  "tags":             ["provisioned"],
+//	  "enforce":          false
+//	}
+//
+// With jit_provisioning unknown devices presenting a certificate signed by one of the CAs are registered in the Namespace
+// on first connect, unless another Namespace trusts the certificate as well. With enforce certificates of registered devices must be signed by one of the CAs as well
+package deviceca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	nspb "github.com/infinimesh/proto/node/namespaces"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ConfigKey - key of Namespace config holding trusted CAs
+const ConfigKey = "device_ca"
+
+var (
+	// ErrUntrusted - certificate isn't signed by any trusted CA or isn't valid at the moment
+	ErrUntrusted = errors.New("certificate is not signed by a trusted CA")
+	// ErrAmbiguous - certificate is trusted by more than one Namespace
+	ErrAmbiguous = errors.New("certificate is trusted by more than one namespace")
+)
+
+// Config - CAs trusted by the Namespace
+type Config struct {
+	Namespace string
+	Roots     *x509.CertPool
+	// CAs - trusted CA certificates in the order they're set
+	CAs []*x509.Certificate
+	// JITProvisioning - register unknown devices with trusted certificates
+	JITProvisioning bool
+	// Tags - tags of the devices registered by JIT Provisioning
+	Tags []string
+	// Enforce - certificates of registered devices must be trusted too
+	Enforce bool
+}
+
+// Parse - reads trusted CAs from Namespace config, returns nil if config doesn't set them
+func Parse(namespace string, config *structpb.Struct) (*Config, error) {
+	v, ok := config.GetFields()[ConfigKey]
+	if !ok {
+		return nil, nil
+	}
+	fields := v.GetStructValue().GetFields()
+	if fields == nil {
+		return nil, fmt.Errorf("%s must be an object", ConfigKey)
+	}
+
+	res := &Config{
+		Namespace:       namespace,
+		Roots:           x509.NewCertPool(),
+		JITProvisioning: fields["jit_provisioning"].GetBoolValue(),
+		Enforce:         fields["enforce"].GetBoolValue(),
+	}
+	for _, tag := range fields["tags"].GetListValue().GetValues() {
+		res.Tags = append(res.Tags, tag.GetStringValue())
+	}
+
+	certs := fields["certificates"].GetListValue().GetValues()
+	if len(certs) == 0 {
+		return nil, errors.New("at least one CA certificate is required")
+	}
+	for i, c := range certs {
+		parsed, err := ParsePEM([]byte(c.GetStringValue()))
+		if err != nil {
+			return nil, fmt.Errorf("certificate %d: %w", i, err)
+		}
+		for _, cert := range parsed {
+			if !cert.IsCA {
+				return nil, fmt.Errorf("certificate %d: %s is not a CA", i, cert.Subject)
+			}
+			res.Roots.AddCert(cert)
+			res.CAs = append(res.CAs, cert)
+		}
+	}
+	return res, nil
+}
+
+// Trust - config with the CA added to trusted ones of the Namespace, changed is false if it's trusted already
+func Trust(config *structpb.Struct, ca *x509.Certificate) (res *structpb.Struct, changed bool, err error) {
+	res = &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	for k, v := range config.GetFields() {
+		res.Fields[k] = v
+	}
+
+	fields := map[string]*structpb.Value{}
+	for k, v := range res.Fields[ConfigKey].GetStructValue().GetFields() {
+		fields[k] = v
+	}
+	var certs []*structpb.Value
+	for _, c := range fields["certificates"].GetListValue().GetValues() {
+		parsed, err := ParsePEM([]byte(c.GetStringValue()))
+		if err == nil && len(parsed) == 1 && parsed[0].Equal(ca) {
+			return config, false, nil
+		}
+		certs = append(certs, c)
+	}
+	certs = append(certs, structpb.NewStringValue(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))))
+	fields["certificates"] = structpb.NewListValue(&structpb.ListValue{Values: certs})
+	res.Fields[ConfigKey] = structpb.NewStructValue(&structpb.Struct{Fields: fields})
+
+	if _, err := Parse("", res); err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
+
+// ParsePEM - parses all certificates in PEM data, other blocks are ignored
+func ParsePEM(data []byte) (res []*x509.Certificate, err error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, cert)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no PEM encoded certificates found")
+	}
+	return res, nil
+}
+
+// Verify - checks chain (leaf first, then intermediates as sent by the Client) is signed by one of the CAs and valid now
+func (c *Config) Verify(chain []*x509.Certificate) error {
+	_, err := c.Issuer(chain)
+	return err
+}
+
+// Issuer - verifies the chain like Verify does and returns the certificate which issued the leaf
+func (c *Config) Issuer(chain []*x509.Certificate) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, ErrUntrusted
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	verified, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         c.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUntrusted, err)
+	}
+	if len(verified[0]) < 2 {
+		return verified[0][0], nil
+	}
+	return verified[0][1], nil
+}
+
+// LoadFunc - fetches all Namespaces along with their configs
+type LoadFunc func(ctx context.Context) ([]*nspb.Namespace, error)
+
+// Store - keeps trusted CAs of all Namespaces for a limited time
+type Store struct {
+	ttl  time.Duration
+	load LoadFunc
+
+	mu      sync.Mutex
+	configs []*Config
+	errs    map[string]error
+	expires time.Time
+}
+
+func NewStore(ttl time.Duration, load LoadFunc) *Store {
+	return &Store{
+		ttl:  ttl,
+		load: load,
+	}
+}
+
+func (s *Store) get(ctx context.Context) ([]*Config, map[string]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().Before(s.expires) {
+		return s.configs, s.errs, nil
+	}
+
+	namespaces, err := s.load(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	configs := make([]*Config, 0)
+	errs := make(map[string]error)
+	for _, ns := range namespaces {
+		config, err := Parse(ns.GetUuid(), ns.GetConfig())
+		if err != nil {
+			errs[ns.GetUuid()] = err
+			continue
+		}
+		if config != nil {
+			configs = append(configs, config)
+		}
+	}
+
+	s.configs, s.errs, s.expires = configs, errs, time.Now().Add(s.ttl)
+	return configs, errs, nil
+}
+
+// Get - trusted CAs of the Namespace, nil if it has none. Invalid configs are reported as error
+func (s *Store) Get(ctx context.Context, namespace string) (*Config, error) {
+	configs, errs, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := errs[namespace]; ok {
+		return nil, err
+	}
+	for _, config := range configs {
+		if config.Namespace == namespace {
+			return config, nil
+		}
+	}
+	return nil, nil
+}
+
+// Find - config of the Namespace trusting the chain, ErrUntrusted if there's none.
+// ErrAmbiguous is returned if more than one Namespace trusts it, e.g. they share a manufacturer CA,
+// since it's unknown which of them the device belongs to
+func (s *Store) Find(ctx context.Context, chain []*x509.Certificate) (*Config, error) {
+	configs, _, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var trusted []*Config
+	for _, config := range configs {
+		if config.Verify(chain) == nil {
+			trusted = append(trusted, config)
+		}
+	}
+	switch len(trusted) {
+	case 0:
+		return nil, ErrUntrusted
+	case 1:
+		return trusted[0], nil
+	}
+	namespaces := make([]string, len(trusted))
+	for i, config := range trusted {
+		namespaces[i] = config.Namespace
+	}
+	return nil, fmt.Errorf("%w: %s", ErrAmbiguous, strings.Join(namespaces, ", "))
+}
+
+// Invalidate - drops cached configs, so they're loaded again on next call
+func (s *Store) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expires = time.Time{}
+}
@@ -0,0 +1,219 @@
+package deviceca_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	nspb "github.com/infinimesh/proto/node/namespaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func issue(t *testing.T, parent *issuer, name string, ca bool, notAfter time.Time) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+	}
+	if ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &issuer{cert: cert, key: key}
+}
+
+func toPEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func config(t *testing.T, c map[string]interface{}) *structpb.Struct {
+	s, err := structpb.NewStruct(map[string]interface{}{deviceca.ConfigKey: c})
+	require.NoError(t, err)
+	return s
+}
+
+func TestParse(t *testing.T) {
+	root := issue(t, nil, "Root", true, time.Now().Add(time.Hour))
+	leaf := issue(t, root, "device", false, time.Now().Add(time.Hour))
+
+	c, err := deviceca.Parse("ns", &structpb.Struct{})
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	c, err = deviceca.Parse("ns", config(t, map[string]interface{}{
+		"certificates":     []interface{}{toPEM(root.cert)},
+		"jit_provisioning": true,
+		"tags":             []interface{}{"provisioned"},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "ns", c.Namespace)
+	assert.True(t, c.JITProvisioning)
+	assert.False(t, c.Enforce)
+	assert.Equal(t, []string{"provisioned"}, c.Tags)
+
+	for _, invalid := range []map[string]interface{}{
+		{},
+		{"certificates": []interface{}{"garbage"}},
+		{"certificates": []interface{}{toPEM(leaf.cert)}},
+	} {
+		_, err = deviceca.Parse("ns", config(t, invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	root := issue(t, nil, "Root", true, time.Now().Add(time.Hour))
+	intermediate := issue(t, root, "Intermediate", true, time.Now().Add(time.Hour))
+	leaf := issue(t, intermediate, "device", false, time.Now().Add(time.Hour))
+	expired := issue(t, intermediate, "device", false, time.Now().Add(-time.Minute))
+	other := issue(t, nil, "Other Root", true, time.Now().Add(time.Hour))
+
+	c, err := deviceca.Parse("ns", config(t, map[string]interface{}{
+		"certificates": []interface{}{toPEM(root.cert)},
+	}))
+	require.NoError(t, err)
+
+	assert.NoError(t, c.Verify([]*x509.Certificate{leaf.cert, intermediate.cert}))
+	assert.ErrorIs(t, c.Verify([]*x509.Certificate{leaf.cert}), deviceca.ErrUntrusted, "intermediate is missing")
+	assert.ErrorIs(t, c.Verify([]*x509.Certificate{expired.cert, intermediate.cert}), deviceca.ErrUntrusted)
+	assert.ErrorIs(t, c.Verify([]*x509.Certificate{other.cert}), deviceca.ErrUntrusted)
+	assert.ErrorIs(t, c.Verify(nil), deviceca.ErrUntrusted)
+}
+
+func TestStore(t *testing.T) {
+	rootA := issue(t, nil, "Root A", true, time.Now().Add(time.Hour))
+	rootB := issue(t, nil, "Root B", true, time.Now().Add(time.Hour))
+	leafB := issue(t, rootB, "device", false, time.Now().Add(time.Hour))
+	unknown := issue(t, issue(t, nil, "Root C", true, time.Now().Add(time.Hour)), "device", false, time.Now().Add(time.Hour))
+
+	loads := 0
+	store := deviceca.NewStore(time.Minute, func(ctx context.Context) ([]*nspb.Namespace, error) {
+		loads++
+		return []*nspb.Namespace{
+			{Uuid: "a", Config: config(t, map[string]interface{}{"certificates": []interface{}{toPEM(rootA.cert)}})},
+			{Uuid: "b", Config: config(t, map[string]interface{}{"certificates": []interface{}{toPEM(rootB.cert)}, "enforce": true})},
+			{Uuid: "broken", Config: config(t, map[string]interface{}{"certificates": []interface{}{"garbage"}})},
+			{Uuid: "none"},
+		}, nil
+	})
+
+	c, err := store.Find(context.Background(), []*x509.Certificate{leafB.cert})
+	require.NoError(t, err)
+	assert.Equal(t, "b", c.Namespace)
+
+	_, err = store.Find(context.Background(), []*x509.Certificate{unknown.cert})
+	assert.ErrorIs(t, err, deviceca.ErrUntrusted)
+
+	c, err = store.Get(context.Background(), "b")
+	require.NoError(t, err)
+	assert.True(t, c.Enforce)
+
+	c, err = store.Get(context.Background(), "none")
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	_, err = store.Get(context.Background(), "broken")
+	assert.Error(t, err)
+	assert.Equal(t, 1, loads)
+
+	store.Invalidate()
+	_, _ = store.Get(context.Background(), "a")
+	assert.Equal(t, 2, loads)
+}
+
+func TestStore_Find_FailsOn_SharedCA(t *testing.T) {
+	manufacturer := issue(t, nil, "Manufacturer", true, time.Now().Add(time.Hour))
+	leaf := issue(t, manufacturer, "device", false, time.Now().Add(time.Hour))
+
+	store := deviceca.NewStore(time.Minute, func(ctx context.Context) ([]*nspb.Namespace, error) {
+		return []*nspb.Namespace{
+			{Uuid: "a", Config: config(t, map[string]interface{}{"certificates": []interface{}{toPEM(manufacturer.cert)}, "jit_provisioning": true})},
+			{Uuid: "b", Config: config(t, map[string]interface{}{"certificates": []interface{}{toPEM(manufacturer.cert)}, "jit_provisioning": true})},
+		}, nil
+	})
+
+	c, err := store.Find(context.Background(), []*x509.Certificate{leaf.cert})
+	assert.ErrorIs(t, err, deviceca.ErrAmbiguous)
+	assert.NotErrorIs(t, err, deviceca.ErrUntrusted)
+	assert.Nil(t, c)
+
+	// Namespaces still verify their own devices against it
+	c, err = store.Get(context.Background(), "b")
+	require.NoError(t, err)
+	assert.NoError(t, c.Verify([]*x509.Certificate{leaf.cert}))
+}
+
+func TestIssuer(t *testing.T) {
+	root := issue(t, nil, "Root", true, time.Now().Add(time.Hour))
+	leaf := issue(t, root, "device", false, time.Now().Add(time.Hour))
+
+	c, err := deviceca.Parse("ns", config(t, map[string]interface{}{
+		"certificates": []interface{}{toPEM(root.cert)},
+	}))
+	require.NoError(t, err)
+
+	ca, err := c.Issuer([]*x509.Certificate{leaf.cert})
+	require.NoError(t, err)
+	assert.True(t, ca.Equal(root.cert))
+}
+
+func TestSigners(t *testing.T) {
+	root := issue(t, nil, "Root", true, time.Now().Add(time.Hour))
+	other := issue(t, nil, "Other", true, time.Now().Add(time.Hour))
+
+	der, err := x509.MarshalPKCS8PrivateKey(root.key)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "root.pem"), data, 0600))
+
+	s, err := deviceca.LoadSigners(dir)
+	require.NoError(t, err)
+	assert.NotNil(t, s.For(root.cert))
+	assert.Nil(t, s.For(other.cert))
+
+	s, err = deviceca.LoadSigners("")
+	require.NoError(t, err)
+	assert.Nil(t, s.For(root.cert))
+
+	var none *deviceca.Signers
+	assert.Nil(t, none.For(root.cert))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("garbage")}), 0600))
+	_, err = deviceca.LoadSigners(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package deviceca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Signers - private keys of CAs the registry can sign with, e.g. CRLs. Keys are matched to CA certificates by public key
+type Signers struct {
+	keys []crypto.Signer
+}
+
+// LoadSigners - reads PEM encoded private keys (PKCS #8, PKCS #1 or SEC 1) from all files in dir, empty dir means no keys
+func LoadSigners(dir string) (*Signers, error) {
+	s := &Signers{}
+	if dir == "" {
+		return s, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			key, err := ParsePrivateKey(block)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+			if key != nil {
+				s.Add(key)
+			}
+		}
+	}
+	return s, nil
+}
+
+// ParsePrivateKey - parses PEM block holding a private key, returns nil for other blocks
+func ParsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key can't sign")
+	}
+	return signer, nil
+}
+
+// Add - adds key to the set
+func (s *Signers) Add(key crypto.Signer) {
+	s.keys = append(s.keys, key)
+}
+
+// For - key of the CA certificate, nil if it's not known
+func (s *Signers) For(ca *x509.Certificate) crypto.Signer {
+	if s == nil {
+		return nil
+	}
+	for _, key := range s.keys {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(der, ca.RawSubjectPublicKeyInfo) {
+			return key
+		}
+	}
+	return nil
+}
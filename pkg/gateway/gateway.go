@@ -0,0 +1,172 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gateway keeps links of child devices (sub-devices) to their gateways, which publish and receive state on their behalf
+// over a single MQTT connection. Registry stores links in the Permissions graph and mirrors them to Redis,
+// where MQTT Bridge checks if the gateway is allowed to use topics of the child
+package gateway
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Key - Redis hash of gateway UUIDs by child device UUID
+const Key = "devices:gateways"
+
+// ChildrenKey - Redis set of child device UUIDs of the gateway
+func ChildrenKey(gateway string) string {
+	return Key + ":" + gateway
+}
+
+type Store struct {
+	rdb redis.Cmdable
+}
+
+func NewStore(rdb redis.Cmdable) *Store {
+	return &Store{rdb: rdb}
+}
+
+// Link - stores the child as linked to the gateway
+func (s *Store) Link(ctx context.Context, gateway, child string) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, Key, child, gateway)
+		pipe.SAdd(ctx, ChildrenKey(gateway), child)
+		return nil
+	})
+	return err
+}
+
+// Unlink - removes the child link to its gateway
+func (s *Store) Unlink(ctx context.Context, child string) error {
+	gateway, err := s.Gateway(ctx, child)
+	if err != nil || gateway == "" {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, Key, child)
+		pipe.SRem(ctx, ChildrenKey(gateway), child)
+		return nil
+	})
+	return err
+}
+
+// Restore - replaces all links with the given gateways by child, meant to fill Redis from the database on startup
+func (s *Store) Restore(ctx context.Context, links map[string]string) error {
+	old, err := s.rdb.HVals(ctx, Key).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{Key}
+	for _, gateway := range old {
+		keys = append(keys, ChildrenKey(gateway))
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		for child, gateway := range links {
+			pipe.HSet(ctx, Key, child, gateway)
+			pipe.SAdd(ctx, ChildrenKey(gateway), child)
+		}
+		return nil
+	})
+	return err
+}
+
+// Gateway - returns UUID of the gateway the child is linked to, empty if it isn't linked
+func (s *Store) Gateway(ctx context.Context, child string) (string, error) {
+	gateway, err := s.rdb.HGet(ctx, Key, child).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return gateway, err
+}
+
+// Children - returns UUIDs of devices linked to the gateway
+func (s *Store) Children(ctx context.Context, gateway string) ([]string, error) {
+	return s.rdb.SMembers(ctx, ChildrenKey(gateway)).Result()
+}
+
+// LoadFunc - fetches UUID of the gateway the child is linked to
+type LoadFunc func(ctx context.Context, child string) (string, error)
+
+type entry struct {
+	gateway string
+	expires time.Time
+}
+
+// Cache - keeps gateways of children for a limited time, entries are dropped once the child changes
+type Cache struct {
+	ttl  time.Duration
+	load LoadFunc
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func NewCache(ttl time.Duration, load LoadFunc) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		load:    load,
+		entries: make(map[string]entry),
+	}
+}
+
+// Gateway - returns cached gateway of the child, loads it if it's not cached or TTL has passed. Errors are not cached
+func (c *Cache) Gateway(ctx context.Context, child string) (string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[child]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.gateway, nil
+	}
+
+	gateway, err := c.load(ctx, child)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[child] = entry{
+		gateway: gateway,
+		expires: time.Now().Add(c.ttl),
+	}
+	return gateway, nil
+}
+
+// Invalidate - drops the child, so next Gateway loads it again
+func (c *Cache) Invalidate(child string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, child)
+}
+
+// IsChild - checks if the device is a child of the gateway, children can't be checked on errors
+func (c *Cache) IsChild(ctx context.Context, gateway, device string) (bool, error) {
+	if device == "" || device == gateway {
+		return false, nil
+	}
+	linked, err := c.Gateway(ctx, device)
+	if err != nil {
+		return false, err
+	}
+	return linked == gateway, nil
+}
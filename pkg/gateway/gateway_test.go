@@ -0,0 +1,124 @@
+package gateway_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/gateway"
+	"github.com/stretchr/testify/assert"
+)
+
+type cacheFixture struct {
+	cache *gateway.Cache
+	links map[string]string
+	loads int
+	err   error
+}
+
+func newCacheFixture(ttl time.Duration) (f *cacheFixture) {
+	f = &cacheFixture{links: map[string]string{"child": "gw"}}
+	f.cache = gateway.NewCache(ttl, func(ctx context.Context, child string) (string, error) {
+		f.loads++
+		if f.err != nil {
+			return "", f.err
+		}
+		return f.links[child], nil
+	})
+	return f
+}
+
+func TestCache_LoadsOnce(t *testing.T) {
+	f := newCacheFixture(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		gw, err := f.cache.Gateway(context.Background(), "child")
+		assert.NoError(t, err)
+		assert.Equal(t, "gw", gw)
+	}
+	assert.Equal(t, 1, f.loads)
+}
+
+func TestCache_DoesntCacheErrors(t *testing.T) {
+	f := newCacheFixture(time.Minute)
+	f.err = assert.AnError
+
+	_, err := f.cache.Gateway(context.Background(), "child")
+	assert.Equal(t, assert.AnError, err)
+
+	f.err = nil
+	gw, err := f.cache.Gateway(context.Background(), "child")
+	assert.NoError(t, err)
+	assert.Equal(t, "gw", gw)
+	assert.Equal(t, 2, f.loads)
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	f := newCacheFixture(time.Minute)
+
+	_, _ = f.cache.Gateway(context.Background(), "child")
+	delete(f.links, "child")
+	f.cache.Invalidate("child")
+
+	gw, err := f.cache.Gateway(context.Background(), "child")
+	assert.NoError(t, err)
+	assert.Empty(t, gw)
+	assert.Equal(t, 2, f.loads)
+}
+
+func TestCache_IsChild(t *testing.T) {
+	f := newCacheFixture(time.Minute)
+	ctx := context.Background()
+
+	ok, err := f.cache.IsChild(ctx, "gw", "child")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, _ = f.cache.IsChild(ctx, "other", "child")
+	assert.False(t, ok)
+
+	ok, _ = f.cache.IsChild(ctx, "gw", "unknown")
+	assert.False(t, ok)
+
+	// Gateway isn't a child of itself, nothing is loaded for it
+	loads := f.loads
+	ok, _ = f.cache.IsChild(ctx, "gw", "gw")
+	assert.False(t, ok)
+	assert.Equal(t, loads, f.loads)
+}
+
+func TestStore_Gateway(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	ctx := context.Background()
+	rdb.EXPECT().HGet(ctx, gateway.Key, "child").Return(redis.NewStringResult("gw", nil))
+	rdb.EXPECT().HGet(ctx, gateway.Key, "unknown").Return(redis.NewStringResult("", redis.Nil))
+
+	s := gateway.NewStore(rdb)
+	gw, err := s.Gateway(ctx, "child")
+	assert.NoError(t, err)
+	assert.Equal(t, "gw", gw)
+
+	gw, err = s.Gateway(ctx, "unknown")
+	assert.NoError(t, err)
+	assert.Empty(t, gw)
+}
+
+func TestStore_Unlink_NotLinked(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	ctx := context.Background()
+	rdb.EXPECT().HGet(ctx, gateway.Key, "child").Return(redis.NewStringResult("", redis.Nil))
+
+	assert.NoError(t, gateway.NewStore(rdb).Unlink(ctx, "child"))
+}
+
+func TestStore_Children(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	ctx := context.Background()
+	rdb.EXPECT().SMembers(ctx, gateway.ChildrenKey("gw")).Return(redis.NewStringSliceResult([]string{"child"}, nil))
+
+	children, err := gateway.NewStore(rdb).Children(ctx, "gw")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"child"}, children)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package graph
+
+import (
+	"context"
+	"crypto/x509"
+
+	"github.com/arangodb/go-driver"
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	"go.uber.org/zap"
+)
+
+// AuthorityDocument - built-in CA, keyed by deviceca.RootName or Namespace UUID
+type AuthorityDocument struct {
+	*deviceca.StoredCA
+	driver.DocumentMeta
+}
+
+// authoritiesStorage - deviceca.Storage in the Authorities Collection
+type authoritiesStorage struct {
+	col driver.Collection
+}
+
+func NewAuthoritiesStorage(db driver.Database) deviceca.Storage {
+	col, _ := db.Collection(context.TODO(), schema.AUTHORITIES_COL)
+	return &authoritiesStorage{col: col}
+}
+
+func (s *authoritiesStorage) Load(ctx context.Context, name string) (*deviceca.StoredCA, error) {
+	doc := AuthorityDocument{StoredCA: &deviceca.StoredCA{}}
+	_, err := s.col.ReadDocument(ctx, name, &doc)
+	if driver.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.StoredCA, nil
+}
+
+func (s *authoritiesStorage) Create(ctx context.Context, name string, ca *deviceca.StoredCA) error {
+	_, err := s.col.CreateDocument(ctx, AuthorityDocument{
+		StoredCA:     ca,
+		DocumentMeta: NewBlankDocument(schema.AUTHORITIES_COL, name),
+	})
+	if driver.IsConflict(err) {
+		return deviceca.ErrExists
+	}
+	return err
+}
+
+// trustRetries - TrustIntermediates gives up once the Namespace has been changed concurrently that many times in a row
+const trustRetries = 5
+
+// TrustIntermediates - deviceca.Authority OnIntermediate callback adding the intermediate to CAs trusted by its Namespace,
+// so MQTT Bridge verifies chains of issued certificates like of any other trusted CA.
+// Only the config is updated and only if the Namespace hasn't changed since it was read, otherwise it's read again
+func TrustIntermediates(log *zap.Logger, db driver.Database) func(context.Context, string, *x509.Certificate) error {
+	log = log.Named("TrustIntermediates")
+	col, _ := db.Collection(context.TODO(), schema.NAMESPACES_COL)
+
+	return func(ctx context.Context, namespace string, ca *x509.Certificate) error {
+		for attempt := 1; ; attempt++ {
+			ns := NewBlankNamespaceDocument(namespace)
+			meta, err := col.ReadDocument(ctx, namespace, ns)
+			if err != nil {
+				return err
+			}
+			config, changed, err := deviceca.Trust(ns.Config, ca)
+			if err != nil || !changed {
+				return err
+			}
+
+			uctx := driver.WithMergeObjects(driver.WithRevision(ctx, meta.Rev), false)
+			_, err = col.UpdateDocument(uctx, namespace, map[string]interface{}{"config": config})
+			if driver.IsPreconditionFailed(err) && attempt < trustRetries {
+				log.Debug("Namespace has changed meanwhile, retrying", zap.String("namespace", namespace), zap.Int("attempt", attempt))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			log.Info("Namespace trusts its built-in intermediate CA now", zap.String("namespace", namespace))
+			return nil
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package graph_test
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	"github.com/google/uuid"
+	driver_mocks "github.com/infinimesh/infinimesh/mocks/github.com/arangodb/go-driver"
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/graph"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newTrustIntermediatesFixture(t *testing.T) (*driver_mocks.MockCollection, func(context.Context, string, *x509.Certificate) error, *x509.Certificate) {
+	db := driver_mocks.NewMockDatabase(t)
+	col := driver_mocks.NewMockCollection(t)
+	db.On("Collection", context.TODO(), schema.NAMESPACES_COL).Return(col, nil)
+
+	authority, err := deviceca.NewAuthority(context.Background(), memoryAuthorities{}, []byte("secret"))
+	require.NoError(t, err)
+
+	return col, graph.TrustIntermediates(zap.NewNop(), db), authority.Root()
+}
+
+func TestTrustIntermediates_RetriesOn_Conflict(t *testing.T) {
+	col, trust, ca := newTrustIntermediatesFixture(t)
+	ns := uuid.New().String()
+
+	col.On("ReadDocument", mock.Anything, ns, mock.Anything).Return(driver.DocumentMeta{Key: ns, Rev: "1"}, nil).Once()
+	col.On("ReadDocument", mock.Anything, ns, mock.Anything).Return(driver.DocumentMeta{Key: ns, Rev: "2"}, nil).Once()
+	col.On("UpdateDocument", mock.Anything, ns, mock.Anything).
+		Return(driver.DocumentMeta{}, driver.ArangoError{HasError: true, Code: 412}).Once()
+	col.On("UpdateDocument", mock.Anything, ns, mock.MatchedBy(func(update map[string]interface{}) bool {
+		config, ok := update["config"].(*structpb.Struct)
+		return ok && config.GetFields()[deviceca.ConfigKey] != nil
+	})).Return(driver.DocumentMeta{}, nil).Once()
+
+	require.NoError(t, trust(context.Background(), ns, ca))
+	col.AssertNumberOfCalls(t, "UpdateDocument", 2)
+}
+
+func TestTrustIntermediates_FailsOn_PersistentConflict(t *testing.T) {
+	col, trust, ca := newTrustIntermediatesFixture(t)
+	ns := uuid.New().String()
+
+	col.On("ReadDocument", mock.Anything, ns, mock.Anything).Return(driver.DocumentMeta{Key: ns, Rev: "1"}, nil)
+	col.On("UpdateDocument", mock.Anything, ns, mock.Anything).
+		Return(driver.DocumentMeta{}, driver.ArangoError{HasError: true, Code: 412})
+
+	err := trust(context.Background(), ns, ca)
+	assert.True(t, driver.IsPreconditionFailed(err))
+}
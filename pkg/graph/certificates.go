@@ -0,0 +1,676 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package graph
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	access "github.com/infinimesh/proto/node/access"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Certificate states
+const (
+	// CertificateActive - Device can connect with the certificate
+	CertificateActive = "active"
+	// CertificatePending - Device can connect with the certificate, once it does the certificate becomes the primary one
+	// and the previous primary certificate is retired
+	CertificatePending = "pending"
+	// CertificateRetired - certificate is kept for the record, Device can't connect with it anymore
+	CertificateRetired = "retired"
+)
+
+// CertificateDocument - Device certificate keyed by hex encoded fingerprint, the primary one is also stored in the Device document.
+// Device can connect with active and pending certificates between NotBefore and NotAfter
+type CertificateDocument struct {
+	Device      string     `json:"device"`
+	PemData     string     `json:"pem_data"`
+	Algorithm   string     `json:"algorithm"`
+	Fingerprint []byte     `json:"fingerprint"`
+	NotBefore   time.Time  `json:"not_before"`
+	NotAfter    time.Time  `json:"not_after"`
+	Subject     string     `json:"subject"`
+	Issuer      string     `json:"issuer"`
+	Serial      string     `json:"serial"`
+	State       string     `json:"state"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+
+	// ExpiryNotified - last expiry event emitted for the certificate, see ExpiryWatcher
+	ExpiryNotified string `json:"expiry_notified,omitempty"`
+
+	// Primary - certificate is the one in the Device document, only set in responses
+	Primary bool `json:"primary,omitempty"`
+
+	driver.DocumentMeta
+}
+
+// StageCertificateRequest - PEM encoded certificate to add to the Device. Connection window defaults to the certificate validity
+// and can only be narrowed. Certificate is pending unless Activate is set, then it's active alongside the primary one
+type StageCertificateRequest struct {
+	Certificate string     `json:"certificate"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	Activate    bool       `json:"activate,omitempty"`
+}
+
+// findByFingerprintQuery - Certificates are looked up first, Devices by the primary certificate only if none matched,
+// both by persistent indexes, see schema.INDEXES
+const findByFingerprintQuery = `LET cert = FIRST(
+    FOR cert IN @@certificates
+    FILTER cert.fingerprint == @fingerprint && cert.state IN @states
+    FILTER DATE_TIMESTAMP(cert.not_before) <= @now && @now < DATE_TIMESTAMP(cert.not_after)
+    LIMIT 1
+    RETURN cert
+)
+LET key = cert ? cert.device : FIRST(
+    FOR device IN @@devices
+    FILTER device.certificate.fingerprint == @fingerprint
+    LIMIT 1
+    RETURN device._key
+)
+FOR device IN @@devices
+FILTER device._key == key
+RETURN device`
+
+// queryByFingerprint - reads Device having the certificate either as the primary one or as an active or pending one into v
+func queryByFingerprint(ctx context.Context, db driver.Database, fingerprint []byte, v interface{}) (driver.DocumentMeta, error) {
+	cr, err := db.Query(ctx, findByFingerprintQuery, map[string]interface{}{
+		"@devices":      schema.DEVICES_COL,
+		"@certificates": schema.CERTIFICATES_COL,
+		"fingerprint":   fingerprint,
+		"states":        []string{CertificateActive, CertificatePending},
+		"now":           time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return driver.DocumentMeta{}, err
+	}
+	defer cr.Close()
+
+	return cr.ReadDocument(ctx, v)
+}
+
+type CertificatesController struct {
+	InfinimeshBaseController
+
+	col     driver.Collection // Certificates Collection
+	dev_col driver.Collection // Devices Collection
+
+	ica_repo InfinimeshCommonActionsRepo // Infinimesh Common Actions Repository
+
+	rdb redis.Cmdable // Device changes are published here, nil disables notifications
+
+	authority *deviceca.Authority // Built-in CA, nil disables issuing certificates
+}
+
+func NewCertificatesController(log *zap.Logger, db driver.Database, ica InfinimeshCommonActionsRepo) *CertificatesController {
+	ctx := context.TODO()
+	col, _ := db.Collection(ctx, schema.CERTIFICATES_COL)
+	dev_col, _ := db.Collection(ctx, schema.DEVICES_COL)
+
+	return &CertificatesController{
+		InfinimeshBaseController: InfinimeshBaseController{
+			log: log.Named("CertificatesController"), db: db,
+		},
+		col: col, dev_col: dev_col,
+		ica_repo: ica,
+	}
+}
+
+// SetRedis - enables device changes notifications on rotation, see devcache.Notify
+func (c *CertificatesController) SetRedis(rdb redis.Cmdable) {
+	c.rdb = rdb
+}
+
+// SetAuthority - enables issuing Device certificates by the built-in CA
+func (c *CertificatesController) SetAuthority(authority *deviceca.Authority) {
+	c.authority = authority
+}
+
+// getDevice - Device with requestor access level, which must be at least lvl
+func getDevice(ctx context.Context, log *zap.Logger, ica InfinimeshCommonActionsRepo, uuid string, lvl access.Level) (*Device, error) {
+	requestor := ctx.Value(inf.InfinimeshAccountCtxKey).(string)
+	log.Debug("Requestor", zap.String("id", requestor))
+
+	device := NewBlankDeviceDocument(uuid)
+	if err := ica.AccessLevelAndGet(ctx, log, NewBlankAccountDocument(requestor), device); err != nil {
+		return nil, status.Error(codes.NotFound, "Device not found or not enough Access Rights")
+	}
+	if device.GetAccess().Level < lvl {
+		return nil, status.Error(codes.PermissionDenied, "Not enough Access Rights")
+	}
+	device.Uuid = uuid
+	return device, nil
+}
+
+const listDeviceCertificatesQuery = `FOR cert IN @@certificates
+FILTER cert.device == @device
+SORT cert.created_at
+RETURN cert`
+
+// List - all Device certificates, the primary one first
+func (c *CertificatesController) List(ctx context.Context, uuid string) ([]*CertificateDocument, error) {
+	log := c.log.Named("List")
+
+	device, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_MGMT)
+	if err != nil {
+		return nil, err
+	}
+
+	cr, err := c.db.Query(ctx, listDeviceCertificatesQuery, map[string]interface{}{
+		"@certificates": schema.CERTIFICATES_COL,
+		"device":        uuid,
+	})
+	if err != nil {
+		log.Warn("Error executing query", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error executing query")
+	}
+	defer cr.Close()
+
+	var primary *CertificateDocument
+	if cert := device.Certificate; cert != nil && len(cert.Fingerprint) > 0 {
+		primary = newCertificateDocument(uuid, cert, CertificateActive)
+		primary.Primary = true
+	}
+
+	r := []*CertificateDocument{}
+	if primary != nil {
+		r = append(r, primary)
+	}
+	for {
+		var cert CertificateDocument
+		_, err := cr.ReadDocument(ctx, &cert)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			log.Warn("Error unmarshalling Document", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Couldn't execute query")
+		}
+		if primary != nil && bytes.Equal(cert.Fingerprint, primary.Fingerprint) {
+			cert.Primary = true
+			r[0] = &cert
+			continue
+		}
+		r = append(r, &cert)
+	}
+	return r, nil
+}
+
+// newCertificateDocument - document for the Device certificate, window is the certificate validity
+func newCertificateDocument(device string, cert *devpb.Certificate, state string) *CertificateDocument {
+	key := hex.EncodeToString(cert.Fingerprint)
+	doc := &CertificateDocument{
+		Device:       device,
+		PemData:      cert.PemData,
+		Algorithm:    cert.Algorithm,
+		Fingerprint:  cert.Fingerprint,
+		State:        state,
+		DocumentMeta: NewBlankDocument(schema.CERTIFICATES_COL, key),
+	}
+	if parsed, err := parseCertificatePEM(cert.PemData); err == nil {
+		doc.NotBefore, doc.NotAfter = parsed.NotBefore, parsed.NotAfter
+		doc.Subject, doc.Issuer = parsed.Subject.String(), parsed.Issuer.String()
+		doc.Serial = parsed.SerialNumber.String()
+	}
+	return doc
+}
+
+// track - stores the primary Device certificate as active, so its expiry is tracked. Certificate stored already is left as is
+func (c *CertificatesController) track(ctx context.Context, device string, cert *devpb.Certificate) error {
+	if cert == nil || len(cert.Fingerprint) == 0 {
+		return nil
+	}
+	doc := newCertificateDocument(device, cert, CertificateActive)
+	doc.CreatedAt = time.Now()
+	_, err := c.col.CreateDocument(ctx, doc)
+	if driver.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+const listUntrackedCertificatesQuery = `FOR device IN @@devices
+FILTER device.certificate.fingerprint != null
+FILTER LENGTH(FOR cert IN @@certificates FILTER cert.fingerprint == device.certificate.fingerprint LIMIT 1 RETURN 1) == 0
+RETURN device`
+
+// Sync - stores primary certificates of Devices registered before certificates were tracked
+func (c *CertificatesController) Sync(ctx context.Context) error {
+	log := c.log.Named("Sync")
+
+	cr, err := c.db.Query(ctx, listUntrackedCertificatesQuery, map[string]interface{}{
+		"@devices":      schema.DEVICES_COL,
+		"@certificates": schema.CERTIFICATES_COL,
+	})
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	n := 0
+	for {
+		var device devpb.Device
+		meta, err := cr.ReadDocument(ctx, &device)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := c.track(ctx, meta.Key, device.Certificate); err != nil {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		log.Info("Device certificates are tracked now", zap.Int("certificates", n))
+	}
+	return nil
+}
+
+// Stage - adds certificate to the Device, requires Admin access to the Device
+func (c *CertificatesController) Stage(ctx context.Context, uuid string, req *StageCertificateRequest) (*CertificateDocument, error) {
+	log := c.log.Named("Stage")
+	log.Debug("Stage request received", zap.String("device", uuid))
+
+	device, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := parseCertificatePEM(req.Certificate)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Can't parse Certificate: %v", err)
+	}
+
+	now := time.Now()
+	cert := &devpb.Certificate{
+		PemData:     req.Certificate,
+		Algorithm:   "sha256",
+		Fingerprint: sha256Sum(parsed.Raw),
+	}
+	state := CertificatePending
+	if req.Activate {
+		state = CertificateActive
+	}
+	doc := newCertificateDocument(device.Uuid, cert, state)
+	doc.CreatedAt = now
+	if req.NotBefore != nil && req.NotBefore.After(doc.NotBefore) {
+		doc.NotBefore = *req.NotBefore
+	}
+	if req.NotAfter != nil && req.NotAfter.Before(doc.NotAfter) {
+		doc.NotAfter = *req.NotAfter
+	}
+	if !doc.NotAfter.After(doc.NotBefore) || !doc.NotAfter.After(now) {
+		return nil, status.Error(codes.InvalidArgument, "Certificate window is empty or over")
+	}
+
+	var other devpb.Device
+	_, err = queryByFingerprint(ctx, c.db, cert.Fingerprint, &other)
+	if err == nil {
+		return nil, status.Error(codes.AlreadyExists, "Certificate is already used by a Device")
+	}
+	if !driver.IsNoMoreDocuments(err) {
+		log.Warn("Error looking up Certificate", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error executing query")
+	}
+
+	meta, err := c.col.CreateDocument(ctx, doc)
+	if driver.IsConflict(err) {
+		return nil, status.Error(codes.AlreadyExists, "Certificate has been used already")
+	}
+	if err != nil {
+		log.Warn("Error creating Certificate", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while creating Certificate")
+	}
+	doc.DocumentMeta = meta
+	log.Info("Certificate staged", zap.String("device", device.Uuid), zap.String("fingerprint", meta.Key), zap.String("state", state))
+
+	return doc, nil
+}
+
+// IssueCertificateRequest - PEM encoded CSR, key pair is generated if it's empty
+type IssueCertificateRequest struct {
+	CSR string `json:"csr,omitempty"`
+}
+
+// IssuedCertificate - PEM encoded Device certificate followed by the CA chain, PrivateKey is only set if it was generated
+type IssuedCertificate struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	State       string `json:"state"`
+	Primary     bool   `json:"primary"`
+}
+
+// Issue - issues Device certificate by the built-in CA, requires Admin access to the Device.
+// Certificate becomes primary if the Device has none, otherwise it's staged as pending
+func (c *CertificatesController) Issue(ctx context.Context, uuid string, req *IssueCertificateRequest) (*IssuedCertificate, error) {
+	log := c.log.Named("Issue")
+	log.Debug("Issue request received", zap.String("device", uuid))
+
+	if c.authority == nil {
+		return nil, status.Error(codes.Unimplemented, "Built-in CA is disabled")
+	}
+
+	device, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	ns := device.GetAccess().GetNamespace()
+	if ns == "" {
+		return nil, status.Error(codes.FailedPrecondition, "Device doesn't belong to a Namespace")
+	}
+
+	var csr *x509.CertificateRequest
+	if req.CSR != "" {
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil {
+			return nil, status.Error(codes.InvalidArgument, "Can't decode CSR PEM data")
+		}
+		if csr, err = x509.ParseCertificateRequest(block.Bytes); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Can't parse CSR: %v", err)
+		}
+	}
+
+	issued, err := c.authority.Issue(ctx, ns, device.Uuid, csr)
+	if errors.Is(err, deviceca.ErrInvalidCSR) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		log.Warn("Error issuing Certificate", zap.String("namespace", ns), zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while issuing Certificate")
+	}
+	key, err := issued.KeyPEM()
+	if err != nil {
+		log.Warn("Error encoding key", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while issuing Certificate")
+	}
+
+	cert := &devpb.Certificate{
+		PemData:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issued.Certificate.Raw})),
+		Algorithm:   "sha256",
+		Fingerprint: sha256Sum(issued.Certificate.Raw),
+	}
+	res := &IssuedCertificate{
+		Certificate: issued.CertificatePEM(),
+		PrivateKey:  key,
+		Fingerprint: hex.EncodeToString(cert.Fingerprint),
+	}
+
+	if device.Certificate == nil || len(device.Certificate.Fingerprint) == 0 {
+		if _, err := c.dev_col.UpdateDocument(ctx, device.Uuid, map[string]interface{}{
+			"certificate": cert,
+		}); err != nil {
+			log.Warn("Error setting Device Certificate", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error while setting Device Certificate")
+		}
+		c.notify(ctx, log, device.Uuid)
+		if err := c.track(ctx, device.Uuid, cert); err != nil {
+			log.Warn("Error tracking Certificate", zap.Error(err))
+		}
+		res.State, res.Primary = CertificateActive, true
+	} else {
+		doc := newCertificateDocument(device.Uuid, cert, CertificatePending)
+		doc.CreatedAt = time.Now()
+		if _, err := c.col.CreateDocument(ctx, doc); err != nil {
+			log.Warn("Error creating Certificate", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error while creating Certificate")
+		}
+		res.State = CertificatePending
+	}
+	log.Info("Certificate issued", zap.String("device", device.Uuid), zap.String("fingerprint", res.Fingerprint), zap.String("state", res.State))
+
+	return res, nil
+}
+
+const findActiveCertificateQuery = `FOR cert IN @@certificates
+FILTER cert.device == @device && cert.state == @state && cert._key != @exclude
+FILTER DATE_TIMESTAMP(cert.not_before) <= @now && @now < DATE_TIMESTAMP(cert.not_after)
+SORT cert.not_after DESC
+LIMIT 1
+RETURN cert`
+
+// Retire - retires the Device certificate, requires Admin access to the Device.
+// Primary certificate can only be retired if there's another active one, which becomes primary then
+func (c *CertificatesController) Retire(ctx context.Context, uuid string, fingerprint string) (*CertificateDocument, error) {
+	log := c.log.Named("Retire")
+	log.Debug("Retire request received", zap.String("device", uuid), zap.String("fingerprint", fingerprint))
+
+	device, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert := device.Certificate; cert != nil && hex.EncodeToString(cert.Fingerprint) == fingerprint {
+		cr, err := c.db.Query(ctx, findActiveCertificateQuery, map[string]interface{}{
+			"@certificates": schema.CERTIFICATES_COL,
+			"device":        device.Uuid,
+			"state":         CertificateActive,
+			"exclude":       fingerprint,
+			"now":           time.Now().UnixMilli(),
+		})
+		if err != nil {
+			log.Warn("Error executing query", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error executing query")
+		}
+		defer cr.Close()
+
+		var next CertificateDocument
+		_, err = cr.ReadDocument(ctx, &next)
+		if driver.IsNoMoreDocuments(err) {
+			return nil, status.Error(codes.FailedPrecondition, "Can't retire the only active Certificate, stage a new one first")
+		}
+		if err != nil {
+			log.Warn("Error unmarshalling Document", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error executing query")
+		}
+
+		retired, err := c.rotate(ctx, log, device, &next)
+		if err != nil {
+			log.Warn("Error rotating Certificate", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error while retiring Certificate")
+		}
+		return retired, nil
+	}
+
+	var doc CertificateDocument
+	meta, err := c.col.ReadDocument(ctx, fingerprint, &doc)
+	if err != nil || doc.Device != device.Uuid {
+		return nil, status.Error(codes.NotFound, "Certificate not found")
+	}
+	doc.DocumentMeta = meta
+
+	now := time.Now()
+	if _, err := c.col.UpdateDocument(ctx, fingerprint, map[string]interface{}{
+		"state":      CertificateRetired,
+		"retired_at": now,
+	}); err != nil {
+		log.Warn("Error updating Certificate", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while retiring Certificate")
+	}
+	doc.State, doc.RetiredAt = CertificateRetired, &now
+	log.Info("Certificate retired", zap.String("device", device.Uuid), zap.String("fingerprint", fingerprint))
+
+	return &doc, nil
+}
+
+// Connected - tells the Device has connected with the certificate and proved it holds its key, requires Root access.
+// Pending certificate becomes the primary one then and the previous primary one is retired, other certificates are left as is.
+// Bridges call it only once the Device is fully authenticated, looking the Device up by fingerprint has no side effects
+func (c *CertificatesController) Connected(ctx context.Context, uuid string, fingerprint string) (*CertificateDocument, error) {
+	log := c.log.Named("Connected")
+	log.Debug("Connected request received", zap.String("device", uuid), zap.String("fingerprint", fingerprint))
+
+	device, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_ROOT)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc CertificateDocument
+	meta, err := c.col.ReadDocument(ctx, fingerprint, &doc)
+	if err != nil || doc.Device != device.Uuid {
+		return nil, status.Error(codes.NotFound, "Certificate not found")
+	}
+	doc.DocumentMeta = meta
+
+	if doc.State != CertificatePending {
+		return &doc, nil
+	}
+	if now := time.Now(); now.Before(doc.NotBefore) || !now.Before(doc.NotAfter) {
+		return nil, status.Error(codes.FailedPrecondition, "Certificate is outside of its connection window")
+	}
+
+	if _, err := c.rotate(ctx, log, device, &doc); err != nil {
+		log.Warn("Error rotating Certificate", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while rotating Certificate")
+	}
+	return &doc, nil
+}
+
+// notify - tells device caches the Device has changed, errors are only logged
+func (c *CertificatesController) notify(ctx context.Context, log *zap.Logger, device string) {
+	if c.rdb == nil {
+		return
+	}
+	if err := devcache.Notify(ctx, c.rdb, device); err != nil {
+		log.Warn("Error notifying about Device change", zap.String("device", device), zap.Error(err))
+	}
+}
+
+// rotate - makes next the primary Device certificate and retires the previous primary one, which is returned
+func (c *CertificatesController) rotate(ctx context.Context, log *zap.Logger, device *Device, next *CertificateDocument) (*CertificateDocument, error) {
+	cert := &devpb.Certificate{
+		PemData:     next.PemData,
+		Algorithm:   next.Algorithm,
+		Fingerprint: next.Fingerprint,
+	}
+	if _, err := c.dev_col.UpdateDocument(ctx, device.Uuid, map[string]interface{}{
+		"certificate": cert,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := c.col.UpdateDocument(ctx, next.Key, map[string]interface{}{
+		"state": CertificateActive,
+	}); err != nil {
+		return nil, err
+	}
+	next.State = CertificateActive
+
+	prev := device.Certificate
+	device.Certificate = cert
+	c.notify(ctx, log, device.Uuid)
+	log.Info("Certificate rotated", zap.String("device", device.Uuid), zap.String("fingerprint", next.Key))
+
+	if prev == nil || len(prev.Fingerprint) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	retired := newCertificateDocument(device.Uuid, prev, CertificateRetired)
+	retired.RetiredAt = &now
+	_, err := c.col.UpdateDocument(ctx, retired.Key, map[string]interface{}{
+		"state":      CertificateRetired,
+		"retired_at": now,
+	})
+	if driver.IsNotFound(err) {
+		retired.CreatedAt = now
+		_, err = c.col.CreateDocument(ctx, retired)
+	}
+	return retired, err
+}
+
+const removeDeviceCertificatesQuery = `FOR cert IN @@certificates
+FILTER cert.device == @device
+REMOVE cert IN @@certificates`
+
+// removeAll - removes all certificates of the deleted Device, errors are only logged
+func (c *CertificatesController) removeAll(ctx context.Context, log *zap.Logger, device string) {
+	cr, err := c.db.Query(ctx, removeDeviceCertificatesQuery, map[string]interface{}{
+		"@certificates": schema.CERTIFICATES_COL,
+		"device":        device,
+	})
+	if err != nil {
+		log.Warn("Error removing Device Certificates", zap.String("device", device), zap.Error(err))
+		return
+	}
+	cr.Close()
+}
+
+// Register - serves Device certificates over HTTP, certificates are referred to by hex encoded fingerprint:
+//
+//	GET  /devices/{uuid}/certificates                         -> []Certificate
+//	POST /devices/{uuid}/certificates                         StageCertificateRequest -> Certificate
+//	POST /devices/{uuid}/certificates/issue                   IssueCertificateRequest -> IssuedCertificate
+//	POST /devices/{uuid}/certificates/{fingerprint}/retire    -> Certificate
+//	POST /devices/{uuid}/certificates/{fingerprint}/connected -> Certificate
+func (c *CertificatesController) Register(router *mux.Router, authenticate func(http.Handler) http.Handler) {
+	router.Handle("/devices/{uuid}/certificates", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := c.List(r.Context(), mux.Vars(r)["uuid"])
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodGet)
+
+	router.Handle("/devices/{uuid}/certificates", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req StageCertificateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		res, err := c.Stage(r.Context(), mux.Vars(r)["uuid"], &req)
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodPost)
+
+	router.Handle("/devices/{uuid}/certificates/issue", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req IssueCertificateRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		res, err := c.Issue(r.Context(), mux.Vars(r)["uuid"], &req)
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodPost)
+
+	router.Handle("/devices/{uuid}/certificates/{fingerprint}/retire", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		res, err := c.Retire(r.Context(), vars["uuid"], vars["fingerprint"])
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodPost)
+
+	router.Handle("/devices/{uuid}/certificates/{fingerprint}/connected", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		res, err := c.Connected(r.Context(), vars["uuid"], vars["fingerprint"])
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,399 @@
+package graph_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/google/uuid"
+	driver_mocks "github.com/infinimesh/infinimesh/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/infinimesh/pkg/graph"
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/graph"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/proto/node/access"
+	devpb "github.com/infinimesh/proto/node/devices"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type certificatesControllerFixture struct {
+	ctrl *graph.CertificatesController
+
+	mocks struct {
+		db       *driver_mocks.MockDatabase
+		col      *driver_mocks.MockCollection
+		dev_col  *driver_mocks.MockCollection
+		cursor   *driver_mocks.MockCursor
+		ica_repo *graph_mocks.MockInfinimeshCommonActionsRepo
+	}
+
+	data struct {
+		ctx      context.Context
+		acc_uuid string
+		dev_uuid string
+
+		primary *devpb.Certificate
+		cert    string
+	}
+}
+
+func selfSigned(t *testing.T, notAfter time.Time) (string, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+	}, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(der)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), sum[:]
+}
+
+func newCertificatesControllerFixture(t *testing.T) *certificatesControllerFixture {
+	f := &certificatesControllerFixture{}
+
+	f.mocks.db = driver_mocks.NewMockDatabase(t)
+	f.mocks.col = driver_mocks.NewMockCollection(t)
+	f.mocks.dev_col = driver_mocks.NewMockCollection(t)
+	f.mocks.cursor = driver_mocks.NewMockCursor(t)
+	f.mocks.db.On("Collection", context.TODO(), schema.CERTIFICATES_COL).Return(f.mocks.col, nil)
+	f.mocks.db.On("Collection", context.TODO(), schema.DEVICES_COL).Return(f.mocks.dev_col, nil)
+	f.mocks.ica_repo = graph_mocks.NewMockInfinimeshCommonActionsRepo(t)
+
+	f.data.acc_uuid = uuid.New().String()
+	f.data.dev_uuid = uuid.New().String()
+	f.data.ctx = context.WithValue(context.Background(), inf.InfinimeshAccountCtxKey, f.data.acc_uuid)
+
+	pem, fingerprint := selfSigned(t, time.Now().Add(time.Hour))
+	f.data.primary = &devpb.Certificate{PemData: pem, Algorithm: "sha256", Fingerprint: fingerprint}
+	f.data.cert, _ = selfSigned(t, time.Now().Add(24*time.Hour))
+
+	f.ctrl = graph.NewCertificatesController(zap.NewExample(), f.mocks.db, f.mocks.ica_repo)
+
+	return f
+}
+
+func (f *certificatesControllerFixture) access(level access.Level) {
+	f.mocks.ica_repo.On("AccessLevelAndGet", f.data.ctx, mock.Anything, mock.Anything, mock.MatchedBy(func(d *graph.Device) bool {
+		d.Access = &access.Access{Level: level}
+		d.Certificate = f.data.primary
+		return true
+	})).Return(nil)
+}
+
+// Stage
+//
+
+func TestStage_FailsOn_NotEnoughAccess(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_MGMT)
+
+	_, err := f.ctrl.Stage(f.data.ctx, f.data.dev_uuid, &graph.StageCertificateRequest{Certificate: f.data.cert})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestStage_FailsOn_InvalidCertificate(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	_, err := f.ctrl.Stage(f.data.ctx, f.data.dev_uuid, &graph.StageCertificateRequest{Certificate: "garbage"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestStage_FailsOn_EmptyWindow(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	past := time.Now().Add(-time.Minute)
+	_, err := f.ctrl.Stage(f.data.ctx, f.data.dev_uuid, &graph.StageCertificateRequest{
+		Certificate: f.data.cert, NotAfter: &past,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestStage_FailsOn_CertificateInUse(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	f.mocks.db.On("Query", f.data.ctx, mock.Anything, mock.Anything).Return(f.mocks.cursor, nil)
+	f.mocks.cursor.On("ReadDocument", f.data.ctx, mock.Anything).Return(driver.DocumentMeta{}, nil)
+	f.mocks.cursor.On("Close").Return(nil)
+
+	_, err := f.ctrl.Stage(f.data.ctx, f.data.dev_uuid, &graph.StageCertificateRequest{Certificate: f.data.cert})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestStage_Success(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	f.mocks.db.On("Query", f.data.ctx, mock.Anything, mock.Anything).Return(f.mocks.cursor, nil)
+	f.mocks.cursor.On("ReadDocument", f.data.ctx, mock.Anything).Return(driver.DocumentMeta{}, driver.NoMoreDocumentsError{})
+	f.mocks.cursor.On("Close").Return(nil)
+	f.mocks.col.On("CreateDocument", f.data.ctx, mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		return doc.State == graph.CertificatePending && doc.Device == f.data.dev_uuid
+	})).Return(driver.DocumentMeta{Key: "key"}, nil)
+
+	notBefore := time.Now().Add(time.Hour)
+	res, err := f.ctrl.Stage(f.data.ctx, f.data.dev_uuid, &graph.StageCertificateRequest{
+		Certificate: f.data.cert, NotBefore: &notBefore,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, graph.CertificatePending, res.State)
+	assert.Equal(t, notBefore, res.NotBefore)
+	assert.Len(t, res.Fingerprint, 32)
+}
+
+// Retire
+//
+
+func TestRetire_FailsOn_OnlyActiveCertificate(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	f.mocks.db.On("Query", f.data.ctx, mock.Anything, mock.Anything).Return(f.mocks.cursor, nil)
+	f.mocks.cursor.On("ReadDocument", f.data.ctx, mock.Anything).Return(driver.DocumentMeta{}, driver.NoMoreDocumentsError{})
+	f.mocks.cursor.On("Close").Return(nil)
+
+	_, err := f.ctrl.Retire(f.data.ctx, f.data.dev_uuid, hex.EncodeToString(f.data.primary.Fingerprint))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestRetire_FailsOn_OtherDeviceCertificate(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	f.mocks.col.On("ReadDocument", f.data.ctx, "abc", mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		doc.Device = uuid.New().String()
+		return true
+	})).Return(driver.DocumentMeta{Key: "abc"}, nil)
+
+	_, err := f.ctrl.Retire(f.data.ctx, f.data.dev_uuid, "abc")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestRetire_Success(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	f.mocks.col.On("ReadDocument", f.data.ctx, "abc", mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		doc.Device = f.data.dev_uuid
+		doc.State = graph.CertificateActive
+		return true
+	})).Return(driver.DocumentMeta{Key: "abc"}, nil)
+	f.mocks.col.On("UpdateDocument", f.data.ctx, "abc", mock.Anything).Return(driver.DocumentMeta{}, nil)
+
+	res, err := f.ctrl.Retire(f.data.ctx, f.data.dev_uuid, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, graph.CertificateRetired, res.State)
+	assert.NotNil(t, res.RetiredAt)
+}
+
+func TestRetire_Primary_RotatesToActive(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	pem, fingerprint := selfSigned(t, time.Now().Add(time.Hour))
+	key := hex.EncodeToString(fingerprint)
+	f.mocks.db.On("Query", f.data.ctx, mock.Anything, mock.Anything).Return(f.mocks.cursor, nil)
+	f.mocks.cursor.On("ReadDocument", f.data.ctx, mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		doc.PemData, doc.Algorithm, doc.Fingerprint = pem, "sha256", fingerprint
+		doc.State = graph.CertificateActive
+		doc.DocumentMeta = driver.DocumentMeta{Key: key}
+		return true
+	})).Return(driver.DocumentMeta{Key: key}, nil)
+	f.mocks.cursor.On("Close").Return(nil)
+
+	f.mocks.dev_col.On("UpdateDocument", f.data.ctx, f.data.dev_uuid, map[string]interface{}{
+		"certificate": &devpb.Certificate{PemData: pem, Algorithm: "sha256", Fingerprint: fingerprint},
+	}).Return(driver.DocumentMeta{}, nil)
+	f.mocks.col.On("UpdateDocument", f.data.ctx, key, mock.Anything).Return(driver.DocumentMeta{}, nil)
+	f.mocks.col.On("UpdateDocument", f.data.ctx, hex.EncodeToString(f.data.primary.Fingerprint), mock.Anything).
+		Return(driver.DocumentMeta{}, driver.ArangoError{HasError: true, Code: 404})
+	f.mocks.col.On("CreateDocument", f.data.ctx, mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		return doc.State == graph.CertificateRetired
+	})).Return(driver.DocumentMeta{}, nil)
+
+	res, err := f.ctrl.Retire(f.data.ctx, f.data.dev_uuid, hex.EncodeToString(f.data.primary.Fingerprint))
+	require.NoError(t, err)
+	assert.Equal(t, graph.CertificateRetired, res.State)
+	assert.Equal(t, f.data.primary.Fingerprint, res.Fingerprint)
+}
+
+// Connected
+//
+
+func TestConnected_FailsOn_NotEnoughAccess(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ADMIN)
+
+	_, err := f.ctrl.Connected(f.data.ctx, f.data.dev_uuid, "abc")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestConnected_Active_KeepsPrimary(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ROOT)
+
+	f.mocks.col.On("ReadDocument", f.data.ctx, "abc", mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		doc.Device = f.data.dev_uuid
+		doc.State = graph.CertificateActive
+		return true
+	})).Return(driver.DocumentMeta{Key: "abc"}, nil)
+
+	res, err := f.ctrl.Connected(f.data.ctx, f.data.dev_uuid, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, graph.CertificateActive, res.State)
+	f.mocks.dev_col.AssertNotCalled(t, "UpdateDocument", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestConnected_Pending_Rotates(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	f.access(access.Level_ROOT)
+
+	pem, fingerprint := selfSigned(t, time.Now().Add(time.Hour))
+	key := hex.EncodeToString(fingerprint)
+	f.mocks.col.On("ReadDocument", f.data.ctx, key, mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		doc.Device = f.data.dev_uuid
+		doc.PemData, doc.Algorithm, doc.Fingerprint = pem, "sha256", fingerprint
+		doc.State = graph.CertificatePending
+		doc.NotBefore, doc.NotAfter = time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+		return true
+	})).Return(driver.DocumentMeta{Key: key}, nil)
+
+	f.mocks.dev_col.On("UpdateDocument", f.data.ctx, f.data.dev_uuid, map[string]interface{}{
+		"certificate": &devpb.Certificate{PemData: pem, Algorithm: "sha256", Fingerprint: fingerprint},
+	}).Return(driver.DocumentMeta{}, nil)
+	f.mocks.col.On("UpdateDocument", f.data.ctx, key, mock.Anything).Return(driver.DocumentMeta{}, nil)
+	f.mocks.col.On("UpdateDocument", f.data.ctx, hex.EncodeToString(f.data.primary.Fingerprint), mock.Anything).
+		Return(driver.DocumentMeta{}, nil)
+
+	res, err := f.ctrl.Connected(f.data.ctx, f.data.dev_uuid, key)
+	require.NoError(t, err)
+	assert.Equal(t, graph.CertificateActive, res.State)
+}
+
+// Issue
+//
+
+type memoryAuthorities map[string]*deviceca.StoredCA
+
+func (s memoryAuthorities) Load(_ context.Context, name string) (*deviceca.StoredCA, error) {
+	return s[name], nil
+}
+
+func (s memoryAuthorities) Create(_ context.Context, name string, ca *deviceca.StoredCA) error {
+	s[name] = ca
+	return nil
+}
+
+func TestIssue_FailsOn_Disabled(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+
+	_, err := f.ctrl.Issue(f.data.ctx, f.data.dev_uuid, &graph.IssueCertificateRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestIssue_SetsPrimary(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	ns := uuid.New().String()
+	f.mocks.ica_repo.On("AccessLevelAndGet", f.data.ctx, mock.Anything, mock.Anything, mock.MatchedBy(func(d *graph.Device) bool {
+		d.Access = &access.Access{Level: access.Level_ADMIN, Namespace: &ns}
+		return true
+	})).Return(nil)
+
+	authority, err := deviceca.NewAuthority(context.Background(), memoryAuthorities{}, []byte("secret"))
+	require.NoError(t, err)
+	f.ctrl.SetAuthority(authority)
+
+	var cert *devpb.Certificate
+	f.mocks.dev_col.On("UpdateDocument", f.data.ctx, f.data.dev_uuid, mock.MatchedBy(func(patch map[string]interface{}) bool {
+		cert = patch["certificate"].(*devpb.Certificate)
+		return true
+	})).Return(driver.DocumentMeta{}, nil)
+	var tracked *graph.CertificateDocument
+	f.mocks.col.On("CreateDocument", f.data.ctx, mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		tracked = doc
+		return true
+	})).Return(driver.DocumentMeta{}, nil)
+
+	res, err := f.ctrl.Issue(f.data.ctx, f.data.dev_uuid, &graph.IssueCertificateRequest{})
+	require.NoError(t, err)
+	assert.True(t, res.Primary)
+	assert.Equal(t, graph.CertificateActive, tracked.State)
+	assert.Equal(t, res.Fingerprint, tracked.Key)
+	assert.Contains(t, tracked.Subject, f.data.dev_uuid)
+	assert.NotEmpty(t, tracked.Issuer)
+	assert.NotEmpty(t, tracked.Serial)
+	assert.False(t, tracked.NotAfter.IsZero())
+	assert.Equal(t, graph.CertificateActive, res.State)
+	assert.NotEmpty(t, res.PrivateKey)
+	assert.Equal(t, hex.EncodeToString(cert.Fingerprint), res.Fingerprint)
+
+	chain, err := deviceca.ParsePEM([]byte(res.Certificate))
+	require.NoError(t, err)
+	require.Len(t, chain, 3)
+	assert.Equal(t, f.data.dev_uuid, chain[0].Subject.CommonName)
+}
+
+func TestIssue_FailsOn_InvalidCSR(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	ns := uuid.New().String()
+	f.mocks.ica_repo.On("AccessLevelAndGet", f.data.ctx, mock.Anything, mock.Anything, mock.MatchedBy(func(d *graph.Device) bool {
+		d.Access = &access.Access{Level: access.Level_ADMIN, Namespace: &ns}
+		return true
+	})).Return(nil)
+
+	authority, err := deviceca.NewAuthority(context.Background(), memoryAuthorities{}, []byte("secret"))
+	require.NoError(t, err)
+	f.ctrl.SetAuthority(authority)
+
+	_, err = f.ctrl.Issue(f.data.ctx, f.data.dev_uuid, &graph.IssueCertificateRequest{CSR: f.data.cert})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// Sync
+//
+
+func TestSync_TracksPrimaryCertificates(t *testing.T) {
+	f := newCertificatesControllerFixture(t)
+	ctx := context.Background()
+
+	f.mocks.db.On("Query", ctx, mock.Anything, mock.Anything).Return(f.mocks.cursor, nil)
+	f.mocks.cursor.On("ReadDocument", ctx, mock.MatchedBy(func(d *devpb.Device) bool {
+		d.Certificate = f.data.primary
+		return true
+	})).Return(driver.DocumentMeta{Key: f.data.dev_uuid}, nil).Once()
+	f.mocks.cursor.On("ReadDocument", ctx, mock.Anything).Return(driver.DocumentMeta{}, driver.NoMoreDocumentsError{})
+	f.mocks.cursor.On("Close").Return(nil)
+
+	f.mocks.col.On("CreateDocument", ctx, mock.MatchedBy(func(doc *graph.CertificateDocument) bool {
+		return doc.Device == f.data.dev_uuid && doc.State == graph.CertificateActive &&
+			doc.Key == hex.EncodeToString(f.data.primary.Fingerprint) && doc.Subject == "CN=device"
+	})).Return(driver.DocumentMeta{}, driver.ArangoError{HasError: true, Code: 409})
+
+	assert.NoError(t, f.ctrl.Sync(ctx))
+}
@@ -198,17 +198,23 @@ func (r *infinimeshCommonActionsRepo) Move(ctx context.Context, c InfinimeshCont
 	return nil
 }
 
+// Paths through gateway to child Device links grant the link level at most and only count if there's no other path,
+// Namespace of such path is the gateway one
 const getWithAccessLevelRoleAndNS = `
 FOR path IN OUTBOUND K_SHORTEST_PATHS @account TO @node
-GRAPH @permissions SORT path.edges[0].level DESC
+GRAPH @permissions
+    LET link = IS_SAME_COLLECTION(@dev2dev, path.edges[-1]) ? path.edges[-1] : null
     LET perm = path.edges[0]
-    LET last = path.edges[-1]
+    LET last = link ? path.edges[-2] : path.edges[-1]
+    LET level = last.role == 2 ? last.level : perm.level
+    SORT link ? 1 : 0, perm.level DESC
+    LIMIT 1
 	RETURN MERGE(
 	    path.vertices[-1], {
 	        access: {
-	            level: last.role == 2 ? last.level : perm.level,
-	            role: last.role == 2 ? last.role : perm.role,
-	            namespace: path.vertices[-2]._key
+	            level: link ? MIN([level, link.level]) : level,
+	            role: link ? link.role : last.role == 2 ? last.role : perm.role,
+	            namespace: path.vertices[link ? -3 : -2]._key
 	        }
 	    }
     )
@@ -219,6 +225,7 @@ func (r *infinimeshCommonActionsRepo) AccessLevelAndGet(ctx context.Context, log
 		"account":     account.ID(),
 		"node":        node.ID(),
 		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"dev2dev":     schema.DEV2DEV,
 	}
 	c, err := r.db.Query(ctx, getWithAccessLevelRoleAndNS, vars)
 	if err != nil {
@@ -243,21 +250,26 @@ func (r *infinimeshCommonActionsRepo) AccessLevelAndGet(ctx context.Context, log
 	return nil
 }
 
+// Objects reached through gateway to child Device links are listed with the link level at most,
+// same as shared ones they have no Namespace, but are filtered by the gateway one
 const listObjectsOfKind = `
 FOR node, edge, path IN 0..@depth OUTBOUND @from
 GRAPH @permissions_graph
 OPTIONS {order: "bfs", uniqueVertices: "global"}
 FILTER IS_SAME_COLLECTION(@@kind, node)
 FILTER edge.level > 0
+    LET link = edge && IS_SAME_COLLECTION(@dev2dev, edge) ? edge : null
+    LET ns = path.vertices[link ? -3 : -2]
 %s
     LET perm = path.edges[0]
-    LET last = path.edges[-1]
+    LET last = link ? path.edges[-2] : path.edges[-1]
+    LET level = last.role == 2 ? last.level : perm.level
 	RETURN MERGE(node, {
 	    uuid: node._key,
 	    access: {
-	        level: last.role == 2 ? last.level : perm.level,
-	        role:  last.role == 2 ? last.role : perm.role,
-	        namespace: last.role == 2 ? null : path.vertices[-2]._key
+	        level: link ? MIN([level, link.level]) : level,
+	        role:  link ? link.role : last.role == 2 ? last.role : perm.role,
+	        namespace: link || last.role == 2 ? null : ns._key
 	     }
 	    }
     )
@@ -275,13 +287,20 @@ func (r *infinimeshCommonActionsRepo) ListQuery(ctx context.Context, log *zap.Lo
 		"depth":             DepthValue(ctx),
 		"from":              from.ID(),
 		"permissions_graph": schema.PERMISSIONS_GRAPH.Name,
+		"dev2dev":           schema.DEV2DEV,
 		"@kind":             children,
 	}
 	log.Debug("Ready to build query", zap.Any("bindVars", bindVars))
 
 	filters := ""
 	if ns := NSFilterValue(ctx); ns != "" {
-		filters += fmt.Sprintf("FILTER path.vertices[-2]._key == \"%s\"\n", ns)
+		filters += fmt.Sprintf("FILTER ns._key == \"%s\"\n", ns)
+	}
+	if before := ExpiringFilterValue(ctx); before > 0 {
+		filters += fmt.Sprintf(
+			"FILTER LENGTH(FOR cert IN %s FILTER cert.device == node._key && cert.state == \"%s\" && DATE_TIMESTAMP(cert.not_after) <= %d LIMIT 1 RETURN 1) > 0\n",
+			schema.CERTIFICATES_COL, CertificateActive, before,
+		)
 	}
 
 	return r.db.Query(ctx, fmt.Sprintf(listObjectsOfKind, filters), bindVars)
@@ -408,7 +427,10 @@ const getWithAccessLevelQuery = `
 FOR path IN OUTBOUND
 K_SHORTEST_PATHS @requestor TO @node
 GRAPH @permissions
-    RETURN path.edges[-1].role == 2 ? path.edges[-1].level : path.edges[0].level
+    LET link = IS_SAME_COLLECTION(@dev2dev, path.edges[-1]) ? path.edges[-1] : null
+    LET last = link ? path.edges[-2] : path.edges[-1]
+    LET level = last.role == 2 ? last.level : path.edges[0].level
+    RETURN link ? MIN([level, link.level]) : level
 `
 
 func (r *infinimeshCommonActionsRepo) AccessLevel(ctx context.Context, requestor InfinimeshGraphNode, node InfinimeshGraphNode) (bool, access.Level) {
@@ -419,6 +441,7 @@ func (r *infinimeshCommonActionsRepo) AccessLevel(ctx context.Context, requestor
 		"requestor":   requestor.ID(),
 		"node":        node.ID(),
 		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"dev2dev":     schema.DEV2DEV,
 	})
 	if err != nil {
 		return false, 0
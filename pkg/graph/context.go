@@ -1,6 +1,9 @@
 package graph
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type GraphContextKey[T any] struct {
 	Key     string
@@ -38,3 +41,20 @@ func NSFilterValue(ctx context.Context) string {
 	}
 	return NamespaceFilterKey.Default
 }
+
+var ExpiringFilterKey = GraphContextKey[int64]{
+	Key:     "expiring-filter",
+	Default: 0,
+}
+
+// WithExpiringFilter - lists only Devices with active certificates expiring before the time
+func WithExpiringFilter(ctx context.Context, before time.Time) context.Context {
+	return context.WithValue(ctx, ExpiringFilterKey, before.UnixMilli())
+}
+
+func ExpiringFilterValue(ctx context.Context) int64 {
+	if v := ctx.Value(ExpiringFilterKey); v != nil {
+		return v.(int64)
+	}
+	return ExpiringFilterKey.Default
+}
@@ -22,10 +22,14 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/arangodb/go-driver"
+	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
 	"github.com/infinimesh/infinimesh/pkg/graph/schema"
 	inf "github.com/infinimesh/infinimesh/pkg/shared"
 	"github.com/infinimesh/proto/handsfree"
@@ -81,6 +85,10 @@ func NewDeviceFromPB(dev *devpb.Device) (res *Device) {
 	}
 }
 
+// ExpiringWithinHeader - Devices.List request header, lists only Devices with active certificates expiring within the number of days
+// (or expired already)
+const ExpiringWithinHeader = "Infinimesh-Expiring-Within"
+
 type DevicesController struct {
 	InfinimeshBaseController
 
@@ -92,6 +100,11 @@ type DevicesController struct {
 
 	ica_repo InfinimeshCommonActionsRepo // Infinimesh Common Actions Repository
 
+	rdb redis.Cmdable // Device changes are published here, nil disables notifications
+
+	certs    *CertificatesController // Device certificates are tracked with it, nil disables tracking
+	gateways *GatewaysController     // Gateway links of deleted Devices are removed with it
+
 	SIGNING_KEY []byte
 }
 
@@ -117,6 +130,41 @@ func NewDevicesController(
 	}
 }
 
+// SetRedis - enables device changes notifications, see devcache.Notify
+func (c *DevicesController) SetRedis(rdb redis.Cmdable) {
+	c.rdb = rdb
+}
+
+// SetCertificates - enables tracking Device certificates and removing them along with deleted Devices
+func (c *DevicesController) SetCertificates(certs *CertificatesController) {
+	c.certs = certs
+}
+
+// SetGateways - enables removing Gateway links of deleted Devices
+func (c *DevicesController) SetGateways(gateways *GatewaysController) {
+	c.gateways = gateways
+}
+
+// track - stores the Device certificate, so its expiry is tracked, errors are only logged
+func (c *DevicesController) track(ctx context.Context, log *zap.Logger, device string, cert *devpb.Certificate) {
+	if c.certs == nil {
+		return
+	}
+	if err := c.certs.track(ctx, device, cert); err != nil {
+		log.Warn("Error tracking Device Certificate", zap.String("device", device), zap.Error(err))
+	}
+}
+
+// notify - tells device caches (e.g. in MQTT Bridge) the device has changed, errors are only logged
+func (c *DevicesController) notify(ctx context.Context, log *zap.Logger, device string) {
+	if c.rdb == nil {
+		return
+	}
+	if err := devcache.Notify(ctx, c.rdb, device); err != nil {
+		log.Warn("Error notifying about Device change", zap.String("device", device), zap.Error(err))
+	}
+}
+
 func sha256Fingerprint(cert *devpb.Certificate) (err error) {
 	if cert == nil {
 		return errors.New("certificate is nil")
@@ -191,6 +239,7 @@ func (c *DevicesController) Create(ctx context.Context, _req *connect.Request[de
 		c.col.RemoveDocument(ctx, device.Uuid)
 		return nil, status.Error(codes.Internal, "error creating Permission")
 	}
+	c.track(ctx, log, device.Uuid, device.Certificate)
 
 	return connect.NewResponse(&devpb.CreateResponse{
 		Device: device.Device,
@@ -278,6 +327,7 @@ func (c *DevicesController) _HandsfreeCreate(ctx context.Context, req *devpb.Cre
 		log.Warn("Couldn't set Device Certificate", zap.Error(err))
 		return cleanup(err)
 	}
+	c.track(ctx, log, device.Uuid, dev.Certificate)
 
 	return connect.NewResponse(&devpb.CreateResponse{
 		Device: dev,
@@ -310,6 +360,7 @@ func (c *DevicesController) Update(ctx context.Context, req *connect.Request[dev
 		log.Warn("Error updating Device", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Error while updating Device")
 	}
+	c.notify(ctx, log, dev.Uuid)
 
 	return curr, nil
 }
@@ -335,6 +386,7 @@ func (c *DevicesController) PatchConfig(ctx context.Context, req *connect.Reques
 		log.Warn("Error updating Device config", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Error while updating Device config")
 	}
+	c.notify(ctx, log, dev.Uuid)
 
 	return curr, nil
 }
@@ -359,6 +411,7 @@ func (c *DevicesController) Toggle(ctx context.Context, req *connect.Request[dev
 		log.Warn("Error updating Device", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Error while updating Device")
 	}
+	c.notify(ctx, log, dev.Uuid)
 
 	return curr, nil
 }
@@ -383,6 +436,7 @@ func (c *DevicesController) ToggleBasic(ctx context.Context, req *connect.Reques
 		log.Warn("Error updating Device", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Error while updating Device")
 	}
+	c.notify(ctx, log, dev.Uuid)
 
 	return curr, nil
 }
@@ -459,6 +513,13 @@ func (c *DevicesController) List(ctx context.Context, req *connect.Request[pb.Qu
 	if q.GetNamespace() != "" {
 		ctx = WithNamespaceFilter(ctx, q.GetNamespace())
 	}
+	if v := req.Header().Get(ExpiringWithinHeader); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s must be a number of days", ExpiringWithinHeader)
+		}
+		ctx = WithExpiringFilter(ctx, time.Now().Add(time.Duration(days)*24*time.Hour))
+	}
 
 	cr, err := c.ica_repo.ListQuery(ctx, log, NewBlankAccountDocument(requestor), schema.DEVICES_COL)
 	if err != nil {
@@ -513,6 +574,13 @@ func (c *DevicesController) Delete(ctx context.Context, _req *connect.Request[de
 		log.Warn("Error removing document", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Error while deleting Device")
 	}
+	c.notify(ctx, log, dev.ID().Key())
+	if c.certs != nil {
+		c.certs.removeAll(ctx, log, dev.ID().Key())
+	}
+	if c.gateways != nil {
+		c.gateways.removeAll(ctx, log, dev.ID().Key())
+	}
 
 	err = c.ica_repo.Link(
 		ctx, log, c.ns2dev,
@@ -526,10 +594,6 @@ func (c *DevicesController) Delete(ctx context.Context, _req *connect.Request[de
 	return connect.NewResponse(&pb.DeleteResponse{}), nil
 }
 
-const findByFingerprintQuery = `FOR device IN @@devices
-FILTER device.certificate.fingerprint == @fingerprint
-RETURN device`
-
 func (c *DevicesController) GetByFingerprint(ctx context.Context, req *connect.Request[devpb.GetByFingerprintRequest]) (*connect.Response[devpb.Device], error) {
 	log := c.log.Named("GetByFingerprint")
 	log.Debug("GetByFingerprint request received", zap.Any("request", req), zap.Any("context", ctx))
@@ -537,22 +601,13 @@ func (c *DevicesController) GetByFingerprint(ctx context.Context, req *connect.R
 	requestor := ctx.Value(inf.InfinimeshAccountCtxKey).(string)
 	log.Debug("Requestor", zap.String("id", requestor))
 
-	cr, err := c.db.Query(ctx, findByFingerprintQuery, map[string]interface{}{
-		"@devices":    schema.DEVICES_COL,
-		"fingerprint": req.Msg.GetFingerprint(),
-	})
-	if err != nil {
-		return nil, status.Error(codes.Internal, "Error executing query")
-	}
-	defer cr.Close()
-
-	var r devpb.Device
-	meta, err := cr.ReadDocument(ctx, &r)
+	r := &devpb.Device{}
+	meta, err := queryByFingerprint(ctx, c.db, req.Msg.GetFingerprint(), r)
 	if driver.IsNoMoreDocuments(err) {
 		return nil, status.Error(codes.NotFound, "Device not found")
 	}
 	if err != nil {
-		log.Warn("Error unmarshalling Document", zap.Error(err))
+		log.Warn("Error executing query", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Error executing query")
 	}
 	r.Uuid = meta.ID.Key()
@@ -565,7 +620,7 @@ func (c *DevicesController) GetByFingerprint(ctx context.Context, req *connect.R
 	}
 	r.Token = token
 
-	return connect.NewResponse(&r), nil
+	return connect.NewResponse(r), nil
 }
 
 func (c *DevicesController) MakeDevicesToken(ctx context.Context, _req *connect.Request[pb.DevicesTokenRequest]) (*connect.Response[pb.TokenResponse], error) {
@@ -616,6 +671,7 @@ const listDeviceJoinsQuery = `
 FOR node, edge, path IN 1 INBOUND @device
 GRAPH Permissions
 FILTER edge.level > 0 && edge.role != 1
+FILTER !IS_SAME_COLLECTION(@dev2dev, edge)
 RETURN {
     node: node._id,
     access: KEEP(edge, ["level", "role"])
@@ -641,7 +697,8 @@ func (c *DevicesController) Joins(ctx context.Context, req *connect.Request[devp
 	}
 
 	cr, err := c.db.Query(ctx, listDeviceJoinsQuery, map[string]interface{}{
-		"device": NewBlankDeviceDocument(dev.Uuid).ID(),
+		"device":  NewBlankDeviceDocument(dev.Uuid).ID(),
+		"dev2dev": schema.DEV2DEV,
 	})
 	if err != nil {
 		log.Warn("Error querying for joins", zap.Error(err))
@@ -3,14 +3,18 @@ package graph_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/arangodb/go-driver"
 	"github.com/go-faker/faker/v4"
+	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	driver_mocks "github.com/infinimesh/infinimesh/mocks/github.com/arangodb/go-driver"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
 	graph_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/infinimesh/pkg/graph"
 	handsfree_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/proto/handsfree"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
 	"github.com/infinimesh/infinimesh/pkg/graph"
 	"github.com/infinimesh/infinimesh/pkg/graph/schema"
 	inf "github.com/infinimesh/infinimesh/pkg/shared"
@@ -559,6 +563,32 @@ func TestDelete_Success(t *testing.T) {
 	assert.NotNil(t, res)
 }
 
+func TestDelete_NotifiesDeviceChange(t *testing.T) {
+	f := newDevicesControllerFixture(t)
+	rdb := redis_mocks.NewMockCmdable(t)
+	f.ctrl.SetRedis(rdb)
+
+	f.mocks.ica_repo.On("AccessLevelAndGet", f.data.ctx, mock.Anything, mock.Anything, mock.MatchedBy(func(d *graph.Device) bool {
+		d.Access = &access.Access{
+			Level:     access.Level_ADMIN,
+			Namespace: &f.data.ns_uuid,
+		}
+		return true
+	})).Return(nil)
+
+	f.mocks.col.On("RemoveDocument", f.data.ctx, f.data.dev_uuid).Return(driver.DocumentMeta{}, nil)
+	f.mocks.ica_repo.On(
+		"Link", f.data.ctx, mock.Anything, f.mocks.ns2dev,
+		mock.Anything, mock.Anything, access.Level_NONE, access.Role_UNSET,
+	).Return(nil)
+	rdb.EXPECT().Publish(f.data.ctx, devcache.Channel, f.data.dev_uuid).Return(redis.NewIntCmd(f.data.ctx))
+
+	_, err := f.ctrl.Delete(f.data.ctx, connect.NewRequest(&devpb.Device{
+		Uuid: f.data.dev_uuid,
+	}))
+	assert.NoError(t, err)
+}
+
 // MakeDevicesToken
 //
 
@@ -665,3 +695,33 @@ func TestPatchConfig_FailsOn_NoAccess(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, res)
 }
+
+// List
+//
+
+func TestList_FailsOn_InvalidExpiringWithin(t *testing.T) {
+	f := newDevicesControllerFixture(t)
+
+	req := connect.NewRequest(&node.QueryRequest{})
+	req.Header().Set(graph.ExpiringWithinHeader, "soon")
+	res, err := f.ctrl.List(f.data.ctx, req)
+
+	assert.Nil(t, res)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestList_FiltersBy_ExpiringWithin(t *testing.T) {
+	f := newDevicesControllerFixture(t)
+
+	before := time.Now().Add(7 * 24 * time.Hour).UnixMilli()
+	f.mocks.ica_repo.On("ListQuery", mock.MatchedBy(func(ctx context.Context) bool {
+		v := graph.ExpiringFilterValue(ctx)
+		return v >= before && v < before+time.Minute.Milliseconds()
+	}), mock.Anything, mock.Anything, schema.DEVICES_COL).Return(nil, assert.AnError)
+
+	req := connect.NewRequest(&node.QueryRequest{})
+	req.Header().Set(graph.ExpiringWithinHeader, "7")
+	_, err := f.ctrl.List(f.data.ctx, req)
+
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -0,0 +1,191 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package graph
+
+import (
+	"context"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	devpb "github.com/infinimesh/proto/node/devices"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// CertificateExpiringEvent - name of the device event emitted for certificates expiring soon or expired already
+const CertificateExpiringEvent = "certificate_expiring"
+
+// Expiry stages, each emits the event once per certificate
+const (
+	expiryStageExpiring = "expiring"
+	expiryStageExpired  = "expired"
+)
+
+var CertificatesExpiringSoon = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "repo_device_certificates_expiring_soon",
+	Help: "The number of active device certificates expiring within the window, per namespace",
+}, []string{"namespace"})
+
+// ExpiryWatcher - periodically looks for active device certificates expiring within the window,
+// logs them, emits device events and updates the metrics
+type ExpiryWatcher struct {
+	log *zap.Logger
+	db  driver.Database
+	col driver.Collection
+
+	within time.Duration
+
+	// Publish - delivers the event, e.g. to the plugins exchange. Events are only logged if not set
+	Publish func(ctx context.Context, device *devpb.Device, event *pb.Shadow) error
+}
+
+func NewExpiryWatcher(log *zap.Logger, db driver.Database, within time.Duration) *ExpiryWatcher {
+	col, _ := db.Collection(context.TODO(), schema.CERTIFICATES_COL)
+	return &ExpiryWatcher{
+		log: log.Named("ExpiryWatcher"), db: db, col: col, within: within,
+	}
+}
+
+type expiringCertificate struct {
+	*CertificateDocument
+	Namespace string   `json:"namespace"`
+	Tags      []string `json:"tags"`
+}
+
+const listExpiringCertificatesQuery = `FOR cert IN @@certificates
+FILTER cert.state == @active && DATE_TIMESTAMP(cert.not_after) <= @before
+LET device = DOCUMENT(@@devices, cert.device)
+FILTER device
+LET namespace = FIRST(
+    FOR ns, edge IN 1 INBOUND device @@ns2dev
+    FILTER edge.role == 1
+    RETURN ns._key
+)
+RETURN MERGE(cert, { namespace, tags: device.tags })`
+
+// Check - emits events for certificates entering the window or expiring since the last check
+func (w *ExpiryWatcher) Check(ctx context.Context) error {
+	now := time.Now()
+	cr, err := w.db.Query(ctx, listExpiringCertificatesQuery, map[string]interface{}{
+		"@certificates": schema.CERTIFICATES_COL,
+		"@devices":      schema.DEVICES_COL,
+		"@ns2dev":       schema.NS2DEV,
+		"active":        CertificateActive,
+		"before":        now.Add(w.within).UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	expiring := map[string]float64{}
+	for {
+		cert := expiringCertificate{CertificateDocument: &CertificateDocument{}}
+		_, err := cr.ReadDocument(ctx, &cert)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		stage := expiryStageExpired
+		if cert.NotAfter.After(now) {
+			stage = expiryStageExpiring
+			expiring[cert.Namespace]++
+		}
+		if cert.ExpiryNotified == stage {
+			continue
+		}
+		w.notify(ctx, now, &cert, stage)
+	}
+
+	CertificatesExpiringSoon.Reset()
+	for ns, n := range expiring {
+		CertificatesExpiringSoon.WithLabelValues(ns).Set(n)
+	}
+	return nil
+}
+
+func (w *ExpiryWatcher) notify(ctx context.Context, now time.Time, cert *expiringCertificate, stage string) {
+	log := w.log.With(
+		zap.String("device", cert.Device), zap.String("namespace", cert.Namespace),
+		zap.String("fingerprint", cert.Key), zap.Time("not_after", cert.NotAfter),
+	)
+	if stage == expiryStageExpired {
+		log.Warn("Device certificate expired")
+	} else {
+		log.Warn("Device certificate expires soon")
+	}
+
+	if w.Publish != nil {
+		device := &devpb.Device{Uuid: cert.Device, Tags: cert.Tags}
+		if err := w.Publish(ctx, device, expiryEvent(now, cert, stage)); err != nil {
+			log.Warn("Error publishing expiry event", zap.Error(err))
+			return
+		}
+	}
+
+	_, err := w.col.UpdateDocument(ctx, cert.Key, map[string]interface{}{"expiry_notified": stage})
+	if err != nil {
+		log.Warn("Error storing expiry notification", zap.Error(err))
+	}
+}
+
+func expiryEvent(now time.Time, cert *expiringCertificate, stage string) *pb.Shadow {
+	details := map[string]*structpb.Value{
+		"fingerprint": structpb.NewStringValue(cert.Key),
+		"not_after":   structpb.NewStringValue(cert.NotAfter.UTC().Format(time.RFC3339)),
+		"days_left":   structpb.NewNumberValue(float64(int(cert.NotAfter.Sub(now).Hours() / 24))),
+		"subject":     structpb.NewStringValue(cert.Subject),
+		"issuer":      structpb.NewStringValue(cert.Issuer),
+		"serial":      structpb.NewStringValue(cert.Serial),
+		"namespace":   structpb.NewStringValue(cert.Namespace),
+		"expired":     structpb.NewBoolValue(stage == expiryStageExpired),
+	}
+
+	return &pb.Shadow{
+		Device: cert.Device,
+		Reported: &pb.State{
+			Timestamp: timestamppb.New(now),
+			Data: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"event": structpb.NewStringValue(CertificateExpiringEvent),
+				"data":  structpb.NewStructValue(&structpb.Struct{Fields: details}),
+			}},
+		},
+	}
+}
+
+// Run - checks certificates every interval until the context is done
+func (w *ExpiryWatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Check(ctx); err != nil {
+			w.log.Warn("Error checking certificates expiry", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
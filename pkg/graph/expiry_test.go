@@ -0,0 +1,129 @@
+package graph_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	driver_mocks "github.com/infinimesh/infinimesh/mocks/github.com/arangodb/go-driver"
+	"github.com/infinimesh/infinimesh/pkg/graph"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	devpb "github.com/infinimesh/proto/node/devices"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type expiryWatcherFixture struct {
+	watcher *graph.ExpiryWatcher
+
+	mocks struct {
+		db     *driver_mocks.MockDatabase
+		col    *driver_mocks.MockCollection
+		cursor *driver_mocks.MockCursor
+	}
+
+	data struct {
+		ctx       context.Context
+		published []*pb.Shadow
+	}
+}
+
+func newExpiryWatcherFixture(t *testing.T) *expiryWatcherFixture {
+	f := &expiryWatcherFixture{}
+
+	f.mocks.db = driver_mocks.NewMockDatabase(t)
+	f.mocks.col = driver_mocks.NewMockCollection(t)
+	f.mocks.cursor = driver_mocks.NewMockCursor(t)
+	f.mocks.db.On("Collection", context.TODO(), schema.CERTIFICATES_COL).Return(f.mocks.col, nil)
+
+	f.data.ctx = context.Background()
+
+	f.watcher = graph.NewExpiryWatcher(zap.NewExample(), f.mocks.db, 30*24*time.Hour)
+	f.watcher.Publish = func(_ context.Context, device *devpb.Device, event *pb.Shadow) error {
+		assert.Equal(t, []string{"plugin:alerts"}, device.Tags)
+		f.data.published = append(f.data.published, event)
+		return nil
+	}
+
+	return f
+}
+
+// certificates - makes the query return certificates as expiring in the Namespace
+func (f *expiryWatcherFixture) certificates(t *testing.T, ns string, certs ...graph.CertificateDocument) {
+	f.mocks.db.On("Query", f.data.ctx, mock.Anything, mock.Anything).Return(f.mocks.cursor, nil)
+	for _, cert := range certs {
+		data, err := json.Marshal(map[string]interface{}{
+			"_key": cert.Key, "device": cert.Device, "state": cert.State, "not_after": cert.NotAfter,
+			"expiry_notified": cert.ExpiryNotified, "namespace": ns, "tags": []string{"plugin:alerts"},
+		})
+		require.NoError(t, err)
+		f.mocks.cursor.On("ReadDocument", f.data.ctx, mock.Anything).Run(func(args mock.Arguments) {
+			require.NoError(t, json.Unmarshal(data, args.Get(1)))
+		}).Return(driver.DocumentMeta{Key: cert.Key}, nil).Once()
+	}
+	f.mocks.cursor.On("ReadDocument", f.data.ctx, mock.Anything).Return(driver.DocumentMeta{}, driver.NoMoreDocumentsError{})
+	f.mocks.cursor.On("Close").Return(nil)
+}
+
+func expiringCertificate(key string, notAfter time.Time, notified string) graph.CertificateDocument {
+	return graph.CertificateDocument{
+		Device: "device-" + key, State: graph.CertificateActive, NotAfter: notAfter, ExpiryNotified: notified,
+		DocumentMeta: driver.DocumentMeta{Key: key},
+	}
+}
+
+func TestExpiryWatcher_Check(t *testing.T) {
+	f := newExpiryWatcherFixture(t)
+	f.certificates(t, "expiry-ns",
+		expiringCertificate("soon", time.Now().Add(10*24*time.Hour+time.Hour), ""),
+		expiringCertificate("notified", time.Now().Add(24*time.Hour), "expiring"),
+		expiringCertificate("expired", time.Now().Add(-time.Hour), "expiring"),
+	)
+	f.mocks.col.On("UpdateDocument", f.data.ctx, "soon", map[string]interface{}{"expiry_notified": "expiring"}).
+		Return(driver.DocumentMeta{}, nil)
+	f.mocks.col.On("UpdateDocument", f.data.ctx, "expired", map[string]interface{}{"expiry_notified": "expired"}).
+		Return(driver.DocumentMeta{}, nil)
+
+	require.NoError(t, f.watcher.Check(f.data.ctx))
+
+	require.Len(t, f.data.published, 2)
+	soon := f.data.published[0]
+	assert.Equal(t, "device-soon", soon.Device)
+	assert.Equal(t, graph.CertificateExpiringEvent, soon.Reported.Data.Fields["event"].GetStringValue())
+	details := soon.Reported.Data.Fields["data"].GetStructValue().Fields
+	assert.Equal(t, "soon", details["fingerprint"].GetStringValue())
+	assert.Equal(t, "expiry-ns", details["namespace"].GetStringValue())
+	assert.Equal(t, float64(10), details["days_left"].GetNumberValue())
+	assert.False(t, details["expired"].GetBoolValue())
+
+	expired := f.data.published[1].Reported.Data.Fields["data"].GetStructValue().Fields
+	assert.True(t, expired["expired"].GetBoolValue())
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(graph.CertificatesExpiringSoon.WithLabelValues("expiry-ns")))
+}
+
+func TestExpiryWatcher_Check_RetriesOn_PublishError(t *testing.T) {
+	f := newExpiryWatcherFixture(t)
+	f.certificates(t, "expiry-ns", expiringCertificate("soon", time.Now().Add(24*time.Hour), ""))
+	f.watcher.Publish = func(context.Context, *devpb.Device, *pb.Shadow) error {
+		return errors.New("unavailable")
+	}
+
+	// Notification isn't stored, so the event is emitted on the next check
+	require.NoError(t, f.watcher.Check(f.data.ctx))
+	f.mocks.col.AssertNotCalled(t, "UpdateDocument", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestExpiryWatcher_Check_FailsOn_Query(t *testing.T) {
+	f := newExpiryWatcherFixture(t)
+	f.mocks.db.On("Query", f.data.ctx, mock.Anything, mock.Anything).Return(nil, errors.New("unavailable"))
+
+	assert.Error(t, f.watcher.Check(f.data.ctx))
+}
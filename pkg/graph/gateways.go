@@ -0,0 +1,323 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/arangodb/go-driver"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/infinimesh/infinimesh/pkg/devcache"
+	"github.com/infinimesh/infinimesh/pkg/gateway"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	access "github.com/infinimesh/proto/node/access"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GatewayChild - Device linked to the gateway, gateway publishes and receives its state over own MQTT connection
+type GatewayChild struct {
+	Uuid    string `json:"uuid"`
+	Title   string `json:"title"`
+	Enabled bool   `json:"enabled"`
+}
+
+// LinkChildRequest - Device to link to the gateway
+type LinkChildRequest struct {
+	Child string `json:"child"`
+}
+
+type GatewaysController struct {
+	InfinimeshBaseController
+
+	dev2dev driver.Collection // Gateways to child Devices permissions edge collection
+
+	ica_repo InfinimeshCommonActionsRepo // Infinimesh Common Actions Repository
+
+	rdb   redis.Cmdable  // Device changes are published here, nil disables notifications
+	links *gateway.Store // Links mirrored for MQTT Bridge, nil if Redis isn't set
+}
+
+func NewGatewaysController(log *zap.Logger, db driver.Database, ica InfinimeshCommonActionsRepo) *GatewaysController {
+	return &GatewaysController{
+		InfinimeshBaseController: InfinimeshBaseController{
+			log: log.Named("GatewaysController"), db: db,
+		},
+		dev2dev:  ica.GetEdgeCol(context.TODO(), schema.DEV2DEV),
+		ica_repo: ica,
+	}
+}
+
+// SetRedis - mirrors links to Redis for MQTT Bridge and enables device changes notifications, see gateway.Store
+func (c *GatewaysController) SetRedis(rdb redis.Cmdable) {
+	c.rdb = rdb
+	c.links = gateway.NewStore(rdb)
+}
+
+const listGatewayChildrenQuery = `FOR child IN 1 OUTBOUND @gateway @@dev2dev
+SORT child.title
+RETURN { uuid: child._key, title: child.title, enabled: child.enabled }`
+
+// Children - Devices linked to the gateway, requires Read access to the gateway
+func (c *GatewaysController) Children(ctx context.Context, uuid string) ([]*GatewayChild, error) {
+	log := c.log.Named("Children")
+
+	gw, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_READ)
+	if err != nil {
+		return nil, err
+	}
+
+	cr, err := c.db.Query(ctx, listGatewayChildrenQuery, map[string]interface{}{
+		"gateway":  gw.ID(),
+		"@dev2dev": schema.DEV2DEV,
+	})
+	if err != nil {
+		log.Warn("Error executing query", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error executing query")
+	}
+	defer cr.Close()
+
+	r := []*GatewayChild{}
+	for {
+		var child GatewayChild
+		_, err := cr.ReadDocument(ctx, &child)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			log.Warn("Error unmarshalling Document", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Couldn't execute query")
+		}
+		r = append(r, &child)
+	}
+	return r, nil
+}
+
+const gatewayLinksQuery = `RETURN {
+    gateway: FIRST(FOR gw IN 1 INBOUND @child @@dev2dev RETURN gw._key),
+    children: LENGTH(FOR child IN 1 OUTBOUND @child @@dev2dev RETURN 1),
+    parent: FIRST(FOR gw IN 1 INBOUND @gateway @@dev2dev RETURN gw._key)
+}`
+
+type gatewayLinks struct {
+	Gateway  string `json:"gateway"`  // Gateway the child is linked to already
+	Children int    `json:"children"` // Number of children of the child
+	Parent   string `json:"parent"`   // Gateway the gateway is linked to itself
+}
+
+// Link - makes the Device a child of the gateway, requires Admin access to both.
+// Child can only have one gateway and gateways can't be nested
+func (c *GatewaysController) Link(ctx context.Context, uuid string, req *LinkChildRequest) (*GatewayChild, error) {
+	log := c.log.Named("Link")
+	log.Debug("Link request received", zap.String("gateway", uuid), zap.String("child", req.Child))
+
+	if req.Child == "" || req.Child == uuid {
+		return nil, status.Error(codes.InvalidArgument, "Child must be another Device")
+	}
+
+	gw, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	child, err := getDevice(ctx, log, c.ica_repo, req.Child, access.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+
+	cr, err := c.db.Query(ctx, gatewayLinksQuery, map[string]interface{}{
+		"gateway":  gw.ID(),
+		"child":    child.ID(),
+		"@dev2dev": schema.DEV2DEV,
+	})
+	if err != nil {
+		log.Warn("Error executing query", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error executing query")
+	}
+	var links gatewayLinks
+	_, err = cr.ReadDocument(ctx, &links)
+	cr.Close()
+	if err != nil {
+		log.Warn("Error unmarshalling Document", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Couldn't execute query")
+	}
+
+	res := &GatewayChild{Uuid: child.Uuid, Title: child.Title, Enabled: child.Enabled}
+	switch {
+	case links.Gateway == gw.Uuid:
+		return res, nil
+	case links.Gateway != "":
+		return nil, status.Errorf(codes.AlreadyExists, "Device is linked to Gateway %s already", links.Gateway)
+	case links.Children > 0:
+		return nil, status.Error(codes.FailedPrecondition, "Device is a Gateway itself, Gateways can't be nested")
+	case links.Parent != "":
+		return nil, status.Error(codes.FailedPrecondition, "Gateway is a child Device itself, Gateways can't be nested")
+	}
+
+	// Accounts with access to the gateway may read its children the same way as Devices shared with them
+	err = c.ica_repo.Link(ctx, log, c.dev2dev, gw, child, access.Level_READ, access.Role_SHARED)
+	if err != nil {
+		log.Warn("Error creating edge", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while linking Device to Gateway")
+	}
+
+	if c.links != nil {
+		if err := c.links.Link(ctx, gw.Uuid, child.Uuid); err != nil {
+			log.Warn("Error storing link in Redis", zap.Error(err))
+		}
+	}
+	c.notify(ctx, log, child.Uuid)
+
+	log.Info("Device linked to Gateway", zap.String("gateway", gw.Uuid), zap.String("child", child.Uuid))
+	return res, nil
+}
+
+// Unlink - removes the Device from gateway children, requires Admin access to the gateway
+func (c *GatewaysController) Unlink(ctx context.Context, uuid string, child string) error {
+	log := c.log.Named("Unlink")
+	log.Debug("Unlink request received", zap.String("gateway", uuid), zap.String("child", child))
+
+	gw, err := getDevice(ctx, log, c.ica_repo, uuid, access.Level_ADMIN)
+	if err != nil {
+		return err
+	}
+
+	err = c.ica_repo.Link(ctx, log, c.dev2dev, gw, NewBlankDeviceDocument(child), access.Level_NONE, access.Role_UNSET)
+	if driver.IsNotFound(err) {
+		return status.Error(codes.NotFound, "Device is not linked to the Gateway")
+	} else if err != nil {
+		log.Warn("Error removing edge", zap.Error(err))
+		return status.Error(codes.Internal, "Error while unlinking Device from Gateway")
+	}
+
+	c.unlinked(ctx, log, child)
+	log.Info("Device unlinked from Gateway", zap.String("gateway", gw.Uuid), zap.String("child", child))
+	return nil
+}
+
+// unlinked - removes the child link from Redis and tells MQTT Bridge about it, errors are only logged
+func (c *GatewaysController) unlinked(ctx context.Context, log *zap.Logger, child string) {
+	if c.links != nil {
+		if err := c.links.Unlink(ctx, child); err != nil {
+			log.Warn("Error removing link from Redis", zap.Error(err))
+		}
+	}
+	c.notify(ctx, log, child)
+}
+
+const listAllGatewayLinksQuery = `FOR link IN @@dev2dev
+RETURN { gateway: PARSE_IDENTIFIER(link._from).key, child: PARSE_IDENTIFIER(link._to).key }`
+
+// Sync - replaces links in Redis with the ones stored in the database, meant to be called on startup
+func (c *GatewaysController) Sync(ctx context.Context) error {
+	if c.links == nil {
+		return nil
+	}
+
+	cr, err := c.db.Query(ctx, listAllGatewayLinksQuery, map[string]interface{}{
+		"@dev2dev": schema.DEV2DEV,
+	})
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	links := map[string]string{}
+	for {
+		var link struct {
+			Gateway string `json:"gateway"`
+			Child   string `json:"child"`
+		}
+		_, err := cr.ReadDocument(ctx, &link)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		links[link.Child] = link.Gateway
+	}
+	return c.links.Restore(ctx, links)
+}
+
+const removeGatewayLinksQuery = `FOR link IN @@dev2dev
+FILTER link._from == @device || link._to == @device
+REMOVE link IN @@dev2dev
+RETURN PARSE_IDENTIFIER(OLD._to).key`
+
+// removeAll - unlinks the deleted Device from its gateway or its children, errors are only logged
+func (c *GatewaysController) removeAll(ctx context.Context, log *zap.Logger, device string) {
+	cr, err := c.db.Query(ctx, removeGatewayLinksQuery, map[string]interface{}{
+		"@dev2dev": schema.DEV2DEV,
+		"device":   NewBlankDeviceDocument(device).ID(),
+	})
+	if err != nil {
+		log.Warn("Error removing Gateway links", zap.String("device", device), zap.Error(err))
+		return
+	}
+	defer cr.Close()
+
+	for {
+		var child string
+		_, err := cr.ReadDocument(ctx, &child)
+		if driver.IsNoMoreDocuments(err) {
+			return
+		} else if err != nil {
+			log.Warn("Error reading removed Gateway link", zap.Error(err))
+			return
+		}
+		c.unlinked(ctx, log, child)
+	}
+}
+
+// notify - tells device caches the Device has changed, errors are only logged
+func (c *GatewaysController) notify(ctx context.Context, log *zap.Logger, device string) {
+	if c.rdb == nil {
+		return
+	}
+	if err := devcache.Notify(ctx, c.rdb, device); err != nil {
+		log.Warn("Error notifying about Device change", zap.String("device", device), zap.Error(err))
+	}
+}
+
+// Register - serves gateway children over HTTP:
+//
+//	GET    /devices/{uuid}/children            -> []GatewayChild
+//	POST   /devices/{uuid}/children            LinkChildRequest -> GatewayChild
+//	DELETE /devices/{uuid}/children/{child}    -> {}
+func (c *GatewaysController) Register(router *mux.Router, authenticate func(http.Handler) http.Handler) {
+	router.Handle("/devices/{uuid}/children", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := c.Children(r.Context(), mux.Vars(r)["uuid"])
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodGet)
+
+	router.Handle("/devices/{uuid}/children", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req LinkChildRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		res, err := c.Link(r.Context(), mux.Vars(r)["uuid"], &req)
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodPost)
+
+	router.Handle("/devices/{uuid}/children/{child}", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		err := c.Unlink(r.Context(), vars["uuid"], vars["child"])
+		writeJSON(w, struct{}{}, err)
+	}))).Methods(http.MethodDelete)
+}
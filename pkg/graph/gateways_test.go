@@ -0,0 +1,208 @@
+package graph_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	"github.com/google/uuid"
+	driver_mocks "github.com/infinimesh/infinimesh/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/infinimesh/pkg/graph"
+	"github.com/infinimesh/infinimesh/pkg/graph"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/proto/node/access"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type gatewaysControllerFixture struct {
+	ctrl *graph.GatewaysController
+
+	mocks struct {
+		db       *driver_mocks.MockDatabase
+		dev2dev  *driver_mocks.MockCollection
+		cursor   *driver_mocks.MockCursor
+		ica_repo *graph_mocks.MockInfinimeshCommonActionsRepo
+	}
+
+	data struct {
+		ctx        context.Context
+		gw_uuid    string
+		child_uuid string
+	}
+}
+
+func newGatewaysControllerFixture(t *testing.T) *gatewaysControllerFixture {
+	f := &gatewaysControllerFixture{}
+
+	f.mocks.db = driver_mocks.NewMockDatabase(t)
+	f.mocks.dev2dev = driver_mocks.NewMockCollection(t)
+	f.mocks.cursor = driver_mocks.NewMockCursor(t)
+	f.mocks.ica_repo = graph_mocks.NewMockInfinimeshCommonActionsRepo(t)
+	f.mocks.ica_repo.On("GetEdgeCol", context.TODO(), schema.DEV2DEV).Return(f.mocks.dev2dev)
+
+	f.data.gw_uuid = uuid.New().String()
+	f.data.child_uuid = uuid.New().String()
+	f.data.ctx = context.WithValue(context.Background(), inf.InfinimeshAccountCtxKey, uuid.New().String())
+
+	f.ctrl = graph.NewGatewaysController(zap.NewExample(), f.mocks.db, f.mocks.ica_repo)
+
+	return f
+}
+
+// access - sets requestor access level to the Device
+func (f *gatewaysControllerFixture) access(device string, level access.Level) {
+	f.mocks.ica_repo.On("AccessLevelAndGet", f.data.ctx, mock.Anything, mock.Anything, mock.MatchedBy(func(d *graph.Device) bool {
+		if d.Key != device {
+			return false
+		}
+		d.Access = &access.Access{Level: level}
+		return true
+	})).Return(nil)
+}
+
+// links - existing links of the gateway and the child
+func (f *gatewaysControllerFixture) links(t *testing.T, gateway string, children int, parent string) {
+	data, err := json.Marshal(map[string]interface{}{
+		"gateway": gateway, "children": children, "parent": parent,
+	})
+	require.NoError(t, err)
+
+	f.mocks.db.On("Query", f.data.ctx, mock.Anything, mock.Anything).Return(f.mocks.cursor, nil)
+	f.mocks.cursor.On("ReadDocument", f.data.ctx, mock.Anything).Run(func(args mock.Arguments) {
+		require.NoError(t, json.Unmarshal(data, args.Get(1)))
+	}).Return(driver.DocumentMeta{}, nil)
+	f.mocks.cursor.On("Close").Return(nil)
+}
+
+func (f *gatewaysControllerFixture) link() (*graph.GatewayChild, error) {
+	return f.ctrl.Link(f.data.ctx, f.data.gw_uuid, &graph.LinkChildRequest{Child: f.data.child_uuid})
+}
+
+// Link
+//
+
+func TestLink_FailsOn_Self(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+
+	_, err := f.ctrl.Link(f.data.ctx, f.data.gw_uuid, &graph.LinkChildRequest{Child: f.data.gw_uuid})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestLink_FailsOn_NotEnoughAccessToChild(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_ADMIN)
+	f.access(f.data.child_uuid, access.Level_MGMT)
+
+	_, err := f.link()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestLink_FailsOn_LinkedToOtherGateway(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_ADMIN)
+	f.access(f.data.child_uuid, access.Level_ADMIN)
+	f.links(t, "other", 0, "")
+
+	_, err := f.link()
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestLink_FailsOn_NestedGateways(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_ADMIN)
+	f.access(f.data.child_uuid, access.Level_ADMIN)
+	f.links(t, "", 0, "other")
+
+	_, err := f.link()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestLink_Success(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_ADMIN)
+	f.access(f.data.child_uuid, access.Level_ADMIN)
+	f.links(t, "", 0, "")
+	f.mocks.ica_repo.On("Link", f.data.ctx, mock.Anything, f.mocks.dev2dev,
+		mock.MatchedBy(func(d *graph.Device) bool { return d.Key == f.data.gw_uuid }),
+		mock.MatchedBy(func(d *graph.Device) bool { return d.Key == f.data.child_uuid }),
+		access.Level_READ, access.Role_SHARED,
+	).Return(nil)
+
+	res, err := f.link()
+	require.NoError(t, err)
+	assert.Equal(t, f.data.child_uuid, res.Uuid)
+}
+
+func TestLink_AlreadyLinked(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_ADMIN)
+	f.access(f.data.child_uuid, access.Level_ADMIN)
+	f.links(t, f.data.gw_uuid, 0, "")
+
+	_, err := f.link()
+	assert.NoError(t, err)
+	f.mocks.ica_repo.AssertNotCalled(t, "Link", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+// Unlink
+//
+
+func TestUnlink_FailsOn_NotLinked(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_ADMIN)
+	f.mocks.ica_repo.On("Link", f.data.ctx, mock.Anything, f.mocks.dev2dev, mock.Anything, mock.Anything, access.Level_NONE, access.Role_UNSET).
+		Return(driver.ArangoError{HasError: true, Code: 404})
+
+	err := f.ctrl.Unlink(f.data.ctx, f.data.gw_uuid, f.data.child_uuid)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestUnlink_Success(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_ADMIN)
+	f.mocks.ica_repo.On("Link", f.data.ctx, mock.Anything, f.mocks.dev2dev, mock.Anything,
+		mock.MatchedBy(func(d *graph.Device) bool { return d.Key == f.data.child_uuid }),
+		access.Level_NONE, access.Role_UNSET,
+	).Return(nil)
+
+	assert.NoError(t, f.ctrl.Unlink(f.data.ctx, f.data.gw_uuid, f.data.child_uuid))
+}
+
+// Children
+//
+
+func TestChildren_FailsOn_NoAccess(t *testing.T) {
+	f := newGatewaysControllerFixture(t)
+	f.access(f.data.gw_uuid, access.Level_NONE)
+
+	_, err := f.ctrl.Children(f.data.ctx, f.data.gw_uuid)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestListQuery_ThroughGateways(t *testing.T) {
+	db := driver_mocks.NewMockDatabase(t)
+	cursor := driver_mocks.NewMockCursor(t)
+	ica := graph.NewInfinimeshCommonActionsRepo(db)
+
+	ctx := graph.WithNamespaceFilter(context.Background(), "ns")
+	db.On("Query", ctx, mock.MatchedBy(func(query string) bool {
+		// Children linked to gateways are filtered by the gateway Namespace
+		return strings.Contains(query, `LET ns = path.vertices[link ? -3 : -2]`) &&
+			strings.Contains(query, `FILTER ns._key == "ns"`)
+	}), mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["dev2dev"] == schema.DEV2DEV && vars["permissions_graph"] == schema.PERMISSIONS_GRAPH.Name
+	})).Return(cursor, nil)
+
+	res, err := ica.ListQuery(ctx, zap.NewExample(), graph.NewBlankAccountDocument("account"), schema.DEVICES_COL)
+
+	require.NoError(t, err)
+	assert.Equal(t, cursor, res)
+}
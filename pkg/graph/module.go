@@ -2,6 +2,7 @@ package graph
 
 import (
 	"github.com/arangodb/go-driver"
+	"github.com/go-redis/redis/v8"
 	"github.com/infinimesh/proto/handsfree"
 	"github.com/infinimesh/proto/node/nodeconnect"
 	"go.uber.org/zap"
@@ -10,6 +11,9 @@ import (
 type DevicesControllerModule interface {
 	Handler() nodeconnect.DevicesServiceHandler
 	SetSigningKey([]byte)
+	SetRedis(redis.Cmdable)
+	SetCertificates(*CertificatesController)
+	SetGateways(*GatewaysController)
 }
 
 type devicesControllerModule struct {
@@ -24,6 +28,18 @@ func (m *devicesControllerModule) SetSigningKey(key []byte) {
 	m.handler.SIGNING_KEY = key
 }
 
+func (m *devicesControllerModule) SetRedis(rdb redis.Cmdable) {
+	m.handler.SetRedis(rdb)
+}
+
+func (m *devicesControllerModule) SetCertificates(certs *CertificatesController) {
+	m.handler.SetCertificates(certs)
+}
+
+func (m *devicesControllerModule) SetGateways(gateways *GatewaysController) {
+	m.handler.SetGateways(gateways)
+}
+
 func NewDevicesControllerModule(log *zap.Logger, db driver.Database,
 	hfc handsfree.HandsfreeServiceClient) DevicesControllerModule {
 	return &devicesControllerModule{
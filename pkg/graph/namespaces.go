@@ -23,6 +23,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
 	"github.com/infinimesh/infinimesh/pkg/graph/schema"
 	inf "github.com/infinimesh/infinimesh/pkg/shared"
 	pb "github.com/infinimesh/proto/node"
@@ -104,6 +105,10 @@ func (c *NamespacesController) Create(ctx context.Context, req *connect.Request[
 		request.Uuid = ""
 	}
 
+	if _, err := deviceca.Parse("", request.Config); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid %s config: %v", deviceca.ConfigKey, err)
+	}
+
 	namespace := Namespace{Namespace: request}
 	meta, err := c.col.CreateDocument(ctx, namespace)
 	if err != nil {
@@ -182,6 +187,9 @@ func (c *NamespacesController) Update(ctx context.Context, req *connect.Request[
 	}
 
 	if ns.Config != nil {
+		if _, err := deviceca.Parse(ns.Uuid, ns.Config); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s config: %v", deviceca.ConfigKey, err)
+		}
 		curr.Config = ns.Config
 		changed = true
 	}
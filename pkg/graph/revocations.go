@@ -0,0 +1,458 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package graph
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/graph/schema"
+	"github.com/infinimesh/infinimesh/pkg/revocation"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	access "github.com/infinimesh/proto/node/access"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RevocationDocument - revoked certificate, keyed by its fingerprint
+type RevocationDocument struct {
+	*revocation.Revocation
+	driver.DocumentMeta
+}
+
+// RevokeRequest - certificate to revoke is given either by Device, by PEM encoded Certificate or by hex encoded Fingerprint.
+// Namespace defaults to the Device one
+type RevokeRequest struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type RevocationsController struct {
+	InfinimeshBaseController
+
+	col    driver.Collection // Revocations Collection
+	ns_col driver.Collection // Namespaces Collection
+
+	ica_repo InfinimeshCommonActionsRepo // Infinimesh Common Actions Repository
+
+	store     *revocation.Store   // Revocations are mirrored here, nil disables mirroring
+	signers   *deviceca.Signers   // CA keys CRLs are signed with
+	authority *deviceca.Authority // Built-in CA, CRLs of Namespace intermediates are signed with its keys
+
+	CRLValidity time.Duration
+}
+
+func NewRevocationsController(log *zap.Logger, db driver.Database, ica InfinimeshCommonActionsRepo) *RevocationsController {
+	ctx := context.TODO()
+	col, _ := db.Collection(ctx, schema.REVOCATIONS_COL)
+	ns_col, _ := db.Collection(ctx, schema.NAMESPACES_COL)
+
+	return &RevocationsController{
+		InfinimeshBaseController: InfinimeshBaseController{
+			log: log.Named("RevocationsController"), db: db,
+		},
+		col: col, ns_col: ns_col,
+		ica_repo: ica,
+
+		CRLValidity: 24 * time.Hour,
+	}
+}
+
+// SetRedis - enables mirroring revocations to Redis, so MQTT Bridge refuses revoked certificates
+func (c *RevocationsController) SetRedis(rdb redis.UniversalClient) {
+	c.store = revocation.NewStore(rdb)
+}
+
+// SetSigners - CA keys to sign CRLs with
+func (c *RevocationsController) SetSigners(signers *deviceca.Signers) {
+	c.signers = signers
+}
+
+// SetAuthority - built-in CA to sign CRLs of Namespace intermediates with
+func (c *RevocationsController) SetAuthority(authority *deviceca.Authority) {
+	c.authority = authority
+}
+
+func parseCertificatePEM(data string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("coudn't decode PEM data")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// findByFingerprint - registered device having the certificate, nil if there's none
+func (c *RevocationsController) findByFingerprint(ctx context.Context, fingerprint []byte) (*Device, error) {
+	device := NewBlankDeviceDocument("")
+	meta, err := queryByFingerprint(ctx, c.db, fingerprint, device)
+	if driver.IsNoMoreDocuments(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	device.Uuid = meta.ID.Key()
+	device.DocumentMeta = meta
+	return device, nil
+}
+
+// revocationKey - revocations are scoped to the Namespace, so the same certificate may be revoked by several of them
+func revocationKey(namespace, fingerprint string) string {
+	return namespace + ":" + fingerprint
+}
+
+// ownsCA - whether the CA is trusted by the Namespace in its device_ca config, Namespace intermediates of the built-in CA
+// are trusted there as well
+func (c *RevocationsController) ownsCA(ctx context.Context, namespace string, cert *x509.Certificate) (bool, error) {
+	ns := NewBlankNamespaceDocument(namespace)
+	if _, err := c.ns_col.ReadDocument(ctx, namespace, ns); err != nil {
+		return false, err
+	}
+	if c.authority != nil {
+		if intermediate, err := c.authority.Intermediate(ctx, namespace); err == nil && intermediate != nil && intermediate.Equal(cert) {
+			return true, nil
+		}
+	}
+	config, err := deviceca.Parse(namespace, ns.Config)
+	if err != nil || config == nil {
+		return false, nil
+	}
+	for _, ca := range config.CAs {
+		if ca.Equal(cert) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Revoke - revokes the certificate in the Namespace, requires Admin access to the Namespace and to the Device the certificate belongs to.
+// Device certificates are revoked in the Device Namespace, CAs only in the Namespace trusting them. Built-in root CA can't be revoked
+func (c *RevocationsController) Revoke(ctx context.Context, req *RevokeRequest) (*revocation.Revocation, error) {
+	log := c.log.Named("Revoke")
+	log.Debug("Revoke request received", zap.Any("request", req))
+
+	requestor := ctx.Value(inf.InfinimeshAccountCtxKey).(string)
+	log.Debug("Requestor", zap.String("id", requestor))
+	account := NewBlankAccountDocument(requestor)
+
+	code, err := revocation.ParseReason(req.Reason)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var device *Device
+	var cert *x509.Certificate
+	var fingerprint []byte
+	switch {
+	case req.Device != "":
+		device = NewBlankDeviceDocument(req.Device)
+		if err := c.ica_repo.AccessLevelAndGet(ctx, log, account, device); err != nil {
+			return nil, status.Error(codes.NotFound, "Device not found or not enough Access Rights")
+		}
+		if device.Certificate == nil || device.Certificate.PemData == "" {
+			return nil, status.Error(codes.FailedPrecondition, "Device has no Certificate")
+		}
+		if cert, err = parseCertificatePEM(device.Certificate.PemData); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "Can't parse Device Certificate: %v", err)
+		}
+	case req.Certificate != "":
+		if cert, err = parseCertificatePEM(req.Certificate); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Can't parse Certificate: %v", err)
+		}
+	case req.Fingerprint != "":
+		fingerprint, err = hex.DecodeString(req.Fingerprint)
+		if err != nil || len(fingerprint) != 32 {
+			return nil, status.Error(codes.InvalidArgument, "Fingerprint must be hex encoded SHA-256")
+		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Device, Certificate or Fingerprint is required")
+	}
+
+	if cert != nil {
+		fingerprint = sha256Sum(cert.Raw)
+	}
+	if device == nil {
+		device, err = c.findByFingerprint(ctx, fingerprint)
+		if err != nil {
+			log.Warn("Error looking up Device by Fingerprint", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error executing query")
+		}
+		// Certificate of someone else's device can't be revoked
+		if device != nil {
+			if err := c.ica_repo.AccessLevelAndGet(ctx, log, account, device); err != nil {
+				return nil, status.Error(codes.PermissionDenied, "Certificate belongs to a Device you have no Access to")
+			}
+			// Serial and Issuer are taken from the Device Certificate to list it in CRLs
+			if cert == nil && device.Certificate != nil {
+				if dc, err := parseCertificatePEM(device.Certificate.PemData); err == nil && bytes.Equal(sha256Sum(dc.Raw), fingerprint) {
+					cert = dc
+				}
+			}
+		}
+	}
+	if device != nil && device.GetAccess().Level < access.Level_ADMIN {
+		return nil, status.Error(codes.PermissionDenied, "Not enough Access Rights to the Device")
+	}
+
+	r := &revocation.Revocation{Fingerprint: hex.EncodeToString(fingerprint)}
+	if cert != nil {
+		r = revocation.FromCertificate(cert)
+	}
+	r.Namespace = req.Namespace
+	if device != nil {
+		r.Device = device.Uuid
+		// Device certificate is revoked in the Namespace the Device belongs to, where it's checked
+		ns := device.GetAccess().GetNamespace()
+		if r.Namespace != "" && r.Namespace != ns {
+			return nil, status.Errorf(codes.InvalidArgument, "Certificate belongs to a Device of Namespace %s", ns)
+		}
+		r.Namespace = ns
+	}
+	if r.Namespace == "" {
+		return nil, status.Error(codes.InvalidArgument, "Namespace is required")
+	}
+	ok, level := c.ica_repo.AccessLevel(ctx, account, NewBlankNamespaceDocument(r.Namespace))
+	if !ok || level < access.Level_ADMIN {
+		return nil, status.Errorf(codes.PermissionDenied, "No Access to Namespace %s", r.Namespace)
+	}
+	if c.authority != nil && revocation.Fingerprint(c.authority.Root().Raw) == r.Fingerprint {
+		return nil, status.Error(codes.PermissionDenied, "Built-in root CA can't be revoked")
+	}
+	if device == nil && cert != nil && cert.IsCA {
+		owned, err := c.ownsCA(ctx, r.Namespace, cert)
+		if err != nil {
+			log.Warn("Error reading Namespace trusted CAs", zap.String("namespace", r.Namespace), zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error reading Namespace trusted CAs")
+		}
+		if !owned {
+			return nil, status.Errorf(codes.PermissionDenied, "CA isn't trusted by Namespace %s", r.Namespace)
+		}
+	}
+
+	r.Reason = req.Reason
+	if r.Reason == "" {
+		r.Reason = "unspecified"
+	}
+	r.ReasonCode = code
+	r.Comment = req.Comment
+	r.RevokedAt = time.Now().UTC()
+
+	_, err = c.col.CreateDocument(ctx, RevocationDocument{
+		Revocation:   r,
+		DocumentMeta: NewBlankDocument(schema.REVOCATIONS_COL, revocationKey(r.Namespace, r.Fingerprint)),
+	})
+	if driver.IsConflict(err) {
+		return nil, status.Error(codes.AlreadyExists, "Certificate is already revoked")
+	}
+	if err != nil {
+		log.Warn("Error storing Revocation", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while storing Revocation")
+	}
+
+	if c.store != nil {
+		if err := c.store.Publish(ctx, r); err != nil {
+			log.Warn("Error publishing Revocation", zap.String("fingerprint", r.Fingerprint), zap.Error(err))
+		}
+	}
+	log.Info("Certificate revoked", zap.String("fingerprint", r.Fingerprint), zap.String("namespace", r.Namespace), zap.String("reason", r.Reason))
+	return r, nil
+}
+
+const listRevocationsQuery = `FOR r IN @@revocations
+FILTER @namespace == null || r.namespace == @namespace
+SORT r.revoked_at DESC
+RETURN r`
+
+func (c *RevocationsController) list(ctx context.Context, namespace *string) ([]*revocation.Revocation, error) {
+	cr, err := c.db.Query(ctx, listRevocationsQuery, map[string]interface{}{
+		"@revocations": schema.REVOCATIONS_COL,
+		"namespace":    namespace,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	res := []*revocation.Revocation{}
+	for cr.HasMore() {
+		r := &revocation.Revocation{}
+		if _, err := cr.ReadDocument(ctx, r); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// List - revocations of the Namespace, newest first. Requires Read access to the Namespace
+func (c *RevocationsController) List(ctx context.Context, namespace string) ([]*revocation.Revocation, error) {
+	log := c.log.Named("List")
+
+	requestor := ctx.Value(inf.InfinimeshAccountCtxKey).(string)
+	ok, level := c.ica_repo.AccessLevel(ctx, NewBlankAccountDocument(requestor), NewBlankNamespaceDocument(namespace))
+	if !ok || level < access.Level_READ {
+		return nil, status.Errorf(codes.PermissionDenied, "No Access to Namespace %s", namespace)
+	}
+
+	res, err := c.list(ctx, &namespace)
+	if err != nil {
+		log.Warn("Error listing Revocations", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error executing query")
+	}
+	return res, nil
+}
+
+// CRL - DER encoded CRL of the Namespace trusted CA with the given index, signed by the CA key if the registry has it
+func (c *RevocationsController) CRL(ctx context.Context, namespace string, ca int) ([]byte, error) {
+	log := c.log.Named("CRL")
+
+	ns := NewBlankNamespaceDocument(namespace)
+	if _, err := c.ns_col.ReadDocument(ctx, namespace, ns); err != nil {
+		return nil, status.Error(codes.NotFound, "Namespace not found")
+	}
+	config, err := deviceca.Parse(namespace, ns.Config)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Invalid %s config: %v", deviceca.ConfigKey, err)
+	}
+	if config == nil || ca < 0 || ca >= len(config.CAs) {
+		return nil, status.Error(codes.NotFound, "Namespace has no such trusted CA")
+	}
+
+	key := c.signers.For(config.CAs[ca])
+	if key == nil {
+		key = c.authority.KeyFor(ctx, namespace, config.CAs[ca])
+	}
+	if key == nil {
+		return nil, status.Error(codes.Unimplemented, "CA key isn't available to the registry")
+	}
+
+	rs, err := c.list(ctx, &namespace)
+	if err != nil {
+		log.Warn("Error listing Revocations", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error executing query")
+	}
+	crl, err := revocation.CreateCRL(config.CAs[ca], key, rs, time.Now(), c.CRLValidity)
+	if err != nil {
+		log.Warn("Error creating CRL", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error creating CRL")
+	}
+	return crl, nil
+}
+
+// Sync - mirrors all revocations to Redis, so they survive Redis being flushed
+func (c *RevocationsController) Sync(ctx context.Context) error {
+	if c.store == nil {
+		return nil
+	}
+	rs, err := c.list(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return c.store.Restore(ctx, rs)
+}
+
+// httpStatus - HTTP status matching gRPC status code of the error
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		http.Error(w, status.Convert(err).Message(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Register - serves revocations over HTTP:
+//
+//	POST /revocations                       RevokeRequest -> Revocation
+//	GET  /namespaces/{uuid}/revocations     -> []Revocation
+//	GET  /namespaces/{uuid}/crl?ca={index}  -> DER encoded CRL, no authentication required
+func (c *RevocationsController) Register(router *mux.Router, authenticate func(http.Handler) http.Handler) {
+	router.Handle("/revocations", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req RevokeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		res, err := c.Revoke(r.Context(), &req)
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodPost)
+
+	router.Handle("/namespaces/{uuid}/revocations", authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := c.List(r.Context(), mux.Vars(r)["uuid"])
+		writeJSON(w, res, err)
+	}))).Methods(http.MethodGet)
+
+	router.HandleFunc("/namespaces/{uuid}/crl", func(w http.ResponseWriter, r *http.Request) {
+		ca := 0
+		if v := r.URL.Query().Get("ca"); v != "" {
+			var err error
+			if ca, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				http.Error(w, "ca must be an index", http.StatusBadRequest)
+				return
+			}
+		}
+		crl, err := c.CRL(r.Context(), mux.Vars(r)["uuid"], ca)
+		if err != nil {
+			http.Error(w, status.Convert(err).Message(), httpStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		_, _ = w.Write(crl)
+	}).Methods(http.MethodGet)
+}
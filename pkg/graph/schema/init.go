@@ -45,6 +45,22 @@ func CheckAndRegisterCollections(log *zap.Logger, db driver.Database, collection
 	}
 }
 
+// CheckAndRegisterIndexes - ensures persistent indexes exist, it's a no-op for the existing ones
+func CheckAndRegisterIndexes(log *zap.Logger, db driver.Database, indexes []InfinimeshIndexSchema) {
+	ctx := context.TODO()
+	for _, index := range indexes {
+		log.Debug("Ensuring Index", zap.String("collection", index.Collection), zap.Strings("fields", index.Fields))
+		col, err := db.Collection(ctx, index.Collection)
+		if err != nil {
+			log.Fatal("Failed to open collection", zap.String("collection", index.Collection), zap.Error(err))
+		}
+		_, _, err = col.EnsurePersistentIndex(ctx, index.Fields, &driver.EnsurePersistentIndexOptions{InBackground: true})
+		if err != nil {
+			log.Fatal("Failed to create index", zap.String("collection", index.Collection), zap.Strings("fields", index.Fields), zap.Error(err))
+		}
+	}
+}
+
 func CheckAndRegisterGraph(log *zap.Logger, db driver.Database, graph_def InfinimeshGraphSchema) {
 	ctx := context.TODO()
 	graphExists, err := db.GraphExists(ctx, graph_def.Name)
@@ -137,6 +153,7 @@ func InitDB(log *zap.Logger, dbHost, dbCred, rootPass string, quick bool) driver
 	db, _ = c.Database(context.TODO(), DB_NAME)
 
 	CheckAndRegisterCollections(log, db, COLLECTIONS)
+	CheckAndRegisterIndexes(log, db, INDEXES)
 
 	for _, graph := range GRAPHS_SCHEMAS {
 		CheckAndRegisterGraph(log, db, graph)
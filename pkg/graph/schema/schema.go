@@ -50,6 +50,7 @@ const (
 const (
 	DEVICES_COL = "Devices"
 	NS2DEV      = NAMESPACES_COL + "2" + DEVICES_COL
+	DEV2DEV     = DEVICES_COL + "2" + DEVICES_COL // Gateways to their child devices, access through them is capped by the link level
 )
 
 const (
@@ -57,6 +58,12 @@ const (
 	NS2PLUG     = NAMESPACES_COL + "2" + PLUGINS_COL
 )
 
+const (
+	REVOCATIONS_COL  = "Revocations"
+	CERTIFICATES_COL = "Certificates"
+	AUTHORITIES_COL  = "Authorities"
+)
+
 type InfinimeshGraphSchema struct {
 	Name  string
 	Edges [][]string
@@ -65,7 +72,20 @@ type InfinimeshGraphSchema struct {
 var COLLECTIONS = []string{
 	ACCOUNTS_COL, NAMESPACES_COL,
 	CREDENTIALS_COL, DEVICES_COL,
-	PLUGINS_COL,
+	PLUGINS_COL, REVOCATIONS_COL,
+	CERTIFICATES_COL, AUTHORITIES_COL,
+}
+
+// InfinimeshIndexSchema - persistent index over Fields of the Collection
+type InfinimeshIndexSchema struct {
+	Collection string
+	Fields     []string
+}
+
+var INDEXES = []InfinimeshIndexSchema{
+	{CERTIFICATES_COL, []string{"fingerprint", "state"}},
+	{CERTIFICATES_COL, []string{"device"}},
+	{DEVICES_COL, []string{"certificate.fingerprint"}},
 }
 
 var PERMISSIONS_GRAPH = InfinimeshGraphSchema{
@@ -76,6 +96,7 @@ var PERMISSIONS_GRAPH = InfinimeshGraphSchema{
 		{NAMESPACES_COL, ACCOUNTS_COL},
 		{NAMESPACES_COL, DEVICES_COL},
 		{NAMESPACES_COL, PLUGINS_COL},
+		{DEVICES_COL, DEVICES_COL},
 	},
 }
 var CREDENTIALS_GRAPH = InfinimeshGraphSchema{
@@ -0,0 +1,689 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jsonschema validates JSON documents against JSON Schema.
+//
+// Supported are the structural and validation keywords shared by drafts 4 to 2020-12:
+// type, enum, const, numeric and string bounds, pattern, items (including draft 4 tuples), prefixItems,
+// properties, patternProperties, additionalProperties, required, property count bounds,
+// allOf, anyOf, oneOf, not and local $ref ("#/definitions/..." and "#/$defs/...").
+// Unknown keywords, including format, are ignored as annotations
+package jsonschema
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// maxErrors - validation stops collecting errors after this many
+const maxErrors = 16
+
+var ErrInvalidSchema = errors.New("invalid schema")
+
+// Error - single validation failure, Path is JSON Pointer to the invalid value
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError - all failures found in the document
+type ValidationError struct {
+	Errors []Error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Schema - compiled JSON Schema
+type Schema struct {
+	root *node
+}
+
+type node struct {
+	// boolean schema, true accepts and false rejects everything
+	always *bool
+
+	// target - schema $ref points to
+	target *node
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	items           *node
+	prefixItems     []*node
+	additionalItems *node
+	minItems        *int
+	maxItems        *int
+	uniqueItems     bool
+
+	properties           map[string]*node
+	patternProperties    []patternNode
+	additionalProperties *node
+	required             []string
+	minProperties        *int
+	maxProperties        *int
+
+	allOf, anyOf, oneOf []*node
+	not                 *node
+}
+
+type patternNode struct {
+	re   *regexp.Regexp
+	node *node
+}
+
+// Compile - compiles schema given as decoded JSON (e.g. result of structpb.Struct.AsMap)
+func Compile(schema interface{}) (*Schema, error) {
+	c := &compiler{doc: schema, refs: make(map[string]*node)}
+	root, err := c.compile(schema, "#")
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// FromStruct - compiles schema stored as google.protobuf.Struct
+func FromStruct(s *structpb.Struct) (*Schema, error) {
+	return Compile(s.AsMap())
+}
+
+// Validate - validates decoded JSON document, returns *ValidationError if it doesn't match the schema
+func (s *Schema) Validate(instance interface{}) error {
+	v := &validator{}
+	v.validate(s.root, instance, "")
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+// ValidateStruct - validates document stored as google.protobuf.Struct
+func (s *Schema) ValidateStruct(data *structpb.Struct) error {
+	return s.Validate(data.AsMap())
+}
+
+type compiler struct {
+	doc  interface{}
+	refs map[string]*node
+}
+
+func (c *compiler) compile(schema interface{}, path string) (*node, error) {
+	if b, ok := schema.(bool); ok {
+		return &node{always: &b}, nil
+	}
+	m, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s must be an object or boolean", ErrInvalidSchema, path)
+	}
+
+	n := &node{}
+	if ref, ok := m["$ref"]; ok {
+		s, ok := ref.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s/$ref must be a string", ErrInvalidSchema, path)
+		}
+		if err := c.resolve(n, s); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	kw := keywords{m: m, path: path}
+
+	if t, ok := m["type"]; ok {
+		switch t := t.(type) {
+		case string:
+			n.types = []string{t}
+		case []interface{}:
+			for _, item := range t {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%w: %s/type must be a string or array of strings", ErrInvalidSchema, path)
+				}
+				n.types = append(n.types, s)
+			}
+		default:
+			return nil, fmt.Errorf("%w: %s/type must be a string or array of strings", ErrInvalidSchema, path)
+		}
+	}
+	if e, ok := m["enum"]; ok {
+		if n.enum, ok = e.([]interface{}); !ok {
+			return nil, fmt.Errorf("%w: %s/enum must be an array", ErrInvalidSchema, path)
+		}
+	}
+	n.constant, n.hasConst = m["const"]
+
+	if n.minimum, err = kw.number("minimum"); err != nil {
+		return nil, err
+	}
+	if n.maximum, err = kw.number("maximum"); err != nil {
+		return nil, err
+	}
+	if n.multipleOf, err = kw.number("multipleOf"); err != nil {
+		return nil, err
+	}
+	// Draft 4 uses booleans modifying minimum and maximum, later drafts use numbers
+	for _, k := range []struct {
+		name  string
+		bound **float64
+		dst   **float64
+	}{{"exclusiveMinimum", &n.minimum, &n.exclusiveMinimum}, {"exclusiveMaximum", &n.maximum, &n.exclusiveMaximum}} {
+		switch v := m[k.name].(type) {
+		case nil:
+		case bool:
+			if v {
+				*k.dst, *k.bound = *k.bound, nil
+			}
+		case float64:
+			*k.dst = &v
+		default:
+			return nil, fmt.Errorf("%w: %s/%s must be a number or boolean", ErrInvalidSchema, path, k.name)
+		}
+	}
+
+	if n.minLength, err = kw.count("minLength"); err != nil {
+		return nil, err
+	}
+	if n.maxLength, err = kw.count("maxLength"); err != nil {
+		return nil, err
+	}
+	if p, ok := m["pattern"]; ok {
+		if n.pattern, err = kw.regexp("pattern", p); err != nil {
+			return nil, err
+		}
+	}
+
+	switch items := m["items"].(type) {
+	case nil:
+	case []interface{}:
+		if n.prefixItems, err = c.compileList(items, path+"/items"); err != nil {
+			return nil, err
+		}
+		if a, ok := m["additionalItems"]; ok {
+			if n.additionalItems, err = c.compile(a, path+"/additionalItems"); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		if n.items, err = c.compile(items, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	if p, ok := m["prefixItems"]; ok {
+		list, ok := p.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: %s/prefixItems must be an array", ErrInvalidSchema, path)
+		}
+		if n.prefixItems, err = c.compileList(list, path+"/prefixItems"); err != nil {
+			return nil, err
+		}
+		// items after prefixItems applies to the rest of the array
+		n.additionalItems, n.items = n.items, nil
+	}
+	if n.minItems, err = kw.count("minItems"); err != nil {
+		return nil, err
+	}
+	if n.maxItems, err = kw.count("maxItems"); err != nil {
+		return nil, err
+	}
+	n.uniqueItems, _ = m["uniqueItems"].(bool)
+
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: %s/properties must be an object", ErrInvalidSchema, path)
+		}
+		n.properties = make(map[string]*node, len(props))
+		for name, prop := range props {
+			if n.properties[name], err = c.compile(prop, path+"/properties/"+escape(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p, ok := m["patternProperties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: %s/patternProperties must be an object", ErrInvalidSchema, path)
+		}
+		for _, pattern := range sortedKeys(props) {
+			re, err := kw.regexp("patternProperties", pattern)
+			if err != nil {
+				return nil, err
+			}
+			sub, err := c.compile(props[pattern], path+"/patternProperties/"+escape(pattern))
+			if err != nil {
+				return nil, err
+			}
+			n.patternProperties = append(n.patternProperties, patternNode{re, sub})
+		}
+	}
+	if a, ok := m["additionalProperties"]; ok {
+		if n.additionalProperties, err = c.compile(a, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if r, ok := m["required"]; ok {
+		list, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: %s/required must be an array of strings", ErrInvalidSchema, path)
+		}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s/required must be an array of strings", ErrInvalidSchema, path)
+			}
+			n.required = append(n.required, s)
+		}
+	}
+	if n.minProperties, err = kw.count("minProperties"); err != nil {
+		return nil, err
+	}
+	if n.maxProperties, err = kw.count("maxProperties"); err != nil {
+		return nil, err
+	}
+
+	for _, k := range []struct {
+		name string
+		dst  *[]*node
+	}{{"allOf", &n.allOf}, {"anyOf", &n.anyOf}, {"oneOf", &n.oneOf}} {
+		v, ok := m[k.name]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("%w: %s/%s must be a non-empty array", ErrInvalidSchema, path, k.name)
+		}
+		if *k.dst, err = c.compileList(list, path+"/"+k.name); err != nil {
+			return nil, err
+		}
+	}
+	if not, ok := m["not"]; ok {
+		if n.not, err = c.compile(not, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+func (c *compiler) compileList(list []interface{}, path string) ([]*node, error) {
+	res := make([]*node, len(list))
+	for i, item := range list {
+		n, err := c.compile(item, path+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		res[i] = n
+	}
+	return res, nil
+}
+
+// resolve - links node to the schema $ref points to within the same document, each target is compiled once so recursive schemas terminate
+func (c *compiler) resolve(n *node, ref string) error {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return fmt.Errorf("%w: only local $ref is supported, got %q", ErrInvalidSchema, ref)
+	}
+	if target, ok := c.refs[ref]; ok {
+		n.target = target
+		return nil
+	}
+	target := &node{}
+	c.refs[ref] = target
+	n.target = target
+
+	schema := c.doc
+	if ref != "#" {
+		for _, token := range strings.Split(ref[2:], "/") {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			switch s := schema.(type) {
+			case map[string]interface{}:
+				schema = s[token]
+			case []interface{}:
+				i, err := strconv.Atoi(token)
+				if err != nil || i < 0 || i >= len(s) {
+					return fmt.Errorf("%w: unresolved $ref %q", ErrInvalidSchema, ref)
+				}
+				schema = s[i]
+			default:
+				schema = nil
+			}
+			if schema == nil {
+				return fmt.Errorf("%w: unresolved $ref %q", ErrInvalidSchema, ref)
+			}
+		}
+	}
+
+	compiled, err := c.compile(schema, ref)
+	if err != nil {
+		return err
+	}
+	*target = *compiled
+	return nil
+}
+
+type keywords struct {
+	m    map[string]interface{}
+	path string
+}
+
+func (k keywords) number(name string) (*float64, error) {
+	v, ok := k.m[name]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s must be a number", ErrInvalidSchema, k.path, name)
+	}
+	return &f, nil
+}
+
+func (k keywords) count(name string) (*int, error) {
+	f, err := k.number(name)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	if *f < 0 || *f != math.Trunc(*f) {
+		return nil, fmt.Errorf("%w: %s/%s must be a non-negative integer", ErrInvalidSchema, k.path, name)
+	}
+	n := int(*f)
+	return &n, nil
+}
+
+func (k keywords) regexp(name string, v interface{}) (*regexp.Regexp, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s must be a string", ErrInvalidSchema, k.path, name)
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s/%s: %v", ErrInvalidSchema, k.path, name, err)
+	}
+	return re, nil
+}
+
+type validator struct {
+	errors []Error
+}
+
+func (v *validator) fail(path, format string, args ...interface{}) {
+	if len(v.errors) < maxErrors {
+		v.errors = append(v.errors, Error{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// valid - checks the instance against subschema without reporting its errors
+func valid(n *node, instance interface{}) bool {
+	sub := &validator{}
+	sub.validate(n, instance, "")
+	return len(sub.errors) == 0
+}
+
+func (v *validator) validate(n *node, instance interface{}, path string) {
+	if n.always != nil {
+		if !*n.always {
+			v.fail(path, "no value is allowed")
+		}
+		return
+	}
+	if n.target != nil {
+		v.validate(n.target, instance, path)
+	}
+
+	if len(n.types) > 0 && !matchesType(n.types, instance) {
+		v.fail(path, "must be %s, got %s", strings.Join(n.types, " or "), typeOf(instance))
+		// Further keywords would only report the same mismatch in other words
+		return
+	}
+	if n.enum != nil {
+		found := false
+		for _, e := range n.enum {
+			if equal(e, instance) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "must be one of the enumerated values")
+		}
+	}
+	if n.hasConst && !equal(n.constant, instance) {
+		v.fail(path, "must be equal to %v", n.constant)
+	}
+
+	switch i := instance.(type) {
+	case float64:
+		v.number(n, i, path)
+	case string:
+		v.string(n, i, path)
+	case []interface{}:
+		v.array(n, i, path)
+	case map[string]interface{}:
+		v.object(n, i, path)
+	}
+
+	for _, sub := range n.allOf {
+		v.validate(sub, instance, path)
+	}
+	if n.anyOf != nil {
+		ok := false
+		for _, sub := range n.anyOf {
+			if valid(sub, instance) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			v.fail(path, "must match at least one schema of anyOf")
+		}
+	}
+	if n.oneOf != nil {
+		matched := 0
+		for _, sub := range n.oneOf {
+			if valid(sub, instance) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(path, "must match exactly one schema of oneOf, matched %d", matched)
+		}
+	}
+	if n.not != nil && valid(n.not, instance) {
+		v.fail(path, "must not match the schema of not")
+	}
+}
+
+func (v *validator) number(n *node, f float64, path string) {
+	if n.minimum != nil && f < *n.minimum {
+		v.fail(path, "must be >= %v", *n.minimum)
+	}
+	if n.maximum != nil && f > *n.maximum {
+		v.fail(path, "must be <= %v", *n.maximum)
+	}
+	if n.exclusiveMinimum != nil && f <= *n.exclusiveMinimum {
+		v.fail(path, "must be > %v", *n.exclusiveMinimum)
+	}
+	if n.exclusiveMaximum != nil && f >= *n.exclusiveMaximum {
+		v.fail(path, "must be < %v", *n.exclusiveMaximum)
+	}
+	if n.multipleOf != nil && *n.multipleOf != 0 {
+		if q := f / *n.multipleOf; q != math.Trunc(q) {
+			v.fail(path, "must be a multiple of %v", *n.multipleOf)
+		}
+	}
+}
+
+func (v *validator) string(n *node, s string, path string) {
+	length := utf8.RuneCountInString(s)
+	if n.minLength != nil && length < *n.minLength {
+		v.fail(path, "must be at least %d characters long", *n.minLength)
+	}
+	if n.maxLength != nil && length > *n.maxLength {
+		v.fail(path, "must be at most %d characters long", *n.maxLength)
+	}
+	if n.pattern != nil && !n.pattern.MatchString(s) {
+		v.fail(path, "must match pattern %q", n.pattern.String())
+	}
+}
+
+func (v *validator) array(n *node, a []interface{}, path string) {
+	if n.minItems != nil && len(a) < *n.minItems {
+		v.fail(path, "must have at least %d items", *n.minItems)
+	}
+	if n.maxItems != nil && len(a) > *n.maxItems {
+		v.fail(path, "must have at most %d items", *n.maxItems)
+	}
+	if n.uniqueItems {
+	unique:
+		for i := range a {
+			for j := i + 1; j < len(a); j++ {
+				if equal(a[i], a[j]) {
+					v.fail(path, "items %d and %d must be unique", i, j)
+					break unique
+				}
+			}
+		}
+	}
+
+	for i, item := range a {
+		itemPath := path + "/" + strconv.Itoa(i)
+		switch {
+		case i < len(n.prefixItems):
+			v.validate(n.prefixItems[i], item, itemPath)
+		case n.prefixItems != nil && n.additionalItems != nil:
+			v.validate(n.additionalItems, item, itemPath)
+		case n.items != nil:
+			v.validate(n.items, item, itemPath)
+		}
+	}
+}
+
+func (v *validator) object(n *node, o map[string]interface{}, path string) {
+	if n.minProperties != nil && len(o) < *n.minProperties {
+		v.fail(path, "must have at least %d properties", *n.minProperties)
+	}
+	if n.maxProperties != nil && len(o) > *n.maxProperties {
+		v.fail(path, "must have at most %d properties", *n.maxProperties)
+	}
+	for _, name := range n.required {
+		if _, ok := o[name]; !ok {
+			v.fail(path, "missing required property %q", name)
+		}
+	}
+
+	for _, name := range sortedKeys(o) {
+		value, propPath := o[name], path+"/"+escape(name)
+		matched := false
+		if sub, ok := n.properties[name]; ok {
+			v.validate(sub, value, propPath)
+			matched = true
+		}
+		for _, p := range n.patternProperties {
+			if p.re.MatchString(name) {
+				v.validate(p.node, value, propPath)
+				matched = true
+			}
+		}
+		if !matched && n.additionalProperties != nil {
+			if a := n.additionalProperties.always; a != nil && !*a {
+				v.fail(path, "property %q is not allowed", name)
+				continue
+			}
+			v.validate(n.additionalProperties, value, propPath)
+		}
+	}
+}
+
+func matchesType(types []string, instance interface{}) bool {
+	for _, t := range types {
+		switch t {
+		case "integer":
+			if f, ok := instance.(float64); ok && f == math.Trunc(f) && !math.IsInf(f, 0) {
+				return true
+			}
+		case typeOf(instance):
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(instance interface{}) string {
+	switch instance.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", instance)
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// escape - escapes JSON Pointer reference token
+func escape(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,150 @@
+package jsonschema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/jsonschema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compile(t *testing.T, schema string) *jsonschema.Schema {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(schema), &doc))
+	s, err := jsonschema.Compile(doc)
+	require.NoError(t, err)
+	return s
+}
+
+func validate(t *testing.T, s *jsonschema.Schema, instance string) error {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(instance), &doc))
+	return s.Validate(doc)
+}
+
+const thermostat = `{
+	"type": "object",
+	"properties": {
+		"temperature": {"type": "number", "minimum": -40, "maximum": 85},
+		"mode": {"enum": ["heat", "cool", "off"]},
+		"name": {"type": "string", "maxLength": 8, "pattern": "^[a-z]+$"},
+		"schedule": {"type": "array", "items": {"$ref": "#/$defs/slot"}, "maxItems": 2},
+		"count": {"type": "integer"}
+	},
+	"required": ["temperature"],
+	"additionalProperties": false,
+	"$defs": {
+		"slot": {
+			"type": "object",
+			"properties": {"at": {"type": "string"}, "temperature": {"type": "number"}},
+			"required": ["at"]
+		}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	s := compile(t, thermostat)
+
+	cases := []struct {
+		instance string
+		errors   []string
+	}{
+		{`{"temperature": 21.5, "mode": "heat", "name": "hall", "count": 3, "schedule": [{"at": "08:00"}]}`, nil},
+		{`{"mode": "heat"}`, []string{`missing required property "temperature"`}},
+		{`{"temperature": 100}`, []string{"/temperature: must be <= 85"}},
+		{`{"temperature": "hot"}`, []string{"/temperature: must be number, got string"}},
+		{`{"temperature": 1, "mode": "auto"}`, []string{"/mode: must be one of the enumerated values"}},
+		{`{"temperature": 1, "name": "Living Room"}`, []string{
+			"/name: must be at most 8 characters long", `/name: must match pattern "^[a-z]+$"`,
+		}},
+		{`{"temperature": 1, "count": 1.5}`, []string{"/count: must be integer, got number"}},
+		{`{"temperature": 1, "schedule": [{"temperature": 1}]}`, []string{`/schedule/0: missing required property "at"`}},
+		{`{"temperature": 1, "humidity": 40}`, []string{`property "humidity" is not allowed`}},
+		{`[]`, []string{"must be object, got array"}},
+	}
+
+	for _, c := range cases {
+		err := validate(t, s, c.instance)
+		if c.errors == nil {
+			assert.NoError(t, err, c.instance)
+			continue
+		}
+
+		var verr *jsonschema.ValidationError
+		require.ErrorAs(t, err, &verr, c.instance)
+		var msgs []string
+		for _, e := range verr.Errors {
+			msgs = append(msgs, e.Error())
+		}
+		assert.Equal(t, c.errors, msgs, c.instance)
+	}
+}
+
+func TestValidate_Combinators(t *testing.T) {
+	s := compile(t, `{
+		"oneOf": [{"type": "string"}, {"type": "number", "minimum": 0}],
+		"not": {"const": "forbidden"}
+	}`)
+
+	assert.NoError(t, validate(t, s, `"ok"`))
+	assert.NoError(t, validate(t, s, `1`))
+	assert.Error(t, validate(t, s, `-1`))
+	assert.Error(t, validate(t, s, `"forbidden"`))
+	assert.Error(t, validate(t, s, `true`))
+
+	s = compile(t, `{"anyOf": [{"maximum": 0}, {"multipleOf": 10}]}`)
+	assert.NoError(t, validate(t, s, `-5`))
+	assert.NoError(t, validate(t, s, `20`))
+	assert.Error(t, validate(t, s, `15`))
+}
+
+func TestValidate_Draft4(t *testing.T) {
+	s := compile(t, `{
+		"type": "array",
+		"items": [{"type": "string"}, {"type": "number", "minimum": 0, "exclusiveMinimum": true}],
+		"additionalItems": false,
+		"uniqueItems": true
+	}`)
+
+	assert.NoError(t, validate(t, s, `["a", 1]`))
+	assert.Error(t, validate(t, s, `["a", 0]`))
+	assert.Error(t, validate(t, s, `["a", 1, 2]`))
+	assert.Error(t, validate(t, s, `[1, 1]`))
+}
+
+func TestValidate_RecursiveRef(t *testing.T) {
+	s := compile(t, `{
+		"definitions": {
+			"tree": {
+				"type": "object",
+				"properties": {"children": {"type": "array", "items": {"$ref": "#/definitions/tree"}}},
+				"additionalProperties": {"type": "number"}
+			}
+		},
+		"$ref": "#/definitions/tree"
+	}`)
+
+	assert.NoError(t, validate(t, s, `{"a": 1, "children": [{"b": 2, "children": []}]}`))
+
+	err := validate(t, s, `{"children": [{"children": [{"c": "x"}]}]}`)
+	assert.EqualError(t, err, "/children/0/children/0/c: must be number, got string")
+}
+
+func TestCompile_Invalid(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": 1}`,
+		`{"minimum": "1"}`,
+		`{"pattern": "("}`,
+		`{"required": "a"}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"$ref": "http://example.com/schema"}`,
+		`{"anyOf": []}`,
+		`"object"`,
+	} {
+		var doc interface{}
+		require.NoError(t, json.Unmarshal([]byte(schema), &doc))
+		_, err := jsonschema.Compile(doc)
+		assert.ErrorIs(t, err, jsonschema.ErrInvalidSchema, schema)
+	}
+}
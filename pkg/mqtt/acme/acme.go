@@ -5,12 +5,27 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 )
 
 type Domain struct {
-	Main string `json:"main"`
+	Main string   `json:"main"`
+	Sans []string `json:"sans,omitempty"`
+}
+
+// IsMQTT - whether certificate is issued for an mqtt.* domain
+func (d Domain) IsMQTT() bool {
+	if strings.HasPrefix(d.Main, "mqtt.") {
+		return true
+	}
+	for _, san := range d.Sans {
+		if strings.HasPrefix(san, "mqtt.") {
+			return true
+		}
+	}
+	return false
 }
 
 type Certificate struct {
@@ -33,30 +48,49 @@ type ACME struct {
 	Letsencrypt letsencrypt `json:"letsencrypt"`
 }
 
+// Load - first certificate issued for an mqtt.* domain
 func Load(path string) (tls.Certificate, error) {
-	data, err := os.ReadFile(path)
+	certs, err := LoadAll(path)
 	if err != nil {
 		return tls.Certificate{}, err
 	}
+	return certs[0], nil
+}
+
+// LoadAll - all certificates issued for mqtt.* domains, in the order they're stored
+func LoadAll(path string) ([]tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 	var acme ACME
 	err = json.Unmarshal(data, &acme)
 	if err != nil {
-		return tls.Certificate{}, err
+		return nil, err
 	}
 
+	var res []tls.Certificate
 	for _, cert := range acme.Letsencrypt.Certificates {
-		if strings.HasPrefix(cert.Domain.Main, "mqtt.") {
-			c, err := base64.StdEncoding.DecodeString(cert.Certificate)
-			if err != nil {
-				return tls.Certificate{}, err
-			}
-			k, err := base64.StdEncoding.DecodeString(cert.Key)
-			if err != nil {
-				return tls.Certificate{}, err
-			}
-			return tls.X509KeyPair(c, k)
+		if !cert.Domain.IsMQTT() {
+			continue
 		}
+		c, err := base64.StdEncoding.DecodeString(cert.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		k, err := base64.StdEncoding.DecodeString(cert.Key)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(c, k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cert.Domain.Main, err)
+		}
+		res = append(res, pair)
 	}
 
-	return tls.Certificate{}, errors.New("mqtt certificate not found")
+	if len(res) == 0 {
+		return nil, errors.New("mqtt certificate not found")
+	}
+	return res, nil
 }
@@ -0,0 +1,198 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package certstore serves server certificates to TLS listeners via GetCertificate and reloads them
+// once the files they're loaded from change, so renewed certificates are picked up without a restart
+package certstore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// debounce - time to wait for the writes to settle before reloading, renewals usually touch several files
+const debounce = 500 * time.Millisecond
+
+// LoadFunc - reads certificates, first one is served to Clients not sending SNI or asking for an unknown name
+type LoadFunc func() ([]tls.Certificate, error)
+
+// KeyPair - LoadFunc reading PEM encoded certificate and key files
+func KeyPair(certFile, keyFile string) LoadFunc {
+	return func() ([]tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return []tls.Certificate{cert}, nil
+	}
+}
+
+type Store struct {
+	log   *zap.Logger
+	load  LoadFunc
+	files []string
+
+	mu     sync.RWMutex
+	certs  []*tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// New - loads certificates right away, files are the ones Watch must reload them on
+func New(log *zap.Logger, load LoadFunc, files ...string) (*Store, error) {
+	s := &Store{
+		log:   log.Named("CertStore"),
+		load:  load,
+		files: files,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload - loads certificates again, currently served ones are kept if that fails
+func (s *Store) Reload() error {
+	loaded, err := s.load()
+	if err != nil {
+		return err
+	}
+	if len(loaded) == 0 {
+		return errors.New("no certificates loaded")
+	}
+
+	certs := make([]*tls.Certificate, 0, len(loaded))
+	byName := make(map[string]*tls.Certificate)
+	for i := range loaded {
+		cert := &loaded[i]
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return err
+			}
+			cert.Leaf = leaf
+		}
+		certs = append(certs, cert)
+
+		if cert.Leaf == nil {
+			continue
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// Earlier certificates win, same as the order of preference in the source
+			if _, ok := byName[name]; !ok {
+				byName[name] = cert
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.certs, s.byName = certs, byName
+	s.mu.Unlock()
+
+	for _, cert := range certs {
+		if cert.Leaf != nil {
+			s.log.Info("Certificate loaded", zap.Strings("names", cert.Leaf.DNSNames), zap.Time("not_after", cert.Leaf.NotAfter))
+		}
+	}
+	return nil
+}
+
+// GetCertificate - picks certificate by SNI: exact name, then wildcard, then the first one. Meant for tls.Config.GetCertificate
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.certs) == 0 {
+		return nil, errors.New("no certificates loaded")
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := s.byName[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := s.byName["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// Watch - reloads certificates once any of the files changes until ctx is done.
+// Parent directories are watched, so files replaced by rename or symlink swap (e.g. Kubernetes Secrets) are noticed too
+func (s *Store) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := make(map[string]struct{})
+	for _, file := range s.files {
+		dir := filepath.Dir(file)
+		if _, ok := dirs[dir]; ok {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+		dirs[dir] = struct{}{}
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			s.log.Debug("Certificate directory changed", zap.String("event", event.String()))
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			s.log.Warn("Watcher error", zap.Error(err))
+		case <-timer.C:
+			if err := s.Reload(); err != nil {
+				s.log.Warn("Couldn't reload certificates, keeping current ones", zap.Error(err))
+			}
+		}
+	}
+}
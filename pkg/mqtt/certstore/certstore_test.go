@@ -0,0 +1,112 @@
+package certstore_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/certstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func selfSigned(t *testing.T, serial int64, names ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func pair(t *testing.T, serial int64, names ...string) tls.Certificate {
+	c, k := selfSigned(t, serial, names...)
+	cert, err := tls.X509KeyPair(c, k)
+	require.NoError(t, err)
+	return cert
+}
+
+func serial(t *testing.T, s *certstore.Store, name string) int64 {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	require.NoError(t, err)
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestGetCertificate_SNI(t *testing.T) {
+	s, err := certstore.New(zap.NewNop(), func() ([]tls.Certificate, error) {
+		return []tls.Certificate{
+			pair(t, 1, "mqtt.example.com"),
+			pair(t, 2, "mqtt.example.org", "*.devices.example.org"),
+		}, nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), serial(t, s, "mqtt.example.com"))
+	assert.Equal(t, int64(2), serial(t, s, "MQTT.example.org"))
+	assert.Equal(t, int64(2), serial(t, s, "eu.devices.example.org"))
+	assert.Equal(t, int64(1), serial(t, s, "unknown.example.net"))
+	assert.Equal(t, int64(1), serial(t, s, ""))
+}
+
+func TestNew_Error(t *testing.T) {
+	_, err := certstore.New(zap.NewNop(), certstore.KeyPair("/nonexistent/tls.crt", "/nonexistent/tls.key"))
+	assert.Error(t, err)
+
+	_, err = certstore.New(zap.NewNop(), func() ([]tls.Certificate, error) { return nil, nil })
+	assert.Error(t, err)
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	write := func(serial int64) {
+		c, k := selfSigned(t, serial, "mqtt.example.com")
+		require.NoError(t, os.WriteFile(keyFile, k, 0600))
+		require.NoError(t, os.WriteFile(certFile, c, 0600))
+	}
+	write(1)
+
+	s, err := certstore.New(zap.NewNop(), certstore.KeyPair(certFile, keyFile), certFile, keyFile)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		assert.NoError(t, s.Watch(ctx))
+	}()
+	// Let the watcher start before files change
+	time.Sleep(100 * time.Millisecond)
+
+	// Broken files don't replace the served certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	time.Sleep(time.Second)
+	assert.Equal(t, int64(1), serial(t, s, ""))
+
+	write(2)
+	assert.Eventually(t, func() bool {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+		return err == nil && cert.Leaf.SerialNumber.Int64() == 2
+	}, 5*time.Second, 50*time.Millisecond)
+}
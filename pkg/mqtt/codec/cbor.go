@@ -0,0 +1,350 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// CBOR - RFC 8949 Concise Binary Object Representation
+var CBOR Codec = cborCodec{}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string        { return "cbor" }
+func (cborCodec) ContentType() string { return "application/cbor" }
+
+func (cborCodec) Decode(data []byte) (*structpb.Value, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, ErrTrailingBytes
+	}
+	return v, nil
+}
+
+func (cborCodec) Encode(v *structpb.Value) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := cborEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CBOR Major Types
+const (
+	cborUint byte = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// cborIndefinite - Additional Information value of indefinite length items, terminated by cborBreak
+const (
+	cborIndefinite byte = 31
+	cborBreak      byte = 0xff
+)
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, ErrUnexpectedEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// head - reads initial byte and the argument following it
+func (d *cborDecoder) head() (major, info byte, arg uint64, err error) {
+	b, err := d.read(1)
+	if err != nil {
+		return
+	}
+	major, info = b[0]>>5, b[0]&31
+
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		b, err = d.read(1)
+		if err == nil {
+			arg = uint64(b[0])
+		}
+	case info == 25:
+		b, err = d.read(2)
+		if err == nil {
+			arg = uint64(binary.BigEndian.Uint16(b))
+		}
+	case info == 26:
+		b, err = d.read(4)
+		if err == nil {
+			arg = uint64(binary.BigEndian.Uint32(b))
+		}
+	case info == 27:
+		b, err = d.read(8)
+		if err == nil {
+			arg = binary.BigEndian.Uint64(b)
+		}
+	case info == cborIndefinite:
+		if major == cborUint || major == cborNegInt || major == cborTag {
+			err = fmt.Errorf("cbor: indefinite length of major type %d", major)
+		}
+	default:
+		err = fmt.Errorf("cbor: reserved additional information %d", info)
+	}
+	return
+}
+
+func (d *cborDecoder) isBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) value(depth int) (*structpb.Value, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return structpb.NewNumberValue(float64(arg)), nil
+	case cborNegInt:
+		return structpb.NewNumberValue(-1 - float64(arg)), nil
+	case cborBytes, cborText:
+		s, err := d.str(major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborBytes {
+			return structpb.NewStringValue(base64.StdEncoding.EncodeToString(s)), nil
+		}
+		return structpb.NewStringValue(string(s)), nil
+	case cborArray:
+		list := &structpb.ListValue{}
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && d.isBreak() {
+				break
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list.Values = append(list.Values, v)
+		}
+		return structpb.NewListValue(list), nil
+	case cborMap:
+		s := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && d.isBreak() {
+				break
+			}
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, err := mapKey(k)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			s.Fields[key] = v
+		}
+		return structpb.NewStructValue(s), nil
+	case cborTag:
+		// Tags (e.g. date/time) only give semantics to the tagged item, the item itself is kept as is
+		return d.value(depth + 1)
+	default:
+		return d.simple(info, arg)
+	}
+}
+
+// str - reads byte or text string, indefinite length strings are concatenated from their chunks
+func (d *cborDecoder) str(major, info byte, arg uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		if arg > uint64(len(d.data)) {
+			return nil, ErrUnexpectedEOF
+		}
+		return d.read(int(arg))
+	}
+
+	var res []byte
+	for !d.isBreak() {
+		m, i, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || i == cborIndefinite {
+			return nil, fmt.Errorf("cbor: invalid chunk of indefinite length string")
+		}
+		chunk, err := d.str(m, i, n)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, chunk...)
+	}
+	return res, nil
+}
+
+func (d *cborDecoder) simple(info byte, arg uint64) (*structpb.Value, error) {
+	switch info {
+	case 20:
+		return structpb.NewBoolValue(false), nil
+	case 21:
+		return structpb.NewBoolValue(true), nil
+	case 22, 23: // null, undefined
+		return structpb.NewNullValue(), nil
+	case 25:
+		return structpb.NewNumberValue(float16(uint16(arg))), nil
+	case 26:
+		return structpb.NewNumberValue(float64(math.Float32frombits(uint32(arg)))), nil
+	case 27:
+		return structpb.NewNumberValue(math.Float64frombits(arg)), nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+}
+
+// float16 - IEEE 754 half-precision float to float64
+func float16(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(mant+1024, exp-25)
+}
+
+// mapKey - JSON objects only have string keys, numeric and boolean keys are formatted
+func mapKey(k *structpb.Value) (string, error) {
+	switch k := k.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return k.StringValue, nil
+	case *structpb.Value_NumberValue:
+		return fmt.Sprint(k.NumberValue), nil
+	case *structpb.Value_BoolValue:
+		return fmt.Sprint(k.BoolValue), nil
+	}
+	return "", ErrUnsupportedKey
+}
+
+func cborHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
+
+func cborEncode(buf *bytes.Buffer, v *structpb.Value) error {
+	switch k := v.GetKind().(type) {
+	case nil, *structpb.Value_NullValue:
+		buf.WriteByte(cborSimple<<5 | 22)
+	case *structpb.Value_BoolValue:
+		if k.BoolValue {
+			buf.WriteByte(cborSimple<<5 | 21)
+		} else {
+			buf.WriteByte(cborSimple<<5 | 20)
+		}
+	case *structpb.Value_NumberValue:
+		n := k.NumberValue
+		switch {
+		case isInt(n) && n >= 0:
+			cborHead(buf, cborUint, uint64(n))
+		case isInt(n):
+			cborHead(buf, cborNegInt, uint64(-1-n))
+		default:
+			buf.WriteByte(cborSimple<<5 | 27)
+			buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(n)))
+		}
+	case *structpb.Value_StringValue:
+		cborHead(buf, cborText, uint64(len(k.StringValue)))
+		buf.WriteString(k.StringValue)
+	case *structpb.Value_ListValue:
+		values := k.ListValue.GetValues()
+		cborHead(buf, cborArray, uint64(len(values)))
+		for _, item := range values {
+			if err := cborEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	case *structpb.Value_StructValue:
+		fields := k.StructValue.GetFields()
+		cborHead(buf, cborMap, uint64(len(fields)))
+		for _, key := range sortedKeys(fields) {
+			cborHead(buf, cborText, uint64(len(key)))
+			buf.WriteString(key)
+			if err := cborEncode(buf, fields[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isInt - whether the number is integral and fits 64 bit integer, so it can be encoded as one
+func isInt(n float64) bool {
+	return n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64
+}
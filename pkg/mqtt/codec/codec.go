@@ -0,0 +1,124 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package codec converts device payloads between wire formats (JSON, CBOR, MessagePack, Protobuf) and structpb.Value.
+// Only the JSON compatible subset of binary formats is supported: byte strings are converted to base64 strings,
+// CBOR tags are ignored and MessagePack extensions are rejected
+package codec
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// maxDepth - maximum nesting of arrays and maps binary decoders accept
+const maxDepth = 64
+
+var (
+	ErrUnknownCodec   = errors.New("unknown codec")
+	ErrTooDeep        = errors.New("payload is nested too deep")
+	ErrUnexpectedEOF  = errors.New("unexpected end of payload")
+	ErrTrailingBytes  = errors.New("unexpected bytes after payload")
+	ErrNotAnObject    = errors.New("payload is not an object")
+	ErrUnsupportedKey = errors.New("unsupported map key type")
+)
+
+type Codec interface {
+	// Name - short name used in topic suffixes and device tags, e.g. "cbor"
+	Name() string
+	// ContentType - MIME type used as MQTT 5 Content Type
+	ContentType() string
+
+	Decode(data []byte) (*structpb.Value, error)
+	Encode(v *structpb.Value) ([]byte, error)
+}
+
+var (
+	mu            sync.RWMutex
+	byName        = make(map[string]Codec)
+	byContentType = make(map[string]Codec)
+)
+
+// Register - makes codec available by its name and content type, replacing the previously registered one
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	byName[c.Name()] = c
+	byContentType[c.ContentType()] = c
+}
+
+// ByName - returns nil if there is no such codec
+func ByName(name string) Codec {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return byName[name]
+}
+
+// ByContentType - returns nil if there is no such codec
+func ByContentType(contentType string) Codec {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return byContentType[contentType]
+}
+
+// Names - names of all registered codecs in alphabetical order
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	res := make([]string, 0, len(byName))
+	for name := range byName {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// DecodeStruct - decodes payload which must be an object, e.g. Reported state
+func DecodeStruct(c Codec, data []byte) (*structpb.Struct, error) {
+	v, err := c.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	s := v.GetStructValue()
+	if s == nil {
+		return nil, ErrNotAnObject
+	}
+	return s, nil
+}
+
+func init() {
+	Register(JSON)
+	Register(CBOR)
+	Register(MessagePack)
+	Register(Protobuf)
+}
+
+// sortedKeys - keys of the map in alphabetical order, so encoding is deterministic
+func sortedKeys(fields map[string]*structpb.Value) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
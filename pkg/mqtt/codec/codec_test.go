@@ -0,0 +1,158 @@
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func sample(t *testing.T) *structpb.Value {
+	v, err := structpb.NewValue(map[string]interface{}{
+		"temperature": 21.5,
+		"humidity":    40,
+		"negative":    -300,
+		"name":        "sensor",
+		"on":          true,
+		"missing":     nil,
+		"list":        []interface{}{1, "two", false},
+		"nested":      map[string]interface{}{"a": map[string]interface{}{"b": 1}},
+	})
+	require.NoError(t, err)
+	return v
+}
+
+func TestRegistry(t *testing.T) {
+	assert.Equal(t, []string{"cbor", "json", "msgpack", "protobuf"}, codec.Names())
+	assert.Equal(t, codec.CBOR, codec.ByName("cbor"))
+	assert.Equal(t, codec.MessagePack, codec.ByContentType("application/msgpack"))
+	assert.Nil(t, codec.ByName("xml"))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range codec.Names() {
+		t.Run(name, func(t *testing.T) {
+			c := codec.ByName(name)
+			v := sample(t)
+
+			data, err := c.Encode(v)
+			require.NoError(t, err)
+
+			res, err := c.Decode(data)
+			require.NoError(t, err)
+			assert.True(t, proto.Equal(v, res), "expected %v, got %v", v, res)
+		})
+	}
+}
+
+func TestCBOR_Decode(t *testing.T) {
+	// {"a": 1, "b": [2, -3], "c": h'0102', "d": 1.5 (half), "e": 0("2023-01-01"), "f": undefined}
+	data := []byte{
+		0xa6,
+		0x61, 'a', 0x01,
+		0x61, 'b', 0x82, 0x02, 0x22,
+		0x61, 'c', 0x42, 0x01, 0x02,
+		0x61, 'd', 0xf9, 0x3e, 0x00,
+		0x61, 'e', 0xc0, 0x6a, '2', '0', '2', '3', '-', '0', '1', '-', '0', '1',
+		0x61, 'f', 0xf7,
+	}
+	s, err := codec.DecodeStruct(codec.CBOR, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"a": 1.0,
+		"b": []interface{}{2.0, -3.0},
+		"c": "AQI=",
+		"d": 1.5,
+		"e": "2023-01-01",
+		"f": nil,
+	}, s.AsMap())
+}
+
+func TestCBOR_Decode_Indefinite(t *testing.T) {
+	// {_ "a": [_ 1, 2], "b": (_ "x", "y")}
+	data := []byte{
+		0xbf,
+		0x61, 'a', 0x9f, 0x01, 0x02, 0xff,
+		0x61, 'b', 0x7f, 0x61, 'x', 0x61, 'y', 0xff,
+		0xff,
+	}
+	s, err := codec.DecodeStruct(codec.CBOR, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"a": []interface{}{1.0, 2.0},
+		"b": "xy",
+	}, s.AsMap())
+}
+
+func TestMessagePack_Decode(t *testing.T) {
+	// {"a": -1, "b": uint16 300, "c": bin8 0102, "d": float32 1.5, "e": int8 -100}
+	data := []byte{
+		0x85,
+		0xa1, 'a', 0xff,
+		0xa1, 'b', 0xcd, 0x01, 0x2c,
+		0xa1, 'c', 0xc4, 0x02, 0x01, 0x02,
+		0xa1, 'd', 0xca, 0x3f, 0xc0, 0x00, 0x00,
+		0xa1, 'e', 0xd0, 0x9c,
+	}
+	s, err := codec.DecodeStruct(codec.MessagePack, data)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"a": -1.0,
+		"b": 300.0,
+		"c": "AQI=",
+		"d": 1.5,
+		"e": -100.0,
+	}, s.AsMap())
+}
+
+func TestMessagePack_Encode_Compact(t *testing.T) {
+	v, err := structpb.NewValue(map[string]interface{}{"a": 1})
+	require.NoError(t, err)
+
+	data, err := codec.MessagePack.Encode(v)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x81, 0xa1, 'a', 0x01}, data)
+}
+
+func TestDecode_Errors(t *testing.T) {
+	_, err := codec.CBOR.Decode([]byte{0x82, 0x01})
+	assert.ErrorIs(t, err, codec.ErrUnexpectedEOF)
+
+	_, err = codec.CBOR.Decode([]byte{0x01, 0x02})
+	assert.ErrorIs(t, err, codec.ErrTrailingBytes)
+
+	// {[]: 1}
+	_, err = codec.CBOR.Decode([]byte{0xa1, 0x80, 0x01})
+	assert.ErrorIs(t, err, codec.ErrUnsupportedKey)
+
+	_, err = codec.MessagePack.Decode([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})
+	assert.ErrorIs(t, err, codec.ErrUnexpectedEOF)
+
+	// fixext 1
+	_, err = codec.MessagePack.Decode([]byte{0xd4, 0x01, 0x00})
+	assert.Error(t, err)
+
+	_, err = codec.DecodeStruct(codec.MessagePack, []byte{0x01})
+	assert.ErrorIs(t, err, codec.ErrNotAnObject)
+}
+
+func TestDecode_TooDeep(t *testing.T) {
+	deep := make([]byte, 100)
+	for i := range deep {
+		deep[i] = 0x81 // array of 1 element
+	}
+	_, err := codec.CBOR.Decode(deep)
+	assert.ErrorIs(t, err, codec.ErrTooDeep)
+
+	for i := range deep {
+		deep[i] = 0x91 // fixarray of 1 element
+	}
+	_, err = codec.MessagePack.Decode(deep)
+	assert.ErrorIs(t, err, codec.ErrTooDeep)
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package codec
+
+import (
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// JSON - default codec
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Decode(data []byte) (*structpb.Value, error) {
+	v := &structpb.Value{}
+	return v, v.UnmarshalJSON(data)
+}
+
+func (jsonCodec) Encode(v *structpb.Value) ([]byte, error) {
+	return v.MarshalJSON()
+}
+
+// Protobuf - payload is serialized google.protobuf.Struct
+var Protobuf Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string        { return "protobuf" }
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Decode(data []byte) (*structpb.Value, error) {
+	s := &structpb.Struct{}
+	if err := proto.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return structpb.NewStructValue(s), nil
+}
+
+func (protobufCodec) Encode(v *structpb.Value) ([]byte, error) {
+	s := v.GetStructValue()
+	if s == nil {
+		return nil, ErrNotAnObject
+	}
+	return proto.Marshal(s)
+}
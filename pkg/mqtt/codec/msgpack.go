@@ -0,0 +1,298 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// MessagePack - https://github.com/msgpack/msgpack/blob/master/spec.md
+var MessagePack Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Decode(data []byte) (*structpb.Value, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, ErrTrailingBytes
+	}
+	return v, nil
+}
+
+func (msgpackCodec) Encode(v *structpb.Value) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := msgpackEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, ErrUnexpectedEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint - reads big-endian unsigned integer of n bytes
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var res uint64
+	for _, c := range b {
+		res = res<<8 | uint64(c)
+	}
+	return res, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (*structpb.Value, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+
+	switch {
+	case t <= 0x7f: // positive fixint
+		return structpb.NewNumberValue(float64(t)), nil
+	case t >= 0xe0: // negative fixint
+		return structpb.NewNumberValue(float64(int8(t))), nil
+	case t&0xf0 == 0x80: // fixmap
+		return d.object(int(t&0x0f), depth)
+	case t&0xf0 == 0x90: // fixarray
+		return d.array(int(t&0x0f), depth)
+	case t&0xe0 == 0xa0: // fixstr
+		return d.str(int(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return structpb.NewNullValue(), nil
+	case 0xc2:
+		return structpb.NewBoolValue(false), nil
+	case 0xc3:
+		return structpb.NewBoolValue(true), nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		n, err := d.uint(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)) {
+			return nil, ErrUnexpectedEOF
+		}
+		data, err := d.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return structpb.NewStringValue(base64.StdEncoding.EncodeToString(data)), nil
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return structpb.NewNumberValue(float64(math.Float32frombits(uint32(n)))), nil
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return structpb.NewNumberValue(math.Float64frombits(n)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		n, err := d.uint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return structpb.NewNumberValue(float64(n)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		size := 1 << (t - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extension
+		shift := 64 - 8*size
+		return structpb.NewNumberValue(float64(int64(n<<shift) >> shift)), nil
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)) {
+			return nil, ErrUnexpectedEOF
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)) {
+			return nil, ErrUnexpectedEOF
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf: // map 16, 32
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)) {
+			return nil, ErrUnexpectedEOF
+		}
+		return d.object(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", t)
+}
+
+func (d *msgpackDecoder) str(n int) (*structpb.Value, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return structpb.NewStringValue(string(b)), nil
+}
+
+func (d *msgpackDecoder) array(n int, depth int) (*structpb.Value, error) {
+	list := &structpb.ListValue{}
+	for i := 0; i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list.Values = append(list.Values, v)
+	}
+	return structpb.NewListValue(list), nil
+}
+
+func (d *msgpackDecoder) object(n int, depth int) (*structpb.Value, error) {
+	s := &structpb.Struct{Fields: make(map[string]*structpb.Value, n)}
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, err := mapKey(k)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		s.Fields[key] = v
+	}
+	return structpb.NewStructValue(s), nil
+}
+
+// msgpackLen - writes the smallest of fix, 8 (if any), 16 or 32 bit length headers
+func msgpackLen(buf *bytes.Buffer, n int, fix byte, fixMax int, first byte, has8 bool) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case has8 && n <= math.MaxUint8:
+		buf.WriteByte(first)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		if has8 {
+			first++
+		}
+		buf.WriteByte(first)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		if has8 {
+			first++
+		}
+		buf.WriteByte(first + 1)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func msgpackString(buf *bytes.Buffer, s string) {
+	msgpackLen(buf, len(s), 0xa0, 31, 0xd9, true)
+	buf.WriteString(s)
+}
+
+func msgpackEncode(buf *bytes.Buffer, v *structpb.Value) error {
+	switch k := v.GetKind().(type) {
+	case nil, *structpb.Value_NullValue:
+		buf.WriteByte(0xc0)
+	case *structpb.Value_BoolValue:
+		if k.BoolValue {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case *structpb.Value_NumberValue:
+		n := k.NumberValue
+		switch {
+		case isInt(n) && n >= 0 && n <= 0x7f:
+			buf.WriteByte(byte(n))
+		case isInt(n) && n < 0 && n >= -32:
+			buf.WriteByte(byte(int8(n)))
+		case isInt(n):
+			buf.WriteByte(0xd3)
+			buf.Write(binary.BigEndian.AppendUint64(nil, uint64(int64(n))))
+		default:
+			buf.WriteByte(0xcb)
+			buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(n)))
+		}
+	case *structpb.Value_StringValue:
+		msgpackString(buf, k.StringValue)
+	case *structpb.Value_ListValue:
+		values := k.ListValue.GetValues()
+		msgpackLen(buf, len(values), 0x90, 15, 0xdc, false)
+		for _, item := range values {
+			if err := msgpackEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	case *structpb.Value_StructValue:
+		fields := k.StructValue.GetFields()
+		msgpackLen(buf, len(fields), 0x80, 15, 0xde, false)
+		for _, key := range sortedKeys(fields) {
+			msgpackString(buf, key)
+			if err := msgpackEncode(buf, fields[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package inflight keeps track of QoS 1 and QoS 2 messages exchanged over a single MQTT connection
+package inflight
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+var ErrClosed = errors.New("inflight window closed")
+
+// State - which acknowledgement outgoing message is waiting for
+type State int
+
+const (
+	AwaitingPubAck  State = iota // QoS 1, PUBLISH sent
+	AwaitingPubRec               // QoS 2, PUBLISH sent
+	AwaitingPubComp              // QoS 2, PUBREL sent
+)
+
+type Message struct {
+	Packet  *protocol.Publish
+	State   State
+	SentAt  time.Time
+	Retries int
+
+	seq uint64
+}
+
+// Window - outgoing messages not yet acknowledged by the Client, limited by the window size,
+// as well as incoming QoS 2 messages for which PUBREL hasn't been received yet
+type Window struct {
+	mu sync.Mutex
+
+	slots chan struct{}
+	done  chan struct{}
+
+	last     uint16
+	seq      uint64
+	outgoing map[uint16]*Message
+	incoming map[uint16]time.Time
+
+	timeout time.Duration
+}
+
+func New(size int, timeout time.Duration) *Window {
+	if size <= 0 {
+		size = 1
+	}
+	return &Window{
+		slots:    make(chan struct{}, size),
+		done:     make(chan struct{}),
+		outgoing: make(map[uint16]*Message),
+		incoming: make(map[uint16]time.Time),
+		timeout:  timeout,
+	}
+}
+
+// Add - waits for a free slot in the window, assigns Packet Identifier to the message and stores it.
+// QoS 0 messages are returned as is, as they don't need to be tracked
+func (w *Window) Add(p *protocol.Publish) (*Message, error) {
+	if p.QoS == packet.QoSLevelNone {
+		return &Message{Packet: p}, nil
+	}
+
+	select {
+	case w.slots <- struct{}{}:
+	case <-w.done:
+		return nil, ErrClosed
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		w.last++
+		if w.last == 0 {
+			continue
+		}
+		if _, ok := w.outgoing[w.last]; !ok {
+			break
+		}
+	}
+	p.PacketID = w.last
+
+	w.seq++
+	m := &Message{
+		Packet: p,
+		SentAt: time.Now(),
+		seq:    w.seq,
+	}
+	if p.QoS == packet.QoSLevelExactlyOnce {
+		m.State = AwaitingPubRec
+	}
+	w.outgoing[p.PacketID] = m
+
+	return m, nil
+}
+
+// Ack - handles PUBACK, returns false if there was no QoS 1 message with such ID
+func (w *Window) Ack(id uint16) bool {
+	return w.complete(id, AwaitingPubAck)
+}
+
+// Received - handles PUBREC, returns false if there was no QoS 2 message with such ID.
+// Caller is expected to respond with PUBREL afterwards
+func (w *Window) Received(id uint16) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	m, ok := w.outgoing[id]
+	if !ok {
+		return false
+	}
+	if m.State == AwaitingPubRec {
+		m.State = AwaitingPubComp
+		m.SentAt = time.Now()
+		m.Retries = 0
+	}
+	return m.State == AwaitingPubComp
+}
+
+// Complete - handles PUBCOMP, returns false if there was no released QoS 2 message with such ID
+func (w *Window) Complete(id uint16) bool {
+	return w.complete(id, AwaitingPubComp)
+}
+
+func (w *Window) complete(id uint16, state State) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	m, ok := w.outgoing[id]
+	if !ok || m.State != state {
+		return false
+	}
+	w.remove(id)
+	return true
+}
+
+// Drop - stops tracking the message, e.g. once it has been retried too many times
+func (w *Window) Drop(id uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.outgoing[id]; ok {
+		w.remove(id)
+	}
+}
+
+func (w *Window) remove(id uint16) {
+	delete(w.outgoing, id)
+	<-w.slots
+}
+
+// Expired - returns messages which haven't been acknowledged within the timeout.
+// Returned messages are considered resent: their retries counter is incremented and DUP flag is set
+func (w *Window) Expired(now time.Time) (res []*Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, m := range w.outgoing {
+		if now.Sub(m.SentAt) < w.timeout {
+			continue
+		}
+		m.Retries++
+		m.SentAt = now
+		m.Packet.Dup = true
+		res = append(res, m)
+	}
+	return res
+}
+
+// Len - number of outgoing messages waiting for acknowledgement
+func (w *Window) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.outgoing)
+}
+
+// Pending - outgoing messages waiting for acknowledgement in the order they were added
+func (w *Window) Pending() []*Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	res := make([]*Message, 0, len(w.outgoing))
+	for _, m := range w.outgoing {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].seq < res[j].seq
+	})
+	return res
+}
+
+// Store - remembers incoming QoS 2 message until PUBREL, returns false if the ID is already stored,
+// meaning message is a duplicate and must not be delivered again
+func (w *Window) Store(id uint16) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.incoming[id]; ok {
+		return false
+	}
+	w.incoming[id] = time.Now()
+	return true
+}
+
+// Release - handles PUBREL for incoming QoS 2 message
+func (w *Window) Release(id uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.incoming, id)
+}
+
+// Done - closed once the window is closed
+func (w *Window) Done() <-chan struct{} {
+	return w.done
+}
+
+// Close - unblocks everyone waiting in Add
+func (w *Window) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+}
@@ -0,0 +1,123 @@
+package inflight_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/inflight"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/slntopp/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func publish(qos packet.QosLevel) *protocol.Publish {
+	return &protocol.Publish{Topic: "t", QoS: qos}
+}
+
+func TestAdd_QoS0_NotTracked(t *testing.T) {
+	w := inflight.New(1, time.Second)
+
+	m, err := w.Add(publish(packet.QoSLevelNone))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0), m.Packet.PacketID)
+	assert.Equal(t, 0, w.Len())
+}
+
+func TestAdd_AssignsUniqueIDs(t *testing.T) {
+	w := inflight.New(3, time.Second)
+
+	a, _ := w.Add(publish(packet.QoSLevelAtLeastOnce))
+	b, _ := w.Add(publish(packet.QoSLevelExactlyOnce))
+
+	assert.NotZero(t, a.Packet.PacketID)
+	assert.NotEqual(t, a.Packet.PacketID, b.Packet.PacketID)
+	assert.Equal(t, inflight.AwaitingPubAck, a.State)
+	assert.Equal(t, inflight.AwaitingPubRec, b.State)
+	assert.Equal(t, 2, w.Len())
+}
+
+func TestAck(t *testing.T) {
+	w := inflight.New(1, time.Second)
+
+	m, _ := w.Add(publish(packet.QoSLevelAtLeastOnce))
+
+	assert.False(t, w.Complete(m.Packet.PacketID))
+	assert.True(t, w.Ack(m.Packet.PacketID))
+	assert.False(t, w.Ack(m.Packet.PacketID))
+	assert.Equal(t, 0, w.Len())
+}
+
+func TestQoS2Flow(t *testing.T) {
+	w := inflight.New(1, time.Second)
+
+	m, _ := w.Add(publish(packet.QoSLevelExactlyOnce))
+	id := m.Packet.PacketID
+
+	assert.False(t, w.Ack(id))
+	assert.True(t, w.Received(id))
+	assert.Equal(t, inflight.AwaitingPubComp, m.State)
+	assert.True(t, w.Received(id), "duplicate PUBREC must still be answered with PUBREL")
+	assert.True(t, w.Complete(id))
+	assert.Equal(t, 0, w.Len())
+}
+
+func TestAdd_BlocksWhenFull(t *testing.T) {
+	w := inflight.New(1, time.Second)
+
+	m, _ := w.Add(publish(packet.QoSLevelAtLeastOnce))
+
+	added := make(chan struct{})
+	go func() {
+		_, _ = w.Add(publish(packet.QoSLevelAtLeastOnce))
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("Add didn't block on full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.Ack(m.Packet.PacketID)
+
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add didn't unblock after Ack")
+	}
+}
+
+func TestAdd_FailsOnClosed(t *testing.T) {
+	w := inflight.New(1, time.Second)
+	_, _ = w.Add(publish(packet.QoSLevelAtLeastOnce))
+
+	go w.Close()
+
+	_, err := w.Add(publish(packet.QoSLevelAtLeastOnce))
+	assert.ErrorIs(t, err, inflight.ErrClosed)
+}
+
+func TestExpired(t *testing.T) {
+	w := inflight.New(2, time.Minute)
+
+	m, _ := w.Add(publish(packet.QoSLevelAtLeastOnce))
+
+	assert.Empty(t, w.Expired(time.Now()))
+
+	expired := w.Expired(time.Now().Add(2 * time.Minute))
+	assert.Len(t, expired, 1)
+	assert.Equal(t, 1, expired[0].Retries)
+	assert.True(t, m.Packet.Dup)
+
+	w.Drop(m.Packet.PacketID)
+	assert.Equal(t, 0, w.Len())
+}
+
+func TestIncomingQoS2(t *testing.T) {
+	w := inflight.New(1, time.Second)
+
+	assert.True(t, w.Store(7))
+	assert.False(t, w.Store(7))
+	w.Release(7)
+	assert.True(t, w.Store(7))
+}
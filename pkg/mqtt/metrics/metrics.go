@@ -34,11 +34,101 @@ var (
 		Help: "The total number of TLS connections closed because the provided certificate is absent, bad or device is not registered, disabled or otherwise not allowed to connect",
 	})
 
-	// Metrics for HandleConn (both BasicAuth and TLS)
+	// Metrics for HandleWSConnections (both WS and WSS)
+	WebsocketAcceptedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_websocket_accepted_total",
+		Help: "The total number of WebSocket connections accepted",
+	})
+	WebsocketFailedToAcceptTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_websocket_failed_to_accept_total",
+		Help: "The total number of WebSocket connections failed to accept",
+	})
+	WebsocketDeviceAuthFailedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_websocket_device_auth_failed_total",
+		Help: "The total number of WebSocket connections closed because credentials or token are invalid, or device is not registered, disabled or otherwise not allowed to connect",
+	})
+
+	// Metrics for HandleConn (BasicAuth, TLS and WebSockets)
 	ActiveConnectionsTotal = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "mqtt_bridge_active_connections_total",
 		Help: "The total number of active connections",
 	})
+	DevicesKickedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_devices_kicked_total",
+		Help: "The total number of connections closed because the device got disabled or deleted",
+	})
+	DevicesProvisionedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_devices_provisioned_total",
+		Help: "The total number of devices registered on first connect with a certificate signed by a trusted CA",
+	})
+	RevokedCertificatesRefusedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_revoked_certificates_refused_total",
+		Help: "The total number of connections refused because the client certificate is revoked",
+	})
+	ConnectionsReapedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_connections_reaped_total",
+		Help: "The total number of connections closed because the Client sent nothing within 1.5 times the Keep Alive",
+	})
+
+	// Metrics for QoS 1 and QoS 2 delivery
+	InflightMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_bridge_inflight_messages",
+		Help: "The number of QoS 1 and QoS 2 messages sent to devices and not yet acknowledged",
+	})
+	PublishRetriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_publish_retries_total",
+		Help: "The total number of PUBLISH and PUBREL packets resent to devices because acknowledgement timed out",
+	})
+	PublishDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_publish_dropped_total",
+		Help: "The total number of QoS 1 and QoS 2 messages given up on after reaching maximum number of retries",
+	})
+	DuplicatePublishesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_duplicate_publishes_total",
+		Help: "The total number of QoS 2 publishes from devices ignored as duplicates",
+	})
+
+	// Metrics for topic ACLs
+	PublishDeniedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_publish_denied_total",
+		Help: "The total number of publishes from devices rejected because the topic is outside of the device subtree or not writable",
+	})
+	SubscribeDeniedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_subscribe_denied_total",
+		Help: "The total number of subscriptions rejected because the topic filter is invalid or outside of the device subtree",
+	})
+
+	// Metrics for ingress limits
+	RateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_bridge_rate_limited_total",
+		Help: "The total number of publishes and connections rejected because of per-device limits, by namespace and exceeded limit",
+	}, []string{"namespace", "reason"})
+
+	// Metrics for Will Messages
+	WillsPublishedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_wills_published_total",
+		Help: "The total number of Will Messages published after connections closed without DISCONNECT",
+	})
+
+	// Metrics for persistent sessions
+	SessionsResumedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_sessions_resumed_total",
+		Help: "The total number of connections resuming a stored session",
+	})
+	QueuedMessagesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_queued_messages_total",
+		Help: "The total number of messages queued for disconnected clients with persistent sessions",
+	})
+	QueueDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_queue_dropped_total",
+		Help: "The total number of queued messages dropped because session queue is full",
+	})
+
+	// Metrics for Sparkplug B Edge Nodes
+	SparkplugRebirthsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_sparkplug_rebirths_total",
+		Help: "The total number of rebirth requests sent to Edge Nodes on sequence gaps and unknown metrics",
+	})
 
 	// Other common metrics
 	ConnNotAnMqttPacketTotal = promauto.NewCounter(prometheus.CounterOpts{
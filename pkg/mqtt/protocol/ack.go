@@ -0,0 +1,114 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+// AckControlPacket - PUBACK, PUBREC, PUBREL or PUBCOMP, which only differ by their type
+type AckControlPacket struct {
+	FixedHeader packet.FixedHeader
+	PacketID    uint16
+	ReasonCode  byte // MQTT 5 only, 0x00 - Success
+}
+
+func newAck(t packet.ControlPacketType, packetID uint16) *AckControlPacket {
+	p := &AckControlPacket{
+		FixedHeader: packet.FixedHeader{ControlPacketType: t},
+		PacketID:    packetID,
+	}
+	// Bits 3,2,1 and 0 of the Fixed Header in the PUBREL packet are reserved and MUST be set to 0,0,1 and 0
+	if t == packet.PUBREL {
+		p.FixedHeader.Flags = 2
+	}
+	return p
+}
+
+func NewPubAck(packetID uint16) *AckControlPacket {
+	return newAck(packet.PUBACK, packetID)
+}
+
+func NewPubRec(packetID uint16) *AckControlPacket {
+	return newAck(packet.PUBREC, packetID)
+}
+
+func NewPubRel(packetID uint16) *AckControlPacket {
+	return newAck(packet.PUBREL, packetID)
+}
+
+func NewPubComp(packetID uint16) *AckControlPacket {
+	return newAck(packet.PUBCOMP, packetID)
+}
+
+func (p *AckControlPacket) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(p.FixedHeader.ControlPacketType)<<4 | p.FixedHeader.Flags)
+	if p.ReasonCode != 0 {
+		buf.WriteByte(3)
+	} else {
+		buf.WriteByte(2)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, p.PacketID)
+	if p.ReasonCode != 0 {
+		buf.WriteByte(p.ReasonCode)
+	}
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func parseAck(fh packet.FixedHeader, body []byte) (*AckControlPacket, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("malformed acknowledgement of type %d: remaining length %d", fh.ControlPacketType, len(body))
+	}
+	p := &AckControlPacket{
+		FixedHeader: fh,
+		PacketID:    binary.BigEndian.Uint16(body[:2]),
+	}
+	if len(body) > 2 {
+		p.ReasonCode = body[2]
+	}
+	return p, nil
+}
+
+// DisconnectControlPacket - sent by the Client as the final packet of the graceful disconnect,
+// or by the Server to MQTT 5 Client to tell the reason of closing the connection
+type DisconnectControlPacket struct {
+	FixedHeader packet.FixedHeader
+	ReasonCode  byte // MQTT 5 only
+}
+
+func NewDisconnect(reasonCode byte) *DisconnectControlPacket {
+	return &DisconnectControlPacket{
+		FixedHeader: packet.FixedHeader{ControlPacketType: packet.DISCONNECT},
+		ReasonCode:  reasonCode,
+	}
+}
+
+func (p *DisconnectControlPacket) WriteTo(w io.Writer) (int64, error) {
+	b := []byte{byte(packet.DISCONNECT) << 4, 0}
+	if p.ReasonCode != ReasonSuccess {
+		b = append(b[:1], 1, p.ReasonCode)
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
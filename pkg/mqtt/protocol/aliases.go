@@ -0,0 +1,64 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package protocol
+
+import "errors"
+
+var (
+	ErrTopicAliasInvalid = errors.New("topic alias is zero or exceeds topic alias maximum")
+	ErrTopicAliasUnknown = errors.New("topic name is empty and topic alias isn't set")
+)
+
+// TopicAliases - Topic Aliases set by the Client, they're valid for the lifetime of the Network Connection
+type TopicAliases struct {
+	max     uint16
+	aliases map[uint16]string
+}
+
+// NewTopicAliases - max is Topic Alias Maximum sent to the Client in CONNACK
+func NewTopicAliases(max uint16) *TopicAliases {
+	return &TopicAliases{
+		max:     max,
+		aliases: make(map[uint16]string),
+	}
+}
+
+// Resolve - sets Topic Name of the PUBLISH from the alias or remembers the alias for the given Topic Name
+func (a *TopicAliases) Resolve(p *Publish) error {
+	if p.Properties == nil || p.Properties.TopicAlias == nil {
+		if p.Topic == "" {
+			return ErrTopicAliasUnknown
+		}
+		return nil
+	}
+
+	alias := *p.Properties.TopicAlias
+	if alias == 0 || alias > a.max {
+		return ErrTopicAliasInvalid
+	}
+
+	if p.Topic != "" {
+		a.aliases[alias] = p.Topic
+		return nil
+	}
+
+	topic, ok := a.aliases[alias]
+	if !ok {
+		return ErrTopicAliasUnknown
+	}
+	p.Topic = topic
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package protocol
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+// ConnAck - CONNACK packet, serialized according to the Client's protocol level.
+// ReasonCode is always an MQTT 5 Reason Code, it's converted to MQTT 3.1.1 Return Code for older Clients
+type ConnAck struct {
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     *Properties // MQTT 5 only
+
+	ProtocolLevel byte
+}
+
+// returnCode - MQTT 3.1.1 Connect Return Code closest to the Reason Code
+func (p *ConnAck) returnCode() byte {
+	switch p.ReasonCode {
+	case ReasonSuccess:
+		return 0x00
+	case ReasonUnsupportedProtocolVersion:
+		return 0x01
+	case ReasonClientIdentifierNotValid:
+		return 0x02
+	case ReasonServerUnavailable, ReasonServerBusy:
+		return 0x03
+	case ReasonBadUserNameOrPassword:
+		return 0x04
+	default:
+		return 0x05 // Not authorized
+	}
+}
+
+func (p *ConnAck) WriteTo(w io.Writer) (int64, error) {
+	var vh bytes.Buffer
+	if p.SessionPresent {
+		vh.WriteByte(1)
+	} else {
+		vh.WriteByte(0)
+	}
+	if p.ProtocolLevel == 5 {
+		vh.WriteByte(p.ReasonCode)
+		writeProperties(&vh, p.Properties)
+	} else {
+		vh.WriteByte(p.returnCode())
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(packet.CONNACK) << 4)
+	writeVarInt(&buf, vh.Len())
+	buf.Write(vh.Bytes())
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
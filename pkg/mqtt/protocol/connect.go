@@ -0,0 +1,138 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+// Will - Will Message to be published by the Server when the Network Connection is closed without DISCONNECT
+type Will struct {
+	Topic      string
+	Payload    []byte
+	QoS        packet.QosLevel
+	Retain     bool
+	Properties *Properties // MQTT 5 only
+}
+
+// ConnectControlPacket - CONNECT packet.
+// Embedded packet.ConnectControlPacket is filled for compatibility with the library,
+// but unlike the library the flags, Will and MQTT 5 properties are decoded completely
+type ConnectControlPacket struct {
+	packet.ConnectControlPacket
+
+	CleanStart bool
+	Will       *Will
+	Properties *Properties // MQTT 5 only
+}
+
+// SessionExpiryInterval - Session Expiry Interval in seconds, 0 if absent
+func (p *ConnectControlPacket) SessionExpiryInterval() uint32 {
+	if p.Properties == nil || p.Properties.SessionExpiryInterval == nil {
+		return 0
+	}
+	return *p.Properties.SessionExpiryInterval
+}
+
+func parseConnect(fh packet.FixedHeader, body []byte) (*ConnectControlPacket, error) {
+	r := bytes.NewReader(body)
+	p := &ConnectControlPacket{}
+	p.FixedHeader = fh
+	vh := &p.VariableHeader
+
+	var err error
+	if vh.ProtocolName, err = readString(r); err != nil {
+		return nil, err
+	}
+	if vh.ProtocolName != "MQTT" && vh.ProtocolName != "MQIsdp" {
+		return nil, fmt.Errorf("invalid protocol: %v", vh.ProtocolName)
+	}
+	if vh.ProtocolLevel, err = r.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if flags&1 != 0 {
+		return nil, errors.New("reserved connect flag is set")
+	}
+	vh.ConnectFlags = packet.ConnectFlags{
+		UserName:   flags&128 != 0,
+		Password:   flags&64 != 0,
+		WillRetain: flags&32 != 0,
+		WillQoS:    int(flags>>3) & 3,
+		WillFlag:   flags&4 != 0,
+		CleanStart: flags&2 != 0,
+	}
+	p.CleanStart = vh.ConnectFlags.CleanStart
+	if vh.ConnectFlags.WillQoS == 3 {
+		return nil, errors.New("invalid will QoS")
+	}
+
+	keepAlive, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	vh.KeepAlive = int(keepAlive)
+
+	if vh.ProtocolLevel == 5 {
+		if p.Properties, err = readProperties(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.ConnectPayload.ClientID, err = readString(r); err != nil {
+		return nil, err
+	}
+
+	if vh.ConnectFlags.WillFlag {
+		will := &Will{
+			QoS:    packet.QosLevel(vh.ConnectFlags.WillQoS),
+			Retain: vh.ConnectFlags.WillRetain,
+		}
+		if vh.ProtocolLevel == 5 {
+			if will.Properties, err = readProperties(r); err != nil {
+				return nil, err
+			}
+		}
+		if will.Topic, err = readString(r); err != nil {
+			return nil, err
+		}
+		if will.Payload, err = readBinary(r); err != nil {
+			return nil, err
+		}
+		p.Will = will
+	}
+
+	if vh.ConnectFlags.UserName {
+		if p.ConnectPayload.Username, err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+	if vh.ConnectFlags.Password {
+		if p.ConnectPayload.Password, err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
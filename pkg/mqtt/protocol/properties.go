@@ -0,0 +1,330 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 5 Property Identifiers
+const (
+	PropPayloadFormatIndicator          byte = 0x01
+	PropMessageExpiryInterval           byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0B
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1A
+	PropServerReference                 byte = 0x1C
+	PropReasonString                    byte = 0x1F
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQoS                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2A
+)
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties - MQTT 5 properties of any packet. Only properties relevant for the packet are expected to be set.
+// Numeric properties are pointers to tell absent property from the zero value
+type Properties struct {
+	PayloadFormatIndicator *byte
+	MessageExpiryInterval  *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+
+	SessionExpiryInterval    *uint32
+	AssignedClientIdentifier string
+	ServerKeepAlive          *uint16
+	AuthenticationMethod     string
+	AuthenticationData       []byte
+
+	RequestProblemInformation  *byte
+	WillDelayInterval          *uint32
+	RequestResponseInformation *byte
+	ResponseInformation        string
+	ServerReference            string
+	ReasonString               string
+
+	ReceiveMaximum    *uint16
+	TopicAliasMaximum *uint16
+	TopicAlias        *uint16
+	MaximumQoS        *byte
+	RetainAvailable   *byte
+	UserProperties    []UserProperty
+	MaximumPacketSize *uint32
+
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+// readProperties - reads Properties Length and Properties following it
+func readProperties(r *bytes.Reader) (*Properties, error) {
+	length, err := readVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > r.Len() {
+		return nil, errors.New("properties length exceeds packet length")
+	}
+
+	raw := make([]byte, length)
+	if _, err = io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	return parseProperties(bytes.NewReader(raw))
+}
+
+func parseProperties(r *bytes.Reader) (*Properties, error) {
+	p := &Properties{}
+	for r.Len() > 0 {
+		id, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case PropPayloadFormatIndicator:
+			p.PayloadFormatIndicator, err = readBytePtr(r)
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval, err = readUint32Ptr(r)
+		case PropContentType:
+			p.ContentType, err = readString(r)
+		case PropResponseTopic:
+			p.ResponseTopic, err = readString(r)
+		case PropCorrelationData:
+			p.CorrelationData, err = readBinary(r)
+		case PropSubscriptionIdentifier:
+			var v int
+			v, err = readVarInt(r)
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, v)
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, err = readUint32Ptr(r)
+		case PropAssignedClientIdentifier:
+			p.AssignedClientIdentifier, err = readString(r)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, err = readUint16Ptr(r)
+		case PropAuthenticationMethod:
+			p.AuthenticationMethod, err = readString(r)
+		case PropAuthenticationData:
+			p.AuthenticationData, err = readBinary(r)
+		case PropRequestProblemInformation:
+			p.RequestProblemInformation, err = readBytePtr(r)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, err = readUint32Ptr(r)
+		case PropRequestResponseInformation:
+			p.RequestResponseInformation, err = readBytePtr(r)
+		case PropResponseInformation:
+			p.ResponseInformation, err = readString(r)
+		case PropServerReference:
+			p.ServerReference, err = readString(r)
+		case PropReasonString:
+			p.ReasonString, err = readString(r)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, err = readUint16Ptr(r)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, err = readUint16Ptr(r)
+		case PropTopicAlias:
+			p.TopicAlias, err = readUint16Ptr(r)
+		case PropMaximumQoS:
+			p.MaximumQoS, err = readBytePtr(r)
+		case PropRetainAvailable:
+			p.RetainAvailable, err = readBytePtr(r)
+		case PropUserProperty:
+			var up UserProperty
+			if up.Key, err = readString(r); err == nil {
+				up.Value, err = readString(r)
+			}
+			p.UserProperties = append(p.UserProperties, up)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, err = readUint32Ptr(r)
+		case PropWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable, err = readBytePtr(r)
+		case PropSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable, err = readBytePtr(r)
+		case PropSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable, err = readBytePtr(r)
+		default:
+			return nil, fmt.Errorf("unknown property identifier: 0x%02x", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func readBytePtr(r *bytes.Reader) (*byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func readUint16(r io.Reader) (v uint16, err error) {
+	err = binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+func readUint16Ptr(r io.Reader) (*uint16, error) {
+	v, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func readUint32Ptr(r io.Reader) (*uint32, error) {
+	var v uint32
+	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func readBinary(r io.Reader) ([]byte, error) {
+	length, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readString(r io.Reader) (string, error) {
+	b, err := readBinary(r)
+	return string(b), err
+}
+
+// writeProperties - writes Properties Length and Properties, nil Properties are written as zero length
+func writeProperties(w *bytes.Buffer, p *Properties) {
+	var buf bytes.Buffer
+	if p != nil {
+		p.encode(&buf)
+	}
+	writeVarInt(w, buf.Len())
+	w.Write(buf.Bytes())
+}
+
+func (p *Properties) encode(w *bytes.Buffer) {
+	writeBytePtr(w, PropPayloadFormatIndicator, p.PayloadFormatIndicator)
+	writeUint32Ptr(w, PropMessageExpiryInterval, p.MessageExpiryInterval)
+	writeStringProp(w, PropContentType, p.ContentType)
+	writeStringProp(w, PropResponseTopic, p.ResponseTopic)
+	if p.CorrelationData != nil {
+		w.WriteByte(PropCorrelationData)
+		writeBinary(w, p.CorrelationData)
+	}
+	for _, id := range p.SubscriptionIdentifier {
+		w.WriteByte(PropSubscriptionIdentifier)
+		writeVarInt(w, id)
+	}
+	writeUint32Ptr(w, PropSessionExpiryInterval, p.SessionExpiryInterval)
+	writeStringProp(w, PropAssignedClientIdentifier, p.AssignedClientIdentifier)
+	writeUint16Ptr(w, PropServerKeepAlive, p.ServerKeepAlive)
+	writeStringProp(w, PropAuthenticationMethod, p.AuthenticationMethod)
+	if p.AuthenticationData != nil {
+		w.WriteByte(PropAuthenticationData)
+		writeBinary(w, p.AuthenticationData)
+	}
+	writeBytePtr(w, PropRequestProblemInformation, p.RequestProblemInformation)
+	writeUint32Ptr(w, PropWillDelayInterval, p.WillDelayInterval)
+	writeBytePtr(w, PropRequestResponseInformation, p.RequestResponseInformation)
+	writeStringProp(w, PropResponseInformation, p.ResponseInformation)
+	writeStringProp(w, PropServerReference, p.ServerReference)
+	writeStringProp(w, PropReasonString, p.ReasonString)
+	writeUint16Ptr(w, PropReceiveMaximum, p.ReceiveMaximum)
+	writeUint16Ptr(w, PropTopicAliasMaximum, p.TopicAliasMaximum)
+	writeUint16Ptr(w, PropTopicAlias, p.TopicAlias)
+	writeBytePtr(w, PropMaximumQoS, p.MaximumQoS)
+	writeBytePtr(w, PropRetainAvailable, p.RetainAvailable)
+	for _, up := range p.UserProperties {
+		w.WriteByte(PropUserProperty)
+		writeString(w, up.Key)
+		writeString(w, up.Value)
+	}
+	writeUint32Ptr(w, PropMaximumPacketSize, p.MaximumPacketSize)
+	writeBytePtr(w, PropWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	writeBytePtr(w, PropSubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+	writeBytePtr(w, PropSharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+}
+
+func writeBytePtr(w *bytes.Buffer, id byte, v *byte) {
+	if v == nil {
+		return
+	}
+	w.WriteByte(id)
+	w.WriteByte(*v)
+}
+
+func writeUint16Ptr(w *bytes.Buffer, id byte, v *uint16) {
+	if v == nil {
+		return
+	}
+	w.WriteByte(id)
+	_ = binary.Write(w, binary.BigEndian, *v)
+}
+
+func writeUint32Ptr(w *bytes.Buffer, id byte, v *uint32) {
+	if v == nil {
+		return
+	}
+	w.WriteByte(id)
+	_ = binary.Write(w, binary.BigEndian, *v)
+}
+
+func writeStringProp(w *bytes.Buffer, id byte, v string) {
+	if v == "" {
+		return
+	}
+	w.WriteByte(id)
+	writeString(w, v)
+}
+
+func writeBinary(w *bytes.Buffer, b []byte) {
+	_ = binary.Write(w, binary.BigEndian, uint16(len(b)))
+	w.Write(b)
+}
+
+func writeString(w *bytes.Buffer, s string) {
+	writeBinary(w, []byte(s))
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package protocol complements github.com/slntopp/mqtt-go/packet with the
+// Control Packets it doesn't (de)serialize correctly: CONNECT with Will and
+// MQTT 5 properties, CONNACK, QoS 1 and QoS 2 acknowledgements, DISCONNECT
+// and PUBLISH with Packet Identifier, header flags and MQTT 5 properties.
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+// Conn wraps a network connection with a buffered reader and serialized writes,
+// so packets written from different goroutines never interleave on the wire
+type Conn struct {
+	net.Conn
+
+	r  *bufio.Reader
+	mu sync.Mutex
+
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	maxPacketSize int
+}
+
+// ErrPacketTooLarge - returned by Conn.ReadPacket for packets exceeding the maximum size, packet itself is not read
+var ErrPacketTooLarge = errors.New("packet exceeds maximum packet size")
+
+// MaxConnectPacketSize - maximum packet size of new connections, so Clients can't make the server allocate
+// arbitrary Remaining Length before they're authenticated. Lifted by SetMaxPacketSize once the CONNECT is accepted
+const MaxConnectPacketSize = 64 * 1024
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{
+		Conn:          c,
+		r:             bufio.NewReader(c),
+		maxPacketSize: MaxConnectPacketSize,
+	}
+}
+
+// SetTimeouts - sets how long ReadPacket waits for the next packet and WritePacket waits for the write to complete,
+// zero disables the timeout. Should not be called concurrently with ReadPacket
+func (c *Conn) SetTimeouts(read, write time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readTimeout, c.writeTimeout = read, write
+}
+
+// SetMaxPacketSize - sets the maximum size of the packet (Fixed Header included) ReadPacket accepts, zero means no limit.
+// Should not be called concurrently with ReadPacket
+func (c *Conn) SetMaxPacketSize(size int) {
+	c.maxPacketSize = size
+}
+
+// ReadPacket - reads next Control Packet from the connection, see ReadPacket.
+// Returns error satisfying IsTimeout if no packet arrives within the read timeout
+// and ErrPacketTooLarge if the packet exceeds the maximum packet size
+func (c *Conn) ReadPacket(protocolLevel byte) (packet.ControlPacket, error) {
+	var deadline time.Time
+	if c.readTimeout > 0 {
+		deadline = time.Now().Add(c.readTimeout)
+	}
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if c.maxPacketSize > 0 {
+		size, err := peekPacketSize(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if size > c.maxPacketSize {
+			return nil, ErrPacketTooLarge
+		}
+	}
+	return ReadPacket(c.r, protocolLevel)
+}
+
+// peekPacketSize - decodes Fixed Header of the next packet without consuming it, returns the size of the whole packet
+func peekPacketSize(r *bufio.Reader) (int, error) {
+	value, multiplier := 0, 1
+	for i := 1; i <= 4; i++ {
+		b, err := r.Peek(i + 1)
+		if err != nil {
+			return 0, err
+		}
+		value += int(b[i]&127) * multiplier
+		if b[i]&128 == 0 {
+			return i + 1 + value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errors.New("malformed remaining length")
+}
+
+// WritePacket - serializes the packet into a buffer and writes it to the connection at once
+func (c *Conn) WritePacket(p io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	_, err := c.Conn.Write(buf.Bytes())
+	return err
+}
+
+// IsTimeout - whether the error is caused by read or write deadline
+func IsTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// ReadPacket reads the next Control Packet from r.
+// CONNECT, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP and DISCONNECT are decoded by this package,
+// any other packet is handed over to packet.ReadPacket
+func ReadPacket(r *bufio.Reader, protocolLevel byte) (packet.ControlPacket, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch packet.ControlPacketType(b[0] >> 4) {
+	case packet.CONNECT:
+		fh, body, err := readRaw(r)
+		if err != nil {
+			return nil, err
+		}
+		return parseConnect(fh, body)
+	case packet.PUBLISH:
+		fh, body, err := readRaw(r)
+		if err != nil {
+			return nil, err
+		}
+		return parsePublish(fh, body, protocolLevel)
+	case packet.PUBACK, packet.PUBREC, packet.PUBREL, packet.PUBCOMP:
+		fh, body, err := readRaw(r)
+		if err != nil {
+			return nil, err
+		}
+		return parseAck(fh, body)
+	case packet.DISCONNECT:
+		fh, body, err := readRaw(r)
+		if err != nil {
+			return nil, err
+		}
+		p := &DisconnectControlPacket{FixedHeader: fh}
+		if len(body) > 0 {
+			p.ReasonCode = body[0]
+		}
+		return p, nil
+	}
+
+	return packet.ReadPacket(r, protocolLevel)
+}
+
+func readRaw(r io.Reader) (fh packet.FixedHeader, body []byte, err error) {
+	var b [1]byte
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		return
+	}
+	fh.ControlPacketType = packet.ControlPacketType(b[0] >> 4)
+	fh.Flags = b[0] & 15
+
+	fh.RemainingLength, err = readVarInt(r)
+	if err != nil {
+		return
+	}
+
+	body = make([]byte, fh.RemainingLength)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+// readVarInt - reads Variable Byte Integer (used for Remaining Length and MQTT 5 Properties Length)
+func readVarInt(r io.Reader) (int, error) {
+	var b [1]byte
+	value, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		value += int(b[0]&127) * multiplier
+		if b[0]&128 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errors.New("malformed variable byte integer")
+}
+
+func writeVarInt(w *bytes.Buffer, value int) {
+	for {
+		b := byte(value % 128)
+		value /= 128
+		if value > 0 {
+			b |= 128
+		}
+		w.WriteByte(b)
+		if value == 0 {
+			return
+		}
+	}
+}
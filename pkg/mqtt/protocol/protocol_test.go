@@ -0,0 +1,305 @@
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/slntopp/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAck_WriteTo(t *testing.T) {
+	cases := []struct {
+		ack      *protocol.AckControlPacket
+		expected []byte
+	}{
+		{protocol.NewPubAck(1), []byte{0x40, 2, 0, 1}},
+		{protocol.NewPubRec(258), []byte{0x50, 2, 1, 2}},
+		{protocol.NewPubRel(3), []byte{0x62, 2, 0, 3}},
+		{protocol.NewPubComp(4), []byte{0x70, 2, 0, 4}},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		_, err := c.ack.WriteTo(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, buf.Bytes())
+	}
+}
+
+func TestAck_WriteTo_ReasonCode(t *testing.T) {
+	ack := protocol.NewPubAck(1)
+	ack.ReasonCode = protocol.ReasonPayloadFormatInvalid
+
+	var buf bytes.Buffer
+	_, err := ack.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x40, 3, 0, 1, 0x99}, buf.Bytes())
+}
+
+func TestReadPacket_Acks(t *testing.T) {
+	var buf bytes.Buffer
+	for _, ack := range []*protocol.AckControlPacket{
+		protocol.NewPubAck(1), protocol.NewPubRec(2),
+		protocol.NewPubRel(3), protocol.NewPubComp(4),
+	} {
+		_, _ = ack.WriteTo(&buf)
+	}
+
+	r := bufio.NewReader(&buf)
+	for i, expected := range []packet.ControlPacketType{
+		packet.PUBACK, packet.PUBREC, packet.PUBREL, packet.PUBCOMP,
+	} {
+		p, err := protocol.ReadPacket(r, 4)
+		assert.NoError(t, err)
+
+		ack, ok := p.(*protocol.AckControlPacket)
+		assert.True(t, ok)
+		assert.Equal(t, expected, ack.FixedHeader.ControlPacketType)
+		assert.Equal(t, uint16(i+1), ack.PacketID)
+	}
+}
+
+func TestReadPacket_Disconnect(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{0xe0, 0}))
+
+	p, err := protocol.ReadPacket(r, 4)
+	assert.NoError(t, err)
+	assert.IsType(t, &protocol.DisconnectControlPacket{}, p)
+}
+
+func TestReadPacket_FallsBackToLibrary(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{0xc0, 0}))
+
+	p, err := protocol.ReadPacket(r, 4)
+	assert.NoError(t, err)
+	assert.IsType(t, &packet.PingReqControlPacket{}, p)
+}
+
+func TestPublish_RoundTrip(t *testing.T) {
+	out := &protocol.Publish{
+		Topic:         "devices/abc/state",
+		PacketID:      42,
+		QoS:           packet.QoSLevelExactlyOnce,
+		Dup:           true,
+		Retain:        true,
+		Payload:       []byte(`{"a":1}`),
+		ProtocolLevel: 4,
+	}
+
+	var buf bytes.Buffer
+	_, err := out.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x3d), buf.Bytes()[0])
+
+	p, err := protocol.ReadPacket(bufio.NewReader(&buf), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, out, p)
+}
+
+func TestPublish_QoS0_HasNoPacketID(t *testing.T) {
+	out := &protocol.Publish{
+		Topic:    "t",
+		PacketID: 42,
+		Payload:  []byte("x"),
+	}
+
+	var buf bytes.Buffer
+	_, err := out.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x30, 4, 0, 1, 't', 'x'}, buf.Bytes())
+}
+
+func TestReadPacket_Connect(t *testing.T) {
+	body := []byte{
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		0xee,  // username, password, will retain, will QoS 1, will, clean session
+		0, 60, // keep alive
+		0, 3, 'c', 'i', 'd',
+		0, 1, 't', 0, 2, 'o', 'k',
+		0, 1, 'u',
+		0, 1, 'p',
+	}
+	r := bufio.NewReader(bytes.NewReader(append([]byte{0x10, byte(len(body))}, body...)))
+
+	p, err := protocol.ReadPacket(r, 0)
+	assert.NoError(t, err)
+
+	connect, ok := p.(*protocol.ConnectControlPacket)
+	assert.True(t, ok)
+	assert.True(t, connect.CleanStart)
+	assert.Equal(t, 60, connect.VariableHeader.KeepAlive)
+	assert.Equal(t, "cid", connect.ConnectPayload.ClientID)
+	assert.Equal(t, "u", connect.ConnectPayload.Username)
+	assert.Equal(t, "p", connect.ConnectPayload.Password)
+	assert.Equal(t, &protocol.Will{
+		Topic: "t", Payload: []byte("ok"), QoS: packet.QoSLevelAtLeastOnce, Retain: true,
+	}, connect.Will)
+}
+
+func TestReadPacket_Connect_SessionExpiry(t *testing.T) {
+	body := []byte{
+		0, 4, 'M', 'Q', 'T', 'T', 5,
+		0,     // flags
+		0, 60, // keep alive
+		5, 0x11, 0, 0, 0x0e, 0x10, // session expiry 3600
+		0, 0,
+	}
+	r := bufio.NewReader(bytes.NewReader(append([]byte{0x10, byte(len(body))}, body...)))
+
+	p, err := protocol.ReadPacket(r, 0)
+	assert.NoError(t, err)
+
+	connect := p.(*protocol.ConnectControlPacket)
+	assert.False(t, connect.CleanStart)
+	assert.Nil(t, connect.Will)
+	assert.Equal(t, uint32(3600), connect.SessionExpiryInterval())
+}
+
+func TestConnAck_WriteTo(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := (&protocol.ConnAck{SessionPresent: true, ProtocolLevel: 4}).WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x20, 2, 1, 0}, buf.Bytes())
+
+	buf.Reset()
+	_, err = (&protocol.ConnAck{
+		Properties:    &protocol.Properties{AssignedClientIdentifier: "id"},
+		ProtocolLevel: 5,
+	}).WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x20, 8, 0, 0, 5, 0x12, 0, 2, 'i', 'd'}, buf.Bytes())
+}
+
+func TestConnAck_WriteTo_ReturnCode(t *testing.T) {
+	cases := map[byte]byte{
+		protocol.ReasonBadUserNameOrPassword: 0x04,
+		protocol.ReasonNotAuthorized:         0x05,
+		protocol.ReasonServerBusy:            0x03,
+	}
+
+	for reason, code := range cases {
+		var buf bytes.Buffer
+		_, err := (&protocol.ConnAck{ReasonCode: reason, ProtocolLevel: 4}).WriteTo(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x20, 2, 0, code}, buf.Bytes())
+
+		buf.Reset()
+		_, err = (&protocol.ConnAck{ReasonCode: reason, ProtocolLevel: 5}).WriteTo(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x20, 3, 0, reason, 0}, buf.Bytes())
+	}
+}
+
+func TestPublish_RoundTrip_Properties(t *testing.T) {
+	expiry := uint32(60)
+	alias := uint16(1)
+	p := &protocol.Publish{
+		Topic:    "devices/dev/state/reported",
+		PacketID: 7,
+		QoS:      packet.QoSLevelExactlyOnce,
+		Retain:   true,
+		Properties: &protocol.Properties{
+			MessageExpiryInterval: &expiry,
+			TopicAlias:            &alias,
+			UserProperties:        []protocol.UserProperty{{Key: "k", Value: "v"}},
+		},
+		Payload:       []byte(`{"a":1}`),
+		ProtocolLevel: 5,
+	}
+
+	var buf bytes.Buffer
+	_, err := p.WriteTo(&buf)
+	assert.NoError(t, err)
+
+	res, err := protocol.ReadPacket(bufio.NewReader(&buf), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, p, res)
+}
+
+func TestDisconnect_WriteTo(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := protocol.NewDisconnect(protocol.ReasonTopicAliasInvalid).WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xe0, 1, 0x94}, buf.Bytes())
+}
+
+func TestTopicAliases_Resolve(t *testing.T) {
+	aliases := protocol.NewTopicAliases(2)
+	alias := func(v uint16) *protocol.Properties {
+		return &protocol.Properties{TopicAlias: &v}
+	}
+
+	p := &protocol.Publish{Topic: "a", Properties: alias(1)}
+	assert.NoError(t, aliases.Resolve(p))
+
+	p = &protocol.Publish{Properties: alias(1)}
+	assert.NoError(t, aliases.Resolve(p))
+	assert.Equal(t, "a", p.Topic)
+
+	assert.Equal(t, protocol.ErrTopicAliasUnknown, aliases.Resolve(&protocol.Publish{Properties: alias(2)}))
+	assert.Equal(t, protocol.ErrTopicAliasInvalid, aliases.Resolve(&protocol.Publish{Topic: "b", Properties: alias(3)}))
+	assert.Equal(t, protocol.ErrTopicAliasInvalid, aliases.Resolve(&protocol.Publish{Topic: "b", Properties: alias(0)}))
+	assert.Equal(t, protocol.ErrTopicAliasUnknown, aliases.Resolve(&protocol.Publish{}))
+}
+
+func TestConn_ReadPacket_Timeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := protocol.NewConn(server)
+	c.SetTimeouts(10*time.Millisecond, 0)
+
+	_, err := c.ReadPacket(4)
+	assert.True(t, protocol.IsTimeout(err))
+}
+
+func TestConn_WritePacket_Timeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := protocol.NewConn(server)
+	c.SetTimeouts(0, 10*time.Millisecond)
+
+	err := c.WritePacket(protocol.NewPubAck(1))
+	assert.True(t, protocol.IsTimeout(err))
+}
+
+func TestConn_ReadPacket_TooLarge(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := protocol.NewConn(server)
+	c.SetMaxPacketSize(8)
+
+	go func() {
+		_, _ = protocol.NewPubAck(1).WriteTo(client)
+		_, _ = (&protocol.Publish{Topic: "topic", Payload: []byte("payload"), ProtocolLevel: 4}).WriteTo(client)
+	}()
+
+	p, err := c.ReadPacket(4)
+	assert.NoError(t, err)
+	assert.IsType(t, &protocol.AckControlPacket{}, p)
+
+	_, err = c.ReadPacket(4)
+	assert.Equal(t, protocol.ErrPacketTooLarge, err)
+}
+
+func TestConn_ReadPacket_ConnectTooLarge(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := protocol.NewConn(server)
+
+	// CONNECT claiming 2 MiB Remaining Length, only the Fixed Header is sent
+	go func() {
+		_, _ = client.Write([]byte{byte(packet.CONNECT) << 4, 0x80, 0x80, 0x80, 0x01})
+	}()
+
+	_, err := c.ReadPacket(0)
+	assert.Equal(t, protocol.ErrPacketTooLarge, err)
+}
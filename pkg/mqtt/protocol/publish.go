@@ -0,0 +1,103 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+// Publish - PUBLISH packet in both directions.
+// Unlike packet.PublishControlPacket it (de)serializes QoS, DUP and RETAIN flags, Packet Identifier and MQTT 5 properties
+type Publish struct {
+	Topic      string
+	PacketID   uint16
+	QoS        packet.QosLevel
+	Dup        bool
+	Retain     bool
+	Properties *Properties // MQTT 5 only
+	Payload    []byte
+
+	ProtocolLevel byte
+}
+
+func (p *Publish) flags() (flags byte) {
+	if p.Dup {
+		flags |= 8
+	}
+	flags |= byte(p.QoS) << 1
+	if p.Retain {
+		flags |= 1
+	}
+	return flags
+}
+
+func (p *Publish) WriteTo(w io.Writer) (int64, error) {
+	var vh bytes.Buffer
+	_ = binary.Write(&vh, binary.BigEndian, uint16(len(p.Topic)))
+	vh.WriteString(p.Topic)
+	if p.QoS > packet.QoSLevelNone {
+		_ = binary.Write(&vh, binary.BigEndian, p.PacketID)
+	}
+	if p.ProtocolLevel == 5 {
+		writeProperties(&vh, p.Properties)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(packet.PUBLISH)<<4 | p.flags())
+	writeVarInt(&buf, vh.Len()+len(p.Payload))
+	buf.Write(vh.Bytes())
+	buf.Write(p.Payload)
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func parsePublish(fh packet.FixedHeader, body []byte, protocolLevel byte) (*Publish, error) {
+	p := &Publish{
+		Dup:           fh.Flags&8 != 0,
+		QoS:           packet.QosLevel(fh.Flags>>1) & 3,
+		Retain:        fh.Flags&1 != 0,
+		ProtocolLevel: protocolLevel,
+	}
+	if p.QoS == 3 {
+		return nil, errors.New("invalid publish QoS")
+	}
+
+	r := bytes.NewReader(body)
+	var err error
+	if p.Topic, err = readString(r); err != nil {
+		return nil, err
+	}
+	if p.QoS > packet.QoSLevelNone {
+		if p.PacketID, err = readUint16(r); err != nil {
+			return nil, err
+		}
+	}
+	if protocolLevel == 5 {
+		if p.Properties, err = readProperties(r); err != nil {
+			return nil, err
+		}
+	}
+
+	p.Payload = make([]byte, r.Len())
+	_, err = io.ReadFull(r, p.Payload)
+	return p, err
+}
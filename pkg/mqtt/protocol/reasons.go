@@ -0,0 +1,41 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package protocol
+
+// MQTT 5 Reason Codes
+const (
+	ReasonSuccess                    byte = 0x00
+	ReasonDisconnectWithWill         byte = 0x04
+	ReasonUnspecifiedError           byte = 0x80
+	ReasonMalformedPacket            byte = 0x81
+	ReasonProtocolError              byte = 0x82
+	ReasonUnsupportedProtocolVersion byte = 0x84
+	ReasonClientIdentifierNotValid   byte = 0x85
+	ReasonBadUserNameOrPassword      byte = 0x86
+	ReasonNotAuthorized              byte = 0x87
+	ReasonServerUnavailable          byte = 0x88
+	ReasonServerBusy                 byte = 0x89
+	ReasonServerShuttingDown         byte = 0x8B
+	ReasonKeepAliveTimeout           byte = 0x8D
+	ReasonSessionTakenOver           byte = 0x8E
+	ReasonPacketIdentifierNotFound   byte = 0x92
+	ReasonTopicAliasInvalid          byte = 0x94
+	ReasonPacketTooLarge             byte = 0x95
+	ReasonMessageRateTooHigh         byte = 0x96
+	ReasonQuotaExceeded              byte = 0x97
+	ReasonPayloadFormatInvalid       byte = 0x99
+	ReasonQoSNotSupported            byte = 0x9B
+)
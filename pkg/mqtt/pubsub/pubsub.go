@@ -17,6 +17,7 @@ package pubsub
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/infinimesh/infinimesh/pkg/pubsub"
@@ -29,30 +30,130 @@ import (
 var (
 	ps     pubsub.PubSub
 	logger *zap.Logger
+	conn   *amqp.Connection
 
 	cap int
+
+	mu sync.Mutex
+	// forwarded - PubSub topics published to RabbitMQ
+	forwarded []string
+	// consumers - channels RabbitMQ Queues are consumed on
+	consumers  []*amqp.Channel
+	publishers sync.WaitGroup
 )
 
 // Setup - Sets up RabbitMQ Queues and internal PubSub.
 // Should only be used when Queue is required.
 //
 // **IMPORTANT!** Should not be used with known Queues unless you know what you're doing (e.g. mqtt.incoming), as you will prevent workers from consuming messages
-func Setup(Log *zap.Logger, conn *amqp.Connection, pub, sub string, buffer_capacity int) (pubsub.PubSub, error) {
+func Setup(Log *zap.Logger, c *amqp.Connection, pub, sub string, buffer_capacity int) (pubsub.PubSub, error) {
 	logger = Log
+	conn = c
 	cap = buffer_capacity
 	ps = pubsub.New(cap)
 
+	if err := Forward(conn, pub); err != nil {
+		return nil, err
+	}
+
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, err
 	}
-
-	go HandlePublish(ch, pub)
+	mu.Lock()
+	consumers = append(consumers, ch)
+	mu.Unlock()
 	go HandleSubscribe(ch, sub)
 
 	return ps, nil
 }
 
+// Forward - additionally publishes messages from PubSub topic to the RabbitMQ Queue with the same name.
+// Setup must be called first
+func Forward(conn *amqp.Connection, topic string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	forwarded = append(forwarded, topic)
+	mu.Unlock()
+	publishers.Add(1)
+	go func() {
+		defer publishers.Done()
+		HandlePublish(ch, topic)
+	}()
+	return nil
+}
+
+// Subscribe - additionally consumes the RabbitMQ Queue into PubSub topic with the same name.
+// Setup must be called first
+func Subscribe(conn *amqp.Connection, topic string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	consumers = append(consumers, ch)
+	mu.Unlock()
+	go HandleSubscribe(ch, topic)
+	return nil
+}
+
+// Shutdown - stops consuming RabbitMQ Queues and closes forwarded PubSub topics,
+// then waits until messages buffered in them are published to RabbitMQ or ctx is done.
+// Messages received but not yet handled by subscribers stay in PubSub channels, those are closed by the caller
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	for _, ch := range consumers {
+		if err := ch.Close(); err != nil {
+			logger.Warn("Error closing consumer channel", zap.Error(err))
+		}
+	}
+	consumers = nil
+	topics := forwarded
+	mu.Unlock()
+
+	ps.Close(topics...)
+
+	done := make(chan struct{})
+	go func() {
+		publishers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PublishNow - publishes messages to the RabbitMQ Queue directly rather than through PubSub buffers, e.g. after Shutdown
+func PublishNow(ctx context.Context, topic string, msgs ...*pb.Shadow) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, msg := range msgs {
+		payload, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		err = ch.PublishWithContext(ctx, "", topic, false, false, amqp.Publishing{
+			ContentType: "text/plain", Body: payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // HandlePublish - Reads messages from PubSub and publishing them to RabbitMQ Queue
 func HandlePublish(ch *amqp.Channel, topic string) {
 	log := logger.Named("publish")
@@ -99,6 +200,9 @@ init:
 		true, false, false, true, nil,
 	)
 	if err != nil {
+		if ch.IsClosed() {
+			return
+		}
 		log.Warn("Error declaring queue", zap.Error(err))
 		time.Sleep(time.Second)
 		goto init
@@ -108,6 +212,9 @@ init:
 consume:
 	messages, err := ch.Consume(q.Name, "", false, false, false, false, nil)
 	if err != nil {
+		if ch.IsClosed() {
+			return
+		}
 		log.Warn("Error setting up consumer", zap.Error(err))
 		time.Sleep(time.Second)
 		goto consume
@@ -0,0 +1,272 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ratelimit implements token bucket limits for MQTT ingress.
+// Limits are read from "mqtt_limits" key of Namespace and Device config, e.g.
+//
+//	{"mqtt_limits": {"messages_per_second": 10, "bytes_per_second": 65536, "max_packet_size": 16384, "max_connections": 1, "policy": "disconnect"}}
+//
+// Device config overrides Namespace config, which overrides bridge defaults. Zero disables the limit.
+// Limits apply to the device, all its connections share the same buckets through Registry
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ConfigKey - key of Namespace and Device config holding the limits
+const ConfigKey = "mqtt_limits"
+
+// Policy - what happens to the Client exceeding the rate limits
+type Policy string
+
+const (
+	// PolicyDrop - over-limit messages are dropped, connection is kept
+	PolicyDrop Policy = "drop"
+	// PolicyDisconnect - Client is disconnected on the first over-limit message
+	PolicyDisconnect Policy = "disconnect"
+)
+
+// Reasons the message is limited, used as metrics labels
+const (
+	ReasonMessages    = "messages"
+	ReasonBytes       = "bytes"
+	ReasonPacketSize  = "packet_size"
+	ReasonConnections = "connections"
+)
+
+type Limits struct {
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+	MaxPacketSize     int
+	MaxConnections    int
+	Policy            Policy
+}
+
+// Merge - returns limits with values set in config overriding the ones of l
+func (l Limits) Merge(config *structpb.Struct) Limits {
+	fields := config.GetFields()[ConfigKey].GetStructValue().GetFields()
+	if fields == nil {
+		return l
+	}
+
+	if v, ok := fields["messages_per_second"]; ok {
+		l.MessagesPerSecond = math.Max(v.GetNumberValue(), 0)
+	}
+	if v, ok := fields["bytes_per_second"]; ok {
+		l.BytesPerSecond = math.Max(v.GetNumberValue(), 0)
+	}
+	if v, ok := fields["max_packet_size"]; ok {
+		l.MaxPacketSize = int(math.Max(v.GetNumberValue(), 0))
+	}
+	if v, ok := fields["max_connections"]; ok {
+		l.MaxConnections = int(math.Max(v.GetNumberValue(), 0))
+	}
+	if v, ok := fields["policy"]; ok {
+		switch p := Policy(v.GetStringValue()); p {
+		case PolicyDrop, PolicyDisconnect:
+			l.Policy = p
+		}
+	}
+	return l
+}
+
+// Bucket - token bucket refilled with rate tokens per second up to burst
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate, burst float64) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// Allow - takes n tokens if there are enough of them at the moment
+func (b *Bucket) Allow(n float64, now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Limiter - rate limits of a single device, safe for concurrent use
+type Limiter struct {
+	mu       sync.Mutex
+	limits   Limits
+	messages *Bucket
+	bytes    *Bucket
+}
+
+// NewLimiter - buckets allow one second worth of traffic at once, but at least a single packet of maximum size
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{}
+	l.reset(limits)
+	return l
+}
+
+// reset - replaces the buckets with ones of the given limits
+func (l *Limiter) reset(limits Limits) {
+	l.limits, l.messages, l.bytes = limits, nil, nil
+	if limits.MessagesPerSecond > 0 {
+		l.messages = NewBucket(limits.MessagesPerSecond, math.Max(limits.MessagesPerSecond, 1))
+	}
+	if limits.BytesPerSecond > 0 {
+		l.bytes = NewBucket(limits.BytesPerSecond, math.Max(limits.BytesPerSecond, float64(limits.MaxPacketSize)))
+	}
+}
+
+func (l *Limiter) Limits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limits
+}
+
+// Allow - accounts the message of the given size, returns the reason if it's over the limits
+func (l *Limiter) Allow(size int, now time.Time) (ok bool, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.MaxPacketSize > 0 && size > l.limits.MaxPacketSize {
+		return false, ReasonPacketSize
+	}
+	if l.messages != nil && !l.messages.Allow(1, now) {
+		return false, ReasonMessages
+	}
+	if l.bytes != nil && !l.bytes.Allow(float64(size), now) {
+		// Dropped message doesn't count towards messages rate
+		if l.messages != nil {
+			l.messages.tokens++
+		}
+		return false, ReasonBytes
+	}
+	return true, ""
+}
+
+// ErrTooManyConnections - device has MaxConnections connections already
+var ErrTooManyConnections = errors.New("too many connections")
+
+// Registry - limiters shared by all connections of the same device, so reconnecting or opening
+// more connections doesn't give the device more tokens. Safe for concurrent use
+type Registry struct {
+	mu       sync.Mutex
+	limiters map[string]*sharedLimiter
+}
+
+type sharedLimiter struct {
+	*Limiter
+	refs int
+	// idle - removes the limiter once it isn't held by any connection for its refill time
+	idle *time.Timer
+}
+
+func NewRegistry() *Registry {
+	return &Registry{limiters: make(map[string]*sharedLimiter)}
+}
+
+// Acquire - limiter of the device, created unless another connection of the device holds it already or released it
+// too recently for its buckets to refill. Limiter is reset if limits differ from the ones it has, e.g. config of the device was changed.
+// Connection is counted towards MaxConnections at once, ErrTooManyConnections is returned if the device has that many.
+// release must be called once the connection is closed
+func (r *Registry) Acquire(device string, limits Limits) (l *Limiter, release func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shared, ok := r.limiters[device]
+	if !ok {
+		shared = &sharedLimiter{Limiter: NewLimiter(limits)}
+		r.limiters[device] = shared
+	} else if shared.Limits() != limits {
+		shared.mu.Lock()
+		shared.reset(limits)
+		shared.mu.Unlock()
+	}
+	if limits.MaxConnections > 0 && shared.refs >= limits.MaxConnections {
+		return nil, nil, ErrTooManyConnections
+	}
+	if shared.idle != nil {
+		shared.idle.Stop()
+		shared.idle = nil
+	}
+	shared.refs++
+
+	var once sync.Once
+	return shared.Limiter, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if shared.refs--; shared.refs == 0 {
+				r.idle(device, shared)
+			}
+		})
+	}, nil
+}
+
+// idle - removes the limiter nobody holds once its buckets are full again, so it's the same as a new one by then.
+// Must be called with r.mu held
+func (r *Registry) idle(device string, shared *sharedLimiter) {
+	refill := shared.refillTime()
+	if refill <= 0 {
+		delete(r.limiters, device)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(refill, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if shared.idle == timer && r.limiters[device] == shared {
+			delete(r.limiters, device)
+		}
+	})
+	shared.idle = timer
+}
+
+// refillTime - how long it takes the buckets to refill from empty
+func (l *Limiter) refillTime() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var res time.Duration
+	for _, b := range []*Bucket{l.messages, l.bytes} {
+		if b == nil {
+			continue
+		}
+		if d := time.Duration(b.burst / b.rate * float64(time.Second)); d > res {
+			res = d
+		}
+	}
+	return res
+}
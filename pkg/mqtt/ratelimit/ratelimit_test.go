@@ -0,0 +1,189 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestBucket_Allow(t *testing.T) {
+	now := time.Now()
+	b := ratelimit.NewBucket(2, 2)
+
+	assert.True(t, b.Allow(1, now))
+	assert.True(t, b.Allow(1, now))
+	assert.False(t, b.Allow(1, now))
+
+	assert.True(t, b.Allow(1, now.Add(500*time.Millisecond)))
+	assert.False(t, b.Allow(1, now.Add(500*time.Millisecond)))
+}
+
+func TestBucket_DoesntExceedBurst(t *testing.T) {
+	now := time.Now()
+	b := ratelimit.NewBucket(10, 2)
+
+	assert.True(t, b.Allow(2, now))
+	assert.False(t, b.Allow(3, now.Add(time.Hour)))
+	assert.True(t, b.Allow(2, now.Add(time.Hour)))
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	l := ratelimit.NewLimiter(ratelimit.Limits{
+		MessagesPerSecond: 2, BytesPerSecond: 100, MaxPacketSize: 60,
+	})
+
+	ok, reason := l.Allow(61, now)
+	assert.False(t, ok)
+	assert.Equal(t, ratelimit.ReasonPacketSize, reason)
+
+	ok, _ = l.Allow(60, now)
+	assert.True(t, ok)
+
+	ok, reason = l.Allow(60, now)
+	assert.False(t, ok)
+	assert.Equal(t, ratelimit.ReasonBytes, reason)
+
+	ok, _ = l.Allow(10, now)
+	assert.True(t, ok)
+
+	ok, reason = l.Allow(10, now)
+	assert.False(t, ok)
+	assert.Equal(t, ratelimit.ReasonMessages, reason)
+}
+
+func TestLimiter_Unlimited(t *testing.T) {
+	l := ratelimit.NewLimiter(ratelimit.Limits{})
+	for i := 0; i < 1000; i++ {
+		ok, _ := l.Allow(1<<20, time.Now())
+		assert.True(t, ok)
+	}
+}
+
+// acquire - limiter of the device, fails the test if it can't be acquired
+func acquire(t *testing.T, r *ratelimit.Registry, device string, limits ratelimit.Limits) (*ratelimit.Limiter, func()) {
+	l, release, err := r.Acquire(device, limits)
+	require.NoError(t, err)
+	return l, release
+}
+
+func TestRegistry_SharesLimiterOfDevice(t *testing.T) {
+	now := time.Now()
+	r := ratelimit.NewRegistry()
+	limits := ratelimit.Limits{MessagesPerSecond: 1}
+
+	first, releaseFirst := acquire(t, r, "device", limits)
+	defer releaseFirst()
+	second, releaseSecond := acquire(t, r, "device", limits)
+	defer releaseSecond()
+	other, releaseOther := acquire(t, r, "other", limits)
+	defer releaseOther()
+
+	ok, _ := first.Allow(1, now)
+	assert.True(t, ok)
+	ok, reason := second.Allow(1, now)
+	assert.False(t, ok)
+	assert.Equal(t, ratelimit.ReasonMessages, reason)
+	ok, _ = other.Allow(1, now)
+	assert.True(t, ok)
+}
+
+func TestRegistry_Release(t *testing.T) {
+	now := time.Now()
+	r := ratelimit.NewRegistry()
+	limits := ratelimit.Limits{MessagesPerSecond: 1}
+
+	l, release := acquire(t, r, "device", limits)
+	ok, _ := l.Allow(1, now)
+	assert.True(t, ok)
+
+	// Kept while any connection of the device holds it
+	_, releaseSecond := acquire(t, r, "device", limits)
+	release()
+	release()
+	l, release = acquire(t, r, "device", limits)
+	ok, _ = l.Allow(1, now)
+	assert.False(t, ok)
+
+	// and until its buckets refill, so reconnecting doesn't refill them
+	release()
+	releaseSecond()
+	l, release = acquire(t, r, "device", limits)
+	ok, _ = l.Allow(1, now)
+	assert.False(t, ok)
+
+	// Removed once they'd be full anyway
+	release()
+	time.Sleep(1200 * time.Millisecond)
+	l, release = acquire(t, r, "device", limits)
+	defer release()
+	ok, _ = l.Allow(1, now)
+	assert.True(t, ok)
+}
+
+func TestRegistry_MaxConnections(t *testing.T) {
+	r := ratelimit.NewRegistry()
+	limits := ratelimit.Limits{MaxConnections: 1}
+
+	_, release := acquire(t, r, "device", limits)
+
+	// Slot is taken at once, not when the connection is set up
+	_, _, err := r.Acquire("device", limits)
+	assert.ErrorIs(t, err, ratelimit.ErrTooManyConnections)
+
+	release()
+	_, release = acquire(t, r, "device", limits)
+	release()
+}
+
+func TestRegistry_ResetsOnLimitsChange(t *testing.T) {
+	now := time.Now()
+	r := ratelimit.NewRegistry()
+
+	l, release := acquire(t, r, "device", ratelimit.Limits{MessagesPerSecond: 1})
+	defer release()
+	ok, _ := l.Allow(1, now)
+	assert.True(t, ok)
+
+	_, releaseSecond := acquire(t, r, "device", ratelimit.Limits{MessagesPerSecond: 2})
+	defer releaseSecond()
+	assert.Equal(t, float64(2), l.Limits().MessagesPerSecond)
+	ok, _ = l.Allow(1, now)
+	assert.True(t, ok)
+}
+
+func TestLimits_Merge(t *testing.T) {
+	defaults := ratelimit.Limits{MessagesPerSecond: 10, MaxPacketSize: 1024, Policy: ratelimit.PolicyDrop}
+
+	config, err := structpb.NewStruct(map[string]any{
+		ratelimit.ConfigKey: map[string]any{
+			"messages_per_second": 1,
+			"max_connections":     2,
+			"policy":              "disconnect",
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, ratelimit.Limits{
+		MessagesPerSecond: 1, MaxPacketSize: 1024, MaxConnections: 2, Policy: ratelimit.PolicyDisconnect,
+	}, defaults.Merge(config))
+}
+
+func TestLimits_Merge_IgnoresInvalid(t *testing.T) {
+	defaults := ratelimit.Limits{MessagesPerSecond: 10, Policy: ratelimit.PolicyDrop}
+
+	config, err := structpb.NewStruct(map[string]any{
+		ratelimit.ConfigKey: map[string]any{
+			"messages_per_second": -5,
+			"policy":              "explode",
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, ratelimit.Limits{Policy: ratelimit.PolicyDrop}, defaults.Merge(config))
+	assert.Equal(t, defaults, defaults.Merge(nil))
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package retained stores MQTT retained messages in Redis, one message per topic, grouped by device
+package retained
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+type Message struct {
+	Topic     string          `json:"topic"`
+	QoS       packet.QosLevel `json:"qos"`
+	Payload   []byte          `json:"payload"`
+	Timestamp time.Time       `json:"timestamp"`
+	// Expiry - MQTT 5 Message Expiry Interval counted from Timestamp, zero means message never expires
+	Expiry time.Duration `json:"expiry,omitempty"`
+	// Codec - name of the codec payload is encoded with, JSON if it's empty
+	Codec string `json:"codec,omitempty"`
+}
+
+// Expired - whether the message lifetime is over at the given time
+func (m *Message) Expired(now time.Time) bool {
+	return m.Expiry > 0 && !now.Before(m.Timestamp.Add(m.Expiry))
+}
+
+// Remaining - lifetime left at the given time, zero if message never expires
+func (m *Message) Remaining(now time.Time) time.Duration {
+	if m.Expiry == 0 {
+		return 0
+	}
+	return m.Timestamp.Add(m.Expiry).Sub(now)
+}
+
+type Store interface {
+	// Set - replaces retained message of the topic, message with empty payload removes it
+	Set(ctx context.Context, device string, msg Message) error
+	// Get - returns nil if there is no retained message for the topic or it has expired
+	Get(ctx context.Context, device, topic string) (*Message, error)
+	// Match - returns not expired retained messages of the device matching the Topic Filter
+	Match(ctx context.Context, device, filter string) ([]Message, error)
+}
+
+type store struct {
+	rdb redis.Cmdable
+}
+
+func NewStore(rdb redis.Cmdable) Store {
+	return &store{rdb: rdb}
+}
+
+func Key(device string) string {
+	return fmt.Sprintf("mqtt:retained:%s", device)
+}
+
+func (s *store) Set(ctx context.Context, device string, msg Message) error {
+	if len(msg.Payload) == 0 {
+		return s.rdb.HDel(ctx, Key(device), msg.Topic).Err()
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.rdb.HSet(ctx, Key(device), msg.Topic, data).Err()
+}
+
+func (s *store) Get(ctx context.Context, device, topic string) (*Message, error) {
+	data, err := s.rdb.HGet(ctx, Key(device), topic).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	if msg.Expired(time.Now()) {
+		return nil, nil
+	}
+	return msg, nil
+}
+
+func (s *store) Match(ctx context.Context, device, filter string) ([]Message, error) {
+	all, err := s.rdb.HGetAll(ctx, Key(device)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var res []Message
+	for topic, data := range all {
+		if !topics.Match(filter, topic) {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil || msg.Expired(now) {
+			continue
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
@@ -0,0 +1,138 @@
+package retained_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/retained"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	"github.com/slntopp/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+type retainedFixture struct {
+	store retained.Store
+
+	mocks struct {
+		rdb *redis_mocks.MockCmdable
+	}
+}
+
+func newRetainedFixture(t *testing.T) (f *retainedFixture) {
+	f = &retainedFixture{}
+	f.mocks.rdb = redis_mocks.NewMockCmdable(t)
+	f.store = retained.NewStore(f.mocks.rdb)
+	return f
+}
+
+func TestSet_Success(t *testing.T) {
+	f := newRetainedFixture(t)
+	msg := retained.Message{
+		Topic: topics.Reported("dev"), QoS: packet.QoSLevelAtLeastOnce,
+		Payload: []byte(`{"a":1}`), Timestamp: time.Unix(1687185838, 0).UTC(),
+	}
+	data, _ := json.Marshal(msg)
+
+	f.mocks.rdb.EXPECT().HSet(context.Background(), "mqtt:retained:dev", msg.Topic, data).
+		Return(redis.NewIntCmd(context.Background()))
+
+	assert.NoError(t, f.store.Set(context.Background(), "dev", msg))
+}
+
+func TestSet_EmptyPayload_Removes(t *testing.T) {
+	f := newRetainedFixture(t)
+
+	f.mocks.rdb.EXPECT().HDel(context.Background(), "mqtt:retained:dev", topics.Reported("dev")).
+		Return(redis.NewIntCmd(context.Background()))
+
+	assert.NoError(t, f.store.Set(context.Background(), "dev", retained.Message{Topic: topics.Reported("dev")}))
+}
+
+func TestGet_NotFound(t *testing.T) {
+	f := newRetainedFixture(t)
+
+	res := redis.NewStringCmd(context.Background())
+	res.SetErr(redis.Nil)
+	f.mocks.rdb.EXPECT().HGet(context.Background(), "mqtt:retained:dev", topics.Reported("dev")).Return(res)
+
+	msg, err := f.store.Get(context.Background(), "dev", topics.Reported("dev"))
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestMatch_FiltersTopics(t *testing.T) {
+	f := newRetainedFixture(t)
+
+	reported := retained.Message{Topic: topics.Reported("dev"), Payload: []byte(`{}`)}
+	event := retained.Message{Topic: topics.Events("dev", "button"), Payload: []byte(`{}`)}
+	rd, _ := json.Marshal(reported)
+	ed, _ := json.Marshal(event)
+
+	res := redis.NewStringStringMapCmd(context.Background())
+	res.SetVal(map[string]string{reported.Topic: string(rd), event.Topic: string(ed)})
+	f.mocks.rdb.EXPECT().HGetAll(context.Background(), "mqtt:retained:dev").Return(res)
+
+	msgs, err := f.store.Match(context.Background(), "dev", "devices/dev/events/#")
+	assert.NoError(t, err)
+	assert.Equal(t, []retained.Message{event}, msgs)
+}
+
+func TestMatch_FailsOn_HGetAll(t *testing.T) {
+	f := newRetainedFixture(t)
+
+	res := redis.NewStringStringMapCmd(context.Background())
+	res.SetErr(assert.AnError)
+	f.mocks.rdb.EXPECT().HGetAll(context.Background(), "mqtt:retained:dev").Return(res)
+
+	_, err := f.store.Match(context.Background(), "dev", "devices/dev/#")
+	assert.Equal(t, assert.AnError, err)
+}
+
+func TestGet_Expired(t *testing.T) {
+	f := newRetainedFixture(t)
+
+	data, _ := json.Marshal(retained.Message{
+		Topic: topics.Reported("dev"), Payload: []byte(`{}`),
+		Timestamp: time.Now().Add(-time.Minute), Expiry: time.Second,
+	})
+	res := redis.NewStringCmd(context.Background())
+	res.SetVal(string(data))
+	f.mocks.rdb.EXPECT().HGet(context.Background(), "mqtt:retained:dev", topics.Reported("dev")).Return(res)
+
+	msg, err := f.store.Get(context.Background(), "dev", topics.Reported("dev"))
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestMatch_SkipsExpired(t *testing.T) {
+	f := newRetainedFixture(t)
+
+	now := time.Now().UTC()
+	fresh := retained.Message{Topic: topics.Reported("dev"), Payload: []byte(`{}`), Timestamp: now, Expiry: time.Hour}
+	expired := retained.Message{Topic: topics.Events("dev", "button"), Payload: []byte(`{}`), Timestamp: now.Add(-time.Hour), Expiry: time.Minute}
+	fd, _ := json.Marshal(fresh)
+	ed, _ := json.Marshal(expired)
+
+	res := redis.NewStringStringMapCmd(context.Background())
+	res.SetVal(map[string]string{fresh.Topic: string(fd), expired.Topic: string(ed)})
+	f.mocks.rdb.EXPECT().HGetAll(context.Background(), "mqtt:retained:dev").Return(res)
+
+	msgs, err := f.store.Match(context.Background(), "dev", "devices/dev/#")
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, fresh.Topic, msgs[0].Topic)
+}
+
+func TestMessage_Remaining(t *testing.T) {
+	now := time.Now()
+	msg := retained.Message{Timestamp: now.Add(-time.Minute), Expiry: time.Hour}
+
+	assert.Equal(t, 59*time.Minute, msg.Remaining(now))
+	assert.False(t, msg.Expired(now))
+	assert.True(t, msg.Expired(now.Add(time.Hour)))
+	assert.Equal(t, time.Duration(0), (&retained.Message{}).Remaining(now))
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package retained
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	pb "github.com/infinimesh/proto/shadow"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// States - Reported states devices published with MQTT Retain flag, so Shadow streams can start with the last value
+type States struct {
+	store Store
+}
+
+func NewStates(store Store) *States {
+	return &States{store: store}
+}
+
+// Reported - latest retained message of the device Reported state topics, format suffixed ones included,
+// decoded with the codec it was published in. Returns nil if there is none
+func (s *States) Reported(ctx context.Context, device string) (*pb.State, error) {
+	msgs, err := s.store.Match(ctx, device, topics.Reported(device)+"/#")
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *Message
+	for i, msg := range msgs {
+		if topics.Parse(msg.Topic).Kind != topics.StateReported {
+			continue
+		}
+		if latest == nil || msg.Timestamp.After(latest.Timestamp) {
+			latest = &msgs[i]
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	c := codec.JSON
+	if latest.Codec != "" {
+		if c = codec.ByName(latest.Codec); c == nil {
+			return nil, fmt.Errorf("%w: %s", codec.ErrUnknownCodec, latest.Codec)
+		}
+	}
+	data, err := codec.DecodeStruct(c, latest.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.State{
+		Timestamp: timestamppb.New(latest.Timestamp),
+		Data:      data,
+	}, nil
+}
@@ -0,0 +1,74 @@
+package retained_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/retained"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func (f *retainedFixture) expectMessages(t *testing.T, msgs ...retained.Message) {
+	all := make(map[string]string)
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		require.NoError(t, err)
+		all[msg.Topic] = string(data)
+	}
+	res := redis.NewStringStringMapCmd(context.Background())
+	res.SetVal(all)
+	f.mocks.rdb.EXPECT().HGetAll(context.Background(), "mqtt:retained:dev").Return(res)
+}
+
+func TestStates_Reported_LatestInItsCodec(t *testing.T) {
+	f := newRetainedFixture(t)
+	now := time.Now().UTC()
+
+	payload, err := codec.CBOR.Encode(structpb.NewStructValue(&structpb.Struct{
+		Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(2)},
+	}))
+	require.NoError(t, err)
+	f.expectMessages(t,
+		retained.Message{Topic: topics.Reported("dev"), Payload: []byte(`{"diff":1}`), Timestamp: now.Add(-time.Minute)},
+		retained.Message{Topic: topics.WithFormat(topics.Reported("dev"), "cbor"), Payload: payload, Timestamp: now, Codec: "cbor"},
+		retained.Message{Topic: topics.Events("dev", "button"), Payload: []byte(`{}`), Timestamp: now.Add(time.Minute)},
+	)
+
+	state, err := retained.NewStates(f.store).Reported(context.Background(), "dev")
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), state.GetData().GetFields()["diff"].GetNumberValue())
+	assert.Equal(t, now.Unix(), state.GetTimestamp().GetSeconds())
+}
+
+func TestStates_Reported_DefaultsToJSON(t *testing.T) {
+	f := newRetainedFixture(t)
+	f.expectMessages(t, retained.Message{Topic: topics.Reported("dev"), Payload: []byte(`{"diff":1}`), Timestamp: time.Now()})
+
+	state, err := retained.NewStates(f.store).Reported(context.Background(), "dev")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), state.GetData().GetFields()["diff"].GetNumberValue())
+}
+
+func TestStates_Reported_None(t *testing.T) {
+	f := newRetainedFixture(t)
+	f.expectMessages(t, retained.Message{Topic: topics.Events("dev", "button"), Payload: []byte(`{}`), Timestamp: time.Now()})
+
+	state, err := retained.NewStates(f.store).Reported(context.Background(), "dev")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestStates_Reported_FailsOn_UnknownCodec(t *testing.T) {
+	f := newRetainedFixture(t)
+	f.expectMessages(t, retained.Message{Topic: topics.Reported("dev"), Payload: []byte(`{}`), Timestamp: time.Now(), Codec: "xml"})
+
+	_, err := retained.NewStates(f.store).Reported(context.Background(), "dev")
+	assert.ErrorIs(t, err, codec.ErrUnknownCodec)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TakeOverChannel - Redis Pub/Sub channel bridges request ClientIDs leased by other bridges through
+const TakeOverChannel = "mqtt:sessions:takeovers"
+
+// TakeOver - request to disconnect the connection serving the ClientID, unless it's the one of Owner
+type TakeOver struct {
+	ClientID string `json:"client_id"`
+	Owner    string `json:"owner"`
+}
+
+func leaseKey(clientID string) string {
+	return fmt.Sprintf("mqtt:sessions:%s:owner", clientID)
+}
+
+func (s *store) Lease(ctx context.Context, clientID, owner string, ttl time.Duration) (bool, error) {
+	return s.rdb.SetNX(ctx, leaseKey(clientID), owner, ttl).Result()
+}
+
+func (s *store) TakeLease(ctx context.Context, clientID, owner string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, leaseKey(clientID), owner, ttl).Err()
+}
+
+// renewScript - extends the lease and the session expiration only while the lease is held by the owner,
+// so a bridge which lost the ClientID can't keep the session of the new one alive
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	for i = 2, #KEYS do
+		redis.call('PEXPIRE', KEYS[i], ARGV[3])
+	end
+end
+return 1
+`)
+
+func (s *store) Renew(ctx context.Context, clientID, owner string, lease, ttl time.Duration) (bool, error) {
+	keys := []string{leaseKey(clientID), sessionKey(clientID), queueKey(clientID), pinnedKey(clientID)}
+	renewed, err := renewScript.Run(ctx, s.rdb, keys, owner, lease.Milliseconds(), ttl.Milliseconds()).Int()
+	return renewed == 1, err
+}
+
+// releaseScript - deletes the lease only if it's still held by the owner
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (s *store) Release(ctx context.Context, clientID, owner string) error {
+	return releaseScript.Run(ctx, s.rdb, []string{leaseKey(clientID)}, owner).Err()
+}
+
+func (s *store) Online(ctx context.Context, clientID string) (bool, error) {
+	n, err := s.rdb.Exists(ctx, leaseKey(clientID)).Result()
+	return n > 0, err
+}
+
+// RequestTakeOver - asks bridges to disconnect the connection serving the ClientID, so owner can lease it
+func RequestTakeOver(ctx context.Context, rdb redis.Cmdable, clientID, owner string) error {
+	data, err := json.Marshal(&TakeOver{ClientID: clientID, Owner: owner})
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(ctx, TakeOverChannel, data).Err()
+}
+
+// SubscribeTakeOvers - calls cb with each take over request until ctx is done
+func SubscribeTakeOvers(ctx context.Context, rdb redis.UniversalClient, cb func(*TakeOver)) {
+	sub := rdb.Subscribe(ctx, TakeOverChannel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			t := &TakeOver{}
+			if err := json.Unmarshal([]byte(msg.Payload), t); err != nil {
+				continue
+			}
+			cb(t)
+		}
+	}
+}
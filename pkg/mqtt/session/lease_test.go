@@ -0,0 +1,57 @@
+package session_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var leaseKeys = []string{"mqtt:sessions:client:owner", "mqtt:sessions:client", "mqtt:sessions:client:queue", "mqtt:sessions:client:queue:pinned"}
+
+func TestLease_TakenByAnotherOwner(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	f.mocks.rdb.EXPECT().SetNX(context.Background(), "mqtt:sessions:client:owner", "owner", time.Minute).
+		Return(redis.NewBoolResult(false, nil))
+
+	ok, err := f.store.Lease(context.Background(), "client", "owner", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRenew_Success(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	f.mocks.rdb.EXPECT().EvalSha(context.Background(), mock.Anything, leaseKeys, "owner", int64(30000), int64(3600000)).
+		Return(redis.NewCmdResult(int64(1), nil))
+
+	ok, err := f.store.Renew(context.Background(), "client", "owner", 30*time.Second, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRenew_LeaseLost(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	f.mocks.rdb.EXPECT().EvalSha(context.Background(), mock.Anything, leaseKeys, "owner", int64(30000), int64(0)).
+		Return(redis.NewCmdResult(int64(0), nil))
+
+	ok, err := f.store.Renew(context.Background(), "client", "owner", 30*time.Second, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestOnline(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	f.mocks.rdb.EXPECT().Exists(context.Background(), "mqtt:sessions:client:owner").
+		Return(redis.NewIntResult(1, nil))
+
+	online, err := f.store.Online(context.Background(), "client")
+	assert.NoError(t, err)
+	assert.True(t, online)
+}
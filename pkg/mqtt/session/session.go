@@ -0,0 +1,269 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package session persists MQTT sessions (subscriptions and queued QoS 1 and QoS 2 messages) in Redis,
+// so they survive disconnects of Clients connecting with Clean Session = 0 or Session Expiry Interval > 0
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+type Session struct {
+	ClientID      string                     `json:"client_id"`
+	Device        string                     `json:"device"`
+	Subscriptions map[string]packet.QosLevel `json:"subscriptions"`
+}
+
+// Message - message queued for the Client while it's offline or left unacknowledged on disconnect
+type Message struct {
+	Topic   string          `json:"topic"`
+	QoS     packet.QosLevel `json:"qos"`
+	Payload []byte          `json:"payload"`
+	// ContentType - MIME type of the payload, sent to MQTT 5 Clients as Content Type
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type Store interface {
+	// Get - returns nil if there is no session for the Client
+	Get(ctx context.Context, clientID string) (*Session, error)
+	// Save - stores the session and schedules its and its queue removal after ttl, 0 keeps them until deleted
+	Save(ctx context.Context, session *Session, ttl time.Duration) error
+	Delete(ctx context.Context, clientID, device string) error
+
+	// Enqueue - appends messages to the session queue, returns the number of oldest messages dropped to fit the queue limit
+	Enqueue(ctx context.Context, clientID string, msgs ...Message) (int64, error)
+	// Requeue - prepends messages to the session queue, e.g. unacknowledged messages on disconnect.
+	// Requeued messages are never dropped to fit the queue limit, the oldest ones queued after them are dropped instead
+	Requeue(ctx context.Context, clientID string, msgs ...Message) (int64, error)
+	// Drain - returns all queued messages and empties the queue
+	Drain(ctx context.Context, clientID string) ([]Message, error)
+
+	// ByDevice - returns Client IDs of all sessions ever stored for the device, some may be expired already
+	ByDevice(ctx context.Context, device string) ([]string, error)
+
+	// Lease - takes the ClientID for owner for ttl, returns false if another owner holds it
+	Lease(ctx context.Context, clientID, owner string, ttl time.Duration) (bool, error)
+	// TakeLease - takes the ClientID for owner for ttl, even if another owner holds it
+	TakeLease(ctx context.Context, clientID, owner string, ttl time.Duration) error
+	// Renew - extends the lease owner holds by lease and expiration of the session and its queue by ttl, if ttl isn't 0.
+	// Returns false if the owner doesn't hold the lease anymore
+	Renew(ctx context.Context, clientID, owner string, lease, ttl time.Duration) (bool, error)
+	// Release - ends the lease, if owner still holds it
+	Release(ctx context.Context, clientID, owner string) error
+	// Online - returns true if the ClientID is leased, i.e. a bridge is serving its connection
+	Online(ctx context.Context, clientID string) (bool, error)
+}
+
+type store struct {
+	rdb redis.Cmdable
+	max int64
+}
+
+// NewStore - max is maximum number of queued messages per session, 0 means unlimited
+func NewStore(rdb redis.Cmdable, max int64) Store {
+	return &store{rdb: rdb, max: max}
+}
+
+func sessionKey(clientID string) string {
+	return fmt.Sprintf("mqtt:sessions:%s", clientID)
+}
+
+func queueKey(clientID string) string {
+	return fmt.Sprintf("mqtt:sessions:%s:queue", clientID)
+}
+
+// pinnedKey - number of requeued messages at the head of the queue, which must not be dropped to fit the queue limit
+func pinnedKey(clientID string) string {
+	return fmt.Sprintf("mqtt:sessions:%s:queue:pinned", clientID)
+}
+
+func deviceKey(device string) string {
+	return fmt.Sprintf("mqtt:sessions:device:%s", device)
+}
+
+func (s *store) Get(ctx context.Context, clientID string) (*Session, error) {
+	data, err := s.rdb.Get(ctx, sessionKey(clientID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{}
+	if err = json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	if session.Subscriptions == nil {
+		session.Subscriptions = make(map[string]packet.QosLevel)
+	}
+	return session, nil
+}
+
+func (s *store) Save(ctx context.Context, session *Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	if err = s.rdb.Set(ctx, sessionKey(session.ClientID), data, ttl).Err(); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		err = s.expireQueue(ctx, session.ClientID, ttl)
+	} else {
+		err = s.persistQueue(ctx, session.ClientID)
+	}
+	if err != nil {
+		return err
+	}
+	return s.rdb.SAdd(ctx, deviceKey(session.Device), session.ClientID).Err()
+}
+
+func (s *store) expireQueue(ctx context.Context, clientID string, ttl time.Duration) error {
+	if err := s.rdb.Expire(ctx, queueKey(clientID), ttl).Err(); err != nil {
+		return err
+	}
+	return s.rdb.Expire(ctx, pinnedKey(clientID), ttl).Err()
+}
+
+func (s *store) persistQueue(ctx context.Context, clientID string) error {
+	if err := s.rdb.Persist(ctx, queueKey(clientID)).Err(); err != nil {
+		return err
+	}
+	return s.rdb.Persist(ctx, pinnedKey(clientID)).Err()
+}
+
+func (s *store) Delete(ctx context.Context, clientID, device string) error {
+	if err := s.rdb.Del(ctx, sessionKey(clientID), queueKey(clientID), pinnedKey(clientID)).Err(); err != nil {
+		return err
+	}
+	return s.rdb.SRem(ctx, deviceKey(device), clientID).Err()
+}
+
+// pushScript - pushes messages to the queue, which inherits expiration of the session, otherwise it would outlive it.
+// Requeued (pinned) messages are prepended and counted, so trimming the queue to the limit drops the oldest messages
+// queued after them instead. Returns the number of dropped messages
+var pushScript = redis.NewScript(`
+local max = tonumber(ARGV[1])
+local n = #ARGV - 2
+if ARGV[2] == '1' then
+	for i = #ARGV, 3, -1 do
+		redis.call('LPUSH', KEYS[1], ARGV[i])
+	end
+	redis.call('INCRBY', KEYS[3], n)
+else
+	for i = 3, #ARGV do
+		redis.call('RPUSH', KEYS[1], ARGV[i])
+	end
+end
+
+local ttl = redis.call('PTTL', KEYS[2])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	redis.call('PEXPIRE', KEYS[3], ttl)
+end
+
+local length = redis.call('LLEN', KEYS[1])
+if max <= 0 or length <= max then
+	return 0
+end
+local pinned = tonumber(redis.call('GET', KEYS[3]) or '0')
+local excess = math.min(length - max, length - pinned)
+if excess <= 0 then
+	return 0
+end
+if pinned == 0 then
+	redis.call('LTRIM', KEYS[1], excess, -1)
+	return excess
+end
+local head = redis.call('LRANGE', KEYS[1], 0, pinned - 1)
+redis.call('LTRIM', KEYS[1], pinned + excess, -1)
+for i = #head, 1, -1 do
+	redis.call('LPUSH', KEYS[1], head[i])
+end
+return excess
+`)
+
+func (s *store) Enqueue(ctx context.Context, clientID string, msgs ...Message) (int64, error) {
+	return s.push(ctx, clientID, false, msgs)
+}
+
+func (s *store) Requeue(ctx context.Context, clientID string, msgs ...Message) (int64, error) {
+	return s.push(ctx, clientID, true, msgs)
+}
+
+func (s *store) push(ctx context.Context, clientID string, pin bool, msgs []Message) (int64, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	args := make([]interface{}, 2, len(msgs)+2)
+	args[0] = s.max
+	args[1] = 0
+	if pin {
+		args[1] = 1
+	}
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, data)
+	}
+
+	keys := []string{queueKey(clientID), sessionKey(clientID), pinnedKey(clientID)}
+	return pushScript.Run(ctx, s.rdb, keys, args...).Int64()
+}
+
+// drainScript - returns and deletes the queue at once, so messages queued meanwhile aren't lost
+var drainScript = redis.NewScript(`
+local values = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1], KEYS[2])
+return values
+`)
+
+func (s *store) Drain(ctx context.Context, clientID string) ([]Message, error) {
+	keys := []string{queueKey(clientID), pinnedKey(clientID)}
+	values, err := drainScript.Run(ctx, s.rdb, keys).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	msgs := make([]Message, 0, len(values))
+	for _, value := range values {
+		var msg Message
+		if err := json.Unmarshal([]byte(value), &msg); err != nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (s *store) ByDevice(ctx context.Context, device string) ([]string, error) {
+	return s.rdb.SMembers(ctx, deviceKey(device)).Result()
+}
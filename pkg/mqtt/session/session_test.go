@@ -0,0 +1,156 @@
+package session_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/session"
+	"github.com/slntopp/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type sessionFixture struct {
+	store session.Store
+
+	mocks struct {
+		rdb *redis_mocks.MockCmdable
+	}
+}
+
+func newSessionFixture(t *testing.T, max int64) (f *sessionFixture) {
+	f = &sessionFixture{}
+	f.mocks.rdb = redis_mocks.NewMockCmdable(t)
+	f.store = session.NewStore(f.mocks.rdb, max)
+	return f
+}
+
+func marshal(t *testing.T, v any) []byte {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestGet_NotFound(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	res := redis.NewStringCmd(context.Background())
+	res.SetErr(redis.Nil)
+	f.mocks.rdb.EXPECT().Get(context.Background(), "mqtt:sessions:client").Return(res)
+
+	s, err := f.store.Get(context.Background(), "client")
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+}
+
+func TestGet_FailsOn_Get(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	res := redis.NewStringCmd(context.Background())
+	res.SetErr(assert.AnError)
+	f.mocks.rdb.EXPECT().Get(context.Background(), "mqtt:sessions:client").Return(res)
+
+	_, err := f.store.Get(context.Background(), "client")
+	assert.Equal(t, assert.AnError, err)
+}
+
+func TestGet_Success(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	expected := &session.Session{
+		ClientID:      "client",
+		Device:        "device",
+		Subscriptions: map[string]packet.QosLevel{"devices/device/state": packet.QoSLevelAtLeastOnce},
+	}
+
+	res := redis.NewStringCmd(context.Background())
+	res.SetVal(string(marshal(t, expected)))
+	f.mocks.rdb.EXPECT().Get(context.Background(), "mqtt:sessions:client").Return(res)
+
+	s, err := f.store.Get(context.Background(), "client")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, s)
+}
+
+var queueKeys = []string{"mqtt:sessions:client:queue", "mqtt:sessions:client", "mqtt:sessions:client:queue:pinned"}
+
+func TestEnqueue_TrimsQueue(t *testing.T) {
+	f := newSessionFixture(t, 2)
+	msg := session.Message{Topic: "t", QoS: packet.QoSLevelAtLeastOnce, Payload: []byte("{}")}
+
+	// Pushing, inheriting the session expiry and trimming happen in a single script
+	f.mocks.rdb.EXPECT().EvalSha(context.Background(), mock.Anything, queueKeys, int64(2), 0, marshal(t, msg)).
+		Return(redis.NewCmdResult(int64(1), nil))
+
+	dropped, err := f.store.Enqueue(context.Background(), "client", msg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), dropped)
+}
+
+func TestRequeue_PinsMessages(t *testing.T) {
+	f := newSessionFixture(t, 2)
+	first := session.Message{Topic: "t", QoS: packet.QoSLevelAtLeastOnce, Payload: []byte("1")}
+	second := session.Message{Topic: "t", QoS: packet.QoSLevelAtLeastOnce, Payload: []byte("2")}
+
+	// Messages are passed in order, the script prepends them in reverse and pins them
+	f.mocks.rdb.EXPECT().EvalSha(context.Background(), mock.Anything, queueKeys, int64(2), 1, marshal(t, first), marshal(t, second)).
+		Return(redis.NewCmdResult(int64(0), nil))
+
+	_, err := f.store.Requeue(context.Background(), "client", first, second)
+	assert.NoError(t, err)
+}
+
+func TestRequeue_FailsOn_Script(t *testing.T) {
+	f := newSessionFixture(t, 0)
+	msg := session.Message{Topic: "t", QoS: packet.QoSLevelAtLeastOnce, Payload: []byte("1")}
+
+	f.mocks.rdb.EXPECT().EvalSha(context.Background(), mock.Anything, queueKeys, int64(0), 1, marshal(t, msg)).
+		Return(redis.NewCmdResult(nil, assert.AnError))
+
+	_, err := f.store.Requeue(context.Background(), "client", msg)
+	assert.Equal(t, assert.AnError, err)
+}
+
+func TestSave_ExpiresQueue(t *testing.T) {
+	f := newSessionFixture(t, 0)
+	s := &session.Session{ClientID: "client", Device: "device"}
+
+	f.mocks.rdb.EXPECT().Set(context.Background(), "mqtt:sessions:client", marshal(t, s), time.Hour).
+		Return(redis.NewStatusCmd(context.Background()))
+	f.mocks.rdb.EXPECT().Expire(context.Background(), "mqtt:sessions:client:queue", time.Hour).
+		Return(redis.NewBoolCmd(context.Background()))
+	f.mocks.rdb.EXPECT().Expire(context.Background(), "mqtt:sessions:client:queue:pinned", time.Hour).
+		Return(redis.NewBoolCmd(context.Background()))
+	f.mocks.rdb.EXPECT().SAdd(context.Background(), "mqtt:sessions:device:device", "client").
+		Return(redis.NewIntCmd(context.Background()))
+
+	assert.NoError(t, f.store.Save(context.Background(), s, time.Hour))
+}
+
+func TestDrain_Success(t *testing.T) {
+	f := newSessionFixture(t, 0)
+	msg := session.Message{Topic: "t", QoS: packet.QoSLevelExactlyOnce, Payload: []byte("{}")}
+
+	// Queue is read and deleted by a single script, nothing else touches it
+	f.mocks.rdb.EXPECT().EvalSha(context.Background(), mock.Anything, []string{"mqtt:sessions:client:queue", "mqtt:sessions:client:queue:pinned"}).
+		Return(redis.NewCmdResult([]interface{}{string(marshal(t, msg))}, nil))
+
+	msgs, err := f.store.Drain(context.Background(), "client")
+	assert.NoError(t, err)
+	assert.Equal(t, []session.Message{msg}, msgs)
+}
+
+func TestDrain_Empty(t *testing.T) {
+	f := newSessionFixture(t, 0)
+
+	f.mocks.rdb.EXPECT().EvalSha(context.Background(), mock.Anything, []string{"mqtt:sessions:client:queue", "mqtt:sessions:client:queue:pinned"}).
+		Return(redis.NewCmdResult([]interface{}{}, nil))
+
+	msgs, err := f.store.Drain(context.Background(), "client")
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+}
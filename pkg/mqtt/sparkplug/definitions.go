@@ -0,0 +1,71 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparkplug
+
+// Definition - metric as declared in BIRTH message
+type Definition struct {
+	Name     string
+	Alias    uint64
+	HasAlias bool
+	DataType DataType
+}
+
+// Definitions - metrics of the Edge Node or device, valid until the next BIRTH
+type Definitions struct {
+	byName  map[string]Definition
+	byAlias map[uint64]Definition
+}
+
+// NewDefinitions - takes metrics of BIRTH message
+func NewDefinitions(metrics []*Metric) *Definitions {
+	d := &Definitions{
+		byName:  make(map[string]Definition, len(metrics)),
+		byAlias: make(map[uint64]Definition),
+	}
+	for _, m := range metrics {
+		def := Definition{Name: m.Name, Alias: m.Alias, HasAlias: m.HasAlias, DataType: m.DataType}
+		d.byName[m.Name] = def
+		if m.HasAlias {
+			d.byAlias[m.Alias] = def
+		}
+	}
+	return d
+}
+
+// Resolve - fills name of the aliased metric and data type if DATA message omits it, false if the metric wasn't declared
+func (d *Definitions) Resolve(m *Metric) bool {
+	var def Definition
+	var ok bool
+	if m.Name == "" && m.HasAlias {
+		def, ok = d.byAlias[m.Alias]
+	} else {
+		def, ok = d.byName[m.Name]
+	}
+	if !ok {
+		return false
+	}
+	m.Name = def.Name
+	if m.DataType == Unknown {
+		m.DataType = def.DataType
+	}
+	return true
+}
+
+// Lookup - declared metric by name
+func (d *Definitions) Lookup(name string) (Definition, bool) {
+	def, ok := d.byName[name]
+	return def, ok
+}
@@ -0,0 +1,558 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparkplug
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	ErrMalformed       = errors.New("malformed Sparkplug payload")
+	ErrUnsupportedType = errors.New("unsupported metric data type")
+	ErrValueType       = errors.New("value doesn't match metric data type")
+
+	// errSkip - returned by consumeFields callbacks for fields they don't handle
+	errSkip = errors.New("skip field")
+)
+
+// DataType - metric data type as defined by Sparkplug B
+type DataType uint32
+
+const (
+	Unknown DataType = iota
+	Int8
+	Int16
+	Int32
+	Int64
+	UInt8
+	UInt16
+	UInt32
+	UInt64
+	Float
+	Double
+	Boolean
+	String
+	DateTime
+	Text
+	UUID
+	DataSet
+	Bytes
+	File
+	Template
+)
+
+// Payload field numbers
+const (
+	payloadTimestamp protowire.Number = 1
+	payloadMetrics   protowire.Number = 2
+	payloadSeq       protowire.Number = 3
+	payloadUUID      protowire.Number = 4
+	payloadBody      protowire.Number = 5
+)
+
+// Metric field numbers, values are a oneof of fields from metricInt to metricTemplate
+const (
+	metricName      protowire.Number = 1
+	metricAlias     protowire.Number = 2
+	metricTimestamp protowire.Number = 3
+	metricDataType  protowire.Number = 4
+	metricIsNull    protowire.Number = 7
+	metricInt       protowire.Number = 10
+	metricLong      protowire.Number = 11
+	metricFloat     protowire.Number = 12
+	metricDouble    protowire.Number = 13
+	metricBoolean   protowire.Number = 14
+	metricString    protowire.Number = 15
+	metricBytes     protowire.Number = 16
+	metricDataSet   protowire.Number = 17
+	metricTemplate  protowire.Number = 18
+)
+
+type Payload struct {
+	Timestamp uint64 // milliseconds since epoch
+	Metrics   []*Metric
+	Seq       uint64
+	HasSeq    bool
+	UUID      string
+	Body      []byte
+}
+
+// Metric - value is kept as it's encoded, since DATA messages may omit data type needed to interpret it until alias is resolved
+type Metric struct {
+	Name      string
+	Alias     uint64
+	HasAlias  bool
+	Timestamp uint64
+	DataType  DataType
+	IsNull    bool
+
+	field protowire.Number // value field, zero if there is no value
+	num   uint64           // varint and fixed values
+	raw   []byte           // string, bytes and nested messages
+}
+
+// NewMetric - metric with the value converted to the data type, e.g. to send commands
+func NewMetric(name string, dt DataType, v *structpb.Value) (*Metric, error) {
+	m := &Metric{Name: name, DataType: dt}
+	if _, ok := v.GetKind().(*structpb.Value_NullValue); v == nil || ok {
+		m.IsNull = true
+		return m, nil
+	}
+
+	number := func() (float64, error) {
+		n, ok := v.GetKind().(*structpb.Value_NumberValue)
+		if !ok {
+			return 0, ErrValueType
+		}
+		return n.NumberValue, nil
+	}
+
+	switch dt {
+	case Int8, Int16, Int32, UInt8, UInt16, UInt32:
+		n, err := number()
+		if err != nil {
+			return nil, err
+		}
+		m.field = metricInt
+		if dt <= Int32 {
+			m.num = uint64(uint32(int32(n)))
+		} else {
+			m.num = uint64(uint32(n))
+		}
+	case Int64, UInt64, DateTime:
+		n, err := number()
+		if err != nil {
+			return nil, err
+		}
+		m.field = metricLong
+		if dt == Int64 {
+			m.num = uint64(int64(n))
+		} else {
+			m.num = uint64(n)
+		}
+	case Float:
+		n, err := number()
+		if err != nil {
+			return nil, err
+		}
+		m.field, m.num = metricFloat, uint64(math.Float32bits(float32(n)))
+	case Double:
+		n, err := number()
+		if err != nil {
+			return nil, err
+		}
+		m.field, m.num = metricDouble, math.Float64bits(n)
+	case Boolean:
+		b, ok := v.GetKind().(*structpb.Value_BoolValue)
+		if !ok {
+			return nil, ErrValueType
+		}
+		m.field = metricBoolean
+		if b.BoolValue {
+			m.num = 1
+		}
+	case String, Text, UUID:
+		s, ok := v.GetKind().(*structpb.Value_StringValue)
+		if !ok {
+			return nil, ErrValueType
+		}
+		m.field, m.raw = metricString, []byte(s.StringValue)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedType, dt)
+	}
+	return m, nil
+}
+
+// InferDataType - data type for the value of metric not declared by the Edge Node, Unknown if it can't be sent as a metric
+func InferDataType(v *structpb.Value) DataType {
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return Boolean
+	case *structpb.Value_StringValue:
+		return String
+	case *structpb.Value_NumberValue:
+		n := k.NumberValue
+		if n == math.Trunc(n) && math.Abs(n) < 1<<63 {
+			return Int64
+		}
+		return Double
+	}
+	return Unknown
+}
+
+// Value - metric value as JSON compatible value: numbers for numeric types and DateTime (milliseconds since epoch),
+// base64 strings for Bytes and File, objects of metric values for Template instances and lists of row objects for DataSet
+func (m *Metric) Value() (*structpb.Value, error) {
+	if m.IsNull || m.field == 0 {
+		return structpb.NewNullValue(), nil
+	}
+
+	switch m.field {
+	case metricInt:
+		u := uint32(m.num)
+		switch m.DataType {
+		case Int8:
+			return structpb.NewNumberValue(float64(int8(u))), nil
+		case Int16:
+			return structpb.NewNumberValue(float64(int16(u))), nil
+		case Int32:
+			return structpb.NewNumberValue(float64(int32(u))), nil
+		}
+		return structpb.NewNumberValue(float64(u)), nil
+	case metricLong:
+		if m.DataType == Int64 {
+			return structpb.NewNumberValue(float64(int64(m.num))), nil
+		}
+		return structpb.NewNumberValue(float64(m.num)), nil
+	case metricFloat:
+		return structpb.NewNumberValue(float64(math.Float32frombits(uint32(m.num)))), nil
+	case metricDouble:
+		return structpb.NewNumberValue(math.Float64frombits(m.num)), nil
+	case metricBoolean:
+		return structpb.NewBoolValue(m.num != 0), nil
+	case metricString:
+		return structpb.NewStringValue(string(m.raw)), nil
+	case metricBytes:
+		return structpb.NewStringValue(base64.StdEncoding.EncodeToString(m.raw)), nil
+	case metricDataSet:
+		return dataSetValue(m.raw)
+	case metricTemplate:
+		return templateValue(m.raw)
+	}
+	return nil, fmt.Errorf("%w: field %d", ErrUnsupportedType, m.field)
+}
+
+// Unmarshal - decodes the payload, unknown fields, metadata and properties are skipped
+func Unmarshal(data []byte) (*Payload, error) {
+	p := &Payload{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == payloadTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.Timestamp = v
+			return n, nil
+		case num == payloadMetrics && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := unmarshalMetric(v)
+			if err != nil {
+				return 0, err
+			}
+			p.Metrics = append(p.Metrics, m)
+			return n, nil
+		case num == payloadSeq && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.Seq, p.HasSeq = v, true
+			return n, nil
+		case num == payloadUUID && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			p.UUID = string(v)
+			return n, nil
+		case num == payloadBody && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			p.Body = append([]byte(nil), v...)
+			return n, nil
+		}
+		return 0, errSkip
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func unmarshalMetric(data []byte) (*Metric, error) {
+	m := &Metric{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case metricAlias:
+				m.Alias, m.HasAlias = v, true
+			case metricTimestamp:
+				m.Timestamp = v
+			case metricDataType:
+				m.DataType = DataType(v)
+			case metricIsNull:
+				m.IsNull = v != 0
+			case metricInt, metricLong, metricBoolean:
+				m.field, m.num = num, v
+			}
+			return n, nil
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if num == metricFloat {
+				m.field, m.num = num, uint64(v)
+			}
+			return n, nil
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if num == metricDouble {
+				m.field, m.num = num, v
+			}
+			return n, nil
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case metricName:
+				m.Name = string(v)
+			case metricString, metricBytes, metricDataSet, metricTemplate:
+				m.field, m.raw = num, append([]byte(nil), v...)
+			}
+			return n, nil
+		}
+		return 0, errSkip
+	})
+	return m, err
+}
+
+// Marshal - encodes the payload, metrics must have been created with NewMetric or decoded
+func (p *Payload) Marshal() []byte {
+	var b []byte
+	if p.Timestamp != 0 {
+		b = protowire.AppendTag(b, payloadTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.Timestamp)
+	}
+	for _, m := range p.Metrics {
+		b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.marshal())
+	}
+	if p.HasSeq {
+		b = protowire.AppendTag(b, payloadSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.Seq)
+	}
+	if p.UUID != "" {
+		b = protowire.AppendTag(b, payloadUUID, protowire.BytesType)
+		b = protowire.AppendString(b, p.UUID)
+	}
+	if len(p.Body) > 0 {
+		b = protowire.AppendTag(b, payloadBody, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Body)
+	}
+	return b
+}
+
+func (m *Metric) marshal() []byte {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, metricName, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.HasAlias {
+		b = protowire.AppendTag(b, metricAlias, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Alias)
+	}
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, metricTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Timestamp)
+	}
+	if m.DataType != Unknown {
+		b = protowire.AppendTag(b, metricDataType, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.DataType))
+	}
+	if m.IsNull {
+		b = protowire.AppendTag(b, metricIsNull, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+		return b
+	}
+
+	switch m.field {
+	case metricInt, metricLong, metricBoolean:
+		b = protowire.AppendTag(b, m.field, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.num)
+	case metricFloat:
+		b = protowire.AppendTag(b, m.field, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, uint32(m.num))
+	case metricDouble:
+		b = protowire.AppendTag(b, m.field, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, m.num)
+	case metricString, metricBytes, metricDataSet, metricTemplate:
+		b = protowire.AppendTag(b, m.field, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.raw)
+	}
+	return b
+}
+
+// consumeFields - calls consume for every field, which returns number of bytes consumed or errSkip to skip the field
+func consumeFields(data []byte, consume func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ErrMalformed
+		}
+		data = data[n:]
+
+		n, err := consume(num, typ, data)
+		if err == errSkip {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		} else if err != nil {
+			return err
+		}
+		if n < 0 {
+			return ErrMalformed
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// templateValue - object of metric values of the Template instance, definitions have no values
+func templateValue(data []byte) (*structpb.Value, error) {
+	fields := make(map[string]*structpb.Value)
+	definition := false
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 2 && typ == protowire.BytesType: // metrics
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := unmarshalMetric(v)
+			if err != nil {
+				return 0, err
+			}
+			value, err := m.Value()
+			if err != nil {
+				return 0, err
+			}
+			fields[m.Name] = value
+			return n, nil
+		case num == 5 && typ == protowire.VarintType: // is_definition
+			v, n := protowire.ConsumeVarint(b)
+			definition = v != 0
+			return n, nil
+		}
+		return 0, errSkip
+	})
+	if err != nil {
+		return nil, err
+	}
+	if definition {
+		return structpb.NewNullValue(), nil
+	}
+	return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+}
+
+// dataSetValue - list of row objects by column name
+func dataSetValue(data []byte) (*structpb.Value, error) {
+	var columns []string
+	var types []DataType
+	var rows [][]byte
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 2 && typ == protowire.BytesType: // columns
+			v, n := protowire.ConsumeBytes(b)
+			columns = append(columns, string(v))
+			return n, nil
+		case num == 3 && typ == protowire.VarintType: // types
+			v, n := protowire.ConsumeVarint(b)
+			types = append(types, DataType(v))
+			return n, nil
+		case num == 3 && typ == protowire.BytesType: // packed types
+			v, n := protowire.ConsumeBytes(b)
+			for len(v) > 0 {
+				t, m := protowire.ConsumeVarint(v)
+				if m < 0 {
+					return m, nil
+				}
+				types = append(types, DataType(t))
+				v = v[m:]
+			}
+			return n, nil
+		case num == 4 && typ == protowire.BytesType: // rows
+			v, n := protowire.ConsumeBytes(b)
+			rows = append(rows, v)
+			return n, nil
+		}
+		return 0, errSkip
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*structpb.Value, 0, len(rows))
+	for _, row := range rows {
+		fields := make(map[string]*structpb.Value, len(columns))
+		i := 0
+		err := consumeFields(row, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if num != 1 || typ != protowire.BytesType { // elements
+				return 0, errSkip
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			if i < len(columns) {
+				var dt DataType
+				if i < len(types) {
+					dt = types[i]
+				}
+				value, err := dataSetElement(dt, v)
+				if err != nil {
+					return 0, err
+				}
+				fields[columns[i]] = value
+			}
+			i++
+			return n, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, structpb.NewStructValue(&structpb.Struct{Fields: fields}))
+	}
+	return structpb.NewListValue(&structpb.ListValue{Values: list}), nil
+}
+
+// dataSetElement - DataSet values share the encoding of metric values with field numbers shifted by 9
+func dataSetElement(dt DataType, data []byte) (*structpb.Value, error) {
+	m := &Metric{DataType: dt}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		field := num + 9
+		switch {
+		case typ == protowire.VarintType && (field == metricInt || field == metricLong || field == metricBoolean):
+			v, n := protowire.ConsumeVarint(b)
+			m.field, m.num = field, v
+			return n, nil
+		case typ == protowire.Fixed32Type && field == metricFloat:
+			v, n := protowire.ConsumeFixed32(b)
+			m.field, m.num = field, uint64(v)
+			return n, nil
+		case typ == protowire.Fixed64Type && field == metricDouble:
+			v, n := protowire.ConsumeFixed64(b)
+			m.field, m.num = field, v
+			return n, nil
+		case typ == protowire.BytesType && field == metricString:
+			v, n := protowire.ConsumeBytes(b)
+			m.field, m.raw = field, append([]byte(nil), v...)
+			return n, nil
+		}
+		return 0, errSkip
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.Value()
+}
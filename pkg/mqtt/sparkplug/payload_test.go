@@ -0,0 +1,171 @@
+package sparkplug_test
+
+import (
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/sparkplug"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestPayload_RoundTrip(t *testing.T) {
+	values := []struct {
+		dt    sparkplug.DataType
+		value *structpb.Value
+	}{
+		{sparkplug.Int8, structpb.NewNumberValue(-8)},
+		{sparkplug.Int16, structpb.NewNumberValue(-1600)},
+		{sparkplug.Int32, structpb.NewNumberValue(-32)},
+		{sparkplug.Int64, structpb.NewNumberValue(-64)},
+		{sparkplug.UInt32, structpb.NewNumberValue(4000000000)},
+		{sparkplug.UInt64, structpb.NewNumberValue(1 << 40)},
+		{sparkplug.Float, structpb.NewNumberValue(1.5)},
+		{sparkplug.Double, structpb.NewNumberValue(2.25)},
+		{sparkplug.Boolean, structpb.NewBoolValue(true)},
+		{sparkplug.String, structpb.NewStringValue("on")},
+		{sparkplug.DateTime, structpb.NewNumberValue(1700000000000)},
+		{sparkplug.Double, structpb.NewNullValue()},
+	}
+
+	p := &sparkplug.Payload{Timestamp: 1700000000000, Seq: 3, HasSeq: true}
+	for i, v := range values {
+		m, err := sparkplug.NewMetric("m", v.dt, v.value)
+		require.NoError(t, err)
+		m.Alias, m.HasAlias = uint64(i), true
+		p.Metrics = append(p.Metrics, m)
+	}
+
+	res, err := sparkplug.Unmarshal(p.Marshal())
+	require.NoError(t, err)
+	assert.Equal(t, p.Timestamp, res.Timestamp)
+	assert.Equal(t, uint64(3), res.Seq)
+	assert.True(t, res.HasSeq)
+	require.Len(t, res.Metrics, len(values))
+	for i, m := range res.Metrics {
+		assert.Equal(t, uint64(i), m.Alias)
+		assert.Equal(t, values[i].dt, m.DataType)
+		v, err := m.Value()
+		require.NoError(t, err)
+		assert.True(t, proto.Equal(values[i].value, v), "%v: %v != %v", values[i].dt, values[i].value, v)
+	}
+}
+
+func TestNewMetric_ValueType(t *testing.T) {
+	_, err := sparkplug.NewMetric("m", sparkplug.Boolean, structpb.NewNumberValue(1))
+	assert.ErrorIs(t, err, sparkplug.ErrValueType)
+
+	_, err = sparkplug.NewMetric("m", sparkplug.Template, structpb.NewNumberValue(1))
+	assert.ErrorIs(t, err, sparkplug.ErrUnsupportedType)
+}
+
+func TestInferDataType(t *testing.T) {
+	assert.Equal(t, sparkplug.Boolean, sparkplug.InferDataType(structpb.NewBoolValue(false)))
+	assert.Equal(t, sparkplug.String, sparkplug.InferDataType(structpb.NewStringValue("")))
+	assert.Equal(t, sparkplug.Int64, sparkplug.InferDataType(structpb.NewNumberValue(-3)))
+	assert.Equal(t, sparkplug.Double, sparkplug.InferDataType(structpb.NewNumberValue(0.5)))
+	assert.Equal(t, sparkplug.Unknown, sparkplug.InferDataType(structpb.NewNullValue()))
+}
+
+func TestDefinitions_Resolve(t *testing.T) {
+	birth, err := sparkplug.NewMetric("Temperature", sparkplug.Float, structpb.NewNumberValue(20))
+	require.NoError(t, err)
+	birth.Alias, birth.HasAlias = 7, true
+	defs := sparkplug.NewDefinitions([]*sparkplug.Metric{birth})
+
+	// DATA messages refer to metrics by alias and may omit data type
+	data := protowire.AppendTag(nil, 2, protowire.VarintType)
+	data = protowire.AppendVarint(data, 7)
+	data = protowire.AppendTag(data, 12, protowire.Fixed32Type)
+	data = protowire.AppendFixed32(data, 0x41b40000) // 22.5
+	payload := protowire.AppendTag(nil, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, data)
+
+	p, err := sparkplug.Unmarshal(payload)
+	require.NoError(t, err)
+	require.Len(t, p.Metrics, 1)
+	m := p.Metrics[0]
+	assert.True(t, defs.Resolve(m))
+	assert.Equal(t, "Temperature", m.Name)
+	assert.Equal(t, sparkplug.Float, m.DataType)
+	v, err := m.Value()
+	require.NoError(t, err)
+	assert.Equal(t, 22.5, v.GetNumberValue())
+
+	unknown := &sparkplug.Metric{Alias: 8, HasAlias: true}
+	assert.False(t, defs.Resolve(unknown))
+
+	def, ok := defs.Lookup("Temperature")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), def.Alias)
+}
+
+func TestMetric_Template(t *testing.T) {
+	member, err := sparkplug.NewMetric("speed", sparkplug.Int32, structpb.NewNumberValue(-5))
+	require.NoError(t, err)
+	inner := (&sparkplug.Payload{Metrics: []*sparkplug.Metric{member}}).Marshal() // Template metrics share Payload field number
+
+	metric := protowire.AppendTag(nil, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, "motor")
+	metric = protowire.AppendTag(metric, 4, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, uint64(sparkplug.Template))
+	metric = protowire.AppendTag(metric, 18, protowire.BytesType)
+	metric = protowire.AppendBytes(metric, inner)
+	payload := protowire.AppendTag(nil, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, metric)
+
+	p, err := sparkplug.Unmarshal(payload)
+	require.NoError(t, err)
+	v, err := p.Metrics[0].Value()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"speed": float64(-5)}, v.AsInterface())
+}
+
+func TestMetric_DataSet(t *testing.T) {
+	element := func(field protowire.Number, v uint64) []byte {
+		b := protowire.AppendTag(nil, field, protowire.VarintType)
+		return protowire.AppendVarint(b, v)
+	}
+	var row []byte
+	for _, e := range [][]byte{element(1, 42), element(5, 1)} { // int_value, boolean_value
+		row = protowire.AppendTag(row, 1, protowire.BytesType)
+		row = protowire.AppendBytes(row, e)
+	}
+
+	var ds []byte
+	ds = protowire.AppendTag(ds, 1, protowire.VarintType)
+	ds = protowire.AppendVarint(ds, 2)
+	for _, c := range []string{"count", "ok"} {
+		ds = protowire.AppendTag(ds, 2, protowire.BytesType)
+		ds = protowire.AppendString(ds, c)
+	}
+	types := protowire.AppendVarint(nil, uint64(sparkplug.Int32))
+	types = protowire.AppendVarint(types, uint64(sparkplug.Boolean))
+	ds = protowire.AppendTag(ds, 3, protowire.BytesType)
+	ds = protowire.AppendBytes(ds, types)
+	ds = protowire.AppendTag(ds, 4, protowire.BytesType)
+	ds = protowire.AppendBytes(ds, row)
+
+	metric := protowire.AppendTag(nil, 4, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, uint64(sparkplug.DataSet))
+	metric = protowire.AppendTag(metric, 17, protowire.BytesType)
+	metric = protowire.AppendBytes(metric, ds)
+	payload := protowire.AppendTag(nil, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, metric)
+
+	p, err := sparkplug.Unmarshal(payload)
+	require.NoError(t, err)
+	v, err := p.Metrics[0].Value()
+	require.NoError(t, err)
+	assert.Equal(t, []any{map[string]any{"count": float64(42), "ok": true}}, v.AsInterface())
+}
+
+func TestUnmarshal_Malformed(t *testing.T) {
+	_, err := sparkplug.Unmarshal([]byte{0x12, 0x05, 0x0a})
+	assert.ErrorIs(t, err, sparkplug.ErrMalformed)
+
+	_, err = sparkplug.Unmarshal([]byte{0xff})
+	assert.ErrorIs(t, err, sparkplug.ErrMalformed)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sparkplug implements topics and payloads of Sparkplug B, the MQTT specification for industrial Edge Nodes:
+//
+//	spBv1.0/{group}/NBIRTH/{edge_node}           - Edge Node comes online, declares its metrics
+//	spBv1.0/{group}/NDATA/{edge_node}            - Edge Node metrics change
+//	spBv1.0/{group}/NDEATH/{edge_node}           - Edge Node goes offline, usually published as Will Message
+//	spBv1.0/{group}/NCMD/{edge_node}             - Host writes Edge Node metrics
+//	spBv1.0/{group}/DBIRTH/{edge_node}/{device}  - same for devices behind the Edge Node
+//	spBv1.0/{group}/DDATA/{edge_node}/{device}
+//	spBv1.0/{group}/DDEATH/{edge_node}/{device}
+//	spBv1.0/{group}/DCMD/{edge_node}/{device}
+//	spBv1.0/STATE/{host_id}                      - Host Application state, Edge Nodes may wait for it to be online
+//
+// Payloads are Protobuf encoded, metrics declared in BIRTH messages may be referred to by alias afterwards
+package sparkplug
+
+import (
+	"strings"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+)
+
+const Namespace = "spBv1.0"
+
+type MessageType string
+
+const (
+	NBIRTH MessageType = "NBIRTH"
+	NDEATH MessageType = "NDEATH"
+	NDATA  MessageType = "NDATA"
+	NCMD   MessageType = "NCMD"
+	DBIRTH MessageType = "DBIRTH"
+	DDEATH MessageType = "DDEATH"
+	DDATA  MessageType = "DDATA"
+	DCMD   MessageType = "DCMD"
+	STATE  MessageType = "STATE"
+)
+
+// IsDevice - whether messages of the type are about a device behind the Edge Node rather than the node itself
+func (t MessageType) IsDevice() bool {
+	return t == DBIRTH || t == DDEATH || t == DDATA || t == DCMD
+}
+
+// Topic - parsed Sparkplug topic, Device is empty for Edge Node messages, HostID is only set for STATE
+type Topic struct {
+	Group    string
+	Type     MessageType
+	EdgeNode string
+	Device   string
+	HostID   string
+}
+
+// IsTopic - whether the topic is in Sparkplug B namespace
+func IsTopic(topic string) bool {
+	return strings.HasPrefix(topic, Namespace+"/")
+}
+
+// ParseTopic - ok is false if topic isn't a valid Sparkplug B topic
+func ParseTopic(topic string) (t Topic, ok bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 || levels[0] != Namespace {
+		return Topic{}, false
+	}
+	if levels[1] == string(STATE) {
+		return Topic{Type: STATE, HostID: levels[2]}, len(levels) == 3 && levels[2] != ""
+	}
+	if len(levels) < 4 {
+		return Topic{}, false
+	}
+
+	t = Topic{Group: levels[1], Type: MessageType(levels[2]), EdgeNode: levels[3]}
+	switch t.Type {
+	case NBIRTH, NDEATH, NDATA, NCMD:
+		ok = len(levels) == 4
+	case DBIRTH, DDEATH, DDATA, DCMD:
+		ok = len(levels) == 5 && levels[4] != ""
+		if ok {
+			t.Device = levels[4]
+		}
+	}
+	if t.Group == "" || t.EdgeNode == "" {
+		ok = false
+	}
+	return t, ok
+}
+
+func (t Topic) String() string {
+	if t.Type == STATE {
+		return StateTopic(t.HostID)
+	}
+	res := Namespace + "/" + t.Group + "/" + string(t.Type) + "/" + t.EdgeNode
+	if t.Device != "" {
+		res += "/" + t.Device
+	}
+	return res
+}
+
+// StateTopic - topic Host Application publishes its state to
+func StateTopic(hostID string) string {
+	return Namespace + "/" + string(STATE) + "/" + hostID
+}
+
+// CanSubscribe - Edge Nodes may subscribe to anything in Sparkplug namespace, they only receive what's sent to them anyway
+func CanSubscribe(filter string) bool {
+	return topics.ValidFilter(filter) && IsTopic(filter)
+}
@@ -0,0 +1,45 @@
+package sparkplug_test
+
+import (
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/sparkplug"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTopic(t *testing.T) {
+	cases := []struct {
+		topic    string
+		expected sparkplug.Topic
+		ok       bool
+	}{
+		{"spBv1.0/plant/NBIRTH/edge", sparkplug.Topic{Group: "plant", Type: sparkplug.NBIRTH, EdgeNode: "edge"}, true},
+		{"spBv1.0/plant/NDATA/edge", sparkplug.Topic{Group: "plant", Type: sparkplug.NDATA, EdgeNode: "edge"}, true},
+		{"spBv1.0/plant/DDATA/edge/pump", sparkplug.Topic{Group: "plant", Type: sparkplug.DDATA, EdgeNode: "edge", Device: "pump"}, true},
+		{"spBv1.0/plant/DCMD/edge/pump", sparkplug.Topic{Group: "plant", Type: sparkplug.DCMD, EdgeNode: "edge", Device: "pump"}, true},
+		{"spBv1.0/STATE/scada", sparkplug.Topic{Type: sparkplug.STATE, HostID: "scada"}, true},
+		{"spBv1.0/plant/NDATA/edge/pump", sparkplug.Topic{}, false},
+		{"spBv1.0/plant/DDATA/edge", sparkplug.Topic{}, false},
+		{"spBv1.0/plant/DDATA/edge/", sparkplug.Topic{}, false},
+		{"spBv1.0/plant/HELLO/edge", sparkplug.Topic{}, false},
+		{"spBv1.0//NDATA/edge", sparkplug.Topic{}, false},
+		{"spBv1.0/STATE/", sparkplug.Topic{}, false},
+		{"spAv1.0/plant/NDATA/edge", sparkplug.Topic{}, false},
+	}
+	for _, c := range cases {
+		res, ok := sparkplug.ParseTopic(c.topic)
+		assert.Equal(t, c.ok, ok, c.topic)
+		if c.ok {
+			assert.Equal(t, c.expected, res, c.topic)
+			assert.Equal(t, c.topic, res.String())
+		}
+	}
+}
+
+func TestCanSubscribe(t *testing.T) {
+	assert.True(t, sparkplug.CanSubscribe("spBv1.0/plant/NCMD/edge"))
+	assert.True(t, sparkplug.CanSubscribe("spBv1.0/plant/DCMD/edge/+"))
+	assert.True(t, sparkplug.CanSubscribe("spBv1.0/STATE/#"))
+	assert.False(t, sparkplug.CanSubscribe("spBv1.0/#/NCMD"))
+	assert.False(t, sparkplug.CanSubscribe("devices/dev/state/desired"))
+}
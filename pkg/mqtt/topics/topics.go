@@ -0,0 +1,208 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package topics defines MQTT topic scheme of the devices and access rules for it.
+//
+// Every device owns the subtree devices/{uuid}, gateways may use subtrees of their child devices as well:
+//
+//	devices/{uuid}/state/reported       - device publishes Reported state
+//	devices/{uuid}/state/desired        - device receives Desired state
+//	devices/{uuid}/state/desired/delta  - device receives difference between Desired and Reported state
+//	devices/{uuid}/events/{name}        - device publishes events
+//	devices/{uuid}/commands/{name}      - device receives commands
+//
+// State and event topics may be suffixed with payload format, e.g. devices/{uuid}/state/reported/cbor,
+// the suffix must be a name of the registered codec. Format suffixed topics are only matched by the
+// exact subscription, so wildcard subscribers don't receive the same message in every format
+package topics
+
+import (
+	"strings"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/slntopp/mqtt-go/packet"
+)
+
+const Root = "devices"
+
+type Kind int
+
+const (
+	Unknown Kind = iota
+	StateReported
+	StateDesired
+	StateDesiredDelta
+	Event
+	Command
+)
+
+// Topic - parsed topic name
+type Topic struct {
+	Device string
+	Kind   Kind
+	Name   string // Event or Command name
+	Format string // Payload codec name, empty if topic isn't format suffixed
+}
+
+func Reported(device string) string {
+	return Root + "/" + device + "/state/reported"
+}
+
+func Desired(device string) string {
+	return Root + "/" + device + "/state/desired"
+}
+
+func DesiredDelta(device string) string {
+	return Root + "/" + device + "/state/desired/delta"
+}
+
+func Events(device, name string) string {
+	return Root + "/" + device + "/events/" + name
+}
+
+func Commands(device, name string) string {
+	return Root + "/" + device + "/commands/" + name
+}
+
+// WithFormat - suffixes State or Event topic with payload format
+func WithFormat(topic, format string) string {
+	return topic + "/" + format
+}
+
+// Parse - parses topic name, Kind is Unknown if topic doesn't belong to the scheme
+func Parse(topic string) Topic {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 || levels[0] != Root || levels[1] == "" {
+		return Topic{}
+	}
+
+	t := Topic{Device: levels[1]}
+	rest := levels[2:]
+	if n := len(rest); n >= 3 && rest[0] != "commands" && codec.ByName(rest[n-1]) != nil {
+		t.Format, rest = rest[n-1], rest[:n-1]
+	}
+	switch {
+	case len(rest) == 2 && rest[0] == "state" && rest[1] == "reported":
+		t.Kind = StateReported
+	case len(rest) == 2 && rest[0] == "state" && rest[1] == "desired":
+		t.Kind = StateDesired
+	case len(rest) == 3 && rest[0] == "state" && rest[1] == "desired" && rest[2] == "delta":
+		t.Kind = StateDesiredDelta
+	case len(rest) >= 2 && rest[0] == "events" && rest[1] != "":
+		t.Kind, t.Name = Event, strings.Join(rest[1:], "/")
+	case len(rest) >= 2 && rest[0] == "commands" && rest[1] != "":
+		t.Kind, t.Name = Command, strings.Join(rest[1:], "/")
+	}
+	if t.Kind == Unknown {
+		t.Format = ""
+	}
+	return t
+}
+
+// ValidFilter - checks if wildcards are used correctly in the Topic Filter
+func ValidFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// Match - checks if Topic Name matches Topic Filter, filter is expected to be valid
+func Match(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// MaxQoS - returns maximum QoS of the subscriptions matching the topic, false if none matches.
+// Format suffixed topics are only matched by the exact subscription
+func MaxQoS(subscriptions map[string]packet.QosLevel, topic string) (qos packet.QosLevel, ok bool) {
+	if Parse(topic).Format != "" {
+		qos, ok = subscriptions[topic]
+		return qos, ok
+	}
+	for filter, q := range subscriptions {
+		if !Match(filter, topic) {
+			continue
+		}
+		if !ok || q > qos {
+			qos = q
+		}
+		ok = true
+	}
+	return qos, ok
+}
+
+// CanPublish - device is only allowed to publish its Reported state and events
+func CanPublish(device, topic string) bool {
+	return CanPublishFor(device, nil, topic)
+}
+
+// CanPublishFor - like CanPublish, gateway may also publish Reported state and events of devices isChild accepts
+func CanPublishFor(device string, isChild func(string) bool, topic string) bool {
+	t := Parse(topic)
+	if t.Device != device && (isChild == nil || t.Device == "" || !isChild(t.Device)) {
+		return false
+	}
+	return t.Kind == StateReported || t.Kind == Event
+}
+
+// CanSubscribe - device is only allowed to subscribe within its own subtree, wildcards can't be used in place of the device UUID
+func CanSubscribe(device, filter string) bool {
+	return CanSubscribeFor(device, nil, filter)
+}
+
+// CanSubscribeFor - like CanSubscribe, gateway may also subscribe within subtrees of devices isChild accepts
+func CanSubscribeFor(device string, isChild func(string) bool, filter string) bool {
+	if !ValidFilter(filter) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	if len(levels) < 3 || levels[0] != Root {
+		return false
+	}
+	return levels[1] == device || (isChild != nil && levels[1] != "+" && levels[1] != "#" && isChild(levels[1]))
+}
+
+// FilterDevice - UUID of the device whose subtree the Topic Filter allowed by CanSubscribeFor is in
+func FilterDevice(filter string) string {
+	levels := strings.SplitN(filter, "/", 3)
+	if len(levels) < 2 {
+		return ""
+	}
+	return levels[1]
+}
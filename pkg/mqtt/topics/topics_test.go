@@ -0,0 +1,144 @@
+package topics_test
+
+import (
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/mqtt/topics"
+	"github.com/slntopp/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		topic    string
+		expected topics.Topic
+	}{
+		{"devices/dev/state/reported", topics.Topic{Device: "dev", Kind: topics.StateReported}},
+		{"devices/dev/state/desired", topics.Topic{Device: "dev", Kind: topics.StateDesired}},
+		{"devices/dev/state/desired/delta", topics.Topic{Device: "dev", Kind: topics.StateDesiredDelta}},
+		{"devices/dev/events/button", topics.Topic{Device: "dev", Kind: topics.Event, Name: "button"}},
+		{"devices/dev/commands/reboot/now", topics.Topic{Device: "dev", Kind: topics.Command, Name: "reboot/now"}},
+		{"devices/dev/state/reported/cbor", topics.Topic{Device: "dev", Kind: topics.StateReported, Format: "cbor"}},
+		{"devices/dev/state/desired/delta/msgpack", topics.Topic{Device: "dev", Kind: topics.StateDesiredDelta, Format: "msgpack"}},
+		{"devices/dev/events/button/json", topics.Topic{Device: "dev", Kind: topics.Event, Name: "button", Format: "json"}},
+		{"devices/dev/events/cbor", topics.Topic{Device: "dev", Kind: topics.Event, Name: "cbor"}},
+		{"devices/dev/commands/reboot/cbor", topics.Topic{Device: "dev", Kind: topics.Command, Name: "reboot/cbor"}},
+		{"devices/dev/state/reported/xml", topics.Topic{Device: "dev"}},
+		{"devices/dev/state", topics.Topic{Device: "dev"}},
+		{"devices/dev/events/", topics.Topic{Device: "dev"}},
+		{"things/dev/state/reported", topics.Topic{}},
+		{"devices//state/reported", topics.Topic{}},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, topics.Parse(c.topic), c.topic)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		expected      bool
+	}{
+		{"devices/dev/state/desired", "devices/dev/state/desired", true},
+		{"devices/dev/#", "devices/dev/state/desired", true},
+		{"devices/dev/state/#", "devices/dev/state", true},
+		{"devices/dev/+/desired", "devices/dev/state/desired", true},
+		{"devices/dev/+", "devices/dev/state/desired", false},
+		{"devices/dev/state/desired", "devices/dev/state/desired/delta", false},
+		{"devices/dev/state/desired/delta", "devices/dev/state/desired", false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, topics.Match(c.filter, c.topic), c.filter+" "+c.topic)
+	}
+}
+
+func TestMaxQoS(t *testing.T) {
+	subs := map[string]packet.QosLevel{
+		"devices/dev/#":             packet.QoSLevelAtLeastOnce,
+		"devices/dev/state/desired": packet.QoSLevelExactlyOnce,
+		"devices/dev/commands/#":    packet.QoSLevelNone,
+	}
+
+	qos, ok := topics.MaxQoS(subs, topics.Desired("dev"))
+	assert.True(t, ok)
+	assert.Equal(t, packet.QoSLevelExactlyOnce, qos)
+
+	qos, ok = topics.MaxQoS(subs, topics.Commands("dev", "reboot"))
+	assert.True(t, ok)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, qos)
+
+	_, ok = topics.MaxQoS(subs, topics.Desired("other"))
+	assert.False(t, ok)
+}
+
+func TestMaxQoS_Format(t *testing.T) {
+	subs := map[string]packet.QosLevel{
+		"devices/dev/#": packet.QoSLevelAtLeastOnce,
+		topics.WithFormat(topics.Desired("dev"), "cbor"): packet.QoSLevelNone,
+	}
+
+	qos, ok := topics.MaxQoS(subs, topics.WithFormat(topics.Desired("dev"), "cbor"))
+	assert.True(t, ok)
+	assert.Equal(t, packet.QoSLevelNone, qos)
+
+	_, ok = topics.MaxQoS(subs, topics.WithFormat(topics.Desired("dev"), "msgpack"))
+	assert.False(t, ok)
+}
+
+func TestCanPublish(t *testing.T) {
+	assert.True(t, topics.CanPublish("dev", topics.Reported("dev")))
+	assert.True(t, topics.CanPublish("dev", topics.Events("dev", "button")))
+	assert.True(t, topics.CanPublish("dev", topics.WithFormat(topics.Reported("dev"), "cbor")))
+
+	assert.False(t, topics.CanPublish("dev", topics.Reported("other")))
+	assert.False(t, topics.CanPublish("dev", topics.Desired("dev")))
+	assert.False(t, topics.CanPublish("dev", topics.Commands("dev", "reboot")))
+	assert.False(t, topics.CanPublish("dev", "devices/dev/state"))
+	assert.False(t, topics.CanPublish("dev", topics.WithFormat(topics.Desired("dev"), "cbor")))
+}
+
+func TestCanSubscribe(t *testing.T) {
+	assert.True(t, topics.CanSubscribe("dev", topics.Desired("dev")))
+	assert.True(t, topics.CanSubscribe("dev", "devices/dev/#"))
+	assert.True(t, topics.CanSubscribe("dev", "devices/dev/commands/+"))
+
+	assert.False(t, topics.CanSubscribe("dev", topics.Desired("other")))
+	assert.False(t, topics.CanSubscribe("dev", "devices/+/state/desired"))
+	assert.False(t, topics.CanSubscribe("dev", "devices/#"))
+	assert.False(t, topics.CanSubscribe("dev", "#"))
+	assert.False(t, topics.CanSubscribe("dev", "devices/dev"))
+	assert.False(t, topics.CanSubscribe("dev", "devices/dev/state#"))
+}
+
+func TestCanPublishFor(t *testing.T) {
+	isChild := func(device string) bool { return device == "child" }
+
+	assert.True(t, topics.CanPublishFor("gw", isChild, topics.Reported("gw")))
+	assert.True(t, topics.CanPublishFor("gw", isChild, topics.Reported("child")))
+	assert.True(t, topics.CanPublishFor("gw", isChild, topics.Events("child", "button")))
+
+	assert.False(t, topics.CanPublishFor("gw", isChild, topics.Reported("other")))
+	assert.False(t, topics.CanPublishFor("gw", isChild, topics.Desired("child")))
+	assert.False(t, topics.CanPublishFor("gw", nil, topics.Reported("child")))
+}
+
+func TestCanSubscribeFor(t *testing.T) {
+	isChild := func(device string) bool { return device == "child" }
+
+	assert.True(t, topics.CanSubscribeFor("gw", isChild, topics.Desired("gw")))
+	assert.True(t, topics.CanSubscribeFor("gw", isChild, topics.Desired("child")))
+	assert.True(t, topics.CanSubscribeFor("gw", isChild, "devices/child/#"))
+
+	assert.False(t, topics.CanSubscribeFor("gw", isChild, topics.Desired("other")))
+	assert.False(t, topics.CanSubscribeFor("gw", isChild, "devices/+/state/desired"))
+	assert.False(t, topics.CanSubscribeFor("gw", isChild, "devices/child"))
+	assert.False(t, topics.CanSubscribeFor("gw", nil, topics.Desired("child")))
+}
+
+func TestFilterDevice(t *testing.T) {
+	assert.Equal(t, "child", topics.FilterDevice("devices/child/#"))
+	assert.Equal(t, "dev", topics.FilterDevice(topics.Desired("dev")))
+	assert.Equal(t, "", topics.FilterDevice("#"))
+}
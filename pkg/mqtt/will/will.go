@@ -0,0 +1,110 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package will persists delayed MQTT 5 Will Messages in Redis, so they're published once due by any bridge,
+// even if the one the Client was connected to has been restarted meanwhile
+package will
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+)
+
+const (
+	// Key - hash of pending Will Messages by ClientID
+	Key = "mqtt:wills"
+	// DueKey - sorted set of ClientIDs with pending Will Messages scored by due time in Unix milliseconds
+	DueKey = "mqtt:wills:due"
+)
+
+// Pending - Will Message waiting for its delay to pass
+type Pending struct {
+	ClientID string         `json:"client_id"`
+	Device   string         `json:"device"`
+	Will     *protocol.Will `json:"will"`
+}
+
+type Store interface {
+	// Schedule - stores the Will Message to be published at due, replacing the one the Client had pending
+	Schedule(ctx context.Context, p *Pending, due time.Time) error
+	// Cancel - discards the pending Will Message of the Client, e.g. once it reconnects
+	Cancel(ctx context.Context, clientID string) error
+	// Due - claims Will Messages due by now, each of them is returned to a single caller only
+	Due(ctx context.Context, now time.Time) ([]*Pending, error)
+}
+
+type store struct {
+	rdb redis.Cmdable
+}
+
+func NewStore(rdb redis.Cmdable) Store {
+	return &store{rdb: rdb}
+}
+
+func (s *store) Schedule(ctx context.Context, p *Pending, due time.Time) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err = s.rdb.HSet(ctx, Key, p.ClientID, data).Err(); err != nil {
+		return err
+	}
+	return s.rdb.ZAdd(ctx, DueKey, &redis.Z{Score: float64(due.UnixMilli()), Member: p.ClientID}).Err()
+}
+
+func (s *store) Cancel(ctx context.Context, clientID string) error {
+	if err := s.rdb.ZRem(ctx, DueKey, clientID).Err(); err != nil {
+		return err
+	}
+	return s.rdb.HDel(ctx, Key, clientID).Err()
+}
+
+// dueScript - returns and removes Will Messages due by ARGV[1] at once, so bridges polling concurrently don't publish them twice
+var dueScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+local res = {}
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[2], id)
+	local value = redis.call('HGET', KEYS[1], id)
+	if value then
+		redis.call('HDEL', KEYS[1], id)
+		table.insert(res, value)
+	end
+end
+return res
+`)
+
+func (s *store) Due(ctx context.Context, now time.Time) ([]*Pending, error) {
+	values, err := dueScript.Run(ctx, s.rdb, []string{Key, DueKey}, strconv.FormatInt(now.UnixMilli(), 10)).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Pending, 0, len(values))
+	for _, value := range values {
+		p := &Pending{}
+		if err := json.Unmarshal([]byte(value), p); err != nil {
+			continue
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
@@ -0,0 +1,68 @@
+package will_test
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/protocol"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/will"
+	"github.com/slntopp/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func pending() *will.Pending {
+	return &will.Pending{
+		ClientID: "client",
+		Device:   "device",
+		Will:     &protocol.Will{Topic: "devices/device/state/reported/delta", QoS: packet.QoSLevelAtLeastOnce, Payload: []byte("{}")},
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := will.NewStore(rdb)
+	p := pending()
+	due := time.UnixMilli(1700000000000)
+
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	rdb.EXPECT().HSet(context.Background(), will.Key, "client", data).Return(redis.NewIntResult(1, nil))
+	rdb.EXPECT().ZAdd(context.Background(), will.DueKey, &redis.Z{Score: 1700000000000, Member: "client"}).Return(redis.NewIntResult(1, nil))
+
+	assert.NoError(t, store.Schedule(context.Background(), p, due))
+}
+
+func TestDue(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := will.NewStore(rdb)
+	p := pending()
+	now := time.UnixMilli(1700000000000)
+
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	// Due Will Messages are claimed by a single script, so no other bridge gets them
+	rdb.EXPECT().EvalSha(context.Background(), mock.Anything, []string{will.Key, will.DueKey}, strconv.FormatInt(now.UnixMilli(), 10)).
+		Return(redis.NewCmdResult([]interface{}{string(data)}, nil))
+
+	res, err := store.Due(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, []*will.Pending{p}, res)
+}
+
+func TestDue_FailsOn_Script(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := will.NewStore(rdb)
+
+	rdb.EXPECT().EvalSha(context.Background(), mock.Anything, []string{will.Key, will.DueKey}, mock.Anything).
+		Return(redis.NewCmdResult(nil, assert.AnError))
+
+	_, err := store.Due(context.Background(), time.Now())
+	assert.Equal(t, assert.AnError, err)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ws serves MQTT over WebSockets: every WebSocket connection using "mqtt" subprotocol
+// is exposed as net.Conn carrying MQTT Control Packets in binary frames, so it can be handled as plain TCP connection
+package ws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const Subprotocol = "mqtt"
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// Conn - net.Conn over WebSocket connection
+type Conn struct {
+	*websocket.Conn
+
+	r  io.Reader
+	mu sync.Mutex
+}
+
+func NewConn(c *websocket.Conn) *Conn {
+	return &Conn{Conn: c}
+}
+
+// Read - reads from binary frames, MQTT packet may span multiple frames and a frame may contain multiple packets
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			mt, r, err := c.Conn.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				return 0, errors.New("MQTT over WebSocket requires binary frames")
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write - writes b as a single binary frame
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Listener - net.Listener accepting MQTT connections upgraded from HTTP requests it serves as http.Handler
+type Listener struct {
+	upgrader websocket.Upgrader
+	addr     net.Addr
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewListener(addr net.Addr) *Listener {
+	return &Listener{
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{Subprotocol},
+			// Devices and browser-based installers connect from any origin, authentication happens on MQTT level
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+
+	c, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader has already responded with error
+		return
+	}
+	if c.Subprotocol() != Subprotocol {
+		_ = c.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "mqtt subprotocol required"),
+			time.Now().Add(time.Second))
+		c.Close()
+		return
+	}
+
+	select {
+	case l.conns <- NewConn(c):
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
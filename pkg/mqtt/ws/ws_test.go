@@ -0,0 +1,71 @@
+package ws_test
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/ws"
+	"github.com/stretchr/testify/assert"
+)
+
+func dial(t *testing.T, url string, subprotocols ...string) *websocket.Conn {
+	d := websocket.Dialer{Subprotocols: subprotocols}
+	c, _, err := d.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+	assert.NoError(t, err)
+	return c
+}
+
+func TestListener_StreamsBinaryFrames(t *testing.T) {
+	l := ws.NewListener(&net.TCPAddr{})
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	client := dial(t, srv.URL, ws.Subprotocol)
+	defer client.Close()
+
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+
+	// Packet split across frames
+	assert.NoError(t, client.WriteMessage(websocket.BinaryMessage, []byte{0xc0}))
+	assert.NoError(t, client.WriteMessage(websocket.BinaryMessage, []byte{0}))
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xc0, 0}, buf)
+
+	_, err = conn.Write([]byte{0xd0, 0})
+	assert.NoError(t, err)
+
+	mt, msg, err := client.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, mt)
+	assert.Equal(t, []byte{0xd0, 0}, msg)
+}
+
+func TestListener_RequiresSubprotocol(t *testing.T) {
+	l := ws.NewListener(&net.TCPAddr{})
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	client := dial(t, srv.URL)
+	defer client.Close()
+
+	_, _, err := client.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseProtocolError))
+}
+
+func TestListener_Close(t *testing.T) {
+	l := ws.NewListener(&net.TCPAddr{})
+	assert.NoError(t, l.Close())
+
+	_, err := l.Accept()
+	assert.Equal(t, ws.ErrListenerClosed, err)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package revocation
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"time"
+)
+
+var oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// CreateCRL - DER encoded CRL of the CA listing revocations issued by it, others are skipped.
+// CRL Number is derived from now, so newer CRLs always have greater numbers
+func CreateCRL(ca *x509.Certificate, key crypto.Signer, rs []*Revocation, now time.Time, validity time.Duration) ([]byte, error) {
+	issuer := hex.EncodeToString(ca.RawSubject)
+
+	var revoked []pkix.RevokedCertificate
+	for _, r := range rs {
+		if r.Issuer != issuer || r.Serial == "" {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(r.Serial, 10)
+		if !ok {
+			continue
+		}
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: r.RevokedAt,
+		}
+		if r.ReasonCode != 0 {
+			value, err := asn1.Marshal(asn1.Enumerated(r.ReasonCode))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidReasonCode, Value: value}}
+		}
+		revoked = append(revoked, entry)
+	}
+
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(validity),
+	}, ca, key)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxOCSPResponse - responses are small, anything bigger is not a response
+const maxOCSPResponse = 64 * 1024
+
+type ocspEntry struct {
+	revoked bool
+	expires time.Time
+}
+
+// OCSP - checks certificates against an OCSP responder, caching answers until their Next Update or for ttl if it's not set
+type OCSP struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]ocspEntry
+}
+
+func NewOCSP(url string, client *http.Client, ttl time.Duration) *OCSP {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OCSP{
+		url:    url,
+		client: client,
+		ttl:    ttl,
+		cache:  make(map[string]ocspEntry),
+	}
+}
+
+// Check - returns ErrRevoked if responder says the certificate is revoked, nil if it's good,
+// other errors if responder can't be reached, doesn't know the certificate or gives an invalid response
+func (o *OCSP) Check(ctx context.Context, cert, issuer *x509.Certificate) error {
+	key := Fingerprint(cert.Raw)
+	o.mu.Lock()
+	e, ok := o.cache[key]
+	o.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		if e.revoked {
+			return ErrRevoked
+		}
+		return nil
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/ocsp-request")
+	r.Header.Set("Accept", "application/ocsp-response")
+
+	res, err := o.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("OCSP responder returned %s", res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxOCSPResponse))
+	if err != nil {
+		return err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return err
+	}
+
+	var revoked bool
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		revoked = true
+	default:
+		return fmt.Errorf("OCSP responder doesn't know the certificate")
+	}
+
+	expires := time.Now().Add(o.ttl)
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(expires) {
+		expires = resp.NextUpdate
+	}
+	o.mu.Lock()
+	o.cache[key] = ocspEntry{revoked: revoked, expires: expires}
+	o.mu.Unlock()
+
+	if revoked {
+		return ErrRevoked
+	}
+	return nil
+}
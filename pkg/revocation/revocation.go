@@ -0,0 +1,202 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package revocation keeps revoked device certificates. Registry stores them in ArangoDB and mirrors them to Redis,
+// where MQTT Bridge checks certificate chains at handshake and learns about new revocations via Pub/Sub.
+// Revocations are scoped to the Namespace which made them and only apply to devices of that Namespace
+package revocation
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Channel - Redis Pub/Sub channel new revocations are published to
+const Channel = "certificates:revocations"
+
+// Key - Redis hash of the Namespace revocations by certificate fingerprint
+func Key(namespace string) string {
+	return "certificates:revoked:" + namespace
+}
+
+// ErrRevoked - certificate is revoked
+var ErrRevoked = errors.New("certificate is revoked")
+
+// Reasons - CRL reason codes by name, RFC 5280 5.3.1
+var Reasons = map[string]int{
+	"unspecified":            0,
+	"key_compromise":         1,
+	"ca_compromise":          2,
+	"affiliation_changed":    3,
+	"superseded":             4,
+	"cessation_of_operation": 5,
+	"certificate_hold":       6,
+	"privilege_withdrawn":    9,
+}
+
+// ParseReason - reason code by name, empty name is unspecified
+func ParseReason(name string) (int, error) {
+	if name == "" {
+		return 0, nil
+	}
+	code, ok := Reasons[name]
+	if !ok {
+		names := make([]string, 0, len(Reasons))
+		for n := range Reasons {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unknown reason %q, must be one of %v", name, names)
+	}
+	return code, nil
+}
+
+type Revocation struct {
+	// Fingerprint - hex encoded SHA-256 of the DER certificate, same as device certificate fingerprint
+	Fingerprint string `json:"fingerprint"`
+	Namespace   string `json:"namespace"`
+	// Device - device the certificate belonged to when revoked, if it was registered
+	Device string `json:"device,omitempty"`
+	// Serial and Issuer (hex encoded DER Name) are only known if the certificate itself was given, CRLs are built from them
+	Serial     string    `json:"serial,omitempty"`
+	Issuer     string    `json:"issuer,omitempty"`
+	Reason     string    `json:"reason"`
+	ReasonCode int       `json:"reason_code"`
+	Comment    string    `json:"comment,omitempty"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+// Fingerprint - hex encoded SHA-256 of the DER certificate
+func Fingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// FromCertificate - revocation with fingerprint, serial and issuer of the certificate set
+func FromCertificate(cert *x509.Certificate) *Revocation {
+	return &Revocation{
+		Fingerprint: Fingerprint(cert.Raw),
+		Serial:      cert.SerialNumber.String(),
+		Issuer:      hex.EncodeToString(cert.RawIssuer),
+	}
+}
+
+type Store struct {
+	rdb redis.UniversalClient
+}
+
+func NewStore(rdb redis.UniversalClient) *Store {
+	return &Store{rdb: rdb}
+}
+
+// Publish - stores revocation and notifies subscribers
+func (s *Store) Publish(ctx context.Context, r *Revocation) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := s.rdb.HSet(ctx, Key(r.Namespace), r.Fingerprint, data).Err(); err != nil {
+		return err
+	}
+	return s.rdb.Publish(ctx, Channel, data).Err()
+}
+
+// Restore - stores revocations without notifying subscribers, meant to fill Redis from the database on startup
+func (s *Store) Restore(ctx context.Context, rs []*Revocation) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	values := make(map[string][]interface{})
+	for _, r := range rs {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		values[r.Namespace] = append(values[r.Namespace], r.Fingerprint, data)
+	}
+	for namespace, v := range values {
+		if err := s.rdb.HSet(ctx, Key(namespace), v...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check - returns revocation of the first certificate in the chain revoked by the Namespace of the device, nil if none is revoked
+func (s *Store) Check(ctx context.Context, namespace string, chain []*x509.Certificate) (*Revocation, error) {
+	fingerprints := make([]string, len(chain))
+	for i, cert := range chain {
+		fingerprints[i] = Fingerprint(cert.Raw)
+	}
+	return s.CheckFingerprints(ctx, namespace, fingerprints...)
+}
+
+// CheckFingerprints - returns revocation of the first hex encoded fingerprint revoked by the Namespace of the device, nil if none is revoked.
+// Meant for devices authenticated by fingerprint alone, e.g. with Basic Auth
+func (s *Store) CheckFingerprints(ctx context.Context, namespace string, fingerprints ...string) (*Revocation, error) {
+	if len(fingerprints) == 0 || namespace == "" {
+		return nil, nil
+	}
+
+	values, err := s.rdb.HMGet(ctx, Key(namespace), fingerprints...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var r Revocation
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, err
+		}
+		return &r, nil
+	}
+	return nil, nil
+}
+
+// Subscribe - calls cb with each new revocation until ctx is done
+func (s *Store) Subscribe(ctx context.Context, cb func(*Revocation)) {
+	sub := s.rdb.Subscribe(ctx, Channel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var r Revocation
+			if err := json.Unmarshal([]byte(msg.Payload), &r); err != nil {
+				continue
+			}
+			cb(&r)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package revocation_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/revocation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func issue(t *testing.T, parent *issuer, name string, ca bool) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+	}
+	if ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		tmpl.SubjectKeyId = []byte(name)
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &issuer{cert: cert, key: key}
+}
+
+func TestParseReason(t *testing.T) {
+	code, err := revocation.ParseReason("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+
+	code, err = revocation.ParseReason("key_compromise")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, code)
+
+	_, err = revocation.ParseReason("lost")
+	assert.Error(t, err)
+}
+
+func TestFromCertificate(t *testing.T) {
+	ca := issue(t, nil, "CA", true)
+	leaf := issue(t, ca, "device", false)
+
+	r := revocation.FromCertificate(leaf.cert)
+	assert.Equal(t, revocation.Fingerprint(leaf.cert.Raw), r.Fingerprint)
+	assert.Len(t, r.Fingerprint, 64)
+	assert.Equal(t, leaf.cert.SerialNumber.String(), r.Serial)
+	assert.NotEmpty(t, r.Issuer)
+}
+
+func TestCreateCRL(t *testing.T) {
+	ca := issue(t, nil, "CA", true)
+	other := issue(t, nil, "Other CA", true)
+
+	compromised := issue(t, ca, "compromised", false)
+	retired := issue(t, ca, "retired", false)
+	foreign := issue(t, other, "foreign", false)
+
+	revokedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	var rs []*revocation.Revocation
+	for _, c := range []struct {
+		cert   *x509.Certificate
+		reason int
+	}{{compromised.cert, 1}, {retired.cert, 0}, {foreign.cert, 0}} {
+		r := revocation.FromCertificate(c.cert)
+		r.ReasonCode = c.reason
+		r.RevokedAt = revokedAt
+		rs = append(rs, r)
+	}
+	// Revoked by fingerprint only, can't be listed
+	rs = append(rs, &revocation.Revocation{Fingerprint: "abc", RevokedAt: revokedAt})
+
+	now := time.Now()
+	der, err := revocation.CreateCRL(ca.cert, ca.key, rs, now, time.Hour)
+	require.NoError(t, err)
+
+	crl, err := x509.ParseRevocationList(der)
+	require.NoError(t, err)
+	require.NoError(t, crl.CheckSignatureFrom(ca.cert))
+	assert.WithinDuration(t, now.Add(time.Hour), crl.NextUpdate, time.Second)
+
+	require.Len(t, crl.RevokedCertificates, 2)
+	assert.Equal(t, compromised.cert.SerialNumber, crl.RevokedCertificates[0].SerialNumber)
+	assert.True(t, revokedAt.Equal(crl.RevokedCertificates[0].RevocationTime))
+	require.Len(t, crl.RevokedCertificates[0].Extensions, 1)
+	var reason asn1.Enumerated
+	_, err = asn1.Unmarshal(crl.RevokedCertificates[0].Extensions[0].Value, &reason)
+	require.NoError(t, err)
+	assert.Equal(t, asn1.Enumerated(1), reason)
+
+	assert.Equal(t, retired.cert.SerialNumber, crl.RevokedCertificates[1].SerialNumber)
+	assert.Empty(t, crl.RevokedCertificates[1].Extensions)
+
+	later, err := revocation.CreateCRL(ca.cert, ca.key, rs, now.Add(time.Second), time.Hour)
+	require.NoError(t, err)
+	next, err := x509.ParseRevocationList(later)
+	require.NoError(t, err)
+	assert.Equal(t, 1, next.Number.Cmp(crl.Number))
+}
+
+// responder - OCSP responder answering with status for every certificate and counting requests
+func responder(t *testing.T, ca *issuer, status *int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+
+		tmpl := ocsp.Response{
+			Status:       int(atomic.LoadInt32(status)),
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if tmpl.Status == ocsp.Revoked {
+			tmpl.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+}
+
+func TestOCSP(t *testing.T) {
+	ca := issue(t, nil, "CA", true)
+	good := issue(t, ca, "good", false)
+	revoked := issue(t, ca, "revoked", false)
+
+	var status, requests int32 = ocsp.Good, 0
+	srv := responder(t, ca, &status, &requests)
+	defer srv.Close()
+
+	o := revocation.NewOCSP(srv.URL, srv.Client(), time.Minute)
+	ctx := context.Background()
+
+	assert.NoError(t, o.Check(ctx, good.cert, ca.cert))
+	// Cached
+	assert.NoError(t, o.Check(ctx, good.cert, ca.cert))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&status, ocsp.Revoked)
+	assert.ErrorIs(t, o.Check(ctx, revoked.cert, ca.cert), revocation.ErrRevoked)
+	assert.ErrorIs(t, o.Check(ctx, revoked.cert, ca.cert), revocation.ErrRevoked)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&status, ocsp.Unknown)
+	fresh := issue(t, ca, "fresh", false)
+	err := o.Check(ctx, fresh.cert, ca.cert)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, revocation.ErrRevoked)
+}
+
+func TestOCSP_Unavailable(t *testing.T) {
+	ca := issue(t, nil, "CA", true)
+	leaf := issue(t, ca, "device", false)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	o := revocation.NewOCSP(srv.URL, srv.Client(), time.Minute)
+	err := o.Check(context.Background(), leaf.cert, ca.cert)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, revocation.ErrRevoked)
+}
+
+func TestStore_Check_NamespaceScoped(t *testing.T) {
+	ctx := context.Background()
+	ca := issue(t, nil, "CA", true)
+	leaf := issue(t, ca, "device", false)
+
+	rdb := redis_mocks.NewMockUniversalClient(t)
+	store := revocation.NewStore(rdb)
+
+	r := revocation.FromCertificate(ca.cert)
+	r.Namespace = "a"
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+
+	chain := []interface{}{revocation.Fingerprint(leaf.cert.Raw), revocation.Fingerprint(ca.cert.Raw)}
+	rdb.EXPECT().HMGet(ctx, revocation.Key("a"), chain...).Return(redis.NewSliceResult([]interface{}{nil, string(data)}, nil))
+	rdb.EXPECT().HMGet(ctx, revocation.Key("b"), chain...).Return(redis.NewSliceResult([]interface{}{nil, nil}, nil))
+
+	res, err := store.Check(ctx, "a", []*x509.Certificate{leaf.cert, ca.cert})
+	require.NoError(t, err)
+	assert.Equal(t, r.Fingerprint, res.Fingerprint)
+
+	// CA revoked by another Namespace doesn't affect devices of this one
+	res, err = store.Check(ctx, "b", []*x509.Certificate{leaf.cert, ca.cert})
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+
+	// Devices outside of any Namespace have nothing revoked
+	res, err = store.Check(ctx, "", []*x509.Certificate{leaf.cert})
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestStore_Restore_ByNamespace(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis_mocks.NewMockUniversalClient(t)
+	store := revocation.NewStore(rdb)
+
+	a := &revocation.Revocation{Fingerprint: "aa", Namespace: "a"}
+	b := &revocation.Revocation{Fingerprint: "bb", Namespace: "b"}
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+
+	rdb.EXPECT().HSet(ctx, revocation.Key("a"), "aa", da).Return(redis.NewIntResult(1, nil))
+	rdb.EXPECT().HSet(ctx, revocation.Key("b"), "bb", db).Return(redis.NewIntResult(1, nil))
+
+	assert.NoError(t, store.Restore(ctx, []*revocation.Revocation{a, b}))
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rotation tells the registry which certificate devices have connected with. Bridges report it once the device
+// is fully authenticated, so a pending certificate only becomes the primary one after the device proved it holds its key
+package rotation
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout - registry must respond within it
+const DefaultTimeout = 10 * time.Second
+
+// Client - calls registry's certificates HTTP API, see graph.CertificatesController.Register
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// NewClient - registryURL is where the registry HTTP API is served, e.g. http://repo:8000, token must have Root access
+func NewClient(registryURL, token string) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(registryURL, "/"),
+		token: token,
+		http:  &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// Connected - tells the registry the device has connected with the certificate having the SHA-256 fingerprint
+func (c *Client) Connected(ctx context.Context, device string, fingerprint []byte) error {
+	endpoint := fmt.Sprintf("%s/devices/%s/certificates/%s/connected", c.url, url.PathEscape(device), hex.EncodeToString(fingerprint))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		_, _ = msg.ReadFrom(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("registry responded with %s: %s", res.Status, strings.TrimSpace(msg.String()))
+	}
+	return nil
+}
+
+// Rotates - tells whether connecting with the certificate having the fingerprint may rotate Device certificates,
+// which is only the case when it's not the primary one
+func Rotates(primary, fingerprint []byte) bool {
+	return !bytes.Equal(primary, fingerprint)
+}
@@ -0,0 +1,42 @@
+package rotation_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/infinimesh/infinimesh/pkg/rotation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnected_Success(t *testing.T) {
+	var path, authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, authorization = r.URL.Path, r.Header.Get("Authorization")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	err := rotation.NewClient(srv.URL+"/", "token").Connected(context.Background(), "device", []byte{0xde, 0xad})
+	require.NoError(t, err)
+	assert.Equal(t, "/devices/device/certificates/dead/connected", path)
+	assert.Equal(t, "Bearer token", authorization)
+}
+
+func TestConnected_FailsOn_ErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Certificate not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	err := rotation.NewClient(srv.URL, "token").Connected(context.Background(), "device", []byte{0xde, 0xad})
+	assert.ErrorContains(t, err, "Certificate not found")
+}
+
+func TestRotates(t *testing.T) {
+	assert.False(t, rotation.Rotates([]byte{1, 2}, []byte{1, 2}))
+	assert.True(t, rotation.Rotates([]byte{1, 2}, []byte{3, 4}))
+	assert.True(t, rotation.Rotates(nil, []byte{3, 4}))
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	redis "github.com/go-redis/redis/v8"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DeltaHeader - gRPC header metadata key Get and StreamShadow send stored deltas of the devices in, as "{device}={State JSON}".
+// It's binary, so the state is sent as is
+const DeltaHeader = "shadow-delta-bin"
+
+// DeltaKey - key of the difference between Desired and Reported state, stored next to the states themselves.
+// Shadow messages have no place for it, so it's published to mqtt.delta as Desired state
+func DeltaKey(device string) string {
+	return device + ":delta"
+}
+
+// Delta - Desired state keys Reported state doesn't match, objects are compared key by key and lists as a whole.
+// Desired null values mean the key isn't managed and never make it into delta
+func Delta(desired, reported *structpb.Struct) *structpb.Struct {
+	res := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+	for k, d := range desired.GetFields() {
+		if _, ok := d.GetKind().(*structpb.Value_NullValue); ok {
+			continue
+		}
+		r, ok := reported.GetFields()[k]
+		if ok && proto.Equal(d, r) {
+			continue
+		}
+		if ds, rs := d.GetStructValue(), r.GetStructValue(); ds != nil && rs != nil {
+			if nested := Delta(ds, rs); len(nested.Fields) > 0 {
+				res.Fields[k] = structpb.NewStructValue(nested)
+			}
+			continue
+		}
+		res.Fields[k] = d
+	}
+	return res
+}
+
+// deltaScript - sets KEYS[3] to ARGV[3] unless versions of Desired (KEYS[1]) and Reported (KEYS[2]) state differ
+// from ARGV[1] and ARGV[2], the ones delta was computed from. Returns 1 if it's set
+var deltaScript = redis.NewScript(luaVersion + `
+if version(KEYS[1]) ~= tonumber(ARGV[1]) or version(KEYS[2]) ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('SET', KEYS[3], ARGV[3])
+return 1
+`)
+
+// UpdateDelta - recomputes delta after Desired or Reported state of the device changed, stores it if it differs
+// from the stored one and publishes it to mqtt.delta unless it's empty.
+// Delta is only stored if neither state changed since it was read, otherwise it's recomputed
+func (s *ShadowServiceServer) UpdateDelta(log *zap.Logger, device string) {
+	ctx := context.Background()
+	key := DeltaKey(device)
+	keys := []string{Key(device, pb.StateKey_DESIRED), Key(device, pb.StateKey_REPORTED), key}
+
+	for i := 0; i < updateRetries; i++ {
+		states, err := s.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			log.Warn("Error Getting States", zap.String("key", key), zap.Error(err))
+			return
+		}
+		var desired, reported, old pb.State
+		var versions [2]int64
+		for i, state := range []*pb.State{&desired, &reported, &old} {
+			if raw, ok := states[i].(string); ok {
+				_ = json.Unmarshal([]byte(raw), state)
+				if i < len(versions) {
+					versions[i] = Version([]byte(raw))
+				}
+			}
+		}
+		if desired.Data == nil && old.Data == nil {
+			return
+		}
+
+		delta := Delta(desired.Data, reported.Data)
+		if old.Data != nil && proto.Equal(delta, old.Data) {
+			return
+		}
+
+		state := &pb.State{Timestamp: timestamppb.Now(), Data: delta}
+		raw, err := json.Marshal(state)
+		if err != nil {
+			log.Warn("Error Marshalling State", zap.String("key", key), zap.Error(err))
+			return
+		}
+		ok, err := deltaScript.Run(ctx, s.rdb, keys, versions[0], versions[1], string(raw)).Int()
+		if err != nil {
+			log.Warn("Error Storing State", zap.String("key", key), zap.Error(err))
+			return
+		}
+		if ok == 0 {
+			log.Debug("States changed while computing delta, retrying", zap.String("key", key))
+			continue
+		}
+
+		if len(delta.Fields) > 0 {
+			s.ps.TryPub(&pb.Shadow{Device: device, Desired: state}, "mqtt.delta")
+		}
+		return
+	}
+	log.Warn("Error Storing State", zap.String("key", key), zap.Error(ErrTooManyRetries))
+}
+
+// LoadDelta - stored delta of the device, nil if it has no Desired state yet
+func LoadDelta(ctx context.Context, rdb redis.Cmdable, device string) (*pb.State, error) {
+	raw, err := rdb.Get(ctx, DeltaKey(device)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state pb.State
+	if err := json.Unmarshal([]byte(raw), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// ParseDeltas - deltas sent in the response header by device
+func ParseDeltas(md metadata.MD) map[string]*pb.State {
+	res := make(map[string]*pb.State)
+	for _, value := range md.Get(DeltaHeader) {
+		device, raw, ok := strings.Cut(value, "=")
+		if !ok {
+			continue
+		}
+		var state pb.State
+		if err := json.Unmarshal([]byte(raw), &state); err == nil {
+			res[device] = &state
+		}
+	}
+	return res
+}
@@ -0,0 +1,114 @@
+package shadow_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/shadow"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func mustStruct(t *testing.T, v map[string]any) *structpb.Struct {
+	s, err := structpb.NewStruct(v)
+	require.NoError(t, err)
+	return s
+}
+
+func TestDelta(t *testing.T) {
+	cases := []struct {
+		name     string
+		desired  map[string]any
+		reported map[string]any
+		expected map[string]any
+	}{
+		{"in sync", map[string]any{"a": 1, "b": "on"}, map[string]any{"a": 1, "b": "on", "c": true}, map[string]any{}},
+		{"missing and different", map[string]any{"a": 1, "b": "on"}, map[string]any{"a": 2}, map[string]any{"a": 1, "b": "on"}},
+		{"nested", map[string]any{"led": map[string]any{"color": "red", "on": true}}, map[string]any{"led": map[string]any{"color": "blue", "on": true}}, map[string]any{"led": map[string]any{"color": "red"}}},
+		{"nested in sync", map[string]any{"led": map[string]any{"on": true}}, map[string]any{"led": map[string]any{"on": true, "level": 3}}, map[string]any{}},
+		{"object replaces value", map[string]any{"led": map[string]any{"on": true}}, map[string]any{"led": "off"}, map[string]any{"led": map[string]any{"on": true}}},
+		{"lists as a whole", map[string]any{"l": []any{1, 2}}, map[string]any{"l": []any{1}}, map[string]any{"l": []any{1, 2}}},
+		{"null isn't managed", map[string]any{"a": nil}, map[string]any{}, map[string]any{}},
+		{"no reported", map[string]any{"a": 1}, nil, map[string]any{"a": 1}},
+	}
+	for _, c := range cases {
+		var reported *structpb.Struct
+		if c.reported != nil {
+			reported = mustStruct(t, c.reported)
+		}
+		res := shadow.Delta(mustStruct(t, c.desired), reported)
+		assert.Equal(t, mustStruct(t, c.expected).AsMap(), res.AsMap(), c.name)
+	}
+}
+
+func TestUpdateDelta_Publishes(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, "device1:desired", "device1:reported", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{"a":1,"b":2},"version":3}`, `{"data":{"a":1},"version":7}`, `{"data":{"a":1,"b":2}}`}, nil))
+	f.expectDelta(3, 7, func(s string) bool {
+		state := pb.State{}
+		return json.Unmarshal([]byte(s), &state) == nil && assert.Equal(t, map[string]any{"b": 2.0}, state.Data.AsMap())
+	})
+	f.mocks.ps.EXPECT().TryPub(mock.MatchedBy(func(s *pb.Shadow) bool {
+		return s.Device == "device1" && s.Desired.Timestamp != nil && assert.Equal(t, map[string]any{"b": 2.0}, s.Desired.Data.AsMap())
+	}), "mqtt.delta").Return()
+
+	f.service.UpdateDelta(f.mocks.log, "device1")
+}
+
+func TestUpdateDelta_RetriesOn_ConcurrentChange(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	// Reported state catches up while delta is computed, so the stale delta isn't stored
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, "device1:desired", "device1:reported", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{"a":1,"b":2},"version":3}`, `{"data":{"a":1},"version":7}`, nil}, nil)).Once()
+	f.mocks.rdb.EXPECT().EvalSha(mock.Anything, mock.Anything, []string{"device1:desired", "device1:reported", "device1:delta"},
+		int64(3), int64(7), mock.Anything).Return(redis.NewCmdResult(int64(0), nil)).Once()
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, "device1:desired", "device1:reported", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{"a":1,"b":2},"version":3}`, `{"data":{"a":1,"b":2},"version":8}`, nil}, nil)).Once()
+	f.expectDelta(3, 8, func(s string) bool {
+		state := pb.State{}
+		return json.Unmarshal([]byte(s), &state) == nil && len(state.Data.GetFields()) == 0
+	})
+
+	f.service.UpdateDelta(f.mocks.log, "device1")
+}
+
+func TestUpdateDelta_Unchanged(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, "device1:desired", "device1:reported", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{"a":1,"b":2}}`, `{"data":{"a":3}}`, `{"data":{"a":1,"b":2}}`}, nil))
+
+	f.service.UpdateDelta(f.mocks.log, "device1")
+}
+
+func TestUpdateDelta_NoDesired(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, "device1:desired", "device1:reported", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{nil, `{"data":{"a":3}}`, nil}, nil))
+
+	f.service.UpdateDelta(f.mocks.log, "device1")
+}
+
+func TestLoadDelta(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+
+	rdb.EXPECT().Get(mock.Anything, "device1:delta").Return(redis.NewStringResult(`{"data":{"a":1}}`, nil))
+	state, err := shadow.LoadDelta(context.Background(), rdb, "device1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": 1.0}, state.Data.AsMap())
+
+	rdb.EXPECT().Get(mock.Anything, "device2:delta").Return(redis.NewStringResult("", redis.Nil))
+	state, err = shadow.LoadDelta(context.Background(), rdb, "device2")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
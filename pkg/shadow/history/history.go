@@ -0,0 +1,222 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package history keeps every Reported and Desired state patch applied to the device Shadow in Redis Streams,
+// one stream per device and state:
+//
+//	{device}:history:reported
+//	{device}:history:desired
+//
+// Entries are identified by stream IDs, which start with the time patch was stored at in milliseconds,
+// so time ranges are queried by ID. Streams are trimmed by retention set in Namespace and Device config
+// (see Retentions), Redis 6.2 or newer is required
+package history
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	pb "github.com/infinimesh/proto/shadow"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+
+	// scanBatches - batches of limit entries scanned for a page before it's returned with fewer entries,
+	// so paths rarely present in patches don't make a single query go through the whole stream
+	scanBatches = 10
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidPath   = errors.New("invalid path")
+)
+
+// Key - Redis Stream of the device state patches
+func Key(device string, key pb.StateKey) string {
+	if key == pb.StateKey_DESIRED {
+		return device + ":history:desired"
+	}
+	return device + ":history:reported"
+}
+
+// Store - appends state patches to the device streams and queries them
+type Store struct {
+	rdb redis.Cmdable
+}
+
+func NewStore(rdb redis.Cmdable) *Store {
+	return &Store{rdb: rdb}
+}
+
+// Append - adds the patch to the device stream and trims the stream to the retention.
+// Streams of devices which stopped sending expire once all their entries would have been trimmed
+func (s *Store) Append(ctx context.Context, device string, key pb.StateKey, state *pb.State, r Retention) error {
+	data, err := state.GetData().MarshalJSON()
+	if err != nil {
+		return err
+	}
+	ts := time.Now()
+	if state.GetTimestamp() != nil {
+		ts = state.GetTimestamp().AsTime()
+	}
+
+	stream := Key(device, key)
+	err = s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: r.MaxEntries,
+		Approx: true,
+		Values: []interface{}{"ts", ts.UnixMilli(), "data", string(data)},
+	}).Err()
+	if err != nil || r.MaxAge <= 0 {
+		return err
+	}
+
+	minID := strconv.FormatInt(time.Now().Add(-r.MaxAge).UnixMilli(), 10)
+	if err := s.rdb.XTrimMinIDApprox(ctx, stream, minID, 0).Err(); err != nil {
+		return err
+	}
+	return s.rdb.Expire(ctx, stream, r.MaxAge).Err()
+}
+
+// Query - patches of the device state setting the path within the time range, zero From and To leave range open.
+// Path is a dot separated list of keys, e.g. "sensors.temperature", empty path matches whole patches
+type Query struct {
+	Device string
+	State  pb.StateKey
+	Path   string
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Cursor string
+}
+
+// Entry - value the patch set the path to, null if it removed the key
+type Entry struct {
+	ID        string          `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Value     *structpb.Value `json:"value"`
+}
+
+// Page - entries in the order they were stored, Next is the cursor to continue the query from, empty if there is no more.
+// Page may hold fewer entries than requested while there is more
+type Page struct {
+	Entries []Entry `json:"entries"`
+	Next    string  `json:"next,omitempty"`
+}
+
+// Query - pages through the device stream, entries not having the path are skipped
+func (s *Store) Query(ctx context.Context, q Query) (*Page, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	var path []string
+	if q.Path != "" {
+		path = strings.Split(q.Path, ".")
+		for _, key := range path {
+			if key == "" {
+				return nil, ErrInvalidPath
+			}
+		}
+	}
+
+	start, end := "-", "+"
+	if !q.From.IsZero() {
+		start = strconv.FormatInt(q.From.UnixMilli(), 10)
+	}
+	if !q.To.IsZero() {
+		end = strconv.FormatInt(q.To.UnixMilli(), 10)
+	}
+	if q.Cursor != "" {
+		if !validID(q.Cursor) {
+			return nil, ErrInvalidCursor
+		}
+		start = "(" + q.Cursor
+	}
+
+	page := &Page{Entries: []Entry{}}
+	for i := 0; i < scanBatches; i++ {
+		msgs, err := s.rdb.XRangeN(ctx, Key(q.Device, q.State), start, end, int64(limit)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if e, ok := entry(msg, path); ok {
+				page.Entries = append(page.Entries, e)
+			}
+			if len(page.Entries) == limit {
+				page.Next = msg.ID
+				return page, nil
+			}
+		}
+		if len(msgs) < limit {
+			return page, nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+	page.Next = start[1:]
+	return page, nil
+}
+
+// entry - value of the path in the patch, false if the patch doesn't set it or can't be decoded
+func entry(msg redis.XMessage, path []string) (Entry, bool) {
+	raw, _ := msg.Values["data"].(string)
+	var data structpb.Struct
+	if err := data.UnmarshalJSON([]byte(raw)); err != nil {
+		return Entry{}, false
+	}
+
+	value := structpb.NewStructValue(&data)
+	for _, key := range path {
+		v, ok := value.GetStructValue().GetFields()[key]
+		if !ok {
+			return Entry{}, false
+		}
+		value = v
+	}
+
+	e := Entry{ID: msg.ID, Value: value}
+	if ts, ok := msg.Values["ts"].(string); ok {
+		if ms, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			e.Timestamp = time.UnixMilli(ms).UTC()
+		}
+	}
+	return e, true
+}
+
+// validID - checks the stream ID has "{ms}-{seq}" format
+func validID(id string) bool {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return false
+	}
+	_, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(seq, 10, 64)
+	return err == nil
+}
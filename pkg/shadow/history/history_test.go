@@ -0,0 +1,140 @@
+package history_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/shadow/history"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func message(id string, ts int64, data string) redis.XMessage {
+	return redis.XMessage{ID: id, Values: map[string]interface{}{
+		"ts": strconv.FormatInt(ts, 10), "data": data,
+	}}
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "device:history:reported", history.Key("device", pb.StateKey_REPORTED))
+	assert.Equal(t, "device:history:desired", history.Key("device", pb.StateKey_DESIRED))
+}
+
+func TestAppend(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := history.NewStore(rdb)
+
+	data, _ := structpb.NewStruct(map[string]any{"temperature": 21.5})
+	ts := time.UnixMilli(1700000000000)
+
+	rdb.EXPECT().XAdd(mock.Anything, mock.MatchedBy(func(a *redis.XAddArgs) bool {
+		return a.Stream == "device:history:reported" && a.MaxLen == 100 && a.Approx &&
+			assert.Equal(t, []interface{}{"ts", ts.UnixMilli(), "data", `{"temperature":21.5}`}, a.Values)
+	})).Return(redis.NewStringResult("1700000000000-0", nil))
+	rdb.EXPECT().XTrimMinIDApprox(mock.Anything, "device:history:reported", mock.MatchedBy(func(id string) bool {
+		ms, err := strconv.ParseInt(id, 10, 64)
+		return err == nil && time.Since(time.UnixMilli(ms)) >= time.Hour
+	}), int64(0)).Return(redis.NewIntResult(0, nil))
+	rdb.EXPECT().Expire(mock.Anything, "device:history:reported", time.Hour).Return(redis.NewBoolResult(true, nil))
+
+	err := store.Append(context.Background(), "device", pb.StateKey_REPORTED, &pb.State{
+		Timestamp: timestamppb.New(ts), Data: data,
+	}, history.Retention{MaxAge: time.Hour, MaxEntries: 100})
+	assert.NoError(t, err)
+}
+
+func TestAppend_Unlimited(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := history.NewStore(rdb)
+
+	rdb.EXPECT().XAdd(mock.Anything, mock.MatchedBy(func(a *redis.XAddArgs) bool {
+		return a.Stream == "device:history:desired" && a.MaxLen == 0
+	})).Return(redis.NewStringResult("1-0", nil))
+
+	err := store.Append(context.Background(), "device", pb.StateKey_DESIRED, &pb.State{Data: &structpb.Struct{}}, history.Retention{})
+	assert.NoError(t, err)
+}
+
+func TestQuery_Path(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := history.NewStore(rdb)
+
+	from := time.UnixMilli(1000)
+	rdb.EXPECT().XRangeN(mock.Anything, "device:history:reported", "1000", "+", int64(10)).Return(redis.NewXMessageSliceCmdResult([]redis.XMessage{
+		message("1000-0", 999, `{"sensors":{"temperature":20}}`),
+		message("1001-0", 1001, `{"sensors":{"humidity":40}}`),
+		message("1002-0", 1002, `{"sensors":{"temperature":null}}`),
+		message("1003-0", 1003, `{"sensors":21}`),
+	}, nil))
+
+	page, err := store.Query(context.Background(), history.Query{
+		Device: "device", State: pb.StateKey_REPORTED, Path: "sensors.temperature", From: from, Limit: 10,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, page.Next)
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, "1000-0", page.Entries[0].ID)
+	assert.Equal(t, time.UnixMilli(999).UTC(), page.Entries[0].Timestamp)
+	assert.Equal(t, 20.0, page.Entries[0].Value.GetNumberValue())
+	assert.Equal(t, "1002-0", page.Entries[1].ID)
+	assert.NotNil(t, page.Entries[1].Value.GetKind().(*structpb.Value_NullValue))
+}
+
+func TestQuery_Pagination(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := history.NewStore(rdb)
+
+	to := time.UnixMilli(5000)
+	rdb.EXPECT().XRangeN(mock.Anything, "device:history:desired", "(1000-1", "5000", int64(2)).Return(redis.NewXMessageSliceCmdResult([]redis.XMessage{
+		message("1001-0", 1001, `{"a":1}`),
+		message("1002-0", 1002, `{"b":1}`),
+	}, nil))
+	rdb.EXPECT().XRangeN(mock.Anything, "device:history:desired", "(1002-0", "5000", int64(2)).Return(redis.NewXMessageSliceCmdResult([]redis.XMessage{
+		message("1003-0", 1003, `{"a":2}`),
+		message("1004-0", 1004, `{"a":3}`),
+	}, nil))
+
+	page, err := store.Query(context.Background(), history.Query{
+		Device: "device", State: pb.StateKey_DESIRED, Path: "a", To: to, Limit: 2, Cursor: "1000-1",
+	})
+	require.NoError(t, err)
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, "1001-0", page.Entries[0].ID)
+	assert.Equal(t, "1003-0", page.Entries[1].ID)
+	assert.Equal(t, "1003-0", page.Next)
+}
+
+func TestQuery_ScanLimit(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	store := history.NewStore(rdb)
+
+	call := 0
+	rdb.EXPECT().XRangeN(mock.Anything, "device:history:reported", mock.Anything, "+", int64(1)).
+		RunAndReturn(func(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+			call++
+			return redis.NewXMessageSliceCmdResult([]redis.XMessage{message(strconv.Itoa(call)+"-0", 0, `{"other":1}`)}, nil)
+		})
+
+	page, err := store.Query(context.Background(), history.Query{Device: "device", Path: "a", Limit: 1})
+	require.NoError(t, err)
+	assert.Empty(t, page.Entries)
+	assert.Equal(t, strconv.Itoa(call)+"-0", page.Next, "query continues where the scan stopped")
+}
+
+func TestQuery_Invalid(t *testing.T) {
+	store := history.NewStore(redis_mocks.NewMockCmdable(t))
+
+	_, err := store.Query(context.Background(), history.Query{Device: "device", Cursor: "abc"})
+	assert.ErrorIs(t, err, history.ErrInvalidCursor)
+
+	_, err = store.Query(context.Background(), history.Query{Device: "device", Path: "a..b"})
+	assert.ErrorIs(t, err, history.ErrInvalidPath)
+}
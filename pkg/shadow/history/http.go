@@ -0,0 +1,104 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/proto/node/access"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+)
+
+// Handler - serves history of the devices in the token scope
+type Handler struct {
+	log   *zap.Logger
+	store *Store
+}
+
+func NewHandler(log *zap.Logger, store *Store) *Handler {
+	return &Handler{log: log.Named("History"), store: store}
+}
+
+// Register - serves history over HTTP, authenticate must put devices token scope into the context:
+//
+//	GET /devices/{uuid}/history?state=reported|desired&path={key.path}&from={RFC3339}&to={RFC3339}&limit={n}&cursor={next} -> Page
+func (h *Handler) Register(router *mux.Router, authenticate func(http.Handler) http.Handler) {
+	router.Handle("/devices/{uuid}/history", authenticate(http.HandlerFunc(h.get))).Methods(http.MethodGet)
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	device := mux.Vars(r)["uuid"]
+	scope, ok := r.Context().Value(inf.InfinimeshDevicesCtxKey).(map[string]access.Level)
+	if !ok {
+		http.Error(w, "token has no devices scope", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := scope[device]; !ok {
+		http.Error(w, "device is outside of token scope", http.StatusForbidden)
+		return
+	}
+
+	params := r.URL.Query()
+	q := Query{Device: device, State: pb.StateKey_REPORTED, Path: params.Get("path"), Cursor: params.Get("cursor")}
+	switch params.Get("state") {
+	case "", "reported":
+	case "desired":
+		q.State = pb.StateKey_DESIRED
+	default:
+		http.Error(w, "state must be reported or desired", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := params.Get(p.name); v != "" {
+			if *p.dst, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, p.name+" must be RFC3339 timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.store.Query(r.Context(), q)
+	if errors.Is(err, ErrInvalidCursor) || errors.Is(err, ErrInvalidPath) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.log.Warn("Failed to query history", zap.String("device", device), zap.Error(err))
+		http.Error(w, "failed to query history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
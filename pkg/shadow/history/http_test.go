@@ -0,0 +1,88 @@
+package history_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/shadow/history"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/proto/node/access"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newRouter(rdb redis.Cmdable, scope map[string]access.Level) *mux.Router {
+	router := mux.NewRouter()
+	history.NewHandler(zap.NewNop(), history.NewStore(rdb)).Register(router, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if scope != nil {
+				r = r.WithContext(context.WithValue(r.Context(), inf.InfinimeshDevicesCtxKey, scope))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	return router
+}
+
+func TestHandler_Get(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	router := newRouter(rdb, map[string]access.Level{"device": access.Level_READ})
+
+	rdb.EXPECT().XRangeN(mock.Anything, "device:history:desired", "1700000000000", "+", int64(5)).Return(redis.NewXMessageSliceCmdResult([]redis.XMessage{
+		message("1700000000000-0", 1700000000000, `{"mode":"eco"}`),
+	}, nil))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/devices/device/history?state=desired&path=mode&from=2023-11-14T22:13:20Z&limit=5", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var page struct {
+		Entries []struct {
+			ID        string `json:"id"`
+			Timestamp string `json:"timestamp"`
+			Value     any    `json:"value"`
+		} `json:"entries"`
+		Next string `json:"next"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Entries, 1)
+	assert.Equal(t, "eco", page.Entries[0].Value)
+	assert.Equal(t, "2023-11-14T22:13:20Z", page.Entries[0].Timestamp)
+	assert.Empty(t, page.Next)
+}
+
+func TestHandler_Scope(t *testing.T) {
+	router := newRouter(redis_mocks.NewMockCmdable(t), map[string]access.Level{"other": access.Level_READ})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/devices/device/history", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	router = newRouter(redis_mocks.NewMockCmdable(t), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/devices/device/history", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestHandler_BadRequest(t *testing.T) {
+	router := newRouter(redis_mocks.NewMockCmdable(t), map[string]access.Level{"device": access.Level_READ})
+	for _, query := range []string{
+		"state=connection",
+		"from=yesterday",
+		"to=1700000000",
+		"limit=-1",
+		"cursor=next",
+		"path=.a",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/devices/device/history?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
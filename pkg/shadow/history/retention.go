@@ -0,0 +1,120 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package history
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ConfigKey - key of Namespace and Device config holding the retention:
+//
+//	"state_history": {
+//	  "retention":   "720h",  // how long patches are kept
+//	  "max_entries": 10000    // how many patches of each state are kept
+//	}
+//
+// Device config overrides Namespace config key by key, unset keys fall back to the service defaults
+const ConfigKey = "state_history"
+
+// Retention - limits of the device stream, zero means no limit
+type Retention struct {
+	MaxAge     time.Duration
+	MaxEntries int64
+}
+
+// ParseRetention - applies the configs over defaults, later configs override earlier ones.
+// Limits must be positive, so configs can't lift them
+func ParseRetention(def Retention, configs ...*structpb.Struct) (Retention, error) {
+	res := def
+	for _, config := range configs {
+		fields := config.GetFields()[ConfigKey].GetStructValue().GetFields()
+		if v, ok := fields["retention"]; ok {
+			d, err := time.ParseDuration(v.GetStringValue())
+			if err != nil || d <= 0 {
+				return def, fmt.Errorf("invalid retention %q", v.GetStringValue())
+			}
+			res.MaxAge = d
+		}
+		if v, ok := fields["max_entries"]; ok {
+			n := v.GetNumberValue()
+			if n < 1 {
+				return def, fmt.Errorf("invalid max_entries %v", n)
+			}
+			res.MaxEntries = int64(n)
+		}
+	}
+	return res, nil
+}
+
+// LoadFunc - fetches configs of the device in the order they override each other, i.e. Namespace config, then Device config
+type LoadFunc func(ctx context.Context, device string) ([]*structpb.Struct, error)
+
+type cached struct {
+	retention Retention
+	err       error
+	expires   time.Time
+}
+
+// Retentions - keeps retentions of the devices for a limited time
+type Retentions struct {
+	ttl  time.Duration
+	def  Retention
+	load LoadFunc
+
+	mu      sync.Mutex
+	entries map[string]cached
+}
+
+func NewRetentions(ttl time.Duration, def Retention, load LoadFunc) *Retentions {
+	return &Retentions{
+		ttl: ttl, def: def, load: load,
+		entries: make(map[string]cached),
+	}
+}
+
+// Get - retention of the device, defaults along with the error if configs can't be loaded or are invalid
+func (c *Retentions) Get(ctx context.Context, device string) (Retention, error) {
+	c.mu.Lock()
+	e, ok := c.entries[device]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.retention, e.err
+	}
+
+	configs, err := c.load(ctx, device)
+	if err != nil {
+		return c.def, err
+	}
+	r, err := ParseRetention(c.def, configs...)
+
+	c.mu.Lock()
+	c.entries[device] = cached{retention: r, err: err, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return r, err
+}
+
+// Invalidate - drops retention of the device, so next Get loads it again
+func (c *Retentions) Invalidate(device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, device)
+}
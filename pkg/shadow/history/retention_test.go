@@ -0,0 +1,72 @@
+package history_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/shadow/history"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func config(t *testing.T, v map[string]any) *structpb.Struct {
+	s, err := structpb.NewStruct(map[string]any{history.ConfigKey: v})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestParseRetention(t *testing.T) {
+	def := history.Retention{MaxAge: time.Hour, MaxEntries: 100}
+
+	r, err := history.ParseRetention(def, nil, &structpb.Struct{})
+	assert.NoError(t, err)
+	assert.Equal(t, def, r)
+
+	r, err = history.ParseRetention(def,
+		config(t, map[string]any{"retention": "24h", "max_entries": 10}),
+		config(t, map[string]any{"max_entries": 5}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, history.Retention{MaxAge: 24 * time.Hour, MaxEntries: 5}, r, "device config overrides namespace config")
+
+	for _, v := range []map[string]any{
+		{"retention": "forever"},
+		{"retention": "0s"},
+		{"max_entries": 0},
+	} {
+		r, err = history.ParseRetention(def, config(t, v))
+		assert.Error(t, err, v)
+		assert.Equal(t, def, r)
+	}
+}
+
+func TestRetentions(t *testing.T) {
+	loads := 0
+	retentions := history.NewRetentions(time.Hour, history.Retention{MaxEntries: 100}, func(ctx context.Context, device string) ([]*structpb.Struct, error) {
+		loads++
+		return []*structpb.Struct{config(t, map[string]any{"max_entries": 10})}, nil
+	})
+
+	r, err := retentions.Get(context.Background(), "device")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), r.MaxEntries)
+
+	_, _ = retentions.Get(context.Background(), "device")
+	assert.Equal(t, 1, loads)
+
+	retentions.Invalidate("device")
+	_, _ = retentions.Get(context.Background(), "device")
+	assert.Equal(t, 2, loads)
+}
+
+func TestRetentions_LoadError(t *testing.T) {
+	def := history.Retention{MaxEntries: 100}
+	retentions := history.NewRetentions(time.Hour, def, func(ctx context.Context, device string) ([]*structpb.Struct, error) {
+		return nil, assert.AnError
+	})
+
+	r, err := retentions.Get(context.Background(), "device")
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, def, r)
+}
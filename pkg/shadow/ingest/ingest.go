@@ -0,0 +1,520 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ingest lets devices which can't keep an MQTT connection (e.g. battery powered ones waking up once in a while)
+// report their state and poll Desired state with plain HTTP requests.
+// Reported state goes through the same mqtt.incoming queue MQTT Bridge publishes to, so it's handled the same way
+package ingest
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/revocation"
+	"github.com/infinimesh/infinimesh/pkg/rotation"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/infinimesh/pkg/shared/auth"
+	"github.com/infinimesh/proto/node/access"
+	devpb "github.com/infinimesh/proto/node/devices"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ClientID - Connection state client ID of devices reporting over HTTP
+const ClientID = "http"
+
+// DefaultMaxBodySize - Reported state payloads larger than this are refused with 413
+const DefaultMaxBodySize = 64 * 1024
+
+// PublishFunc - publishes the Shadow to mqtt.incoming
+type PublishFunc func(ctx context.Context, shadow *pb.Shadow) error
+
+// DeltaFunc - loads difference between Desired and Reported state of the device, nil if there's none
+type DeltaFunc func(ctx context.Context, device string) (*pb.State, error)
+
+// FingerprintFunc - finds the device by SHA-256 fingerprint of its certificate, as registry's GetByFingerprint does.
+// Device must come with its Access, Namespace is the one certificate revocations are checked in
+type FingerprintFunc func(ctx context.Context, fingerprint []byte) (*devpb.Device, error)
+
+// ConnectedFunc - tells the registry the device has connected with the certificate, so a pending one becomes primary
+type ConnectedFunc func(ctx context.Context, device string, fingerprint []byte) error
+
+type Handler struct {
+	log *zap.Logger
+
+	shadow  pb.ShadowServiceClient
+	publish PublishFunc
+
+	auth       auth.AuthInterceptor
+	signingKey []byte
+
+	fingerprints FingerprintFunc
+	revocations  *revocation.Store
+	trustedCAs   *deviceca.Store
+	connected    ConnectedFunc
+
+	presence *Presence
+	deltas   DeltaFunc
+
+	// ClientCertHeader - header TLS terminating proxy passes the client certificate in, either URL-escaped PEM or base64 DER.
+	// Empty means certificates are only taken from the TLS connection itself. Proxy must strip the header from incoming
+	// requests, otherwise anyone knowing a device certificate can pass it in
+	ClientCertHeader string
+	// TrustedProxies - ClientCertHeader is only taken from requests coming from these networks, none means it's never taken
+	TrustedProxies []netip.Prefix
+	MaxBodySize    int64
+}
+
+func NewHandler(log *zap.Logger, shadow pb.ShadowServiceClient, publish PublishFunc) *Handler {
+	return &Handler{
+		log:    log.Named("Ingest"),
+		shadow: shadow, publish: publish,
+		MaxBodySize: DefaultMaxBodySize,
+	}
+}
+
+// SetDeviceAuth - enables authentication with device tokens, e.g. ones returned by GetByToken or MakeDevicesToken
+func (h *Handler) SetDeviceAuth(i auth.AuthInterceptor, signingKey []byte) {
+	h.auth = i
+	h.signingKey = signingKey
+}
+
+// SetFingerprints - enables authentication with client certificates.
+// Certificate chains are checked against revocations of the device Namespace unless they're nil
+func (h *Handler) SetFingerprints(lookup FingerprintFunc, revocations *revocation.Store) {
+	h.fingerprints = lookup
+	h.revocations = revocations
+}
+
+// SetTrustedCAs - enables verifying certificate chains against CAs trusted by the device Namespace if it enforces them,
+// as MQTT Bridge does
+func (h *Handler) SetTrustedCAs(store *deviceca.Store) {
+	h.trustedCAs = store
+}
+
+// SetConnected - enables rotating to pending certificates devices authenticate with
+func (h *Handler) SetConnected(connected ConnectedFunc) {
+	h.connected = connected
+}
+
+// SetPresence - enables Connection state updates, devices are reported disconnected once they go quiet for the Presence TTL
+func (h *Handler) SetPresence(p *Presence) {
+	h.presence = p
+}
+
+// SetDeltas - enables polling difference between Desired and Reported state
+func (h *Handler) SetDeltas(load DeltaFunc) {
+	h.deltas = load
+}
+
+// Register - serves ingest endpoints over HTTP, requests are authenticated with device token or client certificate:
+//
+//	POST /devices/{uuid}/state                  payload -> 202, publishes payload as Reported state
+//	GET  /devices/{uuid}/desired?since={time}   -> {"timestamp", "data"} or 304 if Desired state isn't newer than since (RFC 3339)
+//	GET  /devices/{uuid}/desired/delta?since={time} -> same for the difference between Desired and Reported state, 404 unless enabled
+//
+// Payload format is negotiated with Content-Type and Accept headers, JSON is used by default
+func (h *Handler) Register(router *mux.Router) {
+	router.HandleFunc("/devices/{uuid}/state", h.reported).Methods(http.MethodPost)
+	router.HandleFunc("/devices/{uuid}/desired", h.desired).Methods(http.MethodGet)
+	router.HandleFunc("/devices/{uuid}/desired/delta", h.delta).Methods(http.MethodGet)
+}
+
+func (h *Handler) reported(w http.ResponseWriter, r *http.Request) {
+	device := mux.Vars(r)["uuid"]
+	log := h.log.Named("Reported").With(zap.String("device", device))
+
+	ctx, err := h.authenticate(r, device)
+	if err != nil {
+		log.Debug("Authentication failed", zap.Error(err))
+		writeError(w, err)
+		return
+	}
+
+	c, err := requestCodec(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Payload is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Couldn't read payload", http.StatusBadRequest)
+		return
+	}
+
+	data, err := codec.DecodeStruct(c, payload)
+	if err != nil {
+		log.Debug("Failed to decode Reported state", zap.String("format", c.Name()), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shadow := &pb.Shadow{
+		Device: device,
+		Reported: &pb.State{
+			Timestamp: timestamppb.Now(),
+			Data:      data,
+		},
+	}
+	if h.presence != nil {
+		shadow.Connection = &pb.ConnectionState{
+			Connected: true,
+			Timestamp: timestamppb.Now(),
+			ClientId:  ClientID,
+		}
+	}
+	if err := h.publish(ctx, shadow); err != nil {
+		log.Warn("Failed to publish Reported state", zap.Error(err))
+		http.Error(w, "Couldn't publish Reported state", http.StatusServiceUnavailable)
+		return
+	}
+	if h.presence != nil {
+		h.presence.Touch(ctx, device)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) desired(w http.ResponseWriter, r *http.Request) {
+	h.state(w, r, "Desired", "Desired state", func(ctx context.Context, device string) (*pb.State, error) {
+		res, err := h.shadow.Get(ctx, &pb.GetRequest{Pool: []string{device}})
+		if err != nil {
+			return nil, err
+		}
+		if shadows := res.GetShadows(); len(shadows) > 0 {
+			return shadows[0].GetDesired(), nil
+		}
+		return nil, nil
+	})
+}
+
+func (h *Handler) delta(w http.ResponseWriter, r *http.Request) {
+	if h.deltas == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.state(w, r, "Delta", "delta", h.deltas)
+}
+
+// state - serves the state loaded for the device, logger is named after the endpoint and errors mention the state name
+func (h *Handler) state(w http.ResponseWriter, r *http.Request, logger, name string, load func(ctx context.Context, device string) (*pb.State, error)) {
+	device := mux.Vars(r)["uuid"]
+	log := h.log.Named(logger).With(zap.String("device", device))
+
+	ctx, err := h.authenticate(r, device)
+	if err != nil {
+		log.Debug("Authentication failed", zap.Error(err))
+		writeError(w, err)
+		return
+	}
+
+	var since time.Time
+	if q := r.URL.Query().Get("since"); q != "" {
+		if since, err = time.Parse(time.RFC3339Nano, q); err != nil {
+			http.Error(w, "since must be RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, err := responseCodec(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	state, err := load(ctx, device)
+	if err != nil {
+		log.Warn("Failed to get "+name, zap.Error(err))
+		http.Error(w, "Couldn't get "+name, http.StatusServiceUnavailable)
+		return
+	}
+
+	ts := state.GetTimestamp()
+	if !since.IsZero() && (ts == nil || !ts.AsTime().After(since)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data := state.GetData()
+	if data == nil {
+		data = &structpb.Struct{}
+	}
+	body := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"data": structpb.NewStructValue(data),
+	}}
+	if ts != nil {
+		body.Fields["timestamp"] = structpb.NewStringValue(ts.AsTime().Format(time.RFC3339Nano))
+	}
+
+	payload, err := c.Encode(structpb.NewStructValue(body))
+	if err != nil {
+		log.Warn("Failed to encode "+name, zap.String("format", c.Name()), zap.Error(err))
+		http.Error(w, "Couldn't encode "+name, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", c.ContentType())
+	_, _ = w.Write(payload)
+}
+
+// authenticate - checks the request is made by the device itself, with a token having it in scope or with its certificate.
+// Returned context carries devices scope of the token if there's one
+func (h *Handler) authenticate(r *http.Request, device string) (context.Context, error) {
+	ctx := r.Context()
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		if h.auth == nil {
+			return nil, status.Error(codes.Unauthenticated, "token authentication is disabled")
+		}
+		segments := strings.Split(header, " ")
+		if len(segments) != 2 {
+			return nil, status.Error(codes.Unauthenticated, "invalid Authorization header")
+		}
+		ctx, _, err := h.auth.ConnectDeviceAuthMiddleware(ctx, h.signingKey, segments[1])
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		scope, ok := ctx.Value(inf.InfinimeshDevicesCtxKey).(map[string]access.Level)
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "token has no devices scope")
+		}
+		if _, ok := scope[device]; !ok {
+			return nil, status.Error(codes.PermissionDenied, "device is outside of token scope")
+		}
+		return ctx, nil
+	}
+
+	chain, err := h.clientCertificates(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "neither token nor client certificate given")
+	}
+	if h.fingerprints == nil {
+		return nil, status.Error(codes.Unauthenticated, "certificate authentication is disabled")
+	}
+
+	fingerprint := sha256.Sum256(chain[0].Raw)
+	dev, err := h.fingerprints(ctx, fingerprint[:])
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, status.Error(codes.Unauthenticated, "unknown certificate")
+		}
+		h.log.Warn("Can't find device by fingerprint", zap.Error(err))
+		return nil, status.Error(codes.Unavailable, "can't find device by certificate")
+	}
+	if dev.GetUuid() != device {
+		return nil, status.Error(codes.PermissionDenied, "certificate belongs to another device")
+	}
+	if !dev.GetEnabled() {
+		return nil, status.Error(codes.PermissionDenied, "device is not enabled")
+	}
+
+	if h.revocations != nil {
+		rev, err := h.revocations.Check(ctx, dev.GetAccess().GetNamespace(), chain)
+		if err != nil {
+			h.log.Warn("Can't check certificate revocations", zap.Error(err))
+			return nil, status.Error(codes.Unavailable, "can't check certificate revocations")
+		}
+		if rev != nil {
+			return nil, status.Error(codes.PermissionDenied, revocation.ErrRevoked.Error())
+		}
+	}
+	if err := h.verifyEnforced(ctx, dev, chain); err != nil {
+		return nil, err
+	}
+
+	if h.connected != nil && rotation.Rotates(dev.GetCertificate().GetFingerprint(), fingerprint[:]) {
+		if err := h.connected(ctx, device, fingerprint[:]); err != nil {
+			h.log.Warn("Can't tell the registry which certificate the device connected with", zap.String("device", device), zap.Error(err))
+		}
+	}
+	return ctx, nil
+}
+
+// verifyEnforced - checks the chain against CAs trusted by the device Namespace if it enforces them
+func (h *Handler) verifyEnforced(ctx context.Context, dev *devpb.Device, chain []*x509.Certificate) error {
+	ns := dev.GetAccess().GetNamespace()
+	if h.trustedCAs == nil || ns == "" {
+		return nil
+	}
+	config, err := h.trustedCAs.Get(ctx, ns)
+	if err != nil {
+		h.log.Warn("Can't retrieve trusted CAs of the Namespace", zap.String("namespace", ns), zap.Error(err))
+		return status.Error(codes.Unavailable, "can't retrieve trusted CAs")
+	}
+	if config == nil || !config.Enforce {
+		return nil
+	}
+	if _, err := config.Issuer(chain); err != nil {
+		h.log.Debug("Device certificate is not trusted by its Namespace", zap.String("device", dev.GetUuid()), zap.Error(err))
+		return status.Error(codes.PermissionDenied, "certificate is not trusted by the device Namespace")
+	}
+	return nil
+}
+
+// clientCertificates - certificate chain of the TLS connection, or one passed by a trusted proxy if ClientCertHeader is set
+func (h *Handler) clientCertificates(r *http.Request) ([]*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates, nil
+	}
+	if h.ClientCertHeader == "" {
+		return nil, nil
+	}
+	value := r.Header.Get(h.ClientCertHeader)
+	if value == "" {
+		return nil, nil
+	}
+	if !h.fromTrustedProxy(r) {
+		return nil, status.Error(codes.Unauthenticated, "client certificate header is only accepted from trusted proxies")
+	}
+
+	cert, err := parseCertificateHeader(value)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid client certificate: %v", err)
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+// fromTrustedProxy - tells whether the request comes from one of TrustedProxies
+func (h *Handler) fromTrustedProxy(r *http.Request) bool {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := addr.Addr().Unmap()
+	for _, p := range h.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProxies - parses comma separated networks in CIDR notation, single addresses are taken as is
+func ParseProxies(s string) (res []netip.Prefix, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p.Masked())
+	}
+	return res, nil
+}
+
+// parseCertificateHeader - parses URL-escaped PEM (e.g. nginx $ssl_client_escaped_cert) or base64 DER (e.g. Traefik)
+func parseCertificateHeader(value string) (*x509.Certificate, error) {
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		if block, _ := pem.Decode([]byte(unescaped)); block != nil {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+	der, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("neither PEM nor base64 DER")
+	}
+	return x509.ParseCertificate(der)
+}
+
+// requestCodec - codec of the Content-Type, JSON if it's not set
+func requestCodec(r *http.Request) (codec.Codec, error) {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return codec.JSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return nil, errors.New("invalid Content-Type")
+	}
+	c := codec.ByContentType(mediaType)
+	if c == nil {
+		return nil, fmt.Errorf("unsupported Content-Type %s", mediaType)
+	}
+	return c, nil
+}
+
+// responseCodec - first codec matching Accept header, JSON if any type is accepted. Quality values aren't taken into account
+func responseCodec(r *http.Request) (codec.Codec, error) {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return codec.JSON, nil
+	}
+	for _, part := range strings.Split(header, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return codec.JSON, nil
+		}
+		if c := codec.ByContentType(mediaType); c != nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("none of accepted types is supported")
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	code := http.StatusInternalServerError
+	switch s.Code() {
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.Unavailable:
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, s.Message(), code)
+}
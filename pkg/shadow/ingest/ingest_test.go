@@ -0,0 +1,515 @@
+package ingest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	shadow_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/proto/shadow"
+	"github.com/infinimesh/infinimesh/pkg/deviceca"
+	"github.com/infinimesh/infinimesh/pkg/mqtt/codec"
+	"github.com/infinimesh/infinimesh/pkg/shadow/ingest"
+	inf "github.com/infinimesh/infinimesh/pkg/shared"
+	"github.com/infinimesh/infinimesh/pkg/shared/auth"
+	"github.com/infinimesh/proto/node/access"
+	devpb "github.com/infinimesh/proto/node/devices"
+	nspb "github.com/infinimesh/proto/node/namespaces"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var signingKey = []byte("test")
+
+type ingestFixture struct {
+	handler *ingest.Handler
+	router  *mux.Router
+
+	mocks struct {
+		shadow    *shadow_mocks.MockShadowServiceClient
+		published []*pb.Shadow
+		devices   map[string]*devpb.Device
+	}
+	data struct {
+		uuid  string
+		token string
+		cert  *x509.Certificate
+	}
+}
+
+func newIngestFixture(t *testing.T) *ingestFixture {
+	f := &ingestFixture{}
+	f.mocks.shadow = shadow_mocks.NewMockShadowServiceClient(t)
+	f.mocks.devices = make(map[string]*devpb.Device)
+
+	f.data.uuid = uuid.New().String()
+	f.data.token = deviceToken(t, f.data.uuid)
+	f.data.cert = selfSigned(t)
+	fingerprint := sha256.Sum256(f.data.cert.Raw)
+	f.mocks.devices[string(fingerprint[:])] = &devpb.Device{Uuid: f.data.uuid, Enabled: true}
+
+	f.handler = ingest.NewHandler(zap.NewNop(), f.mocks.shadow, func(ctx context.Context, shadow *pb.Shadow) error {
+		f.mocks.published = append(f.mocks.published, shadow)
+		return nil
+	})
+	f.handler.SetDeviceAuth(auth.NewAuthInterceptor(zap.NewNop(), nil, nil, signingKey), signingKey)
+	f.handler.SetFingerprints(func(ctx context.Context, fingerprint []byte) (*devpb.Device, error) {
+		dev, ok := f.mocks.devices[string(fingerprint)]
+		if !ok {
+			return nil, status.Error(codes.NotFound, "Device not found")
+		}
+		return dev, nil
+	}, nil)
+	f.handler.ClientCertHeader = "X-Client-Cert"
+	f.handler.TrustedProxies, _ = ingest.ParseProxies("192.0.2.0/24") // httptest.NewRequest remote address
+
+	f.router = mux.NewRouter()
+	f.handler.Register(f.router)
+	return f
+}
+
+func (f *ingestFixture) do(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, r)
+	return w
+}
+
+func deviceToken(t *testing.T, devices ...string) string {
+	scope := make(map[string]access.Level, len(devices))
+	for _, d := range devices {
+		scope[d] = access.Level_NONE
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		inf.INFINIMESH_DEVICES_CLAIM: scope,
+	}).SignedString(signingKey)
+	require.NoError(t, err)
+	return token
+}
+
+func selfSigned(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func postState(device, token string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/devices/"+device+"/state", bytes.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestReported_Token(t *testing.T) {
+	f := newIngestFixture(t)
+
+	w := f.do(postState(f.data.uuid, f.data.token, []byte(`{"temperature":21.5}`)))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	require.Len(t, f.mocks.published, 1)
+	shadow := f.mocks.published[0]
+	assert.Equal(t, f.data.uuid, shadow.Device)
+	assert.Equal(t, 21.5, shadow.Reported.Data.Fields["temperature"].GetNumberValue())
+	assert.Nil(t, shadow.Connection, "Connection state is only reported with presence enabled")
+}
+
+func TestReported_FailsOn_NoCredentials(t *testing.T) {
+	f := newIngestFixture(t)
+
+	w := f.do(postState(f.data.uuid, "", []byte(`{}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, f.mocks.published)
+}
+
+func TestReported_FailsOn_InvalidToken(t *testing.T) {
+	f := newIngestFixture(t)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		inf.INFINIMESH_DEVICES_CLAIM: map[string]int{f.data.uuid: 0},
+	}).SignedString([]byte("other"))
+	require.NoError(t, err)
+
+	w := f.do(postState(f.data.uuid, token, []byte(`{}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestReported_FailsOn_OutOfScope(t *testing.T) {
+	f := newIngestFixture(t)
+
+	w := f.do(postState(uuid.New().String(), f.data.token, []byte(`{}`)))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, f.mocks.published)
+}
+
+func TestReported_ContentType(t *testing.T) {
+	f := newIngestFixture(t)
+
+	payload, err := codec.CBOR.Encode(structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+		"on": structpb.NewBoolValue(true),
+	}}))
+	require.NoError(t, err)
+
+	r := postState(f.data.uuid, f.data.token, payload)
+	r.Header.Set("Content-Type", codec.CBOR.ContentType())
+	w := f.do(r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	require.Len(t, f.mocks.published, 1)
+	assert.True(t, f.mocks.published[0].Reported.Data.Fields["on"].GetBoolValue())
+
+	r = postState(f.data.uuid, f.data.token, payload)
+	r.Header.Set("Content-Type", "application/xml")
+	w = f.do(r)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestReported_FailsOn_BadPayload(t *testing.T) {
+	f := newIngestFixture(t)
+
+	w := f.do(postState(f.data.uuid, f.data.token, []byte(`[1, 2]`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	f.handler.MaxBodySize = 4
+	w = f.do(postState(f.data.uuid, f.data.token, []byte(`{"a":1}`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(t, f.mocks.published)
+}
+
+func TestReported_FailsOn_Publish(t *testing.T) {
+	f := newIngestFixture(t)
+	f.handler = ingest.NewHandler(zap.NewNop(), f.mocks.shadow, func(ctx context.Context, shadow *pb.Shadow) error {
+		return errors.New("channel closed")
+	})
+	f.handler.SetDeviceAuth(auth.NewAuthInterceptor(zap.NewNop(), nil, nil, signingKey), signingKey)
+	f.router = mux.NewRouter()
+	f.handler.Register(f.router)
+
+	w := f.do(postState(f.data.uuid, f.data.token, []byte(`{}`)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestReported_Certificate(t *testing.T) {
+	f := newIngestFixture(t)
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	w := f.do(r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, f.mocks.published, 1)
+}
+
+func TestReported_Certificate_Connected(t *testing.T) {
+	f := newIngestFixture(t)
+	var connected [][]byte
+	f.handler.SetConnected(func(ctx context.Context, device string, fingerprint []byte) error {
+		assert.Equal(t, f.data.uuid, device)
+		connected = append(connected, fingerprint)
+		return nil
+	})
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	assert.Equal(t, http.StatusAccepted, f.do(r).Code)
+	require.Len(t, connected, 1)
+
+	// Primary certificate doesn't rotate anything
+	for _, dev := range f.mocks.devices {
+		dev.Certificate = &devpb.Certificate{Fingerprint: connected[0]}
+	}
+	r = postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	assert.Equal(t, http.StatusAccepted, f.do(r).Code)
+	assert.Len(t, connected, 1)
+}
+
+func TestReported_Certificate_FailsOn_OtherDevice(t *testing.T) {
+	f := newIngestFixture(t)
+
+	r := postState(uuid.New().String(), "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	w := f.do(r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, f.mocks.published)
+}
+
+func TestReported_Certificate_FailsOn_Disabled(t *testing.T) {
+	f := newIngestFixture(t)
+	for _, dev := range f.mocks.devices {
+		dev.Enabled = false
+	}
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	w := f.do(r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestReported_Certificate_FailsOn_Unknown(t *testing.T) {
+	f := newIngestFixture(t)
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(selfSigned(t).Raw))
+	w := f.do(r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestReported_Certificate_FailsOn_HeaderDisabled(t *testing.T) {
+	f := newIngestFixture(t)
+	f.handler.ClientCertHeader = ""
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	w := f.do(r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestReported_Certificate_FailsOn_UntrustedProxy(t *testing.T) {
+	f := newIngestFixture(t)
+	f.handler.TrustedProxies, _ = ingest.ParseProxies("10.0.0.0/8, 2001:db8::1")
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	w := f.do(r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, f.mocks.published)
+}
+
+// trustCA - makes the device Namespace trust a CA which didn't sign the device certificate
+func (f *ingestFixture) trustCA(t *testing.T, enforce bool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	config, _, err := deviceca.Trust(nil, ca)
+	require.NoError(t, err)
+	config.Fields[deviceca.ConfigKey].GetStructValue().Fields["enforce"] = structpb.NewBoolValue(enforce)
+
+	ns := uuid.New().String()
+	for _, dev := range f.mocks.devices {
+		dev.Access = &access.Access{Namespace: &ns}
+	}
+	f.handler.SetTrustedCAs(deviceca.NewStore(time.Minute, func(ctx context.Context) ([]*nspb.Namespace, error) {
+		return []*nspb.Namespace{{Uuid: ns, Config: config}}, nil
+	}))
+}
+
+func TestReported_Certificate_NotEnforcedCA(t *testing.T) {
+	f := newIngestFixture(t)
+	f.trustCA(t, false)
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	assert.Equal(t, http.StatusAccepted, f.do(r).Code)
+}
+
+func TestReported_Certificate_FailsOn_EnforcedCA(t *testing.T) {
+	f := newIngestFixture(t)
+	f.trustCA(t, true)
+
+	r := postState(f.data.uuid, "", []byte(`{}`))
+	r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(f.data.cert.Raw))
+	assert.Equal(t, http.StatusForbidden, f.do(r).Code)
+	assert.Empty(t, f.mocks.published)
+}
+
+func TestParseProxies(t *testing.T) {
+	proxies, err := ingest.ParseProxies("10.1.2.3/8, 2001:db8::1,")
+	require.NoError(t, err)
+	require.Len(t, proxies, 2)
+	assert.Equal(t, "10.0.0.0/8", proxies[0].String())
+	assert.Equal(t, "2001:db8::1/128", proxies[1].String())
+
+	_, err = ingest.ParseProxies("not an address")
+	assert.Error(t, err)
+}
+
+func (f *ingestFixture) expectDesired(ts time.Time) {
+	desired := &pb.State{
+		Data: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"interval": structpb.NewNumberValue(60),
+		}},
+	}
+	if !ts.IsZero() {
+		desired.Timestamp = timestamppb.New(ts)
+	}
+	f.mocks.shadow.EXPECT().Get(mock.Anything, &pb.GetRequest{Pool: []string{f.data.uuid}}).Return(&pb.GetResponse{
+		Shadows: []*pb.Shadow{{Device: f.data.uuid, Desired: desired}},
+	}, nil)
+}
+
+func getDesired(device, token, query string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/devices/"+device+"/desired"+query, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestDesired(t *testing.T) {
+	f := newIngestFixture(t)
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	f.expectDesired(ts)
+
+	w := f.do(getDesired(f.data.uuid, f.data.token, ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var res struct {
+		Timestamp string         `json:"timestamp"`
+		Data      map[string]any `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, ts.Format(time.RFC3339Nano), res.Timestamp)
+	assert.Equal(t, 60.0, res.Data["interval"])
+}
+
+func TestDesired_Since(t *testing.T) {
+	f := newIngestFixture(t)
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	f.expectDesired(ts)
+
+	w := f.do(getDesired(f.data.uuid, f.data.token, "?since="+ts.Format(time.RFC3339)))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.Bytes())
+
+	w = f.do(getDesired(f.data.uuid, f.data.token, "?since="+ts.Add(-time.Second).Format(time.RFC3339)))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDesired_Since_NoDesiredState(t *testing.T) {
+	f := newIngestFixture(t)
+	f.expectDesired(time.Time{})
+
+	w := f.do(getDesired(f.data.uuid, f.data.token, "?since=2023-05-01T12:00:00Z"))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestDesired_FailsOn_BadSince(t *testing.T) {
+	f := newIngestFixture(t)
+
+	w := f.do(getDesired(f.data.uuid, f.data.token, "?since=yesterday"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDesired_Accept(t *testing.T) {
+	f := newIngestFixture(t)
+	f.expectDesired(time.Now())
+
+	r := getDesired(f.data.uuid, f.data.token, "")
+	r.Header.Set("Accept", "application/xml, "+codec.CBOR.ContentType())
+	w := f.do(r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, codec.CBOR.ContentType(), w.Header().Get("Content-Type"))
+
+	v, err := codec.CBOR.Decode(w.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, 60.0, v.GetStructValue().Fields["data"].GetStructValue().Fields["interval"].GetNumberValue())
+
+	r = getDesired(f.data.uuid, f.data.token, "")
+	r.Header.Set("Accept", "application/xml")
+	w = f.do(r)
+	assert.Equal(t, http.StatusNotAcceptable, w.Code)
+}
+
+func TestDesired_FailsOn_Shadow(t *testing.T) {
+	f := newIngestFixture(t)
+	f.mocks.shadow.EXPECT().Get(mock.Anything, mock.Anything).Return(nil, status.Error(codes.Unavailable, "down"))
+
+	w := f.do(getDesired(f.data.uuid, f.data.token, ""))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestDelta(t *testing.T) {
+	f := newIngestFixture(t)
+	ts := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	f.handler.SetDeltas(func(ctx context.Context, device string) (*pb.State, error) {
+		assert.Equal(t, f.data.uuid, device)
+		return &pb.State{
+			Timestamp: timestamppb.New(ts),
+			Data: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"interval": structpb.NewNumberValue(60),
+			}},
+		}, nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/devices/"+f.data.uuid+"/desired/delta", nil)
+	r.Header.Set("Authorization", "Bearer "+f.data.token)
+	w := f.do(r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var res struct {
+		Timestamp string         `json:"timestamp"`
+		Data      map[string]any `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, ts.Format(time.RFC3339Nano), res.Timestamp)
+	assert.Equal(t, 60.0, res.Data["interval"])
+
+	r = httptest.NewRequest(http.MethodGet, "/devices/"+f.data.uuid+"/desired/delta?since="+ts.Format(time.RFC3339), nil)
+	r.Header.Set("Authorization", "Bearer "+f.data.token)
+	w = f.do(r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestDelta_NoDelta(t *testing.T) {
+	f := newIngestFixture(t)
+	f.handler.SetDeltas(func(ctx context.Context, device string) (*pb.State, error) {
+		return nil, nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/devices/"+f.data.uuid+"/desired/delta", nil)
+	r.Header.Set("Authorization", "Bearer "+f.data.token)
+	w := f.do(r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":{}}`, w.Body.String())
+}
+
+func TestDelta_Disabled(t *testing.T) {
+	f := newIngestFixture(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/devices/"+f.data.uuid+"/desired/delta", nil)
+	r.Header.Set("Authorization", "Bearer "+f.data.token)
+	w := f.do(r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ingest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	pb "github.com/infinimesh/proto/shadow"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// PresenceKey - Redis key holding ID of the instance the device last reported to
+func PresenceKey(device string) string {
+	return "ingest:presence:" + device
+}
+
+// Presence - reports devices disconnected once they haven't reported for TTL.
+// With Redis, only the instance the device reported to last reports it disconnected, so replicas don't race each other
+type Presence struct {
+	log     *zap.Logger
+	rdb     redis.Cmdable
+	publish PublishFunc
+
+	TTL time.Duration
+	id  string
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// NewPresence - rdb might be nil if there is a single instance
+func NewPresence(log *zap.Logger, rdb redis.Cmdable, publish PublishFunc, ttl time.Duration) *Presence {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	return &Presence{
+		log: log.Named("Presence"), rdb: rdb, publish: publish,
+		TTL: ttl, id: hex.EncodeToString(id),
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// Touch - postpones reporting the device disconnected for another TTL
+func (p *Presence) Touch(ctx context.Context, device string) {
+	if p.rdb != nil {
+		// Key outlives the timer, so it's still there when the timer fires
+		if err := p.rdb.Set(ctx, PresenceKey(device), p.id, 2*p.TTL).Err(); err != nil {
+			p.log.Warn("Failed to store presence", zap.String("device", device), zap.Error(err))
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.timers[device]; ok {
+		t.Stop()
+	}
+	p.timers[device] = time.AfterFunc(p.TTL, func() {
+		p.expire(device)
+	})
+}
+
+// expire - reports the device disconnected unless it has reported to another instance since
+func (p *Presence) expire(device string) {
+	p.mu.Lock()
+	delete(p.timers, device)
+	p.mu.Unlock()
+
+	ctx := context.Background()
+	if p.rdb != nil {
+		owner, err := p.rdb.Get(ctx, PresenceKey(device)).Result()
+		switch {
+		case err == redis.Nil:
+		case err != nil:
+			p.log.Warn("Failed to get presence", zap.String("device", device), zap.Error(err))
+		case owner != p.id:
+			p.log.Debug("Device reported to another instance", zap.String("device", device))
+			return
+		default:
+			_ = p.rdb.Del(ctx, PresenceKey(device)).Err()
+		}
+	}
+
+	p.disconnected(ctx, device)
+}
+
+func (p *Presence) disconnected(ctx context.Context, device string) {
+	err := p.publish(ctx, &pb.Shadow{
+		Device: device,
+		Connection: &pb.ConnectionState{
+			Connected: false,
+			Timestamp: timestamppb.Now(),
+			ClientId:  ClientID,
+		},
+	})
+	if err != nil {
+		p.log.Warn("Failed to report device disconnected", zap.String("device", device), zap.Error(err))
+	}
+}
+
+// Close - stops timers and reports all devices which are still present disconnected, same as bridges do on shutdown
+func (p *Presence) Close(ctx context.Context) {
+	p.mu.Lock()
+	devices := make([]string, 0, len(p.timers))
+	for device, t := range p.timers {
+		if t.Stop() {
+			devices = append(devices, device)
+		}
+	}
+	p.timers = make(map[string]*time.Timer)
+	p.mu.Unlock()
+
+	for _, device := range devices {
+		p.disconnected(ctx, device)
+	}
+}
@@ -0,0 +1,103 @@
+package ingest_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	redis_mocks "github.com/infinimesh/infinimesh/mocks/github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/shadow/ingest"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+)
+
+type presenceFixture struct {
+	presence *ingest.Presence
+
+	mu        sync.Mutex
+	published []*pb.Shadow
+}
+
+func newPresenceFixture(rdb redis.Cmdable, ttl time.Duration) *presenceFixture {
+	f := &presenceFixture{}
+	f.presence = ingest.NewPresence(zap.NewNop(), rdb, func(ctx context.Context, shadow *pb.Shadow) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.published = append(f.published, shadow)
+		return nil
+	}, ttl)
+	return f
+}
+
+func (f *presenceFixture) disconnected() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res []string
+	for _, s := range f.published {
+		if !s.GetConnection().GetConnected() {
+			res = append(res, s.Device)
+		}
+	}
+	return res
+}
+
+func TestPresence_Expires(t *testing.T) {
+	f := newPresenceFixture(nil, 20*time.Millisecond)
+
+	f.presence.Touch(context.Background(), "device")
+	assert.Empty(t, f.disconnected())
+
+	assert.Eventually(t, func() bool {
+		return len(f.disconnected()) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"device"}, f.disconnected())
+	assert.Equal(t, ingest.ClientID, f.published[0].Connection.ClientId)
+}
+
+func TestPresence_TouchPostpones(t *testing.T) {
+	f := newPresenceFixture(nil, 50*time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		f.presence.Touch(context.Background(), "device")
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Empty(t, f.disconnected())
+
+	assert.Eventually(t, func() bool {
+		return len(f.disconnected()) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPresence_OtherInstance(t *testing.T) {
+	rdb := redis_mocks.NewMockCmdable(t)
+	f := newPresenceFixture(rdb, 10*time.Millisecond)
+
+	rdb.EXPECT().Set(mock.Anything, ingest.PresenceKey("device"), mock.Anything, 20*time.Millisecond).
+		Return(redis.NewStatusResult("OK", nil))
+	fired := make(chan struct{})
+	rdb.EXPECT().Get(mock.Anything, ingest.PresenceKey("device")).
+		RunAndReturn(func(ctx context.Context, key string) *redis.StringCmd {
+			defer close(fired)
+			return redis.NewStringResult("another", nil)
+		})
+
+	f.presence.Touch(context.Background(), "device")
+	<-fired
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, f.disconnected(), "device is reported disconnected by the instance it reported to last")
+}
+
+func TestPresence_Close(t *testing.T) {
+	f := newPresenceFixture(nil, time.Hour)
+
+	f.presence.Touch(context.Background(), "a")
+	f.presence.Touch(context.Background(), "b")
+	f.presence.Close(context.Background())
+
+	assert.ElementsMatch(t, []string{"a", "b"}, f.disconnected())
+}
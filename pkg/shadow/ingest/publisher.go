@@ -0,0 +1,67 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ingest
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/infinimesh/proto/shadow"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Publisher - publishes Shadows to the RabbitMQ Queue directly, without consuming anything.
+// Unlike mqtt/pubsub Setup, it doesn't steal messages of known Queues from bridges
+type Publisher struct {
+	queue string
+
+	mu      sync.Mutex
+	channel *amqp.Channel
+}
+
+func NewPublisher(conn *amqp.Connection, queue string) (*Publisher, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = ch.QueueDeclare(queue, true, false, false, true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Publisher{queue: queue, channel: ch}, nil
+}
+
+// Publish - PublishFunc publishing to the Queue
+func (p *Publisher) Publish(ctx context.Context, shadow *pb.Shadow) error {
+	body, err := proto.Marshal(shadow)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.channel.PublishWithContext(ctx, "", p.queue, false, false, amqp.Publishing{
+		ContentType: "text/plain", Body: body,
+	})
+}
+
+func (p *Publisher) Close() error {
+	return p.channel.Close()
+}
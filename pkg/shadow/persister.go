@@ -22,6 +22,7 @@ import (
 	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/infinimesh/infinimesh/pkg/shadow/history"
 	pb "github.com/infinimesh/proto/shadow"
 	"go.uber.org/zap"
 )
@@ -53,16 +54,32 @@ func (s *ShadowServiceServer) Persister() {
 	s.ps.AddSub(messages, "mqtt.incoming", "mqtt.outgoing")
 	defer unsub(s.ps, messages)
 
+	done := make(chan struct{})
+	defer close(done)
+	go s.forgetPersisted(done)
+
 	for msg := range messages {
 		shadow := msg.(*pb.Shadow)
 		log.Debug("Message received", zap.Any("shadow", shadow))
-		if shadow.Reported != nil {
+		// States patched with Patch are stored by it already
+		_, stored := s.persisted.LoadAndDelete(shadow)
+		changed := false
+		if shadow.Reported != nil && !stored {
 			log.Debug("Reporting", zap.String("device", shadow.Device))
-			s.MergeAndStore(log, shadow.Device, pb.StateKey_REPORTED, shadow.Reported)
+			if s.MergeAndStore(log, shadow.Device, pb.StateKey_REPORTED, shadow.Reported) {
+				s.AppendHistory(log, shadow.Device, pb.StateKey_REPORTED, shadow.Reported)
+				changed = true
+			}
 		}
-		if shadow.Desired != nil {
+		if shadow.Desired != nil && !stored {
 			log.Debug("Desiring", zap.String("device", shadow.Device))
-			s.MergeAndStore(log, shadow.Device, pb.StateKey_DESIRED, shadow.Desired)
+			if s.MergeAndStore(log, shadow.Device, pb.StateKey_DESIRED, shadow.Desired) {
+				s.AppendHistory(log, shadow.Device, pb.StateKey_DESIRED, shadow.Desired)
+				changed = true
+			}
+		}
+		if changed {
+			s.UpdateDelta(log, shadow.Device)
 		}
 		if shadow.Connection != nil {
 			s.StoreConnectionState(log, shadow.Device, shadow.Connection)
@@ -70,37 +87,46 @@ func (s *ShadowServiceServer) Persister() {
 	}
 }
 
-func (s *ShadowServiceServer) MergeAndStore(log *zap.Logger, device string, skey pb.StateKey, state *pb.State) {
-	key := Key(device, skey)
-
-	var new []byte
-	var err error
-
-	new, err = json.Marshal(state)
+// MergeAndStore - merges the patch into the stored state, reports whether the state has changed
+func (s *ShadowServiceServer) MergeAndStore(log *zap.Logger, device string, skey pb.StateKey, state *pb.State) bool {
+	_, changed, err := s.Merge(context.Background(), device, skey, state, AnyVersion)
 	if err != nil {
-		log.Warn("Error Marshalling State", zap.String("key", key), zap.Error(err))
-		return
+		log.Warn("Error Storing State", zap.String("key", Key(device, skey)), zap.Error(err))
 	}
+	return changed
+}
 
-	cmd := s.rdb.Get(context.Background(), key)
-	m, err := cmd.Result()
+// Merge - merges the patch into the stored state if it has the expected version, see update
+func (s *ShadowServiceServer) Merge(ctx context.Context, device string, skey pb.StateKey, state *pb.State, expected int64) (version int64, changed bool, err error) {
+	patch, err := json.Marshal(state)
 	if err != nil {
-		goto set
+		return 0, false, err
 	}
 
-	log.Debug("Merging", zap.ByteString("old", []byte(m)), zap.ByteString("new", new))
-	new, err = MergeJSON([]byte(m), new)
-	if err != nil {
-		log.Warn("Error Merging State", zap.String("key", key), zap.Error(err))
-		return
-	}
+	return s.update(ctx, device, skey, expected, func(old []byte) ([]byte, error) {
+		s.log.Debug("Merging", zap.ByteString("old", old), zap.ByteString("new", patch))
+		return MergeJSON(old, patch)
+	})
+}
 
-set:
-	r := s.rdb.Set(context.Background(), key, string(new), 0)
-	if r.Err() != nil {
-		log.Warn("Error Storing State", zap.String("key", key), zap.Error(err))
+// AppendHistory - appends the patch to the device history if it's enabled, device retention falls back to defaults on errors
+func (s *ShadowServiceServer) AppendHistory(log *zap.Logger, device string, skey pb.StateKey, state *pb.State) {
+	if s.history == nil {
 		return
 	}
+	ctx := context.Background()
+
+	var r history.Retention
+	if s.retentions != nil {
+		var err error
+		r, err = s.retentions.Get(ctx, device)
+		if err != nil {
+			log.Warn("Can't retrieve history retention, applying defaults", zap.String("device", device), zap.Error(err))
+		}
+	}
+	if err := s.history.Append(ctx, device, skey, state, r); err != nil {
+		log.Warn("Error Appending State to History", zap.String("key", history.Key(device, skey)), zap.Error(err))
+	}
 }
 
 func MergeJSON(old, new []byte) ([]byte, error) {
@@ -18,6 +18,7 @@ package plugins
 import (
 	"context"
 	"strings"
+	"sync"
 
 	"github.com/infinimesh/infinimesh/pkg/pubsub"
 	devpb "github.com/infinimesh/proto/node/devices"
@@ -127,3 +128,61 @@ func PublishSingle(plugin string, state *pb.Shadow) {
 	}
 	log.Debug("State published")
 }
+
+// Publisher - publishes states to the plugins exchange from outside of the Shadow service, e.g. events emitted by Repo
+type Publisher struct {
+	log     *zap.Logger
+	channel *amqp.Channel
+
+	mu sync.Mutex
+	qs map[string]bool
+}
+
+func NewPublisher(log *zap.Logger, conn *amqp.Connection) (*Publisher, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.ExchangeDeclare("plugins", "topic", true, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Publisher{
+		log: log.Named("PluginsPublisher"), channel: ch, qs: make(map[string]bool),
+	}, nil
+}
+
+// Publish - publishes the state to Plugins the Device is tagged with
+func (p *Publisher) Publish(ctx context.Context, dev *devpb.Device, state *pb.Shadow) error {
+	body, err := proto.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, tag := range dev.Tags {
+		plugin := strings.TrimPrefix(tag, "plugin:")
+		if plugin == tag {
+			continue
+		}
+		if !p.qs[plugin] {
+			if _, err := SetupQueue(p.log, p.channel, plugin); err != nil {
+				return err
+			}
+			p.qs[plugin] = true
+		}
+
+		err = p.channel.PublishWithContext(ctx, "plugins", plugin, false, false, amqp.Publishing{
+			ContentType: "text/plain", Body: body,
+		})
+		if err != nil {
+			delete(p.qs, plugin)
+			return err
+		}
+	}
+	return nil
+}
@@ -17,13 +17,20 @@ package shadow
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"time"
 
 	"encoding/json"
 
 	redis "github.com/go-redis/redis/v8"
 	"github.com/infinimesh/infinimesh/pkg/pubsub"
+	"github.com/infinimesh/infinimesh/pkg/shadow/history"
+	"github.com/infinimesh/infinimesh/pkg/shadow/validation"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
@@ -36,6 +43,25 @@ type ShadowServiceServer struct {
 	log *zap.Logger
 	rdb redis.Cmdable
 	ps  pubsub.PubSub
+
+	schemas *validation.Cache
+
+	history    *history.Store
+	retentions *history.Retentions
+
+	retained RetainedStates
+
+	// persisted - Patch requests stored by Patch itself, so Persister skips them, by the time they were stored
+	persisted sync.Map
+}
+
+// persistedTTL - Patch requests Persister hasn't received within it are forgotten, e.g. if they were dropped by PubSub
+const persistedTTL = time.Minute
+
+// RetainedStates - Reported states devices published with MQTT Retain flag, provided by the MQTT bridge retained messages
+type RetainedStates interface {
+	// Reported - returns nil if the device has no retained Reported state
+	Reported(ctx context.Context, device string) (*pb.State, error)
 }
 
 func NewShadowServiceServer(log *zap.Logger, rdb redis.Cmdable, ps pubsub.PubSub) *ShadowServiceServer {
@@ -46,28 +72,58 @@ func NewShadowServiceServer(log *zap.Logger, rdb redis.Cmdable, ps pubsub.PubSub
 	}
 }
 
+// SetValidation - enables validation of patched state against device JSON Schemas
+func (s *ShadowServiceServer) SetValidation(schemas *validation.Cache) {
+	s.schemas = schemas
+}
+
+// SetHistory - enables appending Reported and Desired state patches to the device history,
+// retentions may be nil to keep everything
+func (s *ShadowServiceServer) SetHistory(store *history.Store, retentions *history.Retentions) {
+	s.history = store
+	s.retentions = retentions
+}
+
+// SetRetained - enables sending retained Reported states to streams which don't request Sync
+func (s *ShadowServiceServer) SetRetained(states RetainedStates) {
+	s.retained = states
+}
+
 func (s *ShadowServiceServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
 	log := s.log.Named("get")
 	pool := req.GetPool()
 	log.Debug("Request received", zap.Strings("pool", pool))
 
-	keys := make([]string, len(pool)*3)
-	for i, dev := range pool {
-		keys[i*3] = Key(dev, pb.StateKey_REPORTED)
-		keys[i*3+1] = Key(dev, pb.StateKey_DESIRED)
-		keys[i*3+2] = Key(dev, pb.StateKey_CONNECTION)
-	}
-	if len(keys) == 0 {
+	if len(pool) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "no devices specified")
 	}
-	r := s.rdb.MGet(ctx, keys...)
-	states, err := r.Result()
+	shadows, md, err := s.states(ctx, pool)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to get Shadows")
 	}
+	log.Debug("Got states", zap.Int("count", len(shadows)))
+	_ = grpc.SetHeader(ctx, md)
+
+	return &pb.GetResponse{Shadows: shadows}, nil
+}
+
+// states - current Shadows of the devices, along with versions of their states and stored deltas
+// as VersionHeader and DeltaHeader metadata
+func (s *ShadowServiceServer) states(ctx context.Context, pool []string) ([]*pb.Shadow, metadata.MD, error) {
+	keys := make([]string, len(pool)*4)
+	for i, dev := range pool {
+		keys[i*4] = Key(dev, pb.StateKey_REPORTED)
+		keys[i*4+1] = Key(dev, pb.StateKey_DESIRED)
+		keys[i*4+2] = Key(dev, pb.StateKey_CONNECTION)
+		keys[i*4+3] = DeltaKey(dev)
+	}
+	states, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	log.Debug("Got states", zap.Int("count", len(states)))
 	shadows := make([]*pb.Shadow, len(pool))
+	md := metadata.MD{}
 	for i := range shadows {
 		s := &pb.Shadow{
 			Device:     pool[i],
@@ -75,22 +131,26 @@ func (s *ShadowServiceServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.
 			Desired:    &pb.State{},
 			Connection: &pb.ConnectionState{},
 		}
-		if states[i*3] != nil {
-			state := states[i*3].(string)
+		if states[i*4] != nil {
+			state := states[i*4].(string)
 			json.Unmarshal([]byte(state), s.Reported)
+			md.Append(VersionHeader, versionHeader(pool[i], pb.StateKey_REPORTED, Version([]byte(state))))
 		}
-		if states[i*3+1] != nil {
-			state := states[i*3+1].(string)
+		if states[i*4+1] != nil {
+			state := states[i*4+1].(string)
 			json.Unmarshal([]byte(state), s.Desired)
+			md.Append(VersionHeader, versionHeader(pool[i], pb.StateKey_DESIRED, Version([]byte(state))))
 		}
-		if states[i*3+2] != nil {
-			state := states[i*3+2].(string)
+		if states[i*4+2] != nil {
+			state := states[i*4+2].(string)
 			json.Unmarshal([]byte(state), s.Connection)
 		}
+		if states[i*4+3] != nil {
+			md.Append(DeltaHeader, pool[i]+"="+states[i*4+3].(string))
+		}
 		shadows[i] = s
 	}
-
-	return &pb.GetResponse{Shadows: shadows}, nil
+	return shadows, md, nil
 }
 
 func (s *ShadowServiceServer) Patch(ctx context.Context, req *pb.Shadow) (*pb.Shadow, error) {
@@ -101,22 +161,122 @@ func (s *ShadowServiceServer) Patch(ctx context.Context, req *pb.Shadow) (*pb.Sh
 		return nil, status.Error(codes.InvalidArgument, "no device specified")
 	}
 
+	expected, err := expectedVersion(ctx)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if expected != AnyVersion && req.Reported != nil && req.Desired != nil {
+		return nil, status.Error(codes.InvalidArgument, "expected version can only be checked for a single state")
+	}
+
+	if err := s.validate(ctx, log, req); err != nil {
+		return nil, err
+	}
+
+	// States are stored before they're published, so the version is known and conflicting patches are never delivered
 	now := timestamppb.Now()
 	topics := []string{}
-	if req.Reported != nil {
-		req.Reported.Timestamp = now
-		topics = append(topics, "mqtt.incoming")
+	versions := []string{}
+	changed := false
+	for _, st := range []struct {
+		key   pb.StateKey
+		state *pb.State
+		topic string
+	}{{pb.StateKey_REPORTED, req.Reported, "mqtt.incoming"}, {pb.StateKey_DESIRED, req.Desired, "mqtt.outgoing"}} {
+		if st.state == nil {
+			continue
+		}
+		st.state.Timestamp = now
+		version, ok, err := s.Merge(ctx, req.Device, st.key, st.state, expected)
+		if errors.Is(err, ErrVersionMismatch) {
+			sendVersions(ctx, versionHeader(req.Device, st.key, version))
+			return nil, status.Error(codes.Aborted, "state version doesn't match expected version")
+		}
+		if err != nil {
+			log.Warn("Error Storing State", zap.String("key", Key(req.Device, st.key)), zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to store state")
+		}
+		if ok {
+			s.AppendHistory(log, req.Device, st.key, st.state)
+			changed = true
+		}
+		topics = append(topics, st.topic)
+		versions = append(versions, versionHeader(req.Device, st.key, version))
 	}
-	if req.Desired != nil {
-		req.Desired.Timestamp = now
-		topics = append(topics, "mqtt.outgoing")
+	if changed {
+		s.UpdateDelta(log, req.Device)
 	}
+	sendVersions(ctx, versions...)
 
-	s.ps.TryPub(req, topics...)
+	if len(topics) > 0 {
+		s.markPersisted(req)
+		s.ps.TryPub(req, topics...)
+	}
 
 	return req, nil
 }
 
+// markPersisted - lets Persister know the request is stored already
+func (s *ShadowServiceServer) markPersisted(req *pb.Shadow) {
+	s.persisted.Store(req, time.Now())
+}
+
+// forgetPersisted - forgets Patch requests Persister hasn't received in time once per persistedTTL, until done is closed
+func (s *ShadowServiceServer) forgetPersisted(done <-chan struct{}) {
+	ticker := time.NewTicker(persistedTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.persisted.Range(func(key, value any) bool {
+				if now.Sub(value.(time.Time)) > persistedTTL {
+					s.persisted.Delete(key)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// validate - checks Reported and Desired state against device schemas. Rejected state fails the request,
+// quarantined state is removed from it. Both are reported as device event.
+// State is let through if schemas can't be retrieved
+func (s *ShadowServiceServer) validate(ctx context.Context, log *zap.Logger, req *pb.Shadow) error {
+	if s.schemas == nil || (req.Reported == nil && req.Desired == nil) {
+		return nil
+	}
+	schemas, err := s.schemas.Get(ctx, req.GetDevice())
+	if err != nil {
+		log.Warn("Can't retrieve state schemas, state is not validated", zap.String("device", req.GetDevice()), zap.Error(err))
+		return nil
+	}
+
+	for _, st := range []struct {
+		key   pb.StateKey
+		state **pb.State
+	}{{pb.StateKey_REPORTED, &req.Reported}, {pb.StateKey_DESIRED, &req.Desired}} {
+		if *st.state == nil {
+			continue
+		}
+		data := (*st.state).GetData()
+		v := schemas.Validate(req.GetDevice(), st.key, data)
+		if v == nil {
+			continue
+		}
+
+		s.ps.TryPub(v.Event(data), "mqtt.events")
+		if v.Policy == validation.PolicyReject {
+			return status.Error(codes.InvalidArgument, v.Error())
+		}
+		log.Info("State quarantined", zap.String("device", req.GetDevice()), zap.Error(v))
+		*st.state = nil
+	}
+	return nil
+}
+
 func (s *ShadowServiceServer) Remove(ctx context.Context, req *pb.RemoveRequest) (*pb.Shadow, error) {
 	log := s.log.Named("remove")
 	log.Debug("Request received", zap.Any("req", req))
@@ -128,27 +288,40 @@ func (s *ShadowServiceServer) Remove(ctx context.Context, req *pb.RemoveRequest)
 		return nil, status.Error(codes.InvalidArgument, "key not specified")
 	}
 
-	skey := Key(req.GetDevice(), req.StateKey)
-	r := s.rdb.Get(ctx, skey)
-	raw, err := r.Result()
+	expected, err := expectedVersion(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to get Shadow")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	var state pb.State
-	err = json.Unmarshal([]byte(raw), &state)
+	version, _, err := s.update(ctx, req.GetDevice(), req.StateKey, expected, func(old []byte) ([]byte, error) {
+		if len(old) == 0 {
+			return nil, status.Error(codes.NotFound, "state not found")
+		}
+		state = pb.State{}
+		if err := json.Unmarshal(old, &state); err != nil {
+			log.Warn("Cannot unmarshal state", zap.ByteString("raw", old), zap.Error(err))
+			return nil, status.Error(codes.Internal, "cannot Unmarshal state")
+		}
+
+		delete(state.GetData().GetFields(), req.GetKey())
+		state.Timestamp = timestamppb.Now()
+		log.Debug("Result", zap.Any("state", &state))
+		return json.Marshal(&state)
+	})
+	if errors.Is(err, ErrVersionMismatch) {
+		sendVersions(ctx, versionHeader(req.GetDevice(), req.StateKey, version))
+		return nil, status.Error(codes.Aborted, "state version doesn't match expected version")
+	}
 	if err != nil {
-		log.Warn("Cannot unmarshal state", zap.String("raw", raw), zap.Error(err))
-		return nil, status.Error(codes.Internal, "cannot Unmarshal state")
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		log.Warn("Error Storing State", zap.String("key", Key(req.GetDevice(), req.StateKey)), zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get Shadow")
 	}
-
-	fields := state.Data.Fields
-	delete(fields, req.GetKey())
-
-	state.Timestamp = timestamppb.Now()
-	log.Debug("Result", zap.Any("state", state))
-
-	s.Store(log, req.Device, req.StateKey, &state)
+	sendVersions(ctx, versionHeader(req.GetDevice(), req.StateKey, version))
+	s.UpdateDelta(log, req.Device)
 
 	result := &pb.Shadow{
 		Device: req.GetDevice(),
@@ -175,20 +348,22 @@ func (s *ShadowServiceServer) StreamShadow(req *pb.StreamShadowRequest, srv pb.S
 		devices[id] = true
 	}
 
+	// Versions and deltas of the current states are sent in the header, so clients can Patch states they've got in the stream
+	log.Debug("Getting current state")
+	shadows, md, err := s.states(srv.Context(), req.GetDevices())
+	if err != nil {
+		log.Warn("Couldn't get current devices Shadow state", zap.Error(err))
+	} else if err := srv.SendHeader(md); err != nil {
+		log.Warn("Couldn't send header", zap.Error(err))
+	}
+
 	if req.Sync {
-		func() {
-			log.Debug("Sending current state")
-			r, err := s.Get(srv.Context(), &pb.GetRequest{
-				Pool: req.GetDevices(),
-			})
-			if err != nil {
-				log.Warn("Couldn't get current devices Shadow state", zap.Error(err))
-				return
-			}
-			for _, s := range r.GetShadows() {
-				srv.Send(s)
-			}
-		}()
+		log.Debug("Sending current state")
+		for _, s := range shadows {
+			srv.Send(s)
+		}
+	} else {
+		s.sendRetained(log, srv, req.GetDevices())
 	}
 
 	messages := make(chan interface{}, 10)
@@ -209,9 +384,35 @@ func (s *ShadowServiceServer) StreamShadow(req *pb.StreamShadowRequest, srv pb.S
 		}
 	}
 
+	// Stream is closed by the server, versions of the states by then are sent in the trailer
+	if _, md, err := s.states(srv.Context(), req.GetDevices()); err == nil {
+		srv.SetTrailer(md)
+	}
+
 	return nil
 }
 
+// sendRetained - sends Reported state devices published with MQTT Retain flag, so stream starts with the last value
+func (s *ShadowServiceServer) sendRetained(log *zap.Logger, srv pb.ShadowService_StreamShadowServer, devices []string) {
+	if s.retained == nil {
+		return
+	}
+	for _, dev := range devices {
+		state, err := s.retained.Reported(srv.Context(), dev)
+		if err != nil {
+			log.Warn("Couldn't get retained state", zap.String("device", dev), zap.Error(err))
+			continue
+		}
+		if state == nil {
+			continue
+		}
+		srv.Send(&pb.Shadow{
+			Device:   dev,
+			Reported: state,
+		})
+	}
+}
+
 func unsub[T chan any](ps pubsub.PubSub, ch chan any) {
 	go ps.Unsub(ch)
 
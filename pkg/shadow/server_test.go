@@ -12,12 +12,15 @@ import (
 	pubsub_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/infinimesh/pkg/pubsub"
 	shadow_mocks "github.com/infinimesh/infinimesh/mocks/github.com/infinimesh/proto/shadow"
 	"github.com/infinimesh/infinimesh/pkg/shadow"
+	"github.com/infinimesh/infinimesh/pkg/shadow/history"
+	"github.com/infinimesh/infinimesh/pkg/shadow/validation"
 	pb "github.com/infinimesh/proto/shadow"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest/observer"
 	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type shadowServiceServerFixture struct {
@@ -77,6 +80,19 @@ func newShadowServiceServerFixture(t *testing.T, args ...bool) *shadowServiceSer
 	return f
 }
 
+// expectStore - expects the state to be stored with the version following the given one
+func (f *shadowServiceServerFixture) expectStore(key string, version int64, check func(s string) bool) {
+	f.mocks.rdb.EXPECT().EvalSha(mock.Anything, mock.Anything, []string{key}, version, mock.MatchedBy(func(s string) bool {
+		return shadow.Version([]byte(s)) == version+1 && check(s)
+	})).Return(redis.NewCmdResult(int64(1), nil)).Once()
+}
+
+// expectDelta - expects delta to be stored if Desired and Reported state are still of the given versions
+func (f *shadowServiceServerFixture) expectDelta(desired, reported int64, check func(s string) bool) {
+	f.mocks.rdb.EXPECT().EvalSha(mock.Anything, mock.Anything, []string{"device1:desired", "device1:reported", "device1:delta"},
+		desired, reported, mock.MatchedBy(check)).Return(redis.NewCmdResult(int64(1), nil)).Once()
+}
+
 // Get
 
 func TestGet_FailsOn_NoDevices(t *testing.T) {
@@ -96,7 +112,7 @@ func TestGet_FailsOn_RedisError(t *testing.T) {
 	mget_cmd.SetErr(assert.AnError)
 	f.mocks.rdb.
 		EXPECT().
-		MGet(f.data.ctx, "device1:reported", "device1:desired", "device1:connection").
+		MGet(f.data.ctx, "device1:reported", "device1:desired", "device1:connection", "device1:delta").
 		Return(mget_cmd)
 
 	_, err := f.service.Get(f.data.ctx, &pb.GetRequest{
@@ -114,11 +130,12 @@ func TestGet_Success(t *testing.T) {
 		f.data.sample_state,
 		f.data.sample_state,
 		f.data.sample_connection,
+		nil,
 	})
 
 	f.mocks.rdb.
 		EXPECT().
-		MGet(f.data.ctx, "device1:reported", "device1:desired", "device1:connection").
+		MGet(f.data.ctx, "device1:reported", "device1:desired", "device1:connection", "device1:delta").
 		Return(mget_cmd)
 
 	resp, err := f.service.Get(f.data.ctx, &pb.GetRequest{
@@ -183,6 +200,15 @@ func TestPatch_Success(t *testing.T) {
 		},
 	}
 
+	for _, key := range []pb.StateKey{pb.StateKey_REPORTED, pb.StateKey_DESIRED} {
+		f.mocks.rdb.EXPECT().Get(f.data.ctx, shadow.Key(request.Device, key)).Return(redis.NewStringResult("", redis.Nil))
+		f.expectStore(shadow.Key(request.Device, key), 0, func(s string) bool {
+			state := pb.State{}
+			return json.Unmarshal([]byte(s), &state) == nil && state.Data.Fields["diff"].GetNumberValue() == 2
+		})
+	}
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, shadow.Key(request.Device, pb.StateKey_DESIRED), shadow.Key(request.Device, pb.StateKey_REPORTED), shadow.DeltaKey(request.Device)).
+		Return(redis.NewSliceResult([]interface{}{nil, nil, nil}, nil))
 	f.mocks.ps.EXPECT().TryPub(request, "mqtt.incoming", "mqtt.outgoing").
 		Return()
 
@@ -200,6 +226,79 @@ func TestPatch_Success(t *testing.T) {
 	assert.NotNil(t, resp.Desired.Timestamp)
 }
 
+func newSchemaCache(t *testing.T, policy validation.Policy) *validation.Cache {
+	config, err := structpb.NewStruct(map[string]interface{}{
+		validation.ConfigKey: map[string]interface{}{
+			"policy": string(policy),
+			"desired": map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"diff": map[string]interface{}{"type": "string"}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	return validation.NewCache(time.Minute, func(ctx context.Context, device string) ([]*structpb.Struct, error) {
+		return []*structpb.Struct{config}, nil
+	})
+}
+
+func TestPatch_Validation_Reject(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	f.service.SetValidation(newSchemaCache(t, validation.PolicyReject))
+
+	request := &pb.Shadow{
+		Device: f.data.uuid,
+		Desired: &pb.State{
+			Data: &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(2)}},
+		},
+	}
+
+	f.mocks.ps.EXPECT().TryPub(mock.MatchedBy(func(s *pb.Shadow) bool {
+		return s.GetReported().GetData().GetFields()["event"].GetStringValue() == validation.EventName
+	}), "mqtt.events").Return()
+
+	_, err := f.service.Patch(f.data.ctx, request)
+
+	assert.EqualError(t, err, "rpc error: code = InvalidArgument desc = desired state doesn't match schema: /diff: must be string, got number")
+	f.mocks.ps.AssertNumberOfCalls(t, "TryPub", 1)
+}
+
+func TestPatch_Validation_Quarantine(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	f.service.SetValidation(newSchemaCache(t, validation.PolicyQuarantine))
+
+	reported := &pb.State{
+		Data: &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(2)}},
+	}
+	request := &pb.Shadow{
+		Device:   f.data.uuid,
+		Reported: reported,
+		Desired: &pb.State{
+			Data: &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(2)}},
+		},
+	}
+
+	f.mocks.ps.EXPECT().TryPub(mock.MatchedBy(func(s *pb.Shadow) bool {
+		data := s.GetReported().GetData().GetFields()["data"].GetStructValue().GetFields()
+		return data["policy"].GetStringValue() == "quarantine" && data["payload"] != nil
+	}), "mqtt.events").Return()
+	f.mocks.rdb.EXPECT().Get(f.data.ctx, shadow.Key(f.data.uuid, pb.StateKey_REPORTED)).Return(redis.NewStringResult("", redis.Nil))
+	f.expectStore(shadow.Key(f.data.uuid, pb.StateKey_REPORTED), 0, func(s string) bool { return true })
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(redis.NewSliceResult([]interface{}{nil, nil, nil}, nil))
+	f.mocks.ps.EXPECT().TryPub(mock.MatchedBy(func(s *pb.Shadow) bool {
+		return s.Desired == nil && s.Reported == reported
+	}), "mqtt.incoming").Return()
+
+	resp, err := f.service.Patch(f.data.ctx, request)
+
+	assert.NoError(t, err)
+	assert.Nil(t, resp.Desired)
+	assert.NotNil(t, resp.Reported.Timestamp)
+	f.mocks.ps.AssertNumberOfCalls(t, "TryPub", 2)
+}
+
 // Remove
 
 func TestRemove_FailsOn_NoDevice(t *testing.T) {
@@ -250,7 +349,7 @@ func TestRemove_Reported_Success(t *testing.T) {
 	f := newShadowServiceServerFixture(t)
 
 	f.mocks.rdb.EXPECT().Get(f.data.ctx, "device1:reported").Return(redis.NewStringResult(f.data.sample_state, nil))
-	f.mocks.rdb.EXPECT().Set(f.data.ctx, "device1:reported", mock.MatchedBy(func(s string) bool {
+	f.expectStore("device1:reported", 0, func(s string) bool {
 		state := pb.State{}
 		err := json.Unmarshal([]byte(s), &state)
 		if err != nil {
@@ -264,7 +363,9 @@ func TestRemove_Reported_Success(t *testing.T) {
 		}
 
 		return true
-	}), time.Duration(0)).Return(redis.NewStatusResult("", nil))
+	})
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, "device1:desired", "device1:reported", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{nil, `{"data":{}}`, nil}, nil))
 
 	res, err := f.service.Remove(f.data.ctx, &pb.RemoveRequest{
 		Device: "device1",
@@ -282,7 +383,7 @@ func TestRemove_Desired_Success(t *testing.T) {
 	f := newShadowServiceServerFixture(t)
 
 	f.mocks.rdb.EXPECT().Get(f.data.ctx, "device1:desired").Return(redis.NewStringResult(f.data.sample_state, nil))
-	f.mocks.rdb.EXPECT().Set(f.data.ctx, "device1:desired", mock.MatchedBy(func(s string) bool {
+	f.expectStore("device1:desired", 0, func(s string) bool {
 		state := pb.State{}
 		err := json.Unmarshal([]byte(s), &state)
 		if err != nil {
@@ -296,7 +397,14 @@ func TestRemove_Desired_Success(t *testing.T) {
 		}
 
 		return true
-	}), time.Duration(0)).Return(redis.NewStatusResult("", nil))
+	})
+	// Removed key isn't out of sync anymore, delta shrinks to empty and isn't published
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, "device1:desired", "device1:reported", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{}}`, nil, `{"data":{"diff":2}}`}, nil))
+	f.expectDelta(0, 0, func(s string) bool {
+		state := pb.State{}
+		return json.Unmarshal([]byte(s), &state) == nil && state.Data != nil && len(state.Data.Fields) == 0
+	})
 
 	res, err := f.service.Remove(f.data.ctx, &pb.RemoveRequest{
 		Device:   "device1",
@@ -328,12 +436,14 @@ func TestStreamShadow_Success_ServerClosed(t *testing.T) {
 	f.mocks.srv.EXPECT().Send(mock.Anything).Return(assert.AnError)
 
 	mget_result := redis.NewSliceCmd(f.data.ctx)
-	mget_result.SetVal([]interface{}{f.data.sample_state, f.data.sample_state, f.data.sample_connection})
+	mget_result.SetVal([]interface{}{f.data.sample_state, f.data.sample_state, f.data.sample_connection, nil})
 	f.mocks.rdb.EXPECT().MGet(
 		f.data.ctx, shadow.Key(f.data.uuid, pb.StateKey_REPORTED),
 		shadow.Key(f.data.uuid, pb.StateKey_DESIRED),
 		shadow.Key(f.data.uuid, pb.StateKey_CONNECTION),
+		shadow.DeltaKey(f.data.uuid),
 	).Return(mget_result)
+	f.mocks.srv.EXPECT().SendHeader(mock.Anything).Return(nil)
 
 	f.mocks.ps.EXPECT().AddSub(mock.MatchedBy(func(ch chan interface{}) bool {
 		ch <- &pb.Shadow{
@@ -375,6 +485,49 @@ timer_loop:
 	f.mocks.srv.AssertNumberOfCalls(t, "Send", 2)
 }
 
+// retainedStates - Reported states by device
+type retainedStates map[string]*pb.State
+
+func (r retainedStates) Reported(ctx context.Context, device string) (*pb.State, error) {
+	return r[device], nil
+}
+
+func TestStreamShadow_SendsRetained(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	f.service.SetRetained(retainedStates{f.data.uuid: {
+		Timestamp: timestamppb.New(time.Unix(1687185838, 0)),
+		Data:      &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(2)}},
+	}})
+
+	f.mocks.srv.EXPECT().Context().Return(f.data.ctx)
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(redis.NewSliceResult([]interface{}{nil, nil, nil, nil}, nil))
+	f.mocks.srv.EXPECT().SendHeader(mock.Anything).Return(nil)
+	f.mocks.srv.EXPECT().Send(mock.MatchedBy(func(s *pb.Shadow) bool {
+		return s.Device == f.data.uuid && s.Reported.Data.Fields["diff"].GetNumberValue() == 2
+	})).Return(nil).Once()
+	f.mocks.srv.EXPECT().Send(mock.Anything).Return(assert.AnError)
+
+	f.mocks.ps.EXPECT().AddSub(mock.MatchedBy(func(ch chan interface{}) bool {
+		ch <- &pb.Shadow{
+			Device: f.data.uuid,
+		}
+		return true
+	}), "mqtt.incoming", "mqtt.outgoing").Return()
+	f.mocks.ps.EXPECT().Unsub(mock.MatchedBy(func(ch chan interface{}) bool {
+		close(ch)
+		return true
+	})).Return()
+
+	err := f.service.StreamShadow(&pb.StreamShadowRequest{
+		Devices: []string{f.data.uuid},
+	}, f.mocks.srv)
+	assert.NoError(t, err)
+
+	f.mocks.srv.AssertNumberOfCalls(t, "Send", 2)
+}
+
 // Store
 
 func TestStore_FailsOn_Marshal(t *testing.T) {
@@ -451,7 +604,7 @@ func TestStoreConnectionState_Success(t *testing.T) {
 
 // MergeAndStore
 
-func TestMergeAndStore_FailsOn_RedisGetAndSet(t *testing.T) {
+func TestMergeAndStore_FailsOn_RedisGet(t *testing.T) {
 	f := newShadowServiceServerFixture(t)
 
 	key := f.data.uuid + ":reported"
@@ -459,14 +612,11 @@ func TestMergeAndStore_FailsOn_RedisGetAndSet(t *testing.T) {
 		f.data.ctx, key,
 	).Return(redis.NewStringResult("", assert.AnError))
 
-	f.mocks.rdb.EXPECT().Set(
-		f.data.ctx, key, "{}", time.Duration(0),
-	).Return(redis.NewStatusResult("", assert.AnError))
-
-	f.service.MergeAndStore(zap.NewExample(), f.data.uuid, pb.StateKey_REPORTED, &pb.State{})
+	// State isn't overwritten if it can't be read
+	changed := f.service.MergeAndStore(zap.NewExample(), f.data.uuid, pb.StateKey_REPORTED, &pb.State{})
 
+	assert.False(t, changed)
 	f.mocks.rdb.AssertNumberOfCalls(t, "Get", 1)
-	f.mocks.rdb.AssertNumberOfCalls(t, "Set", 1)
 }
 
 func TestMergeAndStore_FailsOn_MergeOldIsInvalid(t *testing.T) {
@@ -490,24 +640,22 @@ func TestMergeAndStore_SuccessWithMerge(t *testing.T) {
 		f.data.ctx, key,
 	).Return(redis.NewStringResult(f.data.sample_state, nil))
 
-	f.mocks.rdb.EXPECT().Set(
-		f.data.ctx, key, mock.MatchedBy(func(s string) bool {
-			state := pb.State{}
-			err := json.Unmarshal([]byte(s), &state)
-			if err != nil {
-				t.Errorf("Error unmarshalling state: %s", err)
-				return false
-			}
+	f.expectStore(key, 0, func(s string) bool {
+		state := pb.State{}
+		err := json.Unmarshal([]byte(s), &state)
+		if err != nil {
+			t.Errorf("Error unmarshalling state: %s", err)
+			return false
+		}
 
-			assert.Len(t, state.Data.Fields, 2)
-			assert.Equal(t, float64(2), state.Data.Fields["diff"].GetNumberValue())
-			assert.Equal(t, "bar", state.Data.Fields["foo"].GetStringValue())
+		assert.Len(t, state.Data.Fields, 2)
+		assert.Equal(t, float64(2), state.Data.Fields["diff"].GetNumberValue())
+		assert.Equal(t, "bar", state.Data.Fields["foo"].GetStringValue())
 
-			return true
-		}), time.Duration(0),
-	).Return(redis.NewStatusResult("", nil))
+		return true
+	})
 
-	f.service.MergeAndStore(zap.NewExample(), f.data.uuid, pb.StateKey_REPORTED, &pb.State{
+	changed := f.service.MergeAndStore(zap.NewExample(), f.data.uuid, pb.StateKey_REPORTED, &pb.State{
 		Data: &structpb.Struct{
 			Fields: map[string]*structpb.Value{
 				"foo": structpb.NewStringValue("bar"),
@@ -516,7 +664,8 @@ func TestMergeAndStore_SuccessWithMerge(t *testing.T) {
 	})
 
 	f.mocks.rdb.AssertNumberOfCalls(t, "Get", 1)
-	f.mocks.rdb.AssertNumberOfCalls(t, "Set", 1)
+	assert.True(t, changed)
+	f.mocks.rdb.AssertNumberOfCalls(t, "EvalSha", 1)
 }
 
 func TestMergeAndStore_SuccessWithMergeOldEmpty(t *testing.T) {
@@ -527,23 +676,21 @@ func TestMergeAndStore_SuccessWithMergeOldEmpty(t *testing.T) {
 		f.data.ctx, key,
 	).Return(redis.NewStringResult("", nil))
 
-	f.mocks.rdb.EXPECT().Set(
-		f.data.ctx, key, mock.MatchedBy(func(s string) bool {
-			state := pb.State{}
-			err := json.Unmarshal([]byte(s), &state)
-			if err != nil {
-				t.Errorf("Error unmarshalling state: %s", err)
-				return false
-			}
+	f.expectStore(key, 0, func(s string) bool {
+		state := pb.State{}
+		err := json.Unmarshal([]byte(s), &state)
+		if err != nil {
+			t.Errorf("Error unmarshalling state: %s", err)
+			return false
+		}
 
-			assert.Len(t, state.Data.Fields, 1)
-			assert.Equal(t, "bar", state.Data.Fields["foo"].GetStringValue())
+		assert.Len(t, state.Data.Fields, 1)
+		assert.Equal(t, "bar", state.Data.Fields["foo"].GetStringValue())
 
-			return true
-		}), time.Duration(0),
-	).Return(redis.NewStatusResult("", nil))
+		return true
+	})
 
-	f.service.MergeAndStore(zap.NewExample(), f.data.uuid, pb.StateKey_REPORTED, &pb.State{
+	changed := f.service.MergeAndStore(zap.NewExample(), f.data.uuid, pb.StateKey_REPORTED, &pb.State{
 		Data: &structpb.Struct{
 			Fields: map[string]*structpb.Value{
 				"foo": structpb.NewStringValue("bar"),
@@ -552,7 +699,8 @@ func TestMergeAndStore_SuccessWithMergeOldEmpty(t *testing.T) {
 	})
 
 	f.mocks.rdb.AssertNumberOfCalls(t, "Get", 1)
-	f.mocks.rdb.AssertNumberOfCalls(t, "Set", 1)
+	assert.True(t, changed)
+	f.mocks.rdb.AssertNumberOfCalls(t, "EvalSha", 1)
 }
 
 // MergeJSON
@@ -672,3 +820,30 @@ timer_loop:
 	f.mocks.ps.AssertNumberOfCalls(t, "AddSub", 1)
 	f.mocks.ps.AssertNumberOfCalls(t, "Unsub", 1)
 }
+
+// History
+
+func TestAppendHistory_Disabled(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	f.service.AppendHistory(f.mocks.log, f.data.uuid, pb.StateKey_REPORTED, &pb.State{})
+	f.mocks.rdb.AssertNotCalled(t, "XAdd", mock.Anything, mock.Anything)
+}
+
+func TestAppendHistory_Retention(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	retentions := history.NewRetentions(time.Minute, history.Retention{MaxEntries: 100}, func(ctx context.Context, device string) ([]*structpb.Struct, error) {
+		return nil, assert.AnError
+	})
+	f.service.SetHistory(history.NewStore(f.mocks.rdb), retentions)
+
+	f.mocks.rdb.EXPECT().XAdd(mock.Anything, mock.MatchedBy(func(a *redis.XAddArgs) bool {
+		return a.Stream == history.Key(f.data.uuid, pb.StateKey_DESIRED) && a.MaxLen == 100
+	})).Return(redis.NewStringResult("", assert.AnError))
+
+	f.service.AppendHistory(f.mocks.log, f.data.uuid, pb.StateKey_DESIRED, &pb.State{Data: &structpb.Struct{}})
+
+	assert.Len(t, f.mocks.observer.FilterMessage("Can't retrieve history retention, applying defaults").All(), 1)
+	assert.Len(t, f.mocks.observer.FilterMessage("Error Appending State to History").All(), 1)
+}
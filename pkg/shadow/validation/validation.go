@@ -0,0 +1,224 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validation checks Reported and Desired state against JSON Schemas set in Namespace and Device config:
+//
+//	"state_schema": {
+//	  "reported": { ...JSON Schema... },
+//	  "desired":  { ...JSON Schema... },
+//	  "policy":   "reject" | "quarantine"
+//	}
+//
+// Device config overrides Namespace config key by key. Rejected state is refused to the sender,
+// quarantined one is accepted but isn't applied, instead it's attached to the "schema_violation" device event
+package validation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/jsonschema"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ConfigKey - key of Namespace and Device config holding the schemas
+const ConfigKey = "state_schema"
+
+// EventName - name of the device event published for invalid state
+const EventName = "schema_violation"
+
+type Policy string
+
+const (
+	PolicyReject     Policy = "reject"
+	PolicyQuarantine Policy = "quarantine"
+)
+
+var FailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "shadow_state_validation_failures_total",
+	Help: "The total number of Reported and Desired states not matching the device JSON Schema, by state and policy applied",
+}, []string{"state", "policy"})
+
+// Schemas - JSON Schemas of the device state, nil schema means state isn't validated
+type Schemas struct {
+	Reported *jsonschema.Schema
+	Desired  *jsonschema.Schema
+	Policy   Policy
+}
+
+// Parse - compiles schemas from the configs, later configs override earlier ones. Returns nil if no config sets schemas
+func Parse(configs ...*structpb.Struct) (*Schemas, error) {
+	merged := make(map[string]*structpb.Value)
+	for _, config := range configs {
+		for k, v := range config.GetFields()[ConfigKey].GetStructValue().GetFields() {
+			merged[k] = v
+		}
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+
+	res := &Schemas{Policy: PolicyReject}
+	if p, ok := merged["policy"]; ok {
+		switch policy := Policy(p.GetStringValue()); policy {
+		case PolicyReject, PolicyQuarantine:
+			res.Policy = policy
+		default:
+			return nil, fmt.Errorf("unknown validation policy %q", p.GetStringValue())
+		}
+	}
+
+	var err error
+	for key, dst := range map[string]**jsonschema.Schema{"reported": &res.Reported, "desired": &res.Desired} {
+		v, ok := merged[key]
+		if !ok {
+			continue
+		}
+		if *dst, err = jsonschema.Compile(v.AsInterface()); err != nil {
+			return nil, fmt.Errorf("%s schema: %w", key, err)
+		}
+	}
+	return res, nil
+}
+
+// Violation - state doesn't match the schema
+type Violation struct {
+	Device string
+	State  pb.StateKey
+	Policy Policy
+	Err    error
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("%s state doesn't match schema: %v", stateName(v.State), v.Err)
+}
+
+func (v *Violation) Unwrap() error {
+	return v.Err
+}
+
+// Validate - returns *Violation if the state doesn't match its schema, nil otherwise. Failures are counted in FailuresTotal
+func (s *Schemas) Validate(device string, key pb.StateKey, data *structpb.Struct) *Violation {
+	if s == nil {
+		return nil
+	}
+	schema := s.Reported
+	if key == pb.StateKey_DESIRED {
+		schema = s.Desired
+	}
+	if schema == nil {
+		return nil
+	}
+
+	err := schema.ValidateStruct(data)
+	if err == nil {
+		return nil
+	}
+	FailuresTotal.WithLabelValues(stateName(key), string(s.Policy)).Inc()
+	return &Violation{Device: device, State: key, Policy: s.Policy, Err: err}
+}
+
+// Event - device event describing the violation, published to mqtt.events the same way device events are.
+// Quarantined state is attached as "payload"
+func (v *Violation) Event(data *structpb.Struct) *pb.Shadow {
+	details := map[string]*structpb.Value{
+		"state":  structpb.NewStringValue(stateName(v.State)),
+		"policy": structpb.NewStringValue(string(v.Policy)),
+		"reason": structpb.NewStringValue(v.Err.Error()),
+	}
+	if v.Policy == PolicyQuarantine && data != nil {
+		details["payload"] = structpb.NewStructValue(data)
+	}
+
+	return &pb.Shadow{
+		Device: v.Device,
+		Reported: &pb.State{
+			Timestamp: timestamppb.Now(),
+			Data: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"event": structpb.NewStringValue(EventName),
+				"data":  structpb.NewStructValue(&structpb.Struct{Fields: details}),
+			}},
+		},
+	}
+}
+
+func stateName(key pb.StateKey) string {
+	if key == pb.StateKey_DESIRED {
+		return "desired"
+	}
+	return "reported"
+}
+
+// LoadFunc - fetches configs of the device in the order they override each other, i.e. Namespace config, then Device config
+type LoadFunc func(ctx context.Context, device string) ([]*structpb.Struct, error)
+
+type entry struct {
+	schemas *Schemas
+	err     error
+	expires time.Time
+}
+
+// Cache - keeps compiled schemas of the devices for a limited time
+type Cache struct {
+	ttl  time.Duration
+	load LoadFunc
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func NewCache(ttl time.Duration, load LoadFunc) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		load:    load,
+		entries: make(map[string]entry),
+	}
+}
+
+// Get - returns schemas of the device, nil if it has none. Invalid schemas are cached along with their error, load errors aren't
+func (c *Cache) Get(ctx context.Context, device string) (*Schemas, error) {
+	c.mu.Lock()
+	e, ok := c.entries[device]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.schemas, e.err
+	}
+
+	configs, err := c.load(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := Parse(configs...)
+
+	c.mu.Lock()
+	c.entries[device] = entry{schemas: schemas, err: err, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return schemas, err
+}
+
+// Invalidate - drops schemas of the device, so next Get loads them again
+func (c *Cache) Invalidate(device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, device)
+}
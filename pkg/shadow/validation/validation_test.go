@@ -0,0 +1,118 @@
+package validation_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/infinimesh/pkg/shadow/validation"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func config(t *testing.T, schema map[string]interface{}) *structpb.Struct {
+	s, err := structpb.NewStruct(map[string]interface{}{validation.ConfigKey: schema})
+	require.NoError(t, err)
+	return s
+}
+
+func state(t *testing.T, data map[string]interface{}) *structpb.Struct {
+	s, err := structpb.NewStruct(data)
+	require.NoError(t, err)
+	return s
+}
+
+var numberSchema = map[string]interface{}{
+	"type":       "object",
+	"properties": map[string]interface{}{"temperature": map[string]interface{}{"type": "number"}},
+}
+
+func TestParse(t *testing.T) {
+	schemas, err := validation.Parse(nil, &structpb.Struct{})
+	assert.NoError(t, err)
+	assert.Nil(t, schemas)
+
+	schemas, err = validation.Parse(
+		config(t, map[string]interface{}{"reported": numberSchema, "policy": "quarantine"}),
+		config(t, map[string]interface{}{"desired": numberSchema}),
+	)
+	require.NoError(t, err)
+	assert.NotNil(t, schemas.Reported)
+	assert.NotNil(t, schemas.Desired)
+	assert.Equal(t, validation.PolicyQuarantine, schemas.Policy)
+
+	_, err = validation.Parse(config(t, map[string]interface{}{"policy": "ignore"}))
+	assert.Error(t, err)
+
+	_, err = validation.Parse(config(t, map[string]interface{}{"reported": map[string]interface{}{"type": 1}}))
+	assert.Error(t, err)
+}
+
+func TestSchemas_Validate(t *testing.T) {
+	schemas, err := validation.Parse(config(t, map[string]interface{}{"reported": numberSchema}))
+	require.NoError(t, err)
+
+	assert.Nil(t, schemas.Validate("dev", pb.StateKey_REPORTED, state(t, map[string]interface{}{"temperature": 1})))
+
+	invalid := state(t, map[string]interface{}{"temperature": "hot"})
+	v := schemas.Validate("dev", pb.StateKey_REPORTED, invalid)
+	require.NotNil(t, v)
+	assert.Equal(t, validation.PolicyReject, v.Policy)
+	assert.Equal(t, "reported state doesn't match schema: /temperature: must be number, got string", v.Error())
+
+	// Desired state has no schema
+	assert.Nil(t, schemas.Validate("dev", pb.StateKey_DESIRED, invalid))
+
+	var none *validation.Schemas
+	assert.Nil(t, none.Validate("dev", pb.StateKey_REPORTED, invalid))
+}
+
+func TestViolation_Event(t *testing.T) {
+	data := state(t, map[string]interface{}{"temperature": "hot"})
+	v := &validation.Violation{Device: "dev", State: pb.StateKey_REPORTED, Policy: validation.PolicyQuarantine, Err: errors.New("bad")}
+
+	event := v.Event(data).GetReported().GetData().AsMap()
+	assert.Equal(t, map[string]interface{}{
+		"event": validation.EventName,
+		"data": map[string]interface{}{
+			"state":   "reported",
+			"policy":  "quarantine",
+			"reason":  "bad",
+			"payload": map[string]interface{}{"temperature": "hot"},
+		},
+	}, event)
+
+	v.Policy = validation.PolicyReject
+	details := v.Event(data).GetReported().GetData().AsMap()["data"].(map[string]interface{})
+	assert.NotContains(t, details, "payload")
+}
+
+func TestCache(t *testing.T) {
+	loads := 0
+	cache := validation.NewCache(time.Minute, func(ctx context.Context, device string) ([]*structpb.Struct, error) {
+		loads++
+		if device == "broken" {
+			return nil, errors.New("registry is unavailable")
+		}
+		return []*structpb.Struct{config(t, map[string]interface{}{"reported": numberSchema})}, nil
+	})
+
+	schemas, err := cache.Get(context.Background(), "dev")
+	require.NoError(t, err)
+	assert.NotNil(t, schemas.Reported)
+
+	_, _ = cache.Get(context.Background(), "dev")
+	assert.Equal(t, 1, loads)
+
+	cache.Invalidate("dev")
+	_, _ = cache.Get(context.Background(), "dev")
+	assert.Equal(t, 2, loads)
+
+	_, err = cache.Get(context.Background(), "broken")
+	assert.Error(t, err)
+	_, _ = cache.Get(context.Background(), "broken")
+	assert.Equal(t, 4, loads)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	redis "github.com/go-redis/redis/v8"
+	pb "github.com/infinimesh/proto/shadow"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ExpectedVersionHeader - gRPC metadata key Patch and Remove take the version of the state they change from.
+	// Requests are Aborted if the state was changed since, Patch takes a single state along with it
+	ExpectedVersionHeader = "expected-version"
+	// VersionHeader - gRPC header metadata key versions of the returned states are sent in, as "{device}:{reported|desired}={version}".
+	// Shadow messages have no place for versions, StreamShadow sends the ones at its start in the header and at its end in the trailer
+	VersionHeader = "shadow-version"
+
+	// AnyVersion - expected version which matches any state
+	AnyVersion int64 = -1
+
+	// updateRetries - attempts to store the state before giving up if it keeps changing concurrently
+	updateRetries = 10
+)
+
+var (
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrTooManyRetries  = errors.New("state keeps changing concurrently")
+)
+
+// luaVersion - Lua function returning version of the state stored at the key, see Version.
+// States stored before versions were introduced have version 0
+const luaVersion = `
+local function version(key)
+	local current = redis.call('GET', key)
+	if current then
+		local ok, doc = pcall(cjson.decode, current)
+		if ok and type(doc) == 'table' and type(doc.version) == 'number' then
+			return doc.version
+		end
+	end
+	return 0
+end
+`
+
+// storeScript - sets KEYS[1] to ARGV[2] unless version of the stored state differs from ARGV[1], returns 1 if it's set
+var storeScript = redis.NewScript(luaVersion + `
+if version(KEYS[1]) ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// Version - version of the stored state, incremented on every change. It's kept in the state document itself,
+// so it's read and written along with the state
+func Version(raw []byte) int64 {
+	var doc struct {
+		Version int64 `json:"version"`
+	}
+	_ = json.Unmarshal(raw, &doc)
+	return doc.Version
+}
+
+// withVersion - sets the version of the state document
+func withVersion(raw []byte, version int64) ([]byte, error) {
+	doc := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	doc["version"] = json.RawMessage(strconv.FormatInt(version, 10))
+	return json.Marshal(doc)
+}
+
+// sameJSON - checks documents are equal regardless of formatting and keys order
+func sameJSON(a, b []byte) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// update - applies the change to the stored state and stores it along with the next version, unless the state changed concurrently.
+// Concurrent changes fail the update with ErrVersionMismatch if expected version is set, otherwise it's retried.
+// Changes which leave the state as is aren't stored, current version is returned then
+func (s *ShadowServiceServer) update(ctx context.Context, device string, skey pb.StateKey, expected int64, apply func(old []byte) ([]byte, error)) (version int64, changed bool, err error) {
+	key := Key(device, skey)
+
+	for i := 0; i < updateRetries; i++ {
+		old, err := s.rdb.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return 0, false, err
+		}
+		version := Version([]byte(old))
+		if expected != AnyVersion && version != expected {
+			return version, false, ErrVersionMismatch
+		}
+
+		new, err := apply([]byte(old))
+		if err != nil {
+			return version, false, err
+		}
+		if old != "" && sameJSON([]byte(old), new) {
+			return version, false, nil
+		}
+		if new, err = withVersion(new, version+1); err != nil {
+			return version, false, err
+		}
+
+		ok, err := storeScript.Run(ctx, s.rdb, []string{key}, version, string(new)).Int()
+		if err != nil {
+			return version, false, err
+		}
+		if ok == 1 {
+			return version + 1, true, nil
+		}
+		if expected != AnyVersion {
+			return version, false, ErrVersionMismatch
+		}
+	}
+	return 0, false, ErrTooManyRetries
+}
+
+// expectedVersion - version the request expects the changed state to have, AnyVersion unless it's set
+func expectedVersion(ctx context.Context) (int64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(ExpectedVersionHeader)
+	if len(values) == 0 {
+		return AnyVersion, nil
+	}
+	v, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || v < 0 {
+		return AnyVersion, fmt.Errorf("%s must be a non-negative number", ExpectedVersionHeader)
+	}
+	return v, nil
+}
+
+// versionHeader - VersionHeader value of the device state
+func versionHeader(device string, skey pb.StateKey, version int64) string {
+	return Key(device, skey) + "=" + strconv.FormatInt(version, 10)
+}
+
+// sendVersions - sends versions of the returned states in the response header, ctx must be the gRPC call one
+func sendVersions(ctx context.Context, values ...string) {
+	if len(values) == 0 {
+		return
+	}
+	md := metadata.MD{}
+	md.Append(VersionHeader, values...)
+	_ = grpc.SetHeader(ctx, md)
+}
+
+// ParseVersions - versions sent in the response header by state key, e.g. Key(device, pb.StateKey_DESIRED)
+func ParseVersions(md metadata.MD) map[string]int64 {
+	res := make(map[string]int64)
+	for _, value := range md.Get(VersionHeader) {
+		key, v, ok := strings.Cut(value, "=")
+		if !ok {
+			continue
+		}
+		if version, err := strconv.ParseInt(v, 10, 64); err == nil {
+			res[key] = version
+		}
+	}
+	return res
+}
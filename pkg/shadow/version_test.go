@@ -0,0 +1,258 @@
+package shadow_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/infinimesh/infinimesh/pkg/shadow"
+	pb "github.com/infinimesh/proto/shadow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// transportStream - captures headers set by the handler
+type transportStream struct {
+	grpc.ServerTransportStream
+	header metadata.MD
+}
+
+func (s *transportStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func withExpectedVersion(ctx context.Context, version string) (context.Context, *transportStream) {
+	stream := &transportStream{}
+	ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+	if version != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(shadow.ExpectedVersionHeader, version))
+	}
+	return ctx, stream
+}
+
+func desiredPatch(device string) *pb.Shadow {
+	return &pb.Shadow{
+		Device: device,
+		Desired: &pb.State{
+			Data: &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(3)}},
+		},
+	}
+}
+
+func TestVersion(t *testing.T) {
+	assert.Equal(t, int64(0), shadow.Version(nil))
+	assert.Equal(t, int64(0), shadow.Version([]byte(`{"data":{}}`)))
+	assert.Equal(t, int64(7), shadow.Version([]byte(`{"data":{},"version":7}`)))
+}
+
+func TestParseVersions(t *testing.T) {
+	versions := shadow.ParseVersions(metadata.Pairs(
+		shadow.VersionHeader, "device1:reported=3",
+		shadow.VersionHeader, "device1:desired=5",
+		shadow.VersionHeader, "invalid",
+	))
+	assert.Equal(t, map[string]int64{"device1:reported": 3, "device1:desired": 5}, versions)
+}
+
+func TestMerge_Unchanged(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	key := shadow.Key(f.data.uuid, pb.StateKey_REPORTED)
+	f.mocks.rdb.EXPECT().Get(f.data.ctx, key).Return(redis.NewStringResult(`{"data":{"diff":3},"version":4}`, nil))
+
+	version, changed, err := f.service.Merge(f.data.ctx, f.data.uuid, pb.StateKey_REPORTED, &pb.State{
+		Data: &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(3)}},
+	}, shadow.AnyVersion)
+
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, int64(4), version)
+}
+
+func TestMerge_RetriesOnConflict(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	key := shadow.Key(f.data.uuid, pb.StateKey_REPORTED)
+	f.mocks.rdb.EXPECT().Get(f.data.ctx, key).Return(redis.NewStringResult(`{"data":{},"version":1}`, nil)).Once()
+	f.mocks.rdb.EXPECT().EvalSha(mock.Anything, mock.Anything, []string{key}, int64(1), mock.Anything).
+		Return(redis.NewCmdResult(int64(0), nil)).Once()
+	f.mocks.rdb.EXPECT().Get(f.data.ctx, key).Return(redis.NewStringResult(`{"data":{"foo":"bar"},"version":2}`, nil)).Once()
+	f.expectStore(key, 2, func(s string) bool { return true })
+
+	version, changed, err := f.service.Merge(f.data.ctx, f.data.uuid, pb.StateKey_REPORTED, &pb.State{
+		Data: &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(3)}},
+	}, shadow.AnyVersion)
+
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, int64(3), version)
+}
+
+func TestMerge_FailsOn_VersionMismatch(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	key := shadow.Key(f.data.uuid, pb.StateKey_DESIRED)
+	f.mocks.rdb.EXPECT().Get(f.data.ctx, key).Return(redis.NewStringResult(`{"data":{},"version":3}`, nil))
+
+	version, changed, err := f.service.Merge(f.data.ctx, f.data.uuid, pb.StateKey_DESIRED, &pb.State{}, 2)
+
+	assert.ErrorIs(t, err, shadow.ErrVersionMismatch)
+	assert.False(t, changed)
+	assert.Equal(t, int64(3), version)
+}
+
+func TestMerge_FailsOn_ConcurrentChange(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	key := shadow.Key(f.data.uuid, pb.StateKey_DESIRED)
+	f.mocks.rdb.EXPECT().Get(f.data.ctx, key).Return(redis.NewStringResult(`{"data":{},"version":2}`, nil))
+	f.mocks.rdb.EXPECT().EvalSha(mock.Anything, mock.Anything, []string{key}, int64(2), mock.Anything).
+		Return(redis.NewCmdResult(int64(0), nil))
+
+	_, changed, err := f.service.Merge(f.data.ctx, f.data.uuid, pb.StateKey_DESIRED, &pb.State{
+		Data: &structpb.Struct{Fields: map[string]*structpb.Value{"diff": structpb.NewNumberValue(3)}},
+	}, 2)
+
+	assert.ErrorIs(t, err, shadow.ErrVersionMismatch)
+	assert.False(t, changed)
+}
+
+func TestPatch_ExpectedVersion(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	ctx, stream := withExpectedVersion(f.data.ctx, "2")
+	request := desiredPatch(f.data.uuid)
+
+	key := shadow.Key(f.data.uuid, pb.StateKey_DESIRED)
+	f.mocks.rdb.EXPECT().Get(ctx, key).Return(redis.NewStringResult(`{"data":{"diff":2},"version":2}`, nil))
+	f.expectStore(key, 2, func(s string) bool { return true })
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, key, shadow.Key(f.data.uuid, pb.StateKey_REPORTED), shadow.DeltaKey(f.data.uuid)).
+		Return(redis.NewSliceResult([]interface{}{nil, nil, nil}, nil))
+	f.mocks.ps.EXPECT().TryPub(request, "mqtt.outgoing").Return()
+
+	_, err := f.service.Patch(ctx, request)
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{key: 3}, shadow.ParseVersions(stream.header))
+}
+
+func TestPatch_ExpectedVersion_Aborted(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	ctx, stream := withExpectedVersion(f.data.ctx, "1")
+
+	key := shadow.Key(f.data.uuid, pb.StateKey_DESIRED)
+	f.mocks.rdb.EXPECT().Get(ctx, key).Return(redis.NewStringResult(`{"data":{"diff":2},"version":2}`, nil))
+
+	_, err := f.service.Patch(ctx, desiredPatch(f.data.uuid))
+
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, map[string]int64{key: 2}, shadow.ParseVersions(stream.header))
+	f.mocks.ps.AssertNotCalled(t, "TryPub", mock.Anything, mock.Anything)
+}
+
+func TestPatch_ExpectedVersion_FailsOn_Invalid(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	ctx, _ := withExpectedVersion(f.data.ctx, "latest")
+
+	_, err := f.service.Patch(ctx, desiredPatch(f.data.uuid))
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestPatch_ExpectedVersion_FailsOn_BothStates(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	ctx, _ := withExpectedVersion(f.data.ctx, "1")
+	request := desiredPatch(f.data.uuid)
+	request.Reported = &pb.State{Data: &structpb.Struct{}}
+
+	_, err := f.service.Patch(ctx, request)
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestRemove_ExpectedVersion_Aborted(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	ctx, _ := withExpectedVersion(f.data.ctx, "1")
+
+	f.mocks.rdb.EXPECT().Get(ctx, "device1:reported").Return(redis.NewStringResult(`{"data":{"diff":2},"version":5}`, nil))
+
+	_, err := f.service.Remove(ctx, &pb.RemoveRequest{Device: "device1", Key: "diff"})
+
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestGet_Versions(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	ctx, stream := withExpectedVersion(f.data.ctx, "")
+
+	f.mocks.rdb.EXPECT().MGet(ctx, "device1:reported", "device1:desired", "device1:connection", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{},"version":4}`, f.data.sample_state, nil, `{"data":{"diff":2}}`}, nil))
+
+	_, err := f.service.Get(ctx, &pb.GetRequest{Pool: []string{"device1"}})
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"device1:reported": 4, "device1:desired": 0}, shadow.ParseVersions(stream.header))
+	deltas := shadow.ParseDeltas(stream.header)
+	require.Contains(t, deltas, "device1")
+	assert.Equal(t, map[string]any{"diff": 2.0}, deltas["device1"].Data.AsMap())
+}
+
+func TestStreamShadow_SendsVersions(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+
+	f.mocks.srv.EXPECT().Context().Return(f.data.ctx)
+	f.mocks.rdb.EXPECT().MGet(f.data.ctx, "device1:reported", "device1:desired", "device1:connection", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{},"version":4}`, nil, nil, `{"data":{"diff":2}}`}, nil)).Once()
+	f.mocks.rdb.EXPECT().MGet(f.data.ctx, "device1:reported", "device1:desired", "device1:connection", "device1:delta").
+		Return(redis.NewSliceResult([]interface{}{`{"data":{},"version":5}`, `{"data":{},"version":1}`, nil, nil}, nil)).Once()
+	f.mocks.srv.EXPECT().SendHeader(mock.MatchedBy(func(md metadata.MD) bool {
+		_, ok := shadow.ParseDeltas(md)["device1"]
+		return ok && reflect.DeepEqual(shadow.ParseVersions(md), map[string]int64{"device1:reported": 4})
+	})).Return(nil)
+	f.mocks.srv.EXPECT().SetTrailer(mock.MatchedBy(func(md metadata.MD) bool {
+		return reflect.DeepEqual(shadow.ParseVersions(md), map[string]int64{"device1:reported": 5, "device1:desired": 1})
+	})).Return()
+
+	// Server closes the stream
+	f.mocks.ps.EXPECT().AddSub(mock.MatchedBy(func(ch chan interface{}) bool {
+		close(ch)
+		return true
+	}), "mqtt.incoming", "mqtt.outgoing").Return()
+	f.mocks.ps.EXPECT().Unsub(mock.Anything).Return().Maybe()
+
+	err := f.service.StreamShadow(&pb.StreamShadowRequest{Devices: []string{"device1"}}, f.mocks.srv)
+
+	assert.NoError(t, err)
+}
+
+func TestPersister_SkipsPatched(t *testing.T) {
+	f := newShadowServiceServerFixture(t)
+	request := desiredPatch(f.data.uuid)
+
+	key := shadow.Key(f.data.uuid, pb.StateKey_DESIRED)
+	f.mocks.rdb.EXPECT().Get(f.data.ctx, key).Return(redis.NewStringResult("", redis.Nil)).Once()
+	f.expectStore(key, 0, func(s string) bool { return true })
+	f.mocks.rdb.EXPECT().MGet(mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(redis.NewSliceResult([]interface{}{nil, nil, nil}, nil)).Once()
+	f.mocks.ps.EXPECT().TryPub(request, "mqtt.outgoing").Return()
+
+	_, err := f.service.Patch(f.data.ctx, request)
+	require.NoError(t, err)
+
+	// Request is only stored once, unexpected calls fail the test
+	f.mocks.ps.EXPECT().AddSub(mock.MatchedBy(func(ch chan interface{}) bool {
+		ch <- request
+		close(ch)
+		return true
+	}), "mqtt.incoming", "mqtt.outgoing").Return()
+	f.mocks.ps.EXPECT().Unsub(mock.Anything).Return().Maybe()
+
+	f.service.Persister()
+}
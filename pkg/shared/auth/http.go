@@ -0,0 +1,52 @@
+/*
+Copyright © 2021-2023 Infinite Devices GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// HTTPMiddleware - authenticates plain HTTP handlers with the Bearer token the same way Connect handlers are,
+// requests without a valid token are answered with 401
+func HTTPMiddleware(i AuthInterceptor, signingKey []byte) func(http.Handler) http.Handler {
+	return httpMiddleware(i.ConnectStandardAuthMiddleware, signingKey)
+}
+
+// HTTPDevicesMiddleware - same as HTTPMiddleware, but takes devices token the Shadow API is called with
+func HTTPDevicesMiddleware(i AuthInterceptor, signingKey []byte) func(http.Handler) http.Handler {
+	return httpMiddleware(i.ConnectDeviceAuthMiddleware, signingKey)
+}
+
+func httpMiddleware(middleware func(context.Context, []byte, string) (context.Context, bool, error), signingKey []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			segments := strings.Split(r.Header.Get("Authorization"), " ")
+			if len(segments) != 2 {
+				http.Error(w, "Authorization header is required", http.StatusUnauthorized)
+				return
+			}
+
+			ctx, _, err := middleware(r.Context(), signingKey, segments[1])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}